@@ -0,0 +1,87 @@
+package main
+
+import (
+	"image/color"
+	"slices"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// A sub-palette and how well its colors can be told apart
+type AccessibleSubpal struct {
+	Colors Subpalette
+	// Smallest CIE76 delta E between two of its colors, under the vision
+	// where they are the closest
+	Distance float64
+	// Vision where the closest colors are, "normal" or a deficiency
+	Vision string
+}
+
+// Proposes sub-palettes of p sharing the backdrop and no other color, each
+// made of the three colors that stay the most distinguishable from each
+// other and from the backdrop, with normal vision and with every color
+// vision deficiency, none of them forbidden. The best sub-palettes are
+// picked first
+func accessible_subpalettes(p color.Palette, backdrop uint8, count int, forbidden []int) []AccessibleSubpal {
+	visions := append([]string{"normal"}, nespal.Deficiencies...)
+	// colors of every vision, in CIELAB
+	labs := make([][][3]float64, len(visions))
+	for v, vision := range visions {
+		labs[v] = make([][3]float64, len(p))
+		for i, c := range p {
+			if vision != "normal" {
+				c = nespal.SimulateColor(c, vision)
+			}
+			labs[v][i] = nespal.ToLab(c)
+		}
+	}
+
+	// the $xD, $xE and $xF columns are grays and blacks found elsewhere, or
+	// the $0D that upsets TVs, and colors already seen are duplicates
+	candidates := []uint8{}
+	seen := map[color.RGBA]bool{nespal.ToRGB(p[backdrop]): true}
+	for i := range min(len(p), nespal.PALETTE_SIZE) {
+		c := nespal.ToRGB(p[i])
+		if i&0x0F >= 0x0D || seen[c] || slices.Contains(forbidden, i) {
+			continue
+		}
+		seen[c] = true
+		candidates = append(candidates, uint8(i))
+	}
+
+	cie76 := nespal.CIE76{}
+	// the smallest distance between two of the colors, under any vision
+	score := func(colors []uint8) (float64, string) {
+		best, best_vision := -1.0, ""
+		for v, vision := range visions {
+			for a := range colors {
+				for b := a + 1; b < len(colors); b++ {
+					d := cie76.Compare(labs[v][colors[a]], labs[v][colors[b]])
+					if best < 0 || d < best {
+						best, best_vision = d, vision
+					}
+				}
+			}
+		}
+		return best, best_vision
+	}
+
+	res := []AccessibleSubpal{}
+	for len(res) < count && len(candidates) >= 3 {
+		found := AccessibleSubpal{Distance: -1}
+		for a := range candidates {
+			for b := a + 1; b < len(candidates); b++ {
+				for c := b + 1; c < len(candidates); c++ {
+					colors := Subpalette{backdrop, candidates[a], candidates[b], candidates[c]}
+					if d, vision := score(colors[:]); d > found.Distance {
+						found = AccessibleSubpal{colors, d, vision}
+					}
+				}
+			}
+		}
+
+		res = append(res, found)
+		candidates = slices.DeleteFunc(candidates, func(i uint8) bool { return slices.Contains(found.Colors[1:], i) })
+	}
+	return res
+}
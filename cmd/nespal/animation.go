@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Disposals of the frames of APNGs, what becomes of their area before the
+// next frame is drawn
+const (
+	APNG_DISPOSE_NONE       = 0
+	APNG_DISPOSE_BACKGROUND = 1
+	APNG_DISPOSE_PREVIOUS   = 2
+)
+
+// Blending of the frames of APNGs over the ones before
+const APNG_BLEND_OVER = 1
+
+// Returns the frames of the animation at path as they are shown, every frame
+// drawn over what the ones before left, for animated GIFs and PNGs and the
+// pages of TIFF files. Returns nil for the other images
+func animation_frames(path string) ([]image.Image, error) {
+	if raw_format != nil {
+		return nil, nil
+	}
+
+	var (
+		frames []image.Image
+		err    error
+	)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gif":
+		frames, err = gif_frames(path)
+	case ".png", ".apng":
+		frames, err = apng_frames(path)
+	case ".tif", ".tiff":
+		frames, err = tiff_pages(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(frames) < 2 {
+		return nil, nil
+	}
+	return frames, nil
+}
+
+// Decodes the frames of a GIF, following their disposal
+func gif_frames(path string) ([]image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	g, err := gif.DecodeAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", ex, path, err)
+	}
+	if len(g.Image) < 2 {
+		return nil, nil
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	frames := make([]image.Image, len(g.Image))
+	for i, frame := range g.Image {
+		var previous *image.RGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			previous = clone_rgba(canvas)
+		}
+		draw.Draw(canvas, frame.Rect, frame, frame.Rect.Min, draw.Over)
+		frames[i] = clone_rgba(canvas)
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Rect, image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+	return frames, nil
+}
+
+// A frame of an APNG: where it is drawn, how, and its compressed data
+type apng_frame struct {
+	rect    image.Rectangle
+	dispose byte
+	blend   byte
+	data    []byte
+}
+
+// Decodes the frames of an animated PNG, following their disposal and
+// blending. Returns nil for PNGs that are not animated
+func apng_frames(path string) ([]image.Image, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, []byte(nespal.PNG_SIGNATURE)) {
+		return nil, nil
+	}
+
+	// the chunks the frames are decoded with, and the frames themselves
+	var (
+		ihdr     []byte
+		shared   [][]byte
+		frames   []*apng_frame
+		animated bool
+		invalid  = fmt.Errorf("%s: %s: invalid animated PNG", ex, path)
+	)
+	for rest := data[len(nespal.PNG_SIGNATURE):]; len(rest) >= 12; {
+		n := int(binary.BigEndian.Uint32(rest))
+		if n > len(rest)-12 {
+			return nil, invalid
+		}
+		kind, body := string(rest[4:8]), rest[8:8+n]
+		chunk := rest[:12+n]
+		rest = rest[12+n:]
+
+		switch kind {
+		case "IHDR":
+			ihdr = body
+		case "PLTE", "tRNS", "gAMA", "sRGB", "iCCP", "cHRM", "sBIT":
+			if len(frames) == 0 {
+				shared = append(shared, chunk)
+			}
+		case "acTL":
+			animated = true
+		case "fcTL":
+			if len(body) < 26 {
+				return nil, invalid
+			}
+			w, h := int(binary.BigEndian.Uint32(body[4:])), int(binary.BigEndian.Uint32(body[8:]))
+			x, y := int(binary.BigEndian.Uint32(body[12:])), int(binary.BigEndian.Uint32(body[16:]))
+			frames = append(frames, &apng_frame{rect: image.Rect(x, y, x+w, y+h), dispose: body[24], blend: body[25]})
+		case "IDAT":
+			// the default image is only a frame when a fcTL comes before it
+			if len(frames) > 0 {
+				frames[len(frames)-1].data = append(frames[len(frames)-1].data, body...)
+			}
+		case "fdAT":
+			if len(frames) == 0 || len(body) < 4 {
+				return nil, invalid
+			}
+			frames[len(frames)-1].data = append(frames[len(frames)-1].data, body[4:]...)
+		case "IEND":
+			rest = nil
+		}
+	}
+	if !animated || len(ihdr) < 13 || len(frames) < 2 {
+		return nil, nil
+	}
+
+	width, height := int(binary.BigEndian.Uint32(ihdr)), int(binary.BigEndian.Uint32(ihdr[4:]))
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	res := make([]image.Image, len(frames))
+	for i, frame := range frames {
+		if frame.rect.Empty() || !frame.rect.In(canvas.Rect) {
+			return nil, invalid
+		}
+		img, err := decode_apng_frame(ihdr, shared, frame)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: frame %d: %w", ex, path, i+1, err)
+		}
+
+		var previous *image.RGBA
+		if frame.dispose == APNG_DISPOSE_PREVIOUS {
+			previous = clone_rgba(canvas)
+		}
+		op := draw.Src
+		if frame.blend == APNG_BLEND_OVER {
+			op = draw.Over
+		}
+		draw.Draw(canvas, frame.rect, img, img.Bounds().Min, op)
+		res[i] = clone_rgba(canvas)
+
+		switch {
+		case frame.dispose == APNG_DISPOSE_BACKGROUND, frame.dispose == APNG_DISPOSE_PREVIOUS && i == 0:
+			draw.Draw(canvas, frame.rect, image.Transparent, image.Point{}, draw.Src)
+		case frame.dispose == APNG_DISPOSE_PREVIOUS:
+			canvas = previous
+		}
+	}
+	return res, nil
+}
+
+// Decodes a frame of an APNG as a PNG of its own, with the header of the
+// APNG resized to the frame and the chunks the frames share
+func decode_apng_frame(ihdr []byte, shared [][]byte, frame *apng_frame) (image.Image, error) {
+	if len(frame.data) == 0 {
+		return nil, errors.New("no image data")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(nespal.PNG_SIGNATURE)
+
+	header := bytes.Clone(ihdr)
+	binary.BigEndian.PutUint32(header, uint32(frame.rect.Dx()))
+	binary.BigEndian.PutUint32(header[4:], uint32(frame.rect.Dy()))
+	write_png_chunk(&buf, "IHDR", header)
+	for _, chunk := range shared {
+		buf.Write(chunk)
+	}
+	write_png_chunk(&buf, "IDAT", frame.data)
+	write_png_chunk(&buf, "IEND", nil)
+	return nespal.DecodeImage(&buf)
+}
+
+// Writes a PNG chunk along with its length and CRC
+func write_png_chunk(w io.Writer, kind string, data []byte) {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(data)))
+	w.Write(n[:])
+	crc := crc32.NewIEEE()
+	io.WriteString(crc, kind)
+	crc.Write(data)
+	io.WriteString(w, kind)
+	w.Write(data)
+	binary.BigEndian.PutUint32(n[:], crc.Sum32())
+	w.Write(n[:])
+}
+
+func clone_rgba(m *image.RGBA) *image.RGBA {
+	res := image.NewRGBA(m.Rect)
+	copy(res.Pix, m.Pix)
+	return res
+}
+
+// Reads the rows of a frame of an animation without its transparent
+// pixels, the areas no frame has drawn yet, nor the ones mask leaves out
+type frame_rows struct {
+	img  image.Image
+	mask *Mask
+	y    int
+	row  []color.RGBA
+}
+
+func new_frame_rows(img image.Image, mask *Mask) *frame_rows {
+	return &frame_rows{img: img, mask: mask, y: img.Bounds().Min.Y}
+}
+
+func (r *frame_rows) Bounds() image.Rectangle { return r.img.Bounds() }
+
+func (r *frame_rows) NextRow() ([]color.RGBA, error) {
+	bounds := r.img.Bounds()
+	if r.y >= bounds.Max.Y {
+		return nil, io.EOF
+	}
+
+	r.row = r.row[:0]
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		if c := r.img.At(x, r.y); opaque(c) && !r.mask.ignored(x-bounds.Min.X, r.y-bounds.Min.Y) {
+			r.row = append(r.row, nespal.ToRGB(c))
+		}
+	}
+	r.y++
+	return r.row, nil
+}
+
+func (r *frame_rows) Close() error { return nil }
+
+// Whether a color is not transparent
+func opaque(c color.Color) bool {
+	_, _, _, a := c.RGBA()
+	return a > 0
+}
+
+// Frames of an animation that the same palette was identified in
+type FrameRun struct {
+	// Numbers of the first and last frames, from 1
+	First, Last int
+	Identification
+}
+
+// Groups the results of the frames of an animation into the runs of
+// frames with the same palette and emphasis, with their average confidence
+func frame_runs(results []Identification) []FrameRun {
+	runs := []FrameRun{}
+	sum := 0.0
+	for i, result := range results {
+		if n := len(runs); n > 0 && runs[n-1].label() == result.label() {
+			runs[n-1].Last = i + 1
+			sum += result.Confidence
+			runs[n-1].Confidence = sum / float64(runs[n-1].Last-runs[n-1].First+1)
+			continue
+		}
+		runs = append(runs, FrameRun{i + 1, i + 1, result})
+		sum = result.Confidence
+	}
+	return runs
+}
+
+// Writes the frames of a run, like "frame 3" or "frames 1-10"
+func (r FrameRun) frames() string {
+	if r.First == r.Last {
+		return fmt.Sprintf("frame %d", r.First)
+	}
+	return fmt.Sprintf("frames %d-%d", r.First, r.Last)
+}
+
+// Describes the palettes identified in the frames of an animation, and the
+// frames where they change
+func describe_frames(results []Identification) string {
+	runs := frame_runs(results)
+	if len(runs) == 1 {
+		if runs[0].Name == "" {
+			return fmt.Sprintf("No palette matches any of the %d frames of this animation", len(results))
+		}
+		return fmt.Sprintf("The palette used in the %d frames of this animation was: %s (confidence %.0f%%)", len(results), runs[0].label(), runs[0].Confidence*100)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "The palette changes across the %d frames of this animation:", len(results))
+	for _, run := range runs {
+		if run.Name == "" {
+			fmt.Fprintf(&b, "\n  %s: no palette matches", run.frames())
+		} else {
+			fmt.Fprintf(&b, "\n  %s: %s (confidence %.0f%%)", run.frames(), run.label(), run.Confidence*100)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// An RGB PPU of the arcade machines built on the NES
+type PPU string
+
+// The RP2C03 of the PlayChoice-10 and of some Vs. System games, with the
+// colors in the order of the NES, and the RP2C04 of the other Vs. System
+// games. The RP2C04 came in four versions, 0001 to 0004, with the same
+// colors at scrambled indexes, PPU_2C04 being the one of unknown version
+const (
+	PPU_2C03      PPU = "RP2C03"
+	PPU_2C04      PPU = "RP2C04"
+	PPU_2C04_0001 PPU = "RP2C04-0001"
+	PPU_2C04_0002 PPU = "RP2C04-0002"
+	PPU_2C04_0003 PPU = "RP2C04-0003"
+	PPU_2C04_0004 PPU = "RP2C04-0004"
+)
+
+var ppus = []PPU{PPU_2C03, PPU_2C04_0001, PPU_2C04_0002, PPU_2C04_0003, PPU_2C04_0004}
+
+// Index of the color every index of the RP2C04 versions shows, among the
+// 64 colors of the RP2C04 in the order of the NES. These are the colors of
+// the RP2C03 but for $37 and the $xD to $xF columns, which are its own;
+// $1A, $2F, $30 and $3B are shown by no index
+var ppu_index_tables = map[PPU][nespal.PALETTE_SIZE]uint8{
+	PPU_2C04_0001: {
+		0x35, 0x23, 0x16, 0x22, 0x1C, 0x09, 0x1D, 0x15, 0x20, 0x00, 0x27, 0x05, 0x04, 0x28, 0x08, 0x20,
+		0x21, 0x3E, 0x1F, 0x29, 0x3C, 0x32, 0x36, 0x12, 0x3F, 0x2B, 0x2E, 0x1E, 0x3D, 0x2D, 0x24, 0x01,
+		0x0E, 0x31, 0x33, 0x2A, 0x2C, 0x0C, 0x1B, 0x14, 0x2E, 0x07, 0x34, 0x06, 0x13, 0x02, 0x26, 0x2E,
+		0x2E, 0x19, 0x10, 0x0A, 0x39, 0x03, 0x37, 0x17, 0x0F, 0x11, 0x0B, 0x0D, 0x38, 0x25, 0x18, 0x3A,
+	},
+	PPU_2C04_0002: {
+		0x2E, 0x27, 0x18, 0x39, 0x3A, 0x25, 0x1C, 0x31, 0x16, 0x13, 0x38, 0x34, 0x20, 0x23, 0x3C, 0x0B,
+		0x0F, 0x21, 0x06, 0x3D, 0x1B, 0x29, 0x1E, 0x22, 0x1D, 0x24, 0x0E, 0x2B, 0x32, 0x08, 0x2E, 0x03,
+		0x04, 0x36, 0x26, 0x33, 0x11, 0x1F, 0x10, 0x02, 0x14, 0x3F, 0x00, 0x09, 0x12, 0x2E, 0x28, 0x20,
+		0x3E, 0x0D, 0x2A, 0x17, 0x0C, 0x01, 0x15, 0x19, 0x2E, 0x2C, 0x07, 0x37, 0x35, 0x05, 0x0A, 0x2D,
+	},
+	PPU_2C04_0003: {
+		0x14, 0x25, 0x3A, 0x10, 0x0B, 0x20, 0x31, 0x09, 0x01, 0x2E, 0x36, 0x08, 0x15, 0x3D, 0x3E, 0x3C,
+		0x22, 0x1C, 0x05, 0x12, 0x19, 0x18, 0x17, 0x1B, 0x00, 0x03, 0x2E, 0x02, 0x16, 0x06, 0x34, 0x35,
+		0x23, 0x0F, 0x0E, 0x37, 0x0D, 0x27, 0x26, 0x20, 0x29, 0x04, 0x21, 0x24, 0x11, 0x2D, 0x2E, 0x1F,
+		0x2C, 0x1E, 0x39, 0x33, 0x07, 0x2A, 0x28, 0x1D, 0x0A, 0x2E, 0x32, 0x38, 0x13, 0x2B, 0x3F, 0x0C,
+	},
+	PPU_2C04_0004: {
+		0x18, 0x03, 0x1C, 0x28, 0x2E, 0x35, 0x01, 0x17, 0x10, 0x1F, 0x2A, 0x0E, 0x36, 0x37, 0x0B, 0x39,
+		0x25, 0x1E, 0x12, 0x34, 0x2E, 0x1D, 0x06, 0x26, 0x3E, 0x1B, 0x22, 0x19, 0x04, 0x2E, 0x3A, 0x21,
+		0x05, 0x0A, 0x07, 0x02, 0x13, 0x14, 0x00, 0x15, 0x0C, 0x3D, 0x11, 0x0F, 0x0D, 0x38, 0x2D, 0x24,
+		0x33, 0x20, 0x08, 0x16, 0x3F, 0x2B, 0x20, 0x3C, 0x2E, 0x27, 0x23, 0x31, 0x29, 0x32, 0x2C, 0x09,
+	},
+}
+
+var (
+	// "2C04-0001" to "2C04-0004", or the "vs_001" to "vs_004" of the
+	// palettes named after the files of emulators
+	ppu_2c04_version = regexp.MustCompile(`(?:^|[^a-z0-9])(?:rp)?2c04[-_ ]?000([1-4])(?:$|[^0-9])|(?:^|[^a-z0-9])vs_00([1-4])(?:$|[^0-9])`)
+	ppu_2c04         = regexp.MustCompile(`(?:^|[^a-z0-9])(?:rp)?2c04(?:$|[^0-9])`)
+	ppu_2c03         = regexp.MustCompile(`(?:^|[^a-z0-9])(?:(?:rp)?2c03(?:$|[^0-9])|pc10|playchoice)`)
+)
+
+// Returns the arcade PPU a palette was made for, told by its name naming
+// it explicitly, like "2C04-0001", "vs_001", "2C03", "PC10" or
+// "PlayChoice", empty for the palettes of consoles
+func arcade_ppu(name string) PPU {
+	name = strings.ToLower(name)
+	if m := ppu_2c04_version.FindStringSubmatch(name); m != nil {
+		return PPU(fmt.Sprintf("%s-000%s", PPU_2C04, m[1]+m[2]))
+	}
+	switch {
+	case ppu_2c04.MatchString(name):
+		return PPU_2C04
+	case ppu_2c03.MatchString(name):
+		return PPU_2C03
+	}
+	return ""
+}
+
+// Whether the PPU is one of the versions of the RP2C04
+func (ppu PPU) is_2c04() bool {
+	return strings.HasPrefix(string(ppu), string(PPU_2C04))
+}
+
+// Parses the name of an arcade PPU, like "2C04-0001" or "RP2C03"
+func parse_ppu(value string) (PPU, error) {
+	name := strings.ToUpper(strings.TrimSpace(value))
+	if !strings.HasPrefix(name, "RP") {
+		name = "RP" + name
+	}
+	for _, ppu := range ppus {
+		if string(ppu) == name {
+			return ppu, nil
+		}
+	}
+
+	names := make([]string, len(ppus))
+	for i, ppu := range ppus {
+		names[i] = string(ppu)
+	}
+	return "", fmt.Errorf("%s: unknown PPU '%s', expected one of: %s", ex, value, strings.Join(names, ", "))
+}
+
+// Returns a copy of the content of a .pal file, with the colors of the
+// RP2C04 in the order of the NES, with the colors of every bank moved to
+// the indexes the PPU shows them at
+func scramble_palette(data []byte, ppu PPU) []byte {
+	table, ok := ppu_index_tables[ppu]
+	res := bytes.Clone(data)
+	if !ok {
+		return res
+	}
+	for bank := 0; bank+nespal.PALETTE_SIZE*3 <= len(data); bank += nespal.PALETTE_SIZE * 3 {
+		for i, j := range table {
+			copy(res[bank+i*3:bank+i*3+3], data[bank+int(j)*3:])
+		}
+	}
+	return res
+}
+
+// Returns a copy of the content of a .pal file of the PPU with the colors
+// of every bank moved back to the order of the NES, the ones no index of
+// the PPU shows being black
+func unscramble_palette(data []byte, ppu PPU) []byte {
+	table, ok := ppu_index_tables[ppu]
+	if !ok {
+		return bytes.Clone(data)
+	}
+	res := make([]byte, len(data))
+	for bank := 0; bank+nespal.PALETTE_SIZE*3 <= len(data); bank += nespal.PALETTE_SIZE * 3 {
+		for i, j := range table {
+			copy(res[bank+int(j)*3:bank+int(j)*3+3], data[bank+i*3:])
+		}
+	}
+	return res
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+func TestArcadePPU(t *testing.T) {
+	tests := []struct {
+		name   string
+		ppu    PPU
+		region string
+	}{
+		{"vs_001 - 2C04-0001", PPU_2C04_0001, REGION_VS},
+		{"vs_002 - 2C04-0002", PPU_2C04_0002, REGION_VS},
+		{"vs_003emph", PPU_2C04_0003, REGION_VS},
+		{"vs_004emph", PPU_2C04_0004, REGION_VS},
+		{"RP2C04-0002 capture", PPU_2C04_0002, REGION_VS},
+		{"2c04_0003", PPU_2C04_0003, REGION_VS},
+		{"RP2C04", PPU_2C04, REGION_VS},
+		{"2C03", PPU_2C03, REGION_VS},
+		{"HDN_PC10", PPU_2C03, REGION_VS},
+		{"PC10 Better", PPU_2C03, REGION_VS},
+		{"pc10emph", PPU_2C03, REGION_VS},
+		{"PlayChoice", PPU_2C03, REGION_VS},
+		{"FCEUX vs Mesen", "", REGION_NTSC},
+		{"FCEUX", "", REGION_NTSC},
+		{"vs_005", "", REGION_NTSC},
+		{"2C040001", PPU_2C04_0001, REGION_VS},
+		{"12C03", "", REGION_NTSC},
+		{"Mesen PAL", "", REGION_PAL},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ppu := arcade_ppu(test.name); ppu != test.ppu {
+				t.Errorf("arcade_ppu is '%s', want '%s'", ppu, test.ppu)
+			}
+			if region := palette_region(test.name); region != test.region {
+				t.Errorf("palette_region is '%s', want '%s'", region, test.region)
+			}
+		})
+	}
+}
+
+func TestParsePPU(t *testing.T) {
+	tests := []struct {
+		value string
+		ppu   PPU
+		err   bool
+	}{
+		{"2C04-0001", PPU_2C04_0001, false},
+		{"rp2c04-0004", PPU_2C04_0004, false},
+		{" 2C03 ", PPU_2C03, false},
+		{"RP2C03", PPU_2C03, false},
+		{"2C04", "", true},
+		{"2C04-0005", "", true},
+		{"", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			ppu, err := parse_ppu(test.value)
+			if (err != nil) != test.err {
+				t.Fatalf("error is %v, want an error: %t", err, test.err)
+			}
+			if ppu != test.ppu {
+				t.Errorf("PPU is '%s', want '%s'", ppu, test.ppu)
+			}
+		})
+	}
+}
+
+// The shipped palettes of the four RP2C04 versions must be the same colors
+// under the index tables, so converting one into another gives it back
+func TestScramblePalette(t *testing.T) {
+	versions := []PPU{PPU_2C04_0001, PPU_2C04_0002, PPU_2C04_0003, PPU_2C04_0004}
+	shipped := map[PPU][]byte{}
+	for n, ppu := range versions {
+		data, err := nespal.Palettes.ReadFile(fmt.Sprintf("palettes/vs_00%d - 2C04-000%d.pal", n+1, n+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shipped[ppu] = data[:nespal.PALETTE_SIZE*3]
+	}
+
+	for _, from := range versions {
+		master := unscramble_palette(shipped[from], from)
+		for _, to := range versions {
+			if res := scramble_palette(master, to); !bytes.Equal(res, shipped[to]) {
+				t.Errorf("%s converted to %s differs from the shipped palette", from, to)
+			}
+		}
+	}
+
+	// every bank is moved, and the other PPUs keep the order
+	two := append(bytes.Clone(shipped[PPU_2C04_0001]), shipped[PPU_2C04_0001]...)
+	res := unscramble_palette(two, PPU_2C04_0001)
+	if !bytes.Equal(res[:nespal.PALETTE_SIZE*3], res[nespal.PALETTE_SIZE*3:]) {
+		t.Error("the banks are moved differently")
+	}
+	if res := scramble_palette(two, PPU_2C03); !bytes.Equal(res, two) {
+		t.Error("the RP2C03 moves the colors")
+	}
+}
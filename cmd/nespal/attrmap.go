@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Tints of the sub-palettes in the attribute maps
+var attr_tints = [SUBPALETTES]color.RGBA{
+	{0xE0, 0x40, 0x40, 0xFF},
+	{0x40, 0xC0, 0x40, 0xFF},
+	{0x40, 0x60, 0xE0, 0xFF},
+	{0xE0, 0xC0, 0x20, 0xFF},
+}
+
+// Draws the frame with every attribute block tinted with the color of its
+// sub-palette and outlined with it, to see which one each block uses
+func attr_map(f *Frame) *image.RGBA {
+	bounds := f.Indexed.Bounds()
+	res := image.NewRGBA(bounds)
+	blocks, _, _ := attr_blocks(bounds, f.Grid)
+	for i, block := range blocks {
+		tint := attr_tints[f.Attrs[i]%SUBPALETTES]
+		for y := block.Min.Y; y < block.Max.Y; y++ {
+			for x := block.Min.X; x < block.Max.X; x++ {
+				c := tint
+				if x != block.Min.X && y != block.Min.Y {
+					src := nespal.ToRGB(f.Indexed.At(x, y))
+					c = color.RGBA{uint8((int(src.R) + int(tint.R)) / 2), uint8((int(src.G) + int(tint.G)) / 2), uint8((int(src.B) + int(tint.B)) / 2), 0xFF}
+				}
+				res.SetRGBA(x, y, c)
+			}
+		}
+	}
+	return res
+}
+
+// A block of the attribute table as written by write_attr_table
+type AttrBlock struct {
+	X          int    `json:"x"`
+	Y          int    `json:"y"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	Subpalette int    `json:"subpalette"`
+	Colors     string `json:"colors"`
+}
+
+// Writes which sub-palette every attribute block of the frame uses, as JSON
+// when dst_path ends in .json and as a table otherwise
+func write_attr_table(f *Frame, dst_path string) error {
+	blocks, cols, _ := attr_blocks(f.Indexed.Bounds(), f.Grid)
+	table := make([]AttrBlock, len(blocks))
+	for i, block := range blocks {
+		subpal := f.Subpals[f.Attrs[i]]
+		table[i] = AttrBlock{block.Min.X, block.Min.Y, block.Dx(), block.Dy(), f.Attrs[i], format_indices(subpal[:])}
+	}
+
+	var data []byte
+	if strings.EqualFold(filepath.Ext(dst_path), ".json") {
+		var err error
+		if data, err = json.MarshalIndent(table, "", "\t"); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	} else {
+		var b strings.Builder
+		for i, subpal := range f.Subpals {
+			fmt.Fprintf(&b, "Sub-palette %d: %s\n", i, format_indices(subpal[:]))
+		}
+		b.WriteString("\n")
+		for i := range table {
+			if i%cols > 0 {
+				b.WriteString(" ")
+			}
+			fmt.Fprintf(&b, "%d", table[i].Subpalette)
+			if i%cols == cols-1 {
+				b.WriteString("\n")
+			}
+		}
+		data = []byte(b.String())
+	}
+
+	return os.WriteFile(dst_path, data, 0o644)
+}
+
+// Number of background colors the sub-palettes can hold: the backdrop and
+// three colors of each sub-palette
+const BACKGROUND_COLORS = 1 + SUBPALETTES*3
+
+// How a sub-palette of a frame is used, as written by write_subpal_stats
+type SubpalUsage struct {
+	Subpalette int    `json:"subpalette"`
+	Colors     string `json:"colors"`
+	// Colors set in the sub-palette besides the backdrop, out of three
+	Used   int `json:"used"`
+	Blocks int `json:"blocks"`
+	Pixels int `json:"pixels"`
+}
+
+// How the background colors of a frame are spread across its sub-palettes
+type SubpalStats struct {
+	Backdrop string `json:"backdrop"`
+	// Different colors in the sub-palettes, the backdrop included, out of
+	// the 13 they can hold
+	Colors int `json:"colors"`
+	// Entries of the sub-palettes left to the backdrop, the missing
+	// sub-palettes included
+	Free int `json:"free"`
+	// Colors set in several sub-palettes
+	Shared      string        `json:"shared"`
+	Subpalettes []SubpalUsage `json:"subpalettes"`
+	Blocks      int           `json:"blocks"`
+}
+
+// Counts the colors of the sub-palettes of the frame and the blocks and
+// pixels using each sub-palette
+func subpal_stats(f *Frame) SubpalStats {
+	blocks, _, _ := attr_blocks(f.Indexed.Bounds(), f.Grid)
+	stats := SubpalStats{Backdrop: format_indices([]uint8{f.Backdrop}), Free: SUBPALETTES * 3, Blocks: len(blocks)}
+	stats.Subpalettes = make([]SubpalUsage, len(f.Subpals))
+	for i, subpal := range f.Subpals {
+		stats.Subpalettes[i] = SubpalUsage{Subpalette: i, Colors: format_indices(subpal[:])}
+	}
+	for i, block := range blocks {
+		usage := &stats.Subpalettes[f.Attrs[i]]
+		usage.Blocks++
+		usage.Pixels += block.Dx() * block.Dy()
+	}
+
+	// how many sub-palettes set each color
+	sets := map[uint8]int{}
+	colors := []uint8{f.Backdrop}
+	for i, subpal := range f.Subpals {
+		seen := []uint8{}
+		for _, c := range subpal[1:] {
+			if c == f.Backdrop || slices.Contains(seen, c) {
+				continue
+			}
+			seen = append(seen, c)
+			sets[c]++
+			stats.Subpalettes[i].Used++
+			stats.Free--
+			if !slices.Contains(colors, c) {
+				colors = append(colors, c)
+			}
+		}
+	}
+	stats.Colors = len(colors)
+
+	shared := []uint8{}
+	for _, c := range colors {
+		if sets[c] > 1 {
+			shared = append(shared, c)
+		}
+	}
+	stats.Shared = format_indices(shared)
+	return stats
+}
+
+// Writes how the frame uses its sub-palettes, as JSON when dst_path ends in
+// .json, as text otherwise, and to stdout when it is '-'
+func write_subpal_stats(f *Frame, dst_path string) error {
+	stats := subpal_stats(f)
+
+	var data []byte
+	if strings.EqualFold(filepath.Ext(dst_path), ".json") {
+		var err error
+		if data, err = json.MarshalIndent(stats, "", "\t"); err != nil {
+			return err
+		}
+		data = append(data, '\n')
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "Backdrop: %s\n", stats.Backdrop)
+		fmt.Fprintf(&b, "Colors: %d of %d, %d sub-palette entries free\n", stats.Colors, BACKGROUND_COLORS, stats.Free)
+		if stats.Shared != "" {
+			fmt.Fprintf(&b, "Shared: %s\n", stats.Shared)
+		}
+		for _, usage := range stats.Subpalettes {
+			fmt.Fprintf(&b, "Sub-palette %d: %s, %d of 3 colors, %d of %d blocks, %d pixels\n", usage.Subpalette, usage.Colors, usage.Used, usage.Blocks, stats.Blocks, usage.Pixels)
+		}
+		data = []byte(b.String())
+	}
+
+	if dst_path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(dst_path, data, 0o644)
+}
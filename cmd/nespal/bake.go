@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Maximum number of tiles in a pattern table
+const PATTERN_TABLE_SIZE = 256
+
+// Pattern table tiles and nametable of a frame
+type Background struct {
+	// Tiles in the 16 bytes CHR format
+	Tiles [][16]byte
+	// Tile used in each cell of the nametable, row by row
+	Nametable [NAMETABLE_WIDTH * NAMETABLE_HEIGHT]byte
+	// Attribute table, each byte holds the sub-palettes of a 32x32 area
+	Attributes [64]byte
+	// MMC5 extended attributes, a byte per cell of the nametable with its
+	// sub-palette in the top two bits, for grids with 8x8 attributes
+	ExAttributes []byte
+}
+
+// Size in bytes of the MMC5 extended RAM holding the extended attributes
+const EXRAM_SIZE = 1024
+
+// Encodes the 8x8 area of the frame starting at x, y as a CHR tile
+func encode_tile(f *Frame, x, y int) [16]byte {
+	var tile [16]byte
+	subpal := f.subpal_at(x, y)
+
+	for row := range TILE_SIZE {
+		for col := range TILE_SIZE {
+			i := f.Indexed.ColorIndexAt(x+col, y+row)
+			value := slices.Index(subpal[:], i)
+			if i == f.Backdrop || value < 0 {
+				value = 0
+			}
+
+			bit := byte(0x80 >> col)
+			if value&1 != 0 {
+				tile[row] |= bit
+			}
+			if value&2 != 0 {
+				tile[row+8] |= bit
+			}
+		}
+	}
+	return tile
+}
+
+// Splits the frame into unique tiles, merging the most similar ones to fit
+// in the tile budget of opts when asked to, and builds its nametable and
+// attribute table, or its MMC5 extended attributes when the grid has 8x8
+// attributes. With them, the extended attributes also hold the 4K bank of
+// every tile, so there can be more tiles than a pattern table holds.
+// Returns how the merged tiles changed the frame, nil when none were
+func build_background(f *Frame, p color.Palette, opts RemapOptions) (*Background, *MergeReport, error) {
+	bounds := f.Indexed.Bounds()
+	if f.Grid.Tile != TILE_SIZE {
+		return nil, nil, fmt.Errorf("%s: tiles of %dx%d pixels can not be baked, CHR tiles are %dx%d", ex, f.Grid.Tile, f.Grid.Tile, TILE_SIZE, TILE_SIZE)
+	}
+	if f.Grid.Attr != TILE_SIZE && f.Grid.Attr%ATTR_SIZE != 0 {
+		return nil, nil, fmt.Errorf("%s: attributes of %dx%d pixels can not be baked, expected %d, %d or a multiple of it", ex, f.Grid.Attr, f.Grid.Attr, TILE_SIZE, ATTR_SIZE)
+	}
+	if f.Grid.Offset.X%f.Grid.Attr != 0 || f.Grid.Offset.Y%f.Grid.Attr != 0 {
+		return nil, nil, fmt.Errorf("%s: grid offset %d,%d can not be baked, the nametable starts at the top left of the image", ex, f.Grid.Offset.X, f.Grid.Offset.Y)
+	}
+
+	if bounds.Dx()%TILE_SIZE != 0 || bounds.Dy()%TILE_SIZE != 0 {
+		return nil, nil, fmt.Errorf("%s: image size %dx%d is not a multiple of the %dx%d tile size", ex, bounds.Dx(), bounds.Dy(), TILE_SIZE, TILE_SIZE)
+	}
+	if bounds.Dx() > NAMETABLE_WIDTH*TILE_SIZE || bounds.Dy() > NAMETABLE_HEIGHT*TILE_SIZE {
+		return nil, nil, fmt.Errorf("%s: image size %dx%d is larger than a %dx%d nametable", ex, bounds.Dx(), bounds.Dy(), NAMETABLE_WIDTH*TILE_SIZE, NAMETABLE_HEIGHT*TILE_SIZE)
+	}
+
+	// the first tile is left blank to fill the nametable outside of the image
+	bg := &Background{Tiles: [][16]byte{{}}}
+	seen := map[[16]byte]int{{}: 0}
+
+	cols := bounds.Dx() / TILE_SIZE
+	cells := make([]TileCell, 0, cols*bounds.Dy()/TILE_SIZE)
+	for ty := range bounds.Dy() / TILE_SIZE {
+		for tx := range cols {
+			x, y := bounds.Min.X+tx*TILE_SIZE, bounds.Min.Y+ty*TILE_SIZE
+			tile := encode_tile(f, x, y)
+			n, ok := seen[tile]
+			if !ok {
+				n = len(bg.Tiles)
+				seen[tile] = n
+				bg.Tiles = append(bg.Tiles, tile)
+			}
+			cells = append(cells, TileCell{n, f.attr_at(x, y)})
+		}
+	}
+
+	budget := budget_of(opts)
+	var report *MergeReport
+	if len(bg.Tiles) > budget {
+		if !opts.MergeTiles {
+			return nil, nil, fmt.Errorf("%s: image needs %d unique tiles, more than the budget of %d, '--merge-tiles' merges the most similar ones to fit", ex, len(bg.Tiles), budget)
+		}
+		bg.Tiles, report = merge_tiles(bg.Tiles, cells, f, p, opts.Metric, budget)
+	}
+	for i, cell := range cells {
+		bg.Nametable[(i/cols)*NAMETABLE_WIDTH+i%cols] = byte(cell.Tile % PATTERN_TABLE_SIZE)
+	}
+
+	if f.Grid.Attr == TILE_SIZE {
+		bg.ExAttributes = make([]byte, EXRAM_SIZE)
+		for i, cell := range cells {
+			bg.ExAttributes[(i/cols)*NAMETABLE_WIDTH+i%cols] = byte(cell.Subpal)<<6 | byte(cell.Tile/PATTERN_TABLE_SIZE)
+		}
+		return bg, report, nil
+	}
+
+	// larger blocks set the same sub-palette to every 16x16 area in them
+	for row := range (bounds.Dy() + ATTR_SIZE - 1) / ATTR_SIZE {
+		for col := range (bounds.Dx() + ATTR_SIZE - 1) / ATTR_SIZE {
+			shift := uint((row%2)*4 + (col%2)*2)
+			attr := f.attr_at(bounds.Min.X+col*ATTR_SIZE, bounds.Min.Y+row*ATTR_SIZE)
+			bg.Attributes[(row/2)*8+col/2] |= byte(attr) << shift
+		}
+	}
+
+	return bg, report, nil
+}
+
+// Returns the most tiles the background can have
+func budget_of(opts RemapOptions) int {
+	if opts.TileBudget == 0 {
+		return PATTERN_TABLE_SIZE
+	}
+	return opts.TileBudget
+}
+
+// A cell of the nametable: its tile and the sub-palette it is drawn with
+type TileCell struct {
+	Tile, Subpal int
+}
+
+// How merging tiles changed a frame
+type MergeReport struct {
+	// Number of tiles before and after merging
+	Before, After int
+	// Pixels drawn with another color out of all of them, and their
+	// average distance to it
+	Changed, Pixels int
+	Distance        float64
+}
+
+// Returns the 2 bit value of every pixel of a CHR tile, row by row
+func tile_values(tile [16]byte) [TILE_SIZE * TILE_SIZE]uint8 {
+	var values [TILE_SIZE * TILE_SIZE]uint8
+	for row := range TILE_SIZE {
+		for col := range TILE_SIZE {
+			bit := byte(0x80 >> col)
+			if tile[row]&bit != 0 {
+				values[row*TILE_SIZE+col] |= 1
+			}
+			if tile[row+8]&bit != 0 {
+				values[row*TILE_SIZE+col] |= 2
+			}
+		}
+	}
+	return values
+}
+
+// Merges the tiles until there are at most budget of them, every time
+// drawing the cells of a tile with the one that changes their colors the
+// least. The blank first tile is kept. Updates the tiles of the cells and
+// returns the tiles left
+func merge_tiles(tiles [][16]byte, cells []TileCell, f *Frame, p color.Palette, metric nespal.Metric, budget int) ([][16]byte, *MergeReport) {
+	values := make([][TILE_SIZE * TILE_SIZE]uint8, len(tiles))
+	for i, tile := range tiles {
+		values[i] = tile_values(tile)
+	}
+
+	// how far apart the colors of every sub-palette are
+	matcher := nespal.NewMatcher(p, metric)
+	dist := make([][4][4]float64, len(f.Subpals))
+	for s, subpal := range f.Subpals {
+		indices := make([]int, 4)
+		for i, c := range subpal {
+			indices[i] = int(c)
+		}
+		for a := range 4 {
+			copy(dist[s][a][:], matcher.Distances(p[subpal[a]], indices))
+		}
+	}
+
+	// how many cells draw every tile with every sub-palette
+	counts := make([][]int, len(tiles))
+	for i := range counts {
+		counts[i] = make([]int, len(f.Subpals))
+	}
+	for _, cell := range cells {
+		counts[cell.Tile][cell.Subpal]++
+	}
+
+	// the colors lost drawing the cells of a with b
+	cost := func(a, b int) float64 {
+		total := 0.0
+		for s, n := range counts[a] {
+			if n == 0 {
+				continue
+			}
+			d := 0.0
+			for i, v := range values[a] {
+				d += dist[s][v][values[b][i]]
+			}
+			total += float64(n) * d
+		}
+		return total
+	}
+
+	alive := make([]bool, len(tiles))
+	for i := range alive {
+		alive[i] = true
+	}
+	// the tile every tile is best merged into, and what it costs
+	target := make([]int, len(tiles))
+	target_cost := make([]float64, len(tiles))
+	find_target := func(a int) {
+		target[a], target_cost[a] = -1, math.MaxFloat64
+		for b := range tiles {
+			if b == a || !alive[b] {
+				continue
+			}
+			if c := cost(a, b); c < target_cost[a] {
+				target[a], target_cost[a] = b, c
+			}
+		}
+	}
+	for a := 1; a < len(tiles); a++ {
+		find_target(a)
+	}
+
+	merged := make([]int, len(tiles))
+	for i := range merged {
+		merged[i] = i
+	}
+	for n := len(tiles); n > budget; n-- {
+		a := -1
+		for i := 1; i < len(tiles); i++ {
+			if alive[i] && (a < 0 || target_cost[i] < target_cost[a]) {
+				a = i
+			}
+		}
+		b := target[a]
+		alive[a] = false
+		for i := range merged {
+			if merged[i] == a {
+				merged[i] = b
+			}
+		}
+		for s, count := range counts[a] {
+			counts[b][s] += count
+		}
+
+		// only the tiles merged into a, and b whose cells grew, find another
+		if b != 0 {
+			find_target(b)
+		}
+		for i := 1; i < len(tiles); i++ {
+			if alive[i] && target[i] == a {
+				find_target(i)
+			}
+		}
+	}
+
+	// the tiles left are numbered again in order
+	number := make([]int, len(tiles))
+	left := [][16]byte{}
+	for i, tile := range tiles {
+		if alive[i] {
+			number[i] = len(left)
+			left = append(left, tile)
+		}
+	}
+
+	report := &MergeReport{Before: len(tiles), After: len(left), Pixels: len(cells) * TILE_SIZE * TILE_SIZE}
+	for i, cell := range cells {
+		to := merged[cell.Tile]
+		for j, v := range values[cell.Tile] {
+			if d := dist[cell.Subpal][v][values[to][j]]; d > 0 {
+				report.Changed++
+				report.Distance += d
+			}
+		}
+		cells[i].Tile = number[to]
+	}
+	if report.Changed > 0 {
+		report.Distance /= float64(report.Changed)
+	}
+	return left, report
+}
+
+// Produces the CHR, nametable, attribute table and sub-palettes of an image
+// in out_dir, all named after the image
+func bake(img image.Image, pal io.Reader, name string, out_dir string, opts RemapOptions) (int, error) {
+	p, err := load_palette(pal)
+	if err != nil {
+		return 1, err
+	}
+
+	img = preprocess(img, p, opts)
+	var frame *Frame
+	if opts.Optimize {
+		frame = constrain_optimal(img, p, opts)
+	} else if frame, err = constrain(img, p, opts); err != nil {
+		return 1, err
+	}
+	report_unsafe(img, p, opts, name)
+
+	if opts.AttrMap != "" {
+		if status, err := write_image(attr_map(frame), opts.AttrMap, nil); err != nil {
+			return status, err
+		}
+	}
+	if opts.AttrTable != "" {
+		if err := write_attr_table(frame, opts.AttrTable); err != nil {
+			return 1, err
+		}
+	}
+	if opts.SubpalStats != "" {
+		if err := write_subpal_stats(frame, opts.SubpalStats); err != nil {
+			return 1, err
+		}
+	}
+
+	bg, report, err := build_background(frame, p, opts)
+	if err != nil {
+		return 1, err
+	}
+	if report != nil {
+		log.Printf(
+			"%s: %s: merged %d tiles into %d, %d of the %d pixels changed color by %.1f on average\n",
+			ex, name, report.Before, report.After, report.Changed, report.Pixels, report.Distance,
+		)
+	}
+	log.Printf("%s: %s: %d unique tiles, budget of %d\n", ex, name, len(bg.Tiles), budget_of(opts))
+
+	if err := os.MkdirAll(out_dir, 0o755); err != nil {
+		return 1, err
+	}
+	base := filepath.Join(out_dir, name)
+
+	chr := make([]byte, 0, len(bg.Tiles)*16)
+	for _, tile := range bg.Tiles {
+		chr = append(chr, tile[:]...)
+	}
+	// the editors load whole pattern tables
+	if opts.NESST {
+		chr = append(chr, make([]byte, PATTERN_TABLE_SIZE*16-len(chr))...)
+	}
+
+	subpals := make([]byte, 0, SUBPALETTES*4)
+	for i := range SUBPALETTES {
+		subpal := Subpalette{frame.Backdrop, frame.Backdrop, frame.Backdrop, frame.Backdrop}
+		if i < len(frame.Subpals) {
+			subpal = frame.Subpals[i]
+		}
+		subpals = append(subpals, subpal[:]...)
+	}
+
+	// with extended attributes, they are written instead of the attribute
+	// table, left empty
+	attr_ext, attrs := ".atr", bg.Attributes[:]
+	if bg.ExAttributes != nil {
+		attr_ext, attrs = ".exram", bg.ExAttributes
+	}
+
+	files := []struct {
+		ext  string
+		data []byte
+	}{
+		{".chr", chr},
+		{".nam", append(bg.Nametable[:], bg.Attributes[:]...)},
+		{attr_ext, attrs},
+		{".pal", subpals},
+	}
+	// the editors read the attribute table from the end of the nametable
+	if opts.NESST {
+		files = slices.Delete(files, 2, 3)
+	}
+	for _, file := range files {
+		if err := os.WriteFile(base+file.ext, file.data, 0o644); err != nil {
+			return 1, err
+		}
+	}
+
+	return 0, nil
+}
+
+// Runs the bake command given in the arguments
+func run_bake() int {
+	chosen_pal := pflag.StringP("palette", "p", "", "Color palette to bake the image with")
+	backdrop := pflag.String("backdrop", "", "NES palette index used as the backdrop color")
+	attr_map := pflag.String("attr-map", "", "Write an image showing the sub-palette of every attribute block")
+	attr_table := pflag.String("attr-table", "", "Write the sub-palette of every attribute block as a table, or as JSON for .json files")
+	tile_budget := pflag.Int("tile-budget", PATTERN_TABLE_SIZE, fmt.Sprintf("Most unique tiles, up to %d with '--attr-size 8'", 2*PATTERN_TABLE_SIZE))
+	merge_tiles := pflag.Bool("merge-tiles", false, "Merge the most similar tiles to fit in the tile budget")
+	nesst := pflag.Bool("nesst", false, "Write the files in the layouts NES Screen Tool and NEXXT open")
+	optimize := pflag.Bool("optimize", false, "Search the backdrop and sub-palettes losing the least of the image, slower")
+	subpal_stats := pflag.String("subpal-stats", "", "Write how the colors and blocks are spread across the sub-palettes, as text or as JSON for .json files, '-' for stdout")
+	grid_opts := grid_flags(pflag.CommandLine)
+	remap_opts := remap_flags(pflag.CommandLine)
+	pflag.Parse()
+	args := pflag.Args()
+
+	opts, err := remap_opts()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	if opts.Grid, err = grid_opts(); err != nil {
+		log.Println(err)
+		return 2
+	}
+	opts.AttrMap, opts.AttrTable, opts.SubpalStats = *attr_map, *attr_table, *subpal_stats
+	opts.Optimize, opts.NESST = *optimize, *nesst
+	opts.TileBudget, opts.MergeTiles = *tile_budget, *merge_tiles
+	if max_tiles := PATTERN_TABLE_SIZE; opts.TileBudget < 1 || opts.TileBudget > max_tiles && (opts.Grid.Attr != TILE_SIZE || opts.TileBudget > 2*max_tiles) {
+		log.Printf("%s: invalid value %d for '--tile-budget' flag, expected 1 to %d, or to %d with '--attr-size %d'\n", ex, opts.TileBudget, max_tiles, 2*max_tiles, TILE_SIZE)
+		return 2
+	}
+	if opts.NESST && opts.Grid.Attr == TILE_SIZE {
+		log.Printf("%s: NES Screen Tool and NEXXT do not support the extended attributes of '--attr-size %d'\n", ex, TILE_SIZE)
+		return 2
+	}
+
+	if *backdrop != "" {
+		i, err := parse_nes_index(*backdrop)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		if flag := opts.unusable(i); flag != "" {
+			log.Printf("%s: backdrop $%02X is never used with '%s'\n", ex, i, flag)
+			return 2
+		}
+		b := uint8(i)
+		opts.Backdrop = &b
+	}
+
+	if len(args) == 1 {
+		log.Printf("%s: missing image file\n", ex)
+		return 2
+	}
+
+	pages, err := load_pages(args[1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	name := strings.TrimSuffix(filepath.Base(args[1]), filepath.Ext(args[1]))
+
+	var pal io.Reader
+	out_arg := 3
+	if *chosen_pal != "" {
+		file, err := find_palette(strings.TrimSpace(*chosen_pal))
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		if file == nil {
+			log.Println(unknown_palette(*chosen_pal))
+			return 2
+		}
+		pal = file
+		out_arg = 2
+	} else {
+		if len(args) == 2 {
+			log.Printf("%s: missing color palette\n", ex)
+			return 2
+		}
+		if filepath.Ext(args[2]) != ".pal" {
+			log.Printf("%s: usupported palette file format for '%s', expected '.pal'\n", ex, args[2])
+			return 2
+		}
+
+		file, err := os.Open(args[2])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer file.Close()
+		pal = file
+	}
+
+	if len(args) == out_arg {
+		log.Printf("%s: missing output directory\n", ex)
+		return 2
+	}
+
+	if len(pages) == 1 {
+		if status, err := bake(pages[0], pal, name, args[out_arg], opts); err != nil {
+			log.Println(err)
+			return status
+		}
+		return 0
+	}
+
+	// every page of a TIFF file is baked, into files numbered like
+	// name-1.chr
+	pal_data, err := io.ReadAll(pal)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	for i, page := range pages {
+		opts := opts
+		if opts.AttrMap != "" {
+			opts.AttrMap = page_path(opts.AttrMap, i+1)
+		}
+		if opts.AttrTable != "" {
+			opts.AttrTable = page_path(opts.AttrTable, i+1)
+		}
+		if opts.SubpalStats != "" && opts.SubpalStats != "-" {
+			opts.SubpalStats = page_path(opts.SubpalStats, i+1)
+		}
+		if status, err := bake(page, bytes.NewReader(pal_data), fmt.Sprintf("%s-%d", name, i+1), args[out_arg], opts); err != nil {
+			log.Println(err)
+			return status
+		}
+	}
+	return 0
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+func TestMatcherTies(t *testing.T) {
+	p, _, err := load_named_palette("FCEUX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	matcher := nespal.NewMatcher(p, nil)
+	metric, err := nespal.GetMetric(nespal.DEFAULT_METRIC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		c       color.RGBA
+		allowed []int
+		want    int
+	}{
+		{"black", color.RGBA{0, 0, 0, 255}, nil, 0x0F},
+		{"white", nespal.ToRGB(p[0x30]), nil, 0x30},
+		{"black without $0F", color.RGBA{0, 0, 0, 255}, []int{0x0D, 0x1D, 0x16}, 0x1D},
+		{"black from $0D", color.RGBA{0, 0, 0, 255}, []int{0x0D, 0x16}, 0x0D},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := matcher.Closest(test.c, test.allowed); got != test.want {
+				t.Errorf("closest(%s) = $%02X, want $%02X", hex_color(test.c), got, test.want)
+			}
+			// the closest command lists them in the same order
+			if test.allowed == nil {
+				if got := closest_indices(test.c, p, metric, 1)[0].Index; got != test.want {
+					t.Errorf("closest_indices(%s) starts with $%02X, want $%02X", hex_color(test.c), got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBakeBlackBackdrop(t *testing.T) {
+	p, _, err := load_named_palette("FCEUX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pal, _, err := open_palette("FCEUX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pal.Close()
+
+	// a white and red square on black
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := range 32 {
+		for x := range 32 {
+			c := color.RGBA{0, 0, 0, 255}
+			if x >= 8 && x < 24 && y >= 8 && y < 24 {
+				c = nespal.ToRGB(p[0x30])
+				if x >= 16 {
+					c = nespal.ToRGB(p[0x16])
+				}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+
+	dir := t.TempDir()
+	if _, err := bake(img, pal, "square", dir, RemapOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	subpals, err := os.ReadFile(filepath.Join(dir, "square.pal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subpals[0] != 0x0F {
+		t.Errorf("backdrop is $%02X, want $0F", subpals[0])
+	}
+	if slices.Contains(subpals, 0x0D) || slices.Contains(subpals, 0x20) {
+		t.Errorf("sub-palettes % X use $0D or $20 instead of $0F and $30", subpals)
+	}
+	if !slices.Contains(subpals, 0x30) {
+		t.Errorf("sub-palettes % X miss the $30 white", subpals)
+	}
+}
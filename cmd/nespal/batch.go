@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Number of images processed at the same time by the commands taking
+// several images, set with --jobs
+var jobs = runtime.NumCPU()
+
+// Outcomes of the items of a batch
+const (
+	RESULT_DONE     = "done"
+	RESULT_SKIPPED  = "skipped"
+	RESULT_FAILED   = "failed"
+	RESULT_CANCELED = "canceled"
+)
+
+// Outcome of an item of a batch, written as a line of JSON with --results
+type BatchResult struct {
+	Input   string `json:"input"`
+	Output  string `json:"output,omitempty"`
+	Palette string `json:"palette,omitempty"`
+	// In seconds
+	Duration float64 `json:"duration"`
+	Status   string  `json:"status"`
+	Error    string  `json:"error,omitempty"`
+	// Set by the jobs whose item was up to date
+	skipped bool
+}
+
+// Stream of the results of the batches, set with --results, nil when they
+// are not written
+var batch_results *ResultWriter
+
+// Writes the results of a batch as JSON lines, as the items are done
+type ResultWriter struct {
+	mu   sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// Adds the flag writing the results of a batch. Returns the function
+// opening the file they are written to, setting batch_results
+func results_flags(flags *pflag.FlagSet) func() error {
+	path := flags.String("results", "", "Write the result of every image as a line of JSON to a file, '-' being the standard output")
+
+	return func() error {
+		if *path == "" {
+			return nil
+		}
+		file := os.Stdout
+		if *path != "-" {
+			var err error
+			if file, err = os.Create(*path); err != nil {
+				return err
+			}
+		}
+		batch_results = &ResultWriter{file: file, enc: json.NewEncoder(file)}
+		return nil
+	}
+}
+
+// Writes a result as a line of JSON
+func (r *ResultWriter) write(result BatchResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(result); err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *ResultWriter) Close() error {
+	if r.file == os.Stdout {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// Records how an item of a batch went, writing it when the results are
+func (r *BatchResult) finish(status int, err error, duration time.Duration) {
+	r.Duration = duration.Seconds()
+	switch {
+	case errors.Is(err, context.Canceled):
+		r.Status, r.Error = RESULT_CANCELED, err.Error()
+	case err != nil || status != 0:
+		r.Status = RESULT_FAILED
+		if err != nil {
+			r.Error = err.Error()
+		}
+	case r.skipped:
+		r.Status = RESULT_SKIPPED
+	default:
+		r.Status = RESULT_DONE
+	}
+	if batch_results != nil {
+		batch_results.write(*r)
+	}
+}
+
+// Runs f for each of the items, at most jobs of them at the same time, the
+// errors are logged in the order of the items once every item is done,
+// along with the outcome and duration of each when the log is structured.
+// f can fill the result of its item, written as soon as it is done when
+// the results are. Once ctx is done no other item is started. Returns the
+// highest exit status
+func run_jobs(ctx context.Context, items []string, f func(i int, result *BatchResult) (int, error)) int {
+	n := len(items)
+	statuses := make([]int, n)
+	errs := make([]error, n)
+	durations := make([]time.Duration, n)
+	results := make([]BatchResult, n)
+	for i, item := range items {
+		results[i].Input = item
+	}
+
+	// every worker takes the next item until there are none left
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(max(jobs, 1), n) {
+		wg.Go(func() {
+			for i := range next {
+				start := time.Now()
+				statuses[i], errs[i] = f(i, &results[i])
+				durations[i] = time.Since(start)
+				results[i].finish(statuses[i], errs[i], durations[i])
+			}
+		})
+	}
+dispatch:
+	for i := range n {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			for j := i; j < n; j++ {
+				statuses[j], errs[j] = 1, ctx.Err()
+				results[j].finish(statuses[j], errs[j], 0)
+			}
+			break dispatch
+		}
+	}
+	close(next)
+	wg.Wait()
+
+	status := 0
+	for i, err := range errs {
+		switch {
+		case structured_log() && err != nil:
+			slog.Error(err.Error(), "file", items[i], "status", statuses[i], "duration", durations[i])
+		case structured_log():
+			slog.Info("done", "file", items[i], "status", statuses[i], "duration", durations[i])
+		case err != nil:
+			log.Println(err)
+		}
+		status = max(status, statuses[i])
+	}
+	return status
+}
+
+// Extensions of the images read when given a directory
+var image_extensions = []string{".png", ".jpg", ".jpeg", ".gif", ".tif", ".tiff", ".avif", ".jxl"}
+
+// Returns the images in dir and its subdirectories, sorted by path
+func image_files(dir string) ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && slices.Contains(image_extensions, strings.ToLower(filepath.Ext(path))) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// Adds the flags reading the images from a list of files, for the sets too
+// large to be given as arguments. Returns the function reading the list,
+// which returns nil when none was given
+func files_from_flags(flags *pflag.FlagSet) func() ([]string, error) {
+	path := flags.String("files-from", "", "Also read the images from a file listing them, '-' being the standard input")
+	null := flags.BoolP("null", "0", false, "The files of '--files-from' are separated by NUL bytes, like 'find -print0' does")
+
+	return func() ([]string, error) {
+		if *path == "" {
+			if *null {
+				return nil, fmt.Errorf("%s: flag '--null' requires '--files-from'", ex)
+			}
+			return nil, nil
+		}
+		// raw framebuffers read the image '-' from the standard input too
+		if *path == "-" && raw_format != nil {
+			return nil, fmt.Errorf("%s: flag '--files-from -' can not be used with '--raw'", ex)
+		}
+
+		var r io.Reader = os.Stdin
+		if *path != "-" {
+			file, err := os.Open(*path)
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			r = file
+		}
+		return read_file_list(r, *null)
+	}
+}
+
+// Reads a list of files, one per line or separated by NUL bytes when null,
+// skipping the empty ones
+func read_file_list(r io.Reader, null bool) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if null {
+		scanner.Split(func(data []byte, at_eof bool) (int, []byte, error) {
+			if i := bytes.IndexByte(data, 0); i >= 0 {
+				return i + 1, data[:i], nil
+			}
+			if at_eof && len(data) > 0 {
+				return len(data), data, nil
+			}
+			return 0, nil, nil
+		})
+	}
+
+	files := []string{}
+	for scanner.Scan() {
+		file := scanner.Text()
+		if !null {
+			file = strings.TrimSuffix(file, "\r")
+		}
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, scanner.Err()
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"math/rand/v2"
+	"os"
+	"runtime"
+	"text/tabwriter"
+	"time"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Minimum time an operation is repeated for when benchmarking
+const BENCH_TIME = 300 * time.Millisecond
+
+// Repeats f for at least BENCH_TIME, returns how long a single run took
+func time_op(f func()) time.Duration {
+	runs := 0
+	start := time.Now()
+	for runs == 0 || time.Since(start) < BENCH_TIME {
+		f()
+		runs++
+	}
+	return time.Since(start) / time.Duration(runs)
+}
+
+// Returns a NES sized image going through every hue and brightness
+func bench_image() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, NAMETABLE_WIDTH*TILE_SIZE, NAMETABLE_HEIGHT*TILE_SIZE))
+	bounds := img.Bounds()
+	for y := range bounds.Dy() {
+		for x := range bounds.Dx() {
+			img.SetRGBA(x, y, color.RGBA{uint8(x), uint8(y), uint8(x ^ y), 255})
+		}
+	}
+	return img
+}
+
+// Times loading the palettes, matching colors and remapping img with
+// every number of CPUs up to the available ones
+func bench(img image.Image) (int, error) {
+	if img == nil {
+		img = bench_image()
+	}
+
+	var (
+		defaults []NamedPalette
+		err      error
+	)
+	load_time := time_op(func() { defaults, err = load_palettes() })
+	if err != nil {
+		return 1, err
+	}
+	if len(defaults) == 0 {
+		return 1, fmt.Errorf("%s: no palettes to benchmark with", ex)
+	}
+	p := defaults[0].Palette
+
+	rng := rand.New(rand.NewPCG(0, 0))
+	colors := make([]color.RGBA, 4096)
+	for i := range colors {
+		colors[i] = color.RGBA{uint8(rng.UintN(256)), uint8(rng.UintN(256)), uint8(rng.UintN(256)), 255}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OPERATION\tCPUS\tTIME\tSPEEDUP")
+	fmt.Fprintf(w, "load %d palettes\t1\t%v\t\n", len(defaults), load_time)
+
+	for _, name := range nespal.MetricNames() {
+		metric, _ := nespal.GetMetric(name)
+		matcher := nespal.NewMatcher(p, metric)
+		match_time := time_op(func() {
+			for _, c := range colors {
+				matcher.Closest(c, nil)
+			}
+		})
+		fmt.Fprintf(w, "nearest color (%s)\t1\t%v\t\n", name, match_time/time.Duration(len(colors)))
+	}
+
+	cpus := []int{}
+	for n := 1; n < runtime.NumCPU(); n *= 2 {
+		cpus = append(cpus, n)
+	}
+	cpus = append(cpus, runtime.NumCPU())
+
+	bounds := img.Bounds()
+	prev := runtime.GOMAXPROCS(0)
+	var base time.Duration
+	for _, n := range cpus {
+		runtime.GOMAXPROCS(n)
+		remap_time := time_op(func() { remap_image(img, p, RemapOptions{}) })
+		if base == 0 {
+			base = remap_time
+		}
+		fmt.Fprintf(w, "remap %dx%d\t%d\t%v\t%.2fx\n", bounds.Dx(), bounds.Dy(), n, remap_time, float64(base)/float64(remap_time))
+	}
+	runtime.GOMAXPROCS(prev)
+
+	if err := w.Flush(); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+// Runs the bench command given in the arguments
+func run_bench() int {
+	image_path := pflag.String("image", "", "Image to benchmark with, instead of a generated one")
+	pflag.Parse()
+
+	var source image.Image
+	if *image_path != "" {
+		var err error
+		if source, err = load_image(*image_path); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	if status, err := bench(source); err != nil {
+		log.Println(err)
+		return status
+	}
+	return 0
+}
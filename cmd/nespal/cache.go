@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+const (
+	CLEAR = "clear"
+)
+
+// Returns the directory results are cached in
+func cache_dir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "nespal"), nil
+}
+
+// Returns a hash of the candidates, their names and colors, so cached
+// results are only used with the same palettes
+func (cands *Candidates) hash() string {
+	h := sha256.New()
+	for _, pal := range cands.pals {
+		fmt.Fprintf(h, "%s\x00", pal.Name)
+		for _, c := range pal.Palette {
+			rgb := nespal.ToRGB(c)
+			h.Write([]byte{rgb.R, rgb.G, rgb.B})
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the hash of the content of the file at path
+func file_hash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Caches the identification of images, one file per image content and
+// set of candidates
+type IdentifyCache struct {
+	dir string
+	// hash of the candidates
+	set string
+}
+
+// Opens the cache of the results of identify with cands, of unscaled
+// images or not, returns nil when there is no cache directory
+func open_identify_cache(cands *Candidates, unscaled bool) *IdentifyCache {
+	dir, err := cache_dir()
+	if err != nil {
+		return nil
+	}
+	name := IDENTIFY
+	if unscaled {
+		name += "-unscaled"
+	}
+	return &IdentifyCache{filepath.Join(dir, name), cands.hash()}
+}
+
+func (c *IdentifyCache) path(image_hash string) string {
+	return filepath.Join(c.dir, c.set[:16]+"-"+image_hash+".json")
+}
+
+// Returns the cached identification of the image with the hash, if any
+func (c *IdentifyCache) get(image_hash string) (Identification, bool) {
+	data, err := os.ReadFile(c.path(image_hash))
+	if err != nil {
+		return Identification{}, false
+	}
+
+	var result Identification
+	if err := json.Unmarshal(data, &result); err != nil {
+		return Identification{}, false
+	}
+	return result, true
+}
+
+// Caches the identification of the image with the hash, failing silently
+// as the cache only saves time
+func (c *IdentifyCache) put(image_hash string, result Identification) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return
+	}
+
+	// written aside and then moved, so readers never see half a file
+	tmp, err := os.CreateTemp(c.dir, "*.tmp")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(data)
+	if close_err := tmp.Close(); err != nil || close_err != nil {
+		os.Remove(tmp.Name())
+		return
+	}
+	if err := os.Rename(tmp.Name(), c.path(image_hash)); err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// Runs the cache subcommand given in the arguments
+func run_cache() int {
+	if len(os.Args) == 2 {
+		log.Printf("%s: missing cache command\n", ex)
+		log.Printf("Try: %s %s %s\n", ex, HELP, CACHE)
+		return 2
+	}
+
+	switch os.Args[2] {
+	case CLEAR:
+		dir, err := cache_dir()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Println(err)
+			return 1
+		}
+	default:
+		log.Printf("%s: unknown cache command \"%s\"\n", ex, os.Args[2])
+		log.Printf("Try: %s %s %s\n", ex, HELP, CACHE)
+		return 2
+	}
+
+	return 0
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"os"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// Size in bytes of a nametable along with its attribute table
+	NAMETABLE_SIZE = NAMETABLE_WIDTH*NAMETABLE_HEIGHT + 64
+	// Size in bytes of the two pattern tables the PPU sees
+	CHR_SIZE = 2 * PATTERN_TABLE_SIZE * 16
+	// Size in bytes of the object attribute memory, 4 bytes per sprite
+	OAM_SIZE = 256
+	// Most sprites the PPU draws on a scanline, the ones after them in OAM
+	// are dropped
+	SPRITES_PER_LINE = 8
+)
+
+// Bits of the third byte of the sprites in OAM
+const (
+	SPRITE_BEHIND = 1 << 5
+	SPRITE_FLIP_X = 1 << 6
+	SPRITE_FLIP_Y = 1 << 7
+)
+
+// The memory of the PPU a frame is rendered from
+type PPUFrame struct {
+	// Pattern tables, padded to both tables
+	CHR []byte
+	// Nametable followed by its attribute table
+	Nametable []byte
+	// MMC5 extended attributes, a byte per cell of the nametable with its
+	// sub-palette in the top two bits and the 4K bank of its tile in the
+	// others, nil without them
+	ExAttributes []byte
+	// Contents of the palette RAM, the sprite sub-palettes may be missing
+	// when there are no sprites
+	PaletteRAM []byte
+	// Object attribute memory, nil without sprites
+	OAM []byte
+	// Pattern tables of the background and of the sprites, 0 or 1
+	BgTable, SpriteTable int
+	// Whether the sprites are 8x16, taking their pattern table from the
+	// first bit of their tile
+	TallSprites bool
+}
+
+// Returns the value, from 0 to 3, of the pixel x, y of the tile at offset
+// in the CHR
+func chr_pixel(chr []byte, offset int, x, y int) uint8 {
+	bit := byte(0x80 >> x)
+	v := uint8(0)
+	if chr[offset+y]&bit != 0 {
+		v |= 1
+	}
+	if chr[offset+y+8]&bit != 0 {
+		v |= 2
+	}
+	return v
+}
+
+// Returns the NES palette index of the background at x, y, with whether it
+// is opaque, the backdrop being transparent
+func (f *PPUFrame) background_at(x, y int) (uint8, bool) {
+	cell := (y/TILE_SIZE)*NAMETABLE_WIDTH + x/TILE_SIZE
+	tile := f.BgTable*PATTERN_TABLE_SIZE + int(f.Nametable[cell])
+	var subpal int
+	if f.ExAttributes != nil {
+		subpal = int(f.ExAttributes[cell] >> 6)
+		tile = int(f.ExAttributes[cell]&0x3F)*PATTERN_TABLE_SIZE + int(f.Nametable[cell])
+	} else {
+		attr := f.Nametable[NAMETABLE_WIDTH*NAMETABLE_HEIGHT+(y/32)*8+x/32]
+		subpal = int(attr>>(((y/ATTR_SIZE)%2)*4+((x/ATTR_SIZE)%2)*2)) & 3
+	}
+
+	// the tiles past the CHR are blank
+	v := uint8(0)
+	if (tile+1)*16 <= len(f.CHR) {
+		v = chr_pixel(f.CHR, tile*16, x%TILE_SIZE, y%TILE_SIZE)
+	}
+	if v == 0 {
+		return f.PaletteRAM[0] & 0x3F, false
+	}
+	return f.PaletteRAM[subpal*4+int(v)] & 0x3F, true
+}
+
+// Renders the frame like the PPU: the backdrop where the background is
+// transparent, and on every scanline the first SPRITES_PER_LINE sprites in
+// OAM on it. The first opaque sprite at a pixel wins over the ones after
+// it, even when it is behind the background, hiding them. The sprites show
+// a scanline below their Y, and the ones at 239 or below are hidden.
+// Returns the image, with the colors of p, and the number of scanlines
+// with sprites dropped
+func (f *PPUFrame) render(p color.Palette) (*image.Paletted, int) {
+	m := image.NewPaletted(image.Rect(0, 0, FRAME_WIDTH, FRAME_HEIGHT), p)
+	height := TILE_SIZE
+	if f.TallSprites {
+		height *= 2
+	}
+
+	dropped := 0
+	for y := range FRAME_HEIGHT {
+		// the sprites on the scanline, in the order of OAM
+		line := []int{}
+		for i := 0; i+4 <= len(f.OAM); i += 4 {
+			if row := y - int(f.OAM[i]) - 1; row >= 0 && row < height {
+				line = append(line, i)
+			}
+		}
+		if len(line) > SPRITES_PER_LINE {
+			line = line[:SPRITES_PER_LINE]
+			dropped++
+		}
+
+		for x := range FRAME_WIDTH {
+			index, opaque := f.background_at(x, y)
+			for _, i := range line {
+				v, subpal, behind := f.sprite_at(i, x, y, height)
+				if v == 0 {
+					continue
+				}
+				if !behind || !opaque {
+					index = f.PaletteRAM[16+subpal*4+int(v)] & 0x3F
+				}
+				break
+			}
+			m.Pix[y*m.Stride+x] = index
+		}
+	}
+	return m, dropped
+}
+
+// Returns the value, from 0 to 3, of the sprite at i in OAM at the pixel
+// x, y of the frame, along with its sub-palette and whether it is behind
+// the background
+func (f *PPUFrame) sprite_at(i int, x, y int, height int) (uint8, int, bool) {
+	tile, attr, left := int(f.OAM[i+1]), f.OAM[i+2], int(f.OAM[i+3])
+	col, row := x-left, y-int(f.OAM[i])-1
+	if col < 0 || col >= TILE_SIZE {
+		return 0, 0, false
+	}
+	if attr&SPRITE_FLIP_X != 0 {
+		col = TILE_SIZE - 1 - col
+	}
+	if attr&SPRITE_FLIP_Y != 0 {
+		row = height - 1 - row
+	}
+
+	// 8x16 sprites are two tiles on top of each other, from the pattern
+	// table of the first bit of their tile
+	table := f.SpriteTable
+	if f.TallSprites {
+		table = tile & 1
+		tile = tile&0xFE + row/TILE_SIZE
+		row %= TILE_SIZE
+	}
+	tile += table * PATTERN_TABLE_SIZE
+	if (tile+1)*16 > len(f.CHR) {
+		return 0, 0, false
+	}
+	return chr_pixel(f.CHR, tile*16, col, row), int(attr & 3), attr&SPRITE_BEHIND != 0
+}
+
+// Checks the sizes of the memories of the frame, padding the CHR to both
+// pattern tables
+func (f *PPUFrame) validate() error {
+	if len(f.CHR) == 0 || len(f.CHR)%16 != 0 {
+		return fmt.Errorf("%s: CHR has %d bytes, expected 16 bytes per tile", ex, len(f.CHR))
+	}
+	max_chr := CHR_SIZE
+	if f.ExAttributes != nil {
+		max_chr = 64 * PATTERN_TABLE_SIZE * 16
+	}
+	if len(f.CHR) > max_chr {
+		return fmt.Errorf("%s: CHR has %d bytes, more than the %d the PPU sees", ex, len(f.CHR), max_chr)
+	}
+	if len(f.Nametable) != NAMETABLE_SIZE {
+		return fmt.Errorf("%s: nametable has %d bytes, expected %d, its tiles followed by its attribute table", ex, len(f.Nametable), NAMETABLE_SIZE)
+	}
+	if f.ExAttributes != nil && len(f.ExAttributes) < NAMETABLE_WIDTH*NAMETABLE_HEIGHT {
+		return fmt.Errorf("%s: extended attributes have %d bytes, expected at least %d", ex, len(f.ExAttributes), NAMETABLE_WIDTH*NAMETABLE_HEIGHT)
+	}
+	if f.OAM != nil && len(f.OAM) != OAM_SIZE {
+		return fmt.Errorf("%s: OAM has %d bytes, expected %d, 4 per sprite", ex, len(f.OAM), OAM_SIZE)
+	}
+
+	expected := PALETTE_RAM_SIZE / 2
+	if f.OAM != nil {
+		expected = PALETTE_RAM_SIZE
+	}
+	if len(f.PaletteRAM) != PALETTE_RAM_SIZE && (len(f.PaletteRAM) != PALETTE_RAM_SIZE/2 || f.OAM != nil) {
+		return fmt.Errorf("%s: palette RAM has %d bytes, expected %d", ex, len(f.PaletteRAM), expected)
+	}
+
+	f.CHR = append(f.CHR, make([]byte, max(CHR_SIZE-len(f.CHR), 0))...)
+	return nil
+}
+
+// Runs the compose command given in the arguments
+func run_compose() int {
+	chr_path := pflag.String("chr", "", "Pattern tables, as a .chr file")
+	nam_path := pflag.String("nam", "", "Nametable followed by its attribute table")
+	pal_path := pflag.String("pal", "", "Palette RAM, the background and sprite sub-palettes")
+	oam_path := pflag.String("oam", "", "Object attribute memory with the sprites")
+	exram_path := pflag.String("exram", "", "MMC5 extended attributes, replacing the attribute table")
+	bg_table := pflag.Int("bg-table", 0, "Pattern table of the background, 0 or 1")
+	sprite_table := pflag.Int("sprite-table", 0, "Pattern table of the 8x8 sprites, 0 or 1")
+	tall := pflag.Bool("tall-sprites", false, "Draw 8x16 sprites")
+	bits_flag := pflag.StringSlice("bits", nil, "Emphasis bits to set: r, g and b")
+	pflag.Parse()
+	args := pflag.Args()
+
+	bits, err := parse_emphasis(*bits_flag)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	for _, table := range []struct {
+		flag  string
+		value int
+	}{{"bg-table", *bg_table}, {"sprite-table", *sprite_table}} {
+		if table.value != 0 && table.value != 1 {
+			log.Printf("%s: invalid value '%d' for '--%s' flag, expected 0 or 1\n", ex, table.value, table.flag)
+			return 2
+		}
+	}
+	for _, file := range []struct{ flag, path string }{{"chr", *chr_path}, {"nam", *nam_path}, {"pal", *pal_path}} {
+		if file.path == "" {
+			log.Printf("%s: missing '--%s' file\n", ex, file.flag)
+			return 2
+		}
+	}
+	if len(args) == 1 {
+		log.Printf("%s: missing color palette\n", ex)
+		return 2
+	}
+	if len(args) == 2 {
+		log.Printf("%s: missing output image\n", ex)
+		return 2
+	}
+
+	frame := &PPUFrame{BgTable: *bg_table, SpriteTable: *sprite_table, TallSprites: *tall}
+	for _, file := range []struct {
+		path string
+		data *[]byte
+	}{{*chr_path, &frame.CHR}, {*nam_path, &frame.Nametable}, {*pal_path, &frame.PaletteRAM}, {*oam_path, &frame.OAM}, {*exram_path, &frame.ExAttributes}} {
+		if file.path == "" {
+			continue
+		}
+		if *file.data, err = os.ReadFile(file.path); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	if err := frame.validate(); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	pal, name, err := open_palette(args[1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	var p color.Palette
+	if bits != 0 {
+		_, p, err = load_emphasis(pal, name, bits)
+	} else {
+		p, err = load_palette(pal)
+	}
+	pal.Close()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	img, dropped := frame.render(p)
+	if dropped > 0 {
+		log.Printf("warning: sprites dropped on %d scanlines, the PPU draws at most %d per scanline\n", dropped, SPRITES_PER_LINE)
+	}
+	if status, err := write_image(img, args[2], nil); err != nil {
+		log.Println(err)
+		return status
+	}
+	return 0
+}
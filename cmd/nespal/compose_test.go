@@ -0,0 +1,112 @@
+package main
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Baking an image that already fits the constraints and composing the
+// files back must give the image again
+func TestBakeCompose(t *testing.T) {
+	p, _, err := load_named_palette("FCEUX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	subpals := [][4]uint8{
+		{0x0F, 0x30, 0x16, 0x27},
+		{0x0F, 0x21, 0x12, 0x2A},
+		{0x0F, 0x19, 0x29, 0x38},
+		{0x0F, 0x24, 0x14, 0x3C},
+	}
+
+	tests := []struct {
+		name          string
+		width, height int
+		grid          Grid
+		nesst         bool
+	}{
+		{"frame", FRAME_WIDTH, FRAME_HEIGHT, Grid{}, false},
+		{"smaller", 64, 48, Grid{}, false},
+		{"nesst", FRAME_WIDTH, FRAME_HEIGHT, Grid{}, true},
+		{"exram", FRAME_WIDTH, FRAME_HEIGHT, Grid{TILE_SIZE, TILE_SIZE, image.Point{}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			attr := test.grid.Attr
+			if attr == 0 {
+				attr = ATTR_SIZE
+			}
+			// stripes in the colors of a sub-palette per block, the last
+			// row of blocks left to the backdrop
+			img := image.NewRGBA(image.Rect(0, 0, test.width, test.height))
+			for y := range test.height {
+				for x := range test.width {
+					bx, by := x/attr, y/attr
+					v := ((x%TILE_SIZE)/2 + (y%TILE_SIZE)/2 + (bx+by)%3) % 4
+					if by == (test.height-1)/attr {
+						v = 0
+					}
+					img.SetRGBA(x, y, nespal.ToRGB(p[subpals[(bx+2*by)%len(subpals)][v]]))
+				}
+			}
+
+			pal, _, err := open_palette("FCEUX")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pal.Close()
+			dir := t.TempDir()
+			opts := RemapOptions{Grid: test.grid, NESST: test.nesst}
+			if _, err := bake(img, pal, "test", dir, opts); err != nil {
+				t.Fatal(err)
+			}
+
+			frame := &PPUFrame{}
+			files := []struct {
+				ext  string
+				data *[]byte
+			}{{".chr", &frame.CHR}, {".nam", &frame.Nametable}, {".pal", &frame.PaletteRAM}}
+			if test.grid.Attr == TILE_SIZE {
+				files = append(files, struct {
+					ext  string
+					data *[]byte
+				}{".exram", &frame.ExAttributes})
+			}
+			for _, file := range files {
+				if *file.data, err = os.ReadFile(filepath.Join(dir, "test"+file.ext)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// the attribute table is left to the nametable for the editors,
+			// and replaced by the extended attributes
+			want_atr := !test.nesst && test.grid.Attr != TILE_SIZE
+			if _, err := os.Stat(filepath.Join(dir, "test.atr")); want_atr != (err == nil) {
+				t.Errorf("attribute table written: %t, want %t", err == nil, want_atr)
+			}
+			if err := frame.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			composed, dropped := frame.render(p)
+			if dropped != 0 {
+				t.Errorf("%d scanlines dropped sprites, want none", dropped)
+			}
+			backdrop := nespal.ToRGB(p[0x0F])
+			for y := range FRAME_HEIGHT {
+				for x := range FRAME_WIDTH {
+					want := backdrop
+					if x < test.width && y < test.height {
+						want = img.RGBAAt(x, y)
+					}
+					if got := nespal.ToRGB(composed.At(x, y)); got != want {
+						t.Fatalf("pixel %d,%d is %s, want %s", x, y, hex_color(got), hex_color(want))
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"slices"
+	"sort"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+const (
+	// Size in pixels of a background tile
+	TILE_SIZE = 8
+	// Size in pixels of the area sharing a sub-palette in the attribute table
+	ATTR_SIZE = 16
+	// Number of background sub-palettes
+	SUBPALETTES = 4
+	// Size in tiles of a nametable
+	NAMETABLE_WIDTH  = 32
+	NAMETABLE_HEIGHT = 30
+)
+
+// Geometry of the background grid: the size in pixels of the tiles and of
+// the areas sharing a sub-palette, and the pixel of the image where they
+// start, like in frames scrolled by a few pixels
+type Grid struct {
+	Tile   int
+	Attr   int
+	Offset image.Point
+}
+
+// The grid of the NES PPU without scrolling
+var default_grid = Grid{TILE_SIZE, ATTR_SIZE, image.Point{}}
+
+// Returns the top left corner of the first attribute block of the area,
+// at or before the top left corner of bounds
+func (g Grid) origin(bounds image.Rectangle) image.Point {
+	o := image.Pt(g.Offset.X%g.Attr, g.Offset.Y%g.Attr)
+	if o.X > 0 {
+		o.X -= g.Attr
+	}
+	if o.Y > 0 {
+		o.Y -= g.Attr
+	}
+	return bounds.Min.Add(o)
+}
+
+// Four NES palette indexes, the first being the shared backdrop color
+type Subpalette [4]uint8
+
+// An image remapped to fit the NES background constraints
+type Frame struct {
+	// NES palette index of every pixel
+	Indexed  *image.Paletted
+	Backdrop uint8
+	Subpals  []Subpalette
+	// Sub-palette used by each attribute block, row by row
+	Attrs              []int
+	AttrCols, AttrRows int
+	Grid               Grid
+}
+
+// Returns the sub-palette used by the attribute block containing x, y
+func (f *Frame) subpal_at(x, y int) Subpalette {
+	return f.Subpals[f.attr_at(x, y)]
+}
+
+// Returns which sub-palette the attribute block containing x, y uses
+func (f *Frame) attr_at(x, y int) int {
+	origin := f.Grid.origin(f.Indexed.Bounds())
+	col := (x - origin.X) / f.Grid.Attr
+	row := (y - origin.Y) / f.Grid.Attr
+	return f.Attrs[row*f.AttrCols+col]
+}
+
+// Returns the bounds of every attribute block of the grid in the area, row
+// by row, the blocks on the borders being cut to the area
+func attr_blocks(bounds image.Rectangle, grid Grid) ([]image.Rectangle, int, int) {
+	origin := grid.origin(bounds)
+	cols := (bounds.Max.X - origin.X + grid.Attr - 1) / grid.Attr
+	rows := (bounds.Max.Y - origin.Y + grid.Attr - 1) / grid.Attr
+
+	blocks := make([]image.Rectangle, 0, cols*rows)
+	for row := range rows {
+		for col := range cols {
+			min := origin.Add(image.Pt(col*grid.Attr, row*grid.Attr))
+			blocks = append(blocks, image.Rectangle{min, min.Add(image.Pt(grid.Attr, grid.Attr))}.Intersect(bounds))
+		}
+	}
+	return blocks, cols, rows
+}
+
+// Counts how many pixels use each palette index in the area of m
+func count_indices(m *image.Paletted, r image.Rectangle) [256]int {
+	var counts [256]int
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			counts[m.ColorIndexAt(x, y)]++
+		}
+	}
+	return counts
+}
+
+// Returns the indexes with a non zero count, the most used first
+func by_usage(counts [256]int) []uint8 {
+	used := make([]uint8, 0, nespal.PALETTE_SIZE)
+	for i, n := range counts {
+		if n > 0 {
+			used = append(used, uint8(i))
+		}
+	}
+	sort.SliceStable(used, func(a, b int) bool { return counts[used[a]] > counts[used[b]] })
+	return used
+}
+
+// Remaps img to p while following the NES background constraints: every
+// attribute block of the grid of opts uses at most three colors plus the
+// backdrop, out of at most four sub-palettes
+func constrain(img image.Image, p color.Palette, opts RemapOptions) (*Frame, error) {
+	grid := opts.Grid
+	if grid.Attr == 0 {
+		grid = default_grid
+	}
+
+	indexed := remap_image(img, p, opts)
+	bounds := indexed.Bounds()
+	blocks, cols, rows := attr_blocks(bounds, grid)
+
+	frame := &Frame{
+		Indexed:  indexed,
+		Attrs:    make([]int, len(blocks)),
+		AttrCols: cols,
+		AttrRows: rows,
+		Grid:     grid,
+	}
+
+	if opts.Backdrop != nil {
+		frame.Backdrop = *opts.Backdrop
+	} else {
+		frame.Backdrop = by_usage(count_indices(indexed, bounds))[0]
+	}
+
+	// colors identical to the backdrop, like the many blacks, become the backdrop
+	backdrop := p[frame.Backdrop]
+	for i, c := range indexed.Pix {
+		if p[c] == backdrop {
+			indexed.Pix[i] = frame.Backdrop
+		}
+	}
+	// and so do the transparent pixels, the backdrop showing through them
+	if opts.AlphaThreshold != nil {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if transparent(img, x, y) {
+					indexed.SetColorIndex(x, y, frame.Backdrop)
+				}
+			}
+		}
+	}
+
+	// keeps the three most used colors of each block
+	matcher := nespal.NewMatcher(p, opts.Metric)
+	sets := make([][]uint8, len(blocks))
+	for i, block := range blocks {
+		colors := make([]uint8, 0, 3)
+		for _, c := range by_usage(count_indices(indexed, block)) {
+			if c != frame.Backdrop && len(colors) < 3 {
+				colors = append(colors, c)
+			}
+		}
+		sets[i] = colors
+
+		allowed := []int{int(frame.Backdrop)}
+		for _, c := range colors {
+			allowed = append(allowed, int(c))
+		}
+		reduce_block(img, indexed, block, allowed, matcher)
+	}
+
+	// the blocks with the most colors are the hardest to fit, so they go first
+	order := make([]int, len(blocks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return len(sets[order[a]]) > len(sets[order[b]]) })
+
+	subpals := make([][]uint8, 0, SUBPALETTES)
+	for _, i := range order {
+		j := fit_subpalette(subpals, sets[i])
+		if j < 0 {
+			if len(subpals) == SUBPALETTES {
+				block := blocks[i]
+				return nil, fmt.Errorf(
+					"%s: attribute block at %d,%d needs colors %s that do not fit in the %d sub-palettes",
+					ex, block.Min.X, block.Min.Y, format_indices(sets[i]), SUBPALETTES,
+				)
+			}
+			subpals = append(subpals, nil)
+			j = len(subpals) - 1
+		}
+		subpals[j] = union_indices(subpals[j], sets[i])
+		frame.Attrs[i] = j
+	}
+
+	for _, colors := range subpals {
+		subpal := Subpalette{frame.Backdrop, frame.Backdrop, frame.Backdrop, frame.Backdrop}
+		copy(subpal[1:], colors)
+		frame.Subpals = append(frame.Subpals, subpal)
+	}
+	if len(frame.Subpals) == 0 {
+		frame.Subpals = append(frame.Subpals, Subpalette{frame.Backdrop, frame.Backdrop, frame.Backdrop, frame.Backdrop})
+	}
+
+	return frame, nil
+}
+
+// Remaps the pixels of the block using colors outside of allowed
+func reduce_block(img image.Image, m *image.Paletted, block image.Rectangle, allowed []int, matcher *nespal.Matcher) {
+	for y := block.Min.Y; y < block.Max.Y; y++ {
+		for x := block.Min.X; x < block.Max.X; x++ {
+			i := int(m.ColorIndexAt(x, y))
+			if !slices.Contains(allowed, i) {
+				m.SetColorIndex(x, y, uint8(matcher.Closest(img.At(x, y), allowed)))
+			}
+		}
+	}
+}
+
+// Returns which of subpals can hold the colors, preferring the one that
+// already has the most of them, or -1 if none can
+func fit_subpalette(subpals [][]uint8, colors []uint8) int {
+	best, best_shared := -1, -1
+	for j, subpal := range subpals {
+		union := union_indices(subpal, colors)
+		if len(union) > 3 {
+			continue
+		}
+
+		shared := len(subpal) + len(colors) - len(union)
+		if shared > best_shared {
+			best, best_shared = j, shared
+		}
+	}
+	return best
+}
+
+// Returns the indexes of a followed by the ones only in b
+func union_indices(a, b []uint8) []uint8 {
+	union := append([]uint8{}, a...)
+	for _, c := range b {
+		if !slices.Contains(union, c) {
+			union = append(union, c)
+		}
+	}
+	return union
+}
+
+// Formats indexes the way NES developers write them, like "$0F,$30"
+func format_indices(indices []uint8) string {
+	s := ""
+	for i, c := range indices {
+		if i > 0 {
+			s += ","
+		}
+		s += fmt.Sprintf("$%02X", c)
+	}
+	return s
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+const (
+	DENOISE_MEDIAN    = "median"
+	DENOISE_BILATERAL = "bilateral"
+)
+
+// Strength of --denoise when given without a value
+const DENOISE_STRENGTH = 1
+
+// Largest strength of --denoise, past it the images are only blurred
+const MAX_DENOISE = 10
+
+// Parses the value of --denoise, a strength, a method or both like
+// "bilateral:2", into its pre-pass
+func parse_denoise(value string) (nespal.PrePass, error) {
+	method, arg, found := strings.Cut(strings.TrimSpace(value), ":")
+	if _, err := strconv.Atoi(method); err == nil && !found {
+		method, arg = DENOISE_MEDIAN, method
+	}
+
+	strength := DENOISE_STRENGTH
+	if arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 1 || n > MAX_DENOISE {
+			return nil, fmt.Errorf("%s: invalid strength '%s' for '--denoise' flag, expected 1 to %d", ex, arg, MAX_DENOISE)
+		}
+		strength = n
+	}
+
+	switch method {
+	case DENOISE_MEDIAN:
+		return median_pass(strength), nil
+	case DENOISE_BILATERAL:
+		return bilateral_pass(strength), nil
+	}
+	return nil, fmt.Errorf("%s: invalid value '%s' for '--denoise' flag, expected a strength, '%s' or '%s'", ex, value, DENOISE_MEDIAN, DENOISE_BILATERAL)
+}
+
+// Returns the pixels of img as NRGBA, with the coordinates clamped to its
+// bounds so filters can read past the borders
+func clamped_reader(img image.Image) (*image.NRGBA, func(x, y int) color.NRGBA) {
+	bounds := img.Bounds()
+	src := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			src.SetNRGBA(x, y, color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA))
+		}
+	}
+
+	return src, func(x, y int) color.NRGBA {
+		x = min(max(x, bounds.Min.X), bounds.Max.X-1)
+		y = min(max(y, bounds.Min.Y), bounds.Max.Y-1)
+		return src.NRGBAAt(x, y)
+	}
+}
+
+// Replaces every channel of every pixel with its median in the square of
+// the radius around it, which removes speckles and JPEG artifacts while
+// keeping the edges
+func median_pass(radius int) nespal.PrePass {
+	return func(img image.Image) image.Image {
+		src, at := clamped_reader(img)
+		bounds := src.Rect
+		res := image.NewNRGBA(bounds)
+
+		size := (2*radius + 1) * (2*radius + 1)
+		window := [3][]uint8{make([]uint8, 0, size), make([]uint8, 0, size), make([]uint8, 0, size)}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				for ch := range window {
+					window[ch] = window[ch][:0]
+				}
+				for dy := -radius; dy <= radius; dy++ {
+					for dx := -radius; dx <= radius; dx++ {
+						c := at(x+dx, y+dy)
+						window[0] = append(window[0], c.R)
+						window[1] = append(window[1], c.G)
+						window[2] = append(window[2], c.B)
+					}
+				}
+				for ch := range window {
+					slices.Sort(window[ch])
+				}
+				res.SetNRGBA(x, y, color.NRGBA{window[0][size/2], window[1][size/2], window[2][size/2], src.NRGBAAt(x, y).A})
+			}
+		}
+		return res
+	}
+}
+
+// Averages every pixel with the ones around it, weighted by how close they
+// are and how similar their colors are, so noise is smoothed out but the
+// edges between different colors are kept
+func bilateral_pass(strength int) nespal.PrePass {
+	radius := strength
+	sigma_space := float64(strength)
+	sigma_range := 20.0 * float64(strength)
+
+	return func(img image.Image) image.Image {
+		src, at := clamped_reader(img)
+		bounds := src.Rect
+		res := image.NewNRGBA(bounds)
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				center := src.NRGBAAt(x, y)
+				var sum [3]float64
+				total := 0.0
+				for dy := -radius; dy <= radius; dy++ {
+					for dx := -radius; dx <= radius; dx++ {
+						c := at(x+dx, y+dy)
+						dr, dg, db := float64(c.R)-float64(center.R), float64(c.G)-float64(center.G), float64(c.B)-float64(center.B)
+						space := float64(dx*dx+dy*dy) / (2 * sigma_space * sigma_space)
+						rng := (dr*dr + dg*dg + db*db) / (2 * sigma_range * sigma_range)
+						w := math.Exp(-space - rng)
+						sum[0] += w * float64(c.R)
+						sum[1] += w * float64(c.G)
+						sum[2] += w * float64(c.B)
+						total += w
+					}
+				}
+				res.SetNRGBA(x, y, color.NRGBA{clamp8(sum[0] / total), clamp8(sum[1] / total), clamp8(sum[2] / total), center.A})
+			}
+		}
+		return res
+	}
+}
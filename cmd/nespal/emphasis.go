@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"math"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Emphasis bits of the PPU, in the order of the banks of a .pal file with
+// emphasis: every bank is the 64 colors with one combination of them
+const (
+	EMPHASIS_RED   = 1 << 0
+	EMPHASIS_GREEN = 1 << 1
+	EMPHASIS_BLUE  = 1 << 2
+)
+
+// Number of emphasis banks of a .pal file with emphasis
+const EMPHASIS_BANKS = 8
+
+// Share of the signal the PPU keeps in the channels of the colors an
+// emphasis bit does not emphasize, as measured on the RP2C02
+const EMPHASIS_ATTENUATION = 0.746
+
+// Computes the emphasis banks of the 64 colors of p, returning the content
+// of a .pal file with emphasis. Every emphasis bit dims the two channels of
+// the colors it does not emphasize, the blacks of the columns $xE and $xF
+// are left as they are, like on the PPU. The PAL PPUs emphasize green with
+// the bit of red and red with the one of green, so swap_rg swaps them
+func generate_emphasis(p color.Palette, swap_rg bool) []byte {
+	data := make([]byte, 0, nespal.PALETTE_SIZE*3*EMPHASIS_BANKS)
+	for bits := range EMPHASIS_BANKS {
+		emph := bits
+		if swap_rg {
+			emph = bits&EMPHASIS_BLUE | bits&EMPHASIS_RED<<1 | bits&EMPHASIS_GREEN>>1
+		}
+		// the factor of every channel, dimmed by every bit of the others
+		factors := [3]float64{1, 1, 1}
+		for ch, bit := range []int{EMPHASIS_RED, EMPHASIS_GREEN, EMPHASIS_BLUE} {
+			if emph&bit == 0 {
+				continue
+			}
+			for other := range factors {
+				if other != ch {
+					factors[other] *= EMPHASIS_ATTENUATION
+				}
+			}
+		}
+
+		for i, c := range p[:nespal.PALETTE_SIZE] {
+			rgb := nespal.ToRGB(c)
+			if i%16 >= 0xE {
+				data = append(data, rgb.R, rgb.G, rgb.B)
+				continue
+			}
+			for ch, v := range []uint8{rgb.R, rgb.G, rgb.B} {
+				data = append(data, uint8(math.Round(float64(v)*factors[ch])))
+			}
+		}
+	}
+	return data
+}
+
+// Parses emphasis bits like "r,g,b", "red,blue" or "none"
+func parse_emphasis(values []string) (int, error) {
+	bits := 0
+	for _, v := range values {
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "r", "red":
+			bits |= EMPHASIS_RED
+		case "g", "green":
+			bits |= EMPHASIS_GREEN
+		case "b", "blue":
+			bits |= EMPHASIS_BLUE
+		case "none", "":
+		default:
+			return 0, fmt.Errorf("%s: invalid emphasis bit '%s', expected r, g or b", ex, v)
+		}
+	}
+	return bits, nil
+}
+
+// Reads the .pal file with emphasis of the palette called name, returning
+// the colors without emphasis and the ones of the bank of the emphasis bits
+func load_emphasis(pal io.Reader, name string, bits int) (color.Palette, color.Palette, error) {
+	data, err := io.ReadAll(pal)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(data) < nespal.PALETTE_SIZE*3*EMPHASIS_BANKS {
+		return nil, nil, fmt.Errorf("%s: palette '%s' has %d bytes, expected %d with its emphasis colors", ex, name, len(data), nespal.PALETTE_SIZE*3*EMPHASIS_BANKS)
+	}
+	if data, err = rgb_order(data, name); err != nil {
+		return nil, nil, err
+	}
+	return emphasis_bank(data, 0), emphasis_bank(data, bits), nil
+}
+
+// Returns the colors of the bank b of the content of a .pal file with
+// emphasis
+func emphasis_bank(data []byte, b int) color.Palette {
+	p := make(color.Palette, nespal.PALETTE_SIZE)
+	for i := range p {
+		j := (b*nespal.PALETTE_SIZE + i) * 3
+		p[i] = color.RGBA{data[j], data[j+1], data[j+2], 255}
+	}
+	return p
+}
+
+// Returns the colors of the banks 1 to 7 of the content of a .pal file,
+// nil when it has no emphasis colors
+func emphasis_banks(data []byte) []color.Palette {
+	if len(data) < nespal.PALETTE_SIZE*3*EMPHASIS_BANKS {
+		return nil
+	}
+
+	banks := make([]color.Palette, EMPHASIS_BANKS-1)
+	for b := range banks {
+		banks[b] = emphasis_bank(data, b+1)
+	}
+	return banks
+}
+
+// Names the emphasis bits, like "red and blue"
+func emphasis_name(bits int) string {
+	names := []string{}
+	for _, bit := range []struct {
+		mask int
+		name string
+	}{{EMPHASIS_RED, "red"}, {EMPHASIS_GREEN, "green"}, {EMPHASIS_BLUE, "blue"}} {
+		if bits&bit.mask != 0 {
+			names = append(names, bit.name)
+		}
+	}
+
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+// Writes the emphasis bits like parse_emphasis reads them, as "r,b"
+func format_emphasis(bits int) string {
+	res := []string{}
+	for _, bit := range []struct {
+		mask int
+		name string
+	}{{EMPHASIS_RED, "r"}, {EMPHASIS_GREEN, "g"}, {EMPHASIS_BLUE, "b"}} {
+		if bits&bit.mask != 0 {
+			res = append(res, bit.name)
+		}
+	}
+	return strings.Join(res, ",")
+}
+
+// Renders img, whose colors must all be in base, with the colors of the
+// same NES palette indexes in emphasized
+func emphasize(img image.Image, base, emphasized color.Palette) (*image.Paletted, error) {
+	// colors found more than once, like the blacks, keep their first index
+	indexes := make(map[color.RGBA]uint8, len(base))
+	for i := len(base) - 1; i >= 0; i-- {
+		indexes[nespal.ToRGB(base[i])] = uint8(i)
+	}
+
+	bounds := img.Bounds()
+	res := image.NewPaletted(bounds, emphasized)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := nespal.ToRGB(img.At(x, y))
+			i, ok := indexes[c]
+			if !ok {
+				return nil, fmt.Errorf("%s: color %s at %d,%d is not in the palette, remap the image first", ex, hex_color(c), x, y)
+			}
+			res.SetColorIndex(x, y, i)
+		}
+	}
+	return res, nil
+}
+
+// Runs the emphasize command given in the arguments
+func run_emphasize() int {
+	bits_flag := pflag.StringSlice("bits", nil, "Emphasis bits to set: r, g and b")
+	pflag.Parse()
+	args := pflag.Args()
+
+	bits, err := parse_emphasis(*bits_flag)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if len(args) == 1 {
+		log.Printf("%s: missing image file\n", ex)
+		return 2
+	}
+	if len(args) == 2 {
+		log.Printf("%s: missing color palette\n", ex)
+		return 2
+	}
+	if len(args) == 3 {
+		log.Printf("%s: missing output image\n", ex)
+		return 2
+	}
+
+	img, err := load_image(args[1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	pal, name, err := open_palette(args[2])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	base, emphasized, err := load_emphasis(pal, name, bits)
+	pal.Close()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	res, err := emphasize(img, base, emphasized)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if status, err := write_image(res, args[3], nil); err != nil {
+		log.Println(err)
+		return status
+	}
+	return 0
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Turns a file name into a name usable as a C or assembly symbol
+func symbol_name(path string) string {
+	base := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+
+	res := make([]rune, 0, len(base))
+	for _, r := range strings.ToLower(base) {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			res = append(res, r)
+		} else {
+			res = append(res, '_')
+		}
+	}
+
+	if len(res) == 0 || unicode.IsDigit(res[0]) {
+		res = append([]rune{'_'}, res...)
+	}
+	return string(res)
+}
+
+// Returns the NES palette indexes used by m, in ascending order
+func used_indices(m *image.Paletted) []uint8 {
+	var seen [256]bool
+	for _, i := range m.Pix {
+		seen[i] = true
+	}
+
+	used := make([]uint8, 0, nespal.PALETTE_SIZE)
+	for i, ok := range seen {
+		if ok {
+			used = append(used, uint8(i))
+		}
+	}
+	return used
+}
+
+// Writes the palette and the index of every pixel of m as C arrays
+func write_export_c(m *image.Paletted, dst_path string) error {
+	f, err := os.Create(dst_path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	name := symbol_name(dst_path)
+	bounds := m.Bounds()
+	used := used_indices(m)
+
+	fmt.Fprintf(w, "/* Generated by %s */\n\n", ex)
+	fmt.Fprintf(w, "#define %s_WIDTH %d\n", strings.ToUpper(name), bounds.Dx())
+	fmt.Fprintf(w, "#define %s_HEIGHT %d\n\n", strings.ToUpper(name), bounds.Dy())
+
+	fmt.Fprintf(w, "const unsigned char %s_palette[%d] = {\n", name, len(used))
+	write_byte_rows(w, used, "\t", ", ", "0x%02X", ",")
+	fmt.Fprint(w, "};\n\n")
+
+	fmt.Fprintf(w, "const unsigned char %s_indexes[%d] = {\n", name, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		i := m.PixOffset(bounds.Min.X, y)
+		write_byte_rows(w, m.Pix[i:i+bounds.Dx()], "\t", ", ", "0x%02X", ",")
+	}
+	fmt.Fprint(w, "};\n")
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Writes the palette and the index of every pixel of m as ca65 .byte tables
+func write_export_asm(m *image.Paletted, dst_path string) error {
+	f, err := os.Create(dst_path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	name := symbol_name(dst_path)
+	bounds := m.Bounds()
+
+	fmt.Fprintf(w, "; Generated by %s\n\n", ex)
+	fmt.Fprintf(w, "%s_WIDTH = %d\n", strings.ToUpper(name), bounds.Dx())
+	fmt.Fprintf(w, "%s_HEIGHT = %d\n\n", strings.ToUpper(name), bounds.Dy())
+	fmt.Fprintf(w, ".export %s_palette, %s_indexes\n\n", name, name)
+
+	fmt.Fprintf(w, "%s_palette:\n", name)
+	write_byte_rows(w, used_indices(m), "\t.byte ", ",", "$%02X", "")
+
+	fmt.Fprintf(w, "\n%s_indexes:\n", name)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		i := m.PixOffset(bounds.Min.X, y)
+		write_byte_rows(w, m.Pix[i:i+bounds.Dx()], "\t.byte ", ",", "$%02X", "")
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Writes data in lines of 16 bytes, each line starting with prefix and
+// ending with suffix, the bytes are separated by sep and formatted with format
+func write_byte_rows(w *bufio.Writer, data []uint8, prefix, sep, format, suffix string) {
+	const PER_LINE = 16
+
+	for start := 0; start < len(data); start += PER_LINE {
+		end := min(start+PER_LINE, len(data))
+
+		w.WriteString(prefix)
+		for i, b := range data[start:end] {
+			if i > 0 {
+				w.WriteString(sep)
+			}
+			fmt.Fprintf(w, format, b)
+		}
+		w.WriteString(suffix)
+		w.WriteString("\n")
+	}
+}
+
+// Formats of the export command
+const (
+	ANSI = "ansi"
+	HTML = "html"
+)
+
+// Writes img as 24-bit ANSI art, each character cell being an upper half
+// block showing two rows of pixels, the top one as the foreground color
+// and the bottom one as the background color
+func write_ansi(img image.Image, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bounds := img.Bounds()
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += 2 {
+		// the escape codes are only written when the colors change
+		var fg, bg color.RGBA
+		first := true
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			top := nespal.ToRGB(img.At(x, y))
+			if first || top != fg {
+				fmt.Fprintf(bw, "\x1b[38;2;%d;%d;%dm", top.R, top.G, top.B)
+				fg = top
+			}
+
+			if y+1 < bounds.Max.Y {
+				bottom := nespal.ToRGB(img.At(x, y+1))
+				if first || bottom != bg {
+					fmt.Fprintf(bw, "\x1b[48;2;%d;%d;%dm", bottom.R, bottom.G, bottom.B)
+					bg = bottom
+				}
+			} else if first {
+				// the last row of an odd height image has nothing below it
+				bw.WriteString("\x1b[49m")
+			}
+
+			bw.WriteString("▀")
+			first = false
+		}
+		bw.WriteString("\x1b[0m\n")
+	}
+
+	return bw.Flush()
+}
+
+// Color of the palette and how many pixels use it, in the HTML preview
+type html_swatch struct {
+	Index string
+	Hex   string
+	Count int
+	Share string
+	// Whether the text on the swatch should be black to be readable
+	Light bool
+}
+
+var html_page = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Name}} with {{.Palette}}</title>
+<style>
+body { font-family: sans-serif; background: #202020; color: #E0E0E0; margin: 2em; }
+.images { display: flex; flex-wrap: wrap; gap: 2em; }
+figure { margin: 0; }
+img { image-rendering: pixelated; width: {{.Width}}px; }
+.palette { display: grid; grid-template-columns: repeat(16, 4em); gap: 2px; margin: 1em 0; }
+.swatch { height: 3em; font-size: 0.7em; padding: 2px; box-sizing: border-box; }
+.swatch.unused { opacity: 0.35; }
+.light { color: #000000; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em; text-align: left; }
+td.color { width: 2em; }
+</style>
+</head>
+<body>
+<h1>{{.Name}} with {{.Palette}}</h1>
+<div class="images">
+<figure><img src="{{.Original}}" alt="original"><figcaption>Original</figcaption></figure>
+<figure><img src="{{.Remapped}}" alt="remapped"><figcaption>Remapped to {{.Palette}}</figcaption></figure>
+</div>
+<h2>Palette</h2>
+<div class="palette">
+{{- range .Swatches}}
+<div class="swatch{{if eq .Count 0}} unused{{end}}{{if .Light}} light{{end}}" style="background: {{.Hex}}" title="{{.Index}} {{.Hex}}">{{.Index}}<br>{{.Hex}}</div>
+{{- end}}
+</div>
+<h2>Usage</h2>
+<table>
+<tr><th></th><th>Index</th><th>Color</th><th>Pixels</th><th>Share</th></tr>
+{{- range .Used}}
+<tr><td class="color" style="background: {{.Hex}}"></td><td>{{.Index}}</td><td>{{.Hex}}</td><td>{{.Count}}</td><td>{{.Share}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+// Encodes img as a PNG data URL
+func png_data_url(img image.Image) (template.URL, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// Writes a self-contained HTML page showing the original and the remapped
+// image side by side, the palette with its NES indexes and how many pixels
+// use each of its colors
+func write_html(w io.Writer, name string, pal_name string, src image.Image, m *image.Paletted) error {
+	original, err := png_data_url(src)
+	if err != nil {
+		return err
+	}
+	remapped, err := png_data_url(m)
+	if err != nil {
+		return err
+	}
+
+	counts := count_indices(m, m.Bounds())
+	total := max(1, m.Bounds().Dx()*m.Bounds().Dy())
+	swatches := make([]html_swatch, len(m.Palette))
+	for i, c := range m.Palette {
+		rgb := nespal.ToRGB(c)
+		swatches[i] = html_swatch{
+			Index: fmt.Sprintf("$%02X", i),
+			Hex:   hex_color(c),
+			Count: counts[i],
+			Share: fmt.Sprintf("%.1f%%", float64(counts[i])*100/float64(total)),
+			Light: luma(float64(rgb.R), float64(rgb.G), float64(rgb.B)) > 128,
+		}
+	}
+
+	used := []html_swatch{}
+	for _, i := range by_usage(counts) {
+		used = append(used, swatches[i])
+	}
+
+	return html_page.Execute(w, map[string]any{
+		"Name":     name,
+		"Palette":  pal_name,
+		"Width":    min(512, max(256, m.Bounds().Dx())),
+		"Original": original,
+		"Remapped": remapped,
+		"Swatches": swatches,
+		"Used":     used,
+	})
+}
+
+// Runs the export subcommand given in the arguments
+func run_export() int {
+	if len(os.Args) == 2 {
+		log.Printf("%s: missing export format\n", ex)
+		log.Printf("Try: %s %s %s\n", ex, HELP, EXPORT)
+		return 2
+	}
+
+	switch os.Args[2] {
+	case ANSI:
+		chosen_pal := pflag.StringP("palette", "p", "", "Color palette to remap the image to before exporting it")
+		remap_opts := remap_flags(pflag.CommandLine)
+		pflag.Parse()
+		args := pflag.Args()
+
+		opts, err := remap_opts()
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+
+		if len(args) == 2 {
+			log.Printf("%s: missing image file\n", ex)
+			return 2
+		}
+
+		img, err := load_image(args[2])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		if *chosen_pal != "" {
+			p, _, err := load_named_palette(*chosen_pal)
+			if err != nil {
+				log.Println(err)
+				return 1
+			}
+			img = remap_image(preprocess(img, p, opts), p, opts)
+		}
+
+		var out io.Writer = os.Stdout
+		if len(args) > 3 {
+			file, err := os.Create(args[3])
+			if err != nil {
+				log.Println(err)
+				return 1
+			}
+			defer file.Close()
+			out = file
+		}
+
+		if err := write_ansi(img, out); err != nil {
+			log.Println(err)
+			return 1
+		}
+	case HTML:
+		remap_opts := remap_flags(pflag.CommandLine)
+		pflag.Parse()
+		args := pflag.Args()
+
+		opts, err := remap_opts()
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+
+		if len(args) == 2 {
+			log.Printf("%s: missing image file\n", ex)
+			return 2
+		}
+		if len(args) == 3 {
+			log.Printf("%s: missing color palette\n", ex)
+			return 2
+		}
+		if len(args) == 4 {
+			log.Printf("%s: missing output file\n", ex)
+			return 2
+		}
+
+		img, err := load_image(args[2])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		p, pal_name, err := load_named_palette(args[3])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		indexed := remap_image(preprocess(img, p, opts), p, opts)
+
+		file, err := os.Create(args[4])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer file.Close()
+
+		name := strings.TrimSuffix(filepath.Base(args[2]), filepath.Ext(args[2]))
+		if err := write_html(file, name, pal_name, img, indexed); err != nil {
+			log.Println(err)
+			return 1
+		}
+		if err := file.Close(); err != nil {
+			log.Println(err)
+			return 1
+		}
+	default:
+		log.Printf("%s: unknown export format \"%s\"\n", ex, os.Args[2])
+		log.Printf("Try: %s %s %s\n", ex, HELP, EXPORT)
+		return 2
+	}
+
+	return 0
+}
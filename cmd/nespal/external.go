@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// A program converting an image into a PNG, with its arguments. "{in}" and
+// "{out}" stand for the paths of the image and of the PNG
+type ExternalDecoder []string
+
+// Programs decoding the formats there is no Go decoder for, by format,
+// tried in order until one is installed
+var external_decoders = map[string][]ExternalDecoder{
+	"avif": {
+		{"avifdec", "{in}", "{out}"},
+		{"ffmpeg", "-v", "error", "-i", "{in}", "-frames:v", "1", "{out}"},
+	},
+	"jxl": {
+		{"djxl", "{in}", "{out}"},
+		{"ffmpeg", "-v", "error", "-i", "{in}", "-frames:v", "1", "{out}"},
+	},
+}
+
+// Signatures of the formats decoded by external programs, '?' matching any
+// byte
+var external_signatures = map[string][]string{
+	"avif": {"????ftypavif", "????ftypavis"},
+	// bare codestreams and ISOBMFF containers
+	"jxl": {"\xff\x0a", "\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a"},
+}
+
+// Decodes an image of format with the first of its external decoders that
+// is installed, through temporary files
+func decode_external(format string, r io.Reader) (image.Image, error) {
+	decoders := external_decoders[format]
+	names := make([]string, len(decoders))
+	for i, decoder := range decoders {
+		names[i] = "'" + decoder[0] + "'"
+	}
+
+	for _, decoder := range decoders {
+		path, err := exec.LookPath(decoder[0])
+		if err != nil {
+			continue
+		}
+
+		dir, err := os.MkdirTemp("", ex+"-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+
+		in, out := filepath.Join(dir, "image."+format), filepath.Join(dir, "image.png")
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(in, data, 0o644); err != nil {
+			return nil, err
+		}
+
+		args := make([]string, len(decoder)-1)
+		for i, arg := range decoder[1:] {
+			args[i] = strings.NewReplacer("{in}", in, "{out}", out).Replace(arg)
+		}
+		if output, err := exec.Command(path, args...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("%s: '%s' could not decode the %s image: %s", ex, decoder[0], strings.ToUpper(format), strings.TrimSpace(string(output)))
+		}
+
+		f, err := os.Open(out)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return png.Decode(f)
+	}
+
+	return nil, fmt.Errorf(
+		"%s: %s images are decoded with %s, install one of them or convert the image to PNG",
+		ex, strings.ToUpper(format), strings.Join(names, " or "),
+	)
+}
+
+func init() {
+	for format, signatures := range external_signatures {
+		decode := func(r io.Reader) (image.Image, error) {
+			return decode_external(format, r)
+		}
+		config := func(r io.Reader) (image.Config, error) {
+			img, err := decode(r)
+			if err != nil {
+				return image.Config{}, err
+			}
+			return image.Config{ColorModel: img.ColorModel(), Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}, nil
+		}
+		for _, signature := range signatures {
+			image.RegisterFormat(format, signature, decode, config)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Largest scale of the grid overlays
+const MAX_GRID_SCALE = 16
+
+// Whether v is on a line of a grid of cells of size starting at offset
+func on_grid(v, offset, size int) bool {
+	return ((v-offset)%size+size)%size == 0
+}
+
+// Draws the tile and attribute grids of g over img scaled up by scale, so
+// artists can align their work with the hardware. The lines run along the
+// top and left edges of the cells, blended half over the pixels so they
+// still show, the attribute lines over the tile ones
+func draw_grid(img image.Image, g Grid, scale int, tile_color, attr_color color.RGBA) *image.RGBA {
+	bounds := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*scale, bounds.Dy()*scale))
+	for y := range res.Rect.Dy() {
+		for x := range res.Rect.Dx() {
+			src := image.Pt(x/scale, y/scale)
+			c := nespal.ToRGB(img.At(bounds.Min.X+src.X, bounds.Min.Y+src.Y))
+
+			// only the first row and column of a scaled pixel are on a line
+			on_x, on_y := x%scale == 0, y%scale == 0
+			switch {
+			case on_x && on_grid(src.X, g.Offset.X, g.Attr), on_y && on_grid(src.Y, g.Offset.Y, g.Attr):
+				c = blend_half(c, attr_color)
+			case on_x && on_grid(src.X, g.Offset.X, g.Tile), on_y && on_grid(src.Y, g.Offset.Y, g.Tile):
+				c = blend_half(c, tile_color)
+			}
+			res.SetRGBA(x, y, c)
+		}
+	}
+	return res
+}
+
+// Mixes two opaque colors evenly
+func blend_half(a, b color.RGBA) color.RGBA {
+	return color.RGBA{uint8((int(a.R) + int(b.R)) / 2), uint8((int(a.G) + int(b.G)) / 2), uint8((int(a.B) + int(b.B)) / 2), 255}
+}
+
+// Runs the grid command given in the arguments
+func run_grid() int {
+	tile_color := pflag.String("tile-color", "#808080", "Color of the lines of the tiles")
+	attr_color := pflag.String("attr-color", "#FF0000", "Color of the lines of the attribute areas")
+	scale := pflag.Int("scale", 1, fmt.Sprintf("Scale the image up, from 1 to %d", MAX_GRID_SCALE))
+	grid_opts := grid_flags(pflag.CommandLine)
+	pflag.Parse()
+	args := pflag.Args()
+
+	grid, err := grid_opts()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	tile, err := parse_hex_color(*tile_color)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	attr, err := parse_hex_color(*attr_color)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	if *scale < 1 || *scale > MAX_GRID_SCALE {
+		log.Printf("%s: invalid value %d for '--scale' flag, expected 1 to %d\n", ex, *scale, MAX_GRID_SCALE)
+		return 2
+	}
+
+	if len(args) == 1 {
+		log.Printf("%s: missing image file\n", ex)
+		return 2
+	}
+	if len(args) == 2 {
+		log.Printf("%s: missing output image\n", ex)
+		return 2
+	}
+
+	img, err := load_image(args[1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if status, err := write_image(draw_grid(img, grid, *scale, tile, attr), args[2], nil); err != nil {
+		log.Println(err)
+		return status
+	}
+	return 0
+}
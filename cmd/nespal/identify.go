@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Palettes images are matched against, with the colors of each as a set
+type Candidates struct {
+	pals   []NamedPalette
+	colors []map[color.RGBA]bool
+	// emphasis bits of the colors of every palette, 0 for the ones without
+	emphasis []int
+}
+
+// Loads the input palettes and then the available palettes, only the ones
+// made for the region when given
+func load_candidates(custom_pals []*os.File, custom_only bool, region string) (*Candidates, int, error) {
+	if custom_only && len(custom_pals) == 0 {
+		return nil, 2, fmt.Errorf("%s: flag 'custom-only' reguires input color palettes", ex)
+	}
+
+	candidates := &Candidates{pals: make([]NamedPalette, 0, len(custom_pals))}
+	for _, pal := range custom_pals {
+		p, banks, err := load_palette_banks(pal)
+		if err != nil {
+			return nil, 1, err
+		}
+		candidates.pals = append(candidates.pals, NamedPalette{Name: strings.TrimSuffix(pal.Name(), ".pal"), Palette: p, Emphasis: banks})
+	}
+
+	if !custom_only {
+		available, err := load_palettes()
+		if err != nil {
+			return nil, 1, err
+		}
+		if region != "" {
+			available = slices.DeleteFunc(available, func(p NamedPalette) bool { return !region_matches(region, p.region()) })
+		}
+		candidates.pals = append(candidates.pals, available...)
+	}
+
+	// the emphasis banks come after every palette, so images matching a
+	// palette with and without emphasis are told it has none
+	candidates.emphasis = make([]int, len(candidates.pals))
+	for _, pal := range slices.Clone(candidates.pals) {
+		for b, bank := range pal.Emphasis {
+			candidates.pals = append(candidates.pals, NamedPalette{Name: pal.Name, Palette: bank})
+			candidates.emphasis = append(candidates.emphasis, b+1)
+		}
+	}
+
+	candidates.colors = make([]map[color.RGBA]bool, len(candidates.pals))
+	for i, candidate := range candidates.pals {
+		candidates.colors[i] = make(map[color.RGBA]bool, len(candidate.Palette))
+		for _, c := range candidate.Palette {
+			candidates.colors[i][nespal.ToRGB(c)] = true
+		}
+	}
+	return candidates, 0, nil
+}
+
+// Number of distinct colors past which an image uses enough of a palette
+// to tell it apart, as far as the confidence of identify goes
+const CONFIDENT_COLORS = 16
+
+// The palette an image was identified with and how sure it is
+type Identification struct {
+	Name string
+	// From 0 to 1, the average of the share of the CONFIDENT_COLORS the
+	// image uses and of the margin over the best other palette, the share
+	// of the colors of the image it lacks
+	Confidence float64
+	// Emphasis bits of the colors that matched, 0 for none
+	Emphasis int
+}
+
+// Names the palette along with its emphasis, like "smooth with red emphasis"
+func (id Identification) label() string {
+	if id.Emphasis == 0 {
+		return id.Name
+	}
+	return fmt.Sprintf("%s with %s emphasis", id.Name, emphasis_name(id.Emphasis))
+}
+
+// Tells the arcade machine a screenshot identified with the palette named
+// name comes from, empty for the palettes of consoles
+func arcade_note(name string) string {
+	switch ppu := arcade_ppu(name); {
+	case ppu.is_2c04():
+		return fmt.Sprintf(", a Vs. System screenshot with an %s PPU. Its versions 0001 to 0004 share the same colors at different indexes, so only the game tells which one it ran on", PPU_2C04)
+	case ppu == PPU_2C03:
+		return fmt.Sprintf(", a Vs. System or PlayChoice-10 screenshot with an %s PPU", PPU_2C03)
+	}
+	return ""
+}
+
+// Matches the image against the candidates row by row, so the image is only
+// read until every palette mismatches. Returns the first matching palette,
+// with an empty name if none matches. Stops with the error of ctx once it
+// is done
+func (cands *Candidates) identify(ctx context.Context, rows nespal.RowReader) (Identification, error) {
+	// indexes of the candidates that match every row read so far
+	matching := make([]int, len(cands.pals))
+	for i := range matching {
+		matching[i] = i
+	}
+	colors := map[color.RGBA]bool{}
+
+	// paletted images only need each used color of their palette checked once
+	if indexed, ok := rows.(nespal.IndexedRows); ok && indexed.Palette() != nil {
+		p := indexed.Palette()
+		var seen [256]bool
+		for len(matching) > 0 {
+			if err := ctx.Err(); err != nil {
+				return Identification{}, err
+			}
+			row, err := indexed.NextIndexRow()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return Identification{}, err
+			}
+
+			for _, i := range row {
+				if seen[i] {
+					continue
+				}
+				seen[i] = true
+				c := nespal.PaletteColor(p, i)
+				colors[c] = true
+				matching = slices.DeleteFunc(matching, func(j int) bool { return !cands.colors[j][c] })
+			}
+		}
+	} else {
+		for len(matching) > 0 {
+			if err := ctx.Err(); err != nil {
+				return Identification{}, err
+			}
+			row, err := rows.NextRow()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return Identification{}, err
+			}
+
+			for _, c := range row {
+				colors[c] = true
+			}
+			matching = slices.DeleteFunc(matching, func(i int) bool {
+				for _, c := range row {
+					if !cands.colors[i][c] {
+						return true
+					}
+				}
+				return false
+			})
+		}
+	}
+
+	if len(matching) == 0 {
+		return Identification{}, nil
+	}
+	best := matching[0]
+
+	// the closest other palette, palettes with the very same colors aside
+	// as telling them apart makes no difference
+	second := 0.0
+	for i := range cands.pals {
+		if i == best || maps.Equal(cands.colors[i], cands.colors[best]) {
+			continue
+		}
+		found := 0
+		for c := range colors {
+			if cands.colors[i][c] {
+				found++
+			}
+		}
+		second = max(second, float64(found)/float64(max(1, len(colors))))
+	}
+
+	coverage := min(1, float64(len(colors))/CONFIDENT_COLORS)
+	return Identification{cands.pals[best].Name, (coverage + 1 - second) / 2, cands.emphasis[best]}, nil
+}
+
+// Identifies the palette of every image, at most jobs at the same time, and
+// prints the results as sentences, as a table or as CSV, given by format.
+// Results are cached by the content of the image and the candidates, unless
+// use_cache is false or there is a mask. With unscaled, the images are
+// unscaled before being matched, and the pixels mask ignores are left out.
+// Stops with the error of ctx once it is done
+func identify(ctx context.Context, images []string, custom_pals []*os.File, custom_only bool, region string, format string, use_cache bool, unscaled bool, mask *Mask) (int, error) {
+	candidates, status, err := load_candidates(custom_pals, custom_only, region)
+	if err != nil {
+		return status, err
+	}
+
+	var cache *IdentifyCache
+	if use_cache && mask == nil {
+		cache = open_identify_cache(candidates, unscaled)
+	}
+
+	results := make([]Identification, len(images))
+	// results of every frame of the animations, nil for the other images
+	frame_results := make([][]Identification, len(images))
+	status = run_jobs(ctx, images, func(i int, result *BatchResult) (int, error) {
+		// every frame of an animation is identified on its own, so palette
+		// swaps and emphasis flashes show, and they are not cached
+		frames, err := animation_frames(images[i])
+		if err != nil {
+			return 1, err
+		}
+		if frames != nil {
+			size := frames[0].Bounds().Size()
+			release, err := reserve_memory(ctx, image.Pt(size.X, size.Y*len(frames)), false)
+			if err != nil {
+				return 1, err
+			}
+			defer release()
+
+			frame_results[i] = make([]Identification, len(frames))
+			for f, frame := range frames {
+				var rows nespal.RowReader = new_frame_rows(frame, mask)
+				if unscaled {
+					rows = unscale(frame, mask)
+				}
+				if frame_results[i][f], err = candidates.identify(ctx, rows); err != nil {
+					return 1, err
+				}
+			}
+			results[i] = frame_results[i][0]
+			result.Palette = results[i].Name
+			return 0, nil
+		}
+
+		hash := ""
+		if cache != nil {
+			if hash, err = file_hash(images[i]); err != nil {
+				return 1, err
+			}
+			if cached, ok := cache.get(hash); ok {
+				results[i], result.Palette = cached, cached.Name
+				return 0, nil
+			}
+		}
+
+		// the images wait for the memory they take under --max-memory
+		size, by_rows := image_size(images[i])
+		release, err := reserve_memory(ctx, size, by_rows && !unscaled)
+		if err != nil {
+			return 1, err
+		}
+		defer release()
+
+		var rows nespal.RowReader
+		if unscaled {
+			img, err := load_image(images[i])
+			if err != nil {
+				return 1, err
+			}
+			rows = unscale(img, mask)
+		} else {
+			if rows, err = open_rows(images[i]); err != nil {
+				return 1, err
+			}
+			defer rows.Close()
+			rows = mask_rows(rows, mask)
+		}
+
+		results[i], err = candidates.identify(ctx, rows)
+		if err != nil {
+			return 1, err
+		}
+		result.Palette = results[i].Name
+		if cache != nil {
+			cache.put(hash, results[i])
+		}
+		return 0, nil
+	})
+
+	// the tables have a row for every run of frames of the animations with
+	// the same palette
+	files, ids := []string{}, []Identification{}
+	for i, result := range results {
+		if frame_results[i] == nil {
+			files, ids = append(files, images[i]), append(ids, result)
+			continue
+		}
+		for _, run := range frame_runs(frame_results[i]) {
+			files, ids = append(files, fmt.Sprintf("%s (%s)", images[i], run.frames())), append(ids, run.Identification)
+		}
+	}
+
+	switch format {
+	case "csv":
+		cw := csv.NewWriter(os.Stdout)
+		cw.Write([]string{"file", "palette", "confidence", "emphasis", "ppu"})
+		for i, result := range ids {
+			confidence := ""
+			if result.Name != "" {
+				confidence = strconv.FormatFloat(result.Confidence, 'f', 2, 64)
+			}
+			cw.Write([]string{files[i], result.Name, confidence, format_emphasis(result.Emphasis), string(arcade_ppu(result.Name))})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return 1, err
+		}
+		return status, nil
+	case "table":
+		file_width, name_width := len("FILE"), len("PALETTE")
+		for i, result := range ids {
+			file_width = max(file_width, len(files[i]))
+			name_width = max(name_width, len(result.label()))
+		}
+		fmt.Printf("%-*s  %-*s  %s\n", file_width, "FILE", name_width, "PALETTE", "CONFIDENCE")
+		for i, result := range ids {
+			if result.Name == "" {
+				fmt.Printf("%-*s  %-*s  %s\n", file_width, files[i], name_width, "-", "-")
+			} else {
+				fmt.Printf("%-*s  %-*s  %.0f%%\n", file_width, files[i], name_width, result.label(), result.Confidence*100)
+			}
+		}
+		return status, nil
+	}
+
+	for i, result := range results {
+		msg := "No palette matches this image colorscheme"
+		if result.Name != "" {
+			msg = fmt.Sprintf("The palette used in this image was: %s (confidence %.0f%%)", result.label(), result.Confidence*100) + arcade_note(result.Name)
+		}
+		if frame_results[i] != nil {
+			msg = describe_frames(frame_results[i])
+		}
+		if len(images) > 1 {
+			msg = images[i] + ": " + msg
+		}
+		println(msg)
+	}
+	return status, nil
+}
+
+// Runs the identify command given in the arguments
+func run_identify() int {
+	custom_only := pflag.BoolP("custom-only", "c", false, "Only match against input color palettes")
+	region := pflag.String("region", "", "Only match against the palettes made for a region: ntsc, pal, dendy or vs")
+	format := pflag.String("format", "text", "Format of the results: text, table or csv")
+	no_cache := pflag.Bool("no-cache", false, "Identify every image again instead of using cached results")
+	unscaled := pflag.Bool("unscale", false, "Undo the integer scaling and mild filtering of screenshots before matching")
+	ignore := pflag.StringArray("ignore", nil, "Area left out of the matching, as 'x,y,w,h', can be repeated")
+	mask_path := pflag.String("mask", "", "Image whose non-black pixels are left out of the matching")
+	raw := pflag.String("raw", "", "Read the images as raw framebuffers, like '256x240:rgb', '-' being the standard input")
+	files_from := files_from_flags(pflag.CommandLine)
+	open_results := results_flags(pflag.CommandLine)
+	pflag.Parse()
+	args := pflag.Args()
+
+	if *region != "" && !slices.Contains(regions, *region) {
+		log.Printf("%s: invalid value '%s' for '--region' flag, expected one of: %s\n", ex, *region, strings.Join(regions, ", "))
+		return 2
+	}
+	if *format != "text" && *format != "table" && *format != "csv" {
+		log.Printf("%s: invalid value '%s' for '--format' flag", ex, *format)
+		return 2
+	}
+	if *raw != "" {
+		var err error
+		if raw_format, err = parse_raw(*raw); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+
+	// the palettes are told apart from the images by their extension
+	images := []string{}
+	custom_pals := []*os.File{}
+	for _, path := range args[1:] {
+		if filepath.Ext(path) != ".pal" {
+			if len(custom_pals) > 0 {
+				log.Printf("%s: usupported palette file format for '%s', expected '.pal'\n", ex, path)
+				return 2
+			}
+
+			// directories stand for the images in them
+			if info, err := os.Stat(path); err == nil && info.IsDir() {
+				files, err := image_files(path)
+				if err != nil {
+					log.Println(err)
+					return 1
+				}
+				images = append(images, files...)
+			} else {
+				images = append(images, path)
+			}
+			continue
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer file.Close()
+		custom_pals = append(custom_pals, file)
+	}
+	listed, err := files_from()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	images = append(images, listed...)
+
+	if len(images) == 0 {
+		log.Printf("%s: missing image file\n", ex)
+		return 2
+	}
+
+	mask, err := load_mask(*ignore, *mask_path)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if err := open_results(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if batch_results != nil {
+		defer batch_results.Close()
+	}
+	if err := setup_memory_budget(); err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	// the same bytes are another image with another '--raw'
+	use_cache := !*no_cache && raw_format == nil
+	status, err := identify(context.Background(), images, custom_pals, *custom_only, *region, *format, use_cache, *unscaled, mask)
+	if err != nil {
+		log.Println(err)
+	}
+	if status != 0 {
+		return status
+	}
+	return 0
+}
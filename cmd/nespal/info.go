@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Checks whether the colors of m fit the NES background constraints,
+// trying every color as the backdrop. Returns the backdrop that needs the
+// fewest sub-palettes and how many it needs, -1 when no color can be the
+// backdrop. Also returns the attribute blocks of the grid with more than
+// four colors, which can never fit
+func fit_attributes(m *image.Paletted, grid Grid) (int, int, []image.Rectangle) {
+	blocks, _, _ := attr_blocks(m.Bounds(), grid)
+	sets := make([][]uint8, len(blocks))
+	crowded := []image.Rectangle{}
+	for i, block := range blocks {
+		sets[i] = by_usage(count_indices(m, block))
+		if len(sets[i]) > 4 {
+			crowded = append(crowded, block)
+		}
+	}
+	if len(crowded) > 0 {
+		return -1, 0, crowded
+	}
+
+	best, best_count := -1, 0
+	for _, backdrop := range by_usage(count_indices(m, m.Bounds())) {
+		others := make([][]uint8, 0, len(sets))
+		fits := true
+		for _, set := range sets {
+			colors := make([]uint8, 0, 3)
+			for _, c := range set {
+				if c != backdrop {
+					colors = append(colors, c)
+				}
+			}
+			if len(colors) > 3 {
+				fits = false
+				break
+			}
+			others = append(others, colors)
+		}
+		if !fits {
+			continue
+		}
+
+		// the blocks with the most colors are the hardest to fit, so they go first
+		sort.SliceStable(others, func(a, b int) bool { return len(others[a]) > len(others[b]) })
+		subpals := [][]uint8{}
+		for _, colors := range others {
+			j := fit_subpalette(subpals, colors)
+			if j < 0 {
+				subpals = append(subpals, nil)
+				j = len(subpals) - 1
+			}
+			subpals[j] = union_indices(subpals[j], colors)
+		}
+
+		if best < 0 || len(subpals) < best_count {
+			best, best_count = int(backdrop), len(subpals)
+		}
+	}
+	return best, best_count, crowded
+}
+
+// Why an attribute block breaks the NES background constraints
+const (
+	// More than three colors besides the backdrop
+	VIOLATION_COLORS = "colors"
+	// Colors that fit in no sub-palette along with the other blocks
+	VIOLATION_SUBPALETTES = "sub-palettes"
+)
+
+// Tints of the blocks of each violation in the violation maps
+var violation_tints = map[string]color.RGBA{
+	VIOLATION_COLORS:      {0xFF, 0x20, 0x20, 0xFF},
+	VIOLATION_SUBPALETTES: {0xFF, 0xC0, 0x00, 0xFF},
+}
+
+// An attribute block breaking the NES background constraints
+type Violation struct {
+	Block  image.Rectangle
+	Reason string
+}
+
+// Returns the attribute blocks of the grid that break the NES background
+// constraints with the backdrop fit_attributes picks, or with the most used
+// color when none fits: the ones with too many colors, then the ones whose
+// colors fit in none of the four sub-palettes once the blocks with the most
+// colors took them
+func attr_violations(m *image.Paletted, grid Grid) (uint8, []Violation) {
+	backdrop := by_usage(count_indices(m, m.Bounds()))[0]
+	if best, _, _ := fit_attributes(m, grid); best >= 0 {
+		backdrop = uint8(best)
+	}
+
+	blocks, _, _ := attr_blocks(m.Bounds(), grid)
+	sets := make([][]uint8, len(blocks))
+	violations := []Violation{}
+	order := []int{}
+	for i, block := range blocks {
+		for _, c := range by_usage(count_indices(m, block)) {
+			if c != backdrop {
+				sets[i] = append(sets[i], c)
+			}
+		}
+		if len(sets[i]) > 3 {
+			violations = append(violations, Violation{block, VIOLATION_COLORS})
+		} else {
+			order = append(order, i)
+		}
+	}
+
+	// the blocks with the most colors are the hardest to fit, so they go first
+	sort.SliceStable(order, func(a, b int) bool { return len(sets[order[a]]) > len(sets[order[b]]) })
+	subpals := make([][]uint8, 0, SUBPALETTES)
+	for _, i := range order {
+		j := fit_subpalette(subpals, sets[i])
+		if j < 0 {
+			if len(subpals) == SUBPALETTES {
+				violations = append(violations, Violation{blocks[i], VIOLATION_SUBPALETTES})
+				continue
+			}
+			subpals = append(subpals, nil)
+			j = len(subpals) - 1
+		}
+		subpals[j] = union_indices(subpals[j], sets[i])
+	}
+	return backdrop, violations
+}
+
+// Draws img with the blocks breaking the constraints outlined and tinted
+// with the color of their violation, and the other blocks faded
+func violation_map(img image.Image, violations []Violation) *image.RGBA {
+	bounds := img.Bounds()
+	res := image.NewRGBA(bounds)
+	gray := color.RGBA{0x80, 0x80, 0x80, 0xFF}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			res.SetRGBA(x, y, blend_half(nespal.ToRGB(img.At(x, y)), gray))
+		}
+	}
+
+	for _, v := range violations {
+		tint := violation_tints[v.Reason]
+		block := v.Block
+		for y := block.Min.Y; y < block.Max.Y; y++ {
+			for x := block.Min.X; x < block.Max.X; x++ {
+				c := tint
+				if x != block.Min.X && y != block.Min.Y && x != block.Max.X-1 && y != block.Max.Y-1 {
+					c = blend_half(nespal.ToRGB(img.At(x, y)), tint)
+				}
+				res.SetRGBA(x, y, c)
+			}
+		}
+	}
+	return res
+}
+
+// Prints the size and colors of img, which palettes have all of its colors,
+// or whether pal has them when given, and whether it follows the NES
+// background constraints with the grid. With violations_path, the blocks
+// breaking the constraints are counted and drawn to it. The status is 1
+// when the image is not NES-legal
+func info(img image.Image, pal *NamedPalette, grid Grid, violations_path string) (int, error) {
+	bounds := img.Bounds()
+	colors := map[color.RGBA]bool{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			colors[nespal.ToRGB(img.At(x, y))] = true
+		}
+	}
+
+	fmt.Printf("Size: %dx%d\n", bounds.Dx(), bounds.Dy())
+	fmt.Printf("Colors: %d\n", len(colors))
+
+	legal := true
+	if pal != nil {
+		in_pal := make(map[color.RGBA]bool, len(pal.Palette))
+		for _, c := range pal.Palette {
+			in_pal[nespal.ToRGB(c)] = true
+		}
+		missing := 0
+		for c := range colors {
+			if !in_pal[c] {
+				missing++
+			}
+		}
+
+		if missing == 0 {
+			fmt.Printf("Palette: every color is in %s\n", pal.Name)
+		} else {
+			fmt.Printf("Palette: %d colors are not in %s\n", missing, pal.Name)
+			legal = false
+		}
+	} else {
+		candidates, status, err := load_candidates(nil, false, "")
+		if err != nil {
+			return status, err
+		}
+
+		names := []string{}
+		for i, candidate := range candidates.pals {
+			// the emphasis banks share the name of their palette
+			if candidates.emphasis[i] != 0 {
+				continue
+			}
+			matches := true
+			for c := range colors {
+				if !candidates.colors[i][c] {
+					matches = false
+					break
+				}
+			}
+			if matches {
+				names = append(names, candidate.Name)
+			}
+		}
+
+		if len(names) == 0 {
+			fmt.Println("Palettes: no palette has every color")
+			legal = false
+		} else {
+			fmt.Printf("Palettes: %s\n", strings.Join(names, ", "))
+		}
+	}
+
+	m := nespal.ToPaletted(img)
+	if m == nil {
+		fmt.Println("Attributes: too many colors to check")
+		legal = false
+	} else if backdrop, count, crowded := fit_attributes(m, grid); len(crowded) > 0 {
+		fmt.Printf("Attributes: %d of the %dx%d blocks have more than 4 colors, the first at %d,%d\n", len(crowded), grid.Attr, grid.Attr, crowded[0].Min.X, crowded[0].Min.Y)
+		legal = false
+	} else if backdrop < 0 {
+		fmt.Println("Attributes: no color is shared by every block with 4 colors to be the backdrop")
+		legal = false
+	} else if count > SUBPALETTES {
+		fmt.Printf("Attributes: needs %d sub-palettes with the backdrop %s, more than the %d available\n", count, hex_color(m.Palette[backdrop]), SUBPALETTES)
+		legal = false
+	} else {
+		fmt.Printf("Attributes: fits in %d sub-palettes with the backdrop %s\n", count, hex_color(m.Palette[backdrop]))
+	}
+
+	if violations_path != "" {
+		if m == nil {
+			fmt.Println("Violations: too many colors to check")
+		} else {
+			backdrop, violations := attr_violations(m, grid)
+			counts := map[string]int{}
+			for _, v := range violations {
+				counts[v.Reason]++
+			}
+			blocks, _, _ := attr_blocks(m.Bounds(), grid)
+			fmt.Printf(
+				"Violations: %d of the %d blocks with the backdrop %s, %d with more than 4 colors and %d needing more than %d sub-palettes\n",
+				len(violations), len(blocks), hex_color(m.Palette[backdrop]), counts[VIOLATION_COLORS], counts[VIOLATION_SUBPALETTES], SUBPALETTES,
+			)
+			if status, err := write_image(violation_map(img, violations), violations_path, nil); err != nil {
+				return status, err
+			}
+		}
+	}
+
+	if legal {
+		fmt.Println("NES-legal: yes")
+		return 0, nil
+	}
+	fmt.Println("NES-legal: no")
+	return 1, nil
+}
+
+// Runs the info command given in the arguments
+func run_info() int {
+	violations := pflag.String("violations", "", "Write an image showing the blocks breaking the NES background constraints")
+	grid_opts := grid_flags(pflag.CommandLine)
+	pflag.Parse()
+	args := pflag.Args()
+
+	grid, err := grid_opts()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if len(args) == 1 {
+		log.Printf("%s: missing image file\n", ex)
+		return 2
+	}
+
+	img, err := load_image(args[1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	var pal *NamedPalette
+	if len(args) > 2 {
+		p, name, err := load_named_palette(args[2])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		pal = &NamedPalette{Name: name, Palette: p}
+	}
+
+	status, err := info(img, pal, grid, *violations)
+	if err != nil {
+		log.Println(err)
+	}
+	return status
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// Formats of the log records
+const (
+	LOG_TEXT = "text"
+	LOG_JSON = "json"
+)
+
+var log_formats = []string{LOG_TEXT, LOG_JSON}
+
+var (
+	// File the log is appended to, set with --log-file
+	log_file string
+	// Format of the log records, set with --log-format
+	log_format string
+)
+
+// Defines the logging flags on flags
+func log_flags(flags *pflag.FlagSet) {
+	flags.StringVar(&log_file, "log-file", "", "Append the log to a file instead of printing it")
+	flags.StringVar(&log_format, "log-format", "", "Log timestamped records as text or json")
+}
+
+// Whether the log is made of timestamped records, for batches and servers,
+// rather than plain messages
+func structured_log() bool {
+	return log_file != "" || log_format != ""
+}
+
+// Sets up the log from the logging flags of args, before the flags of the
+// command are parsed so every message goes to the right place. Without
+// logging flags, messages are printed to stderr as they are
+func setup_logging(args []string) error {
+	flags := pflag.NewFlagSet(ex, pflag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	log_flags(flags)
+	// errors of the other flags are reported once the command parses them
+	flags.Parse(args)
+
+	if log_format != "" && !slices.Contains(log_formats, log_format) {
+		return fmt.Errorf("%s: invalid value '%s' for '--log-format' flag, expected one of: %s", ex, log_format, strings.Join(log_formats, ", "))
+	}
+	if !structured_log() {
+		return nil
+	}
+
+	var out io.Writer = os.Stderr
+	if log_file != "" {
+		file, err := os.OpenFile(log_file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		out = file
+	}
+
+	var handler slog.Handler = slog.NewTextHandler(out, nil)
+	if log_format == LOG_JSON {
+		handler = slog.NewJSONHandler(out, nil)
+	}
+	slog.SetDefault(slog.New(handler))
+	// the messages of the log package are errors, they become records too
+	log.SetOutput(slog.NewLogLogger(handler, slog.LevelError).Writer())
+	log.SetFlags(0)
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Palette the colors are looked up in when none is given
+const DEFAULT_PALETTE = "FCEUX"
+
+// A NES palette index and how far its color is from another one
+type Nearby struct {
+	Index    int
+	Distance float64
+}
+
+// Returns the count indexes of p whose colors are the closest to c under
+// the metric, the closest first, the ones at the same distance in the
+// order of tie_rank like remap picks them
+func closest_indices(c color.Color, p color.Palette, metric nespal.Metric, count int) []Nearby {
+	res := make([]Nearby, len(p))
+	for i, pc := range p {
+		res[i] = Nearby{i, metric.Distance(c, pc)}
+	}
+	sort.SliceStable(res, func(a, b int) bool {
+		if res[a].Distance != res[b].Distance {
+			return res[a].Distance < res[b].Distance
+		}
+		return nespal.TieRank(res[a].Index) < nespal.TieRank(res[b].Index)
+	})
+	return res[:min(max(count, 1), len(res))]
+}
+
+// Runs the closest command given in the arguments
+func run_closest() int {
+	chosen_pal := pflag.StringP("palette", "p", DEFAULT_PALETTE, "Color palette to look the colors up in")
+	metric_name := pflag.String("metric", nespal.DEFAULT_METRIC, "Color distance metric: "+strings.Join(nespal.MetricNames(), ", "))
+	count := pflag.Int("count", 1, "Number of indexes printed for each color, the closest first")
+	pflag.Parse()
+	args := pflag.Args()
+
+	if len(args) == 1 {
+		log.Printf("%s: missing color\n", ex)
+		return 2
+	}
+
+	metric, err := nespal.GetMetric(*metric_name)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	colors := make([]color.RGBA, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		c, err := parse_hex_color(arg)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		colors = append(colors, c)
+	}
+
+	p, _, err := load_named_palette(*chosen_pal)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	for _, c := range colors {
+		for _, nearby := range closest_indices(c, p, metric, *count) {
+			if len(colors) > 1 {
+				fmt.Printf("%s: ", hex_color(c))
+			}
+			fmt.Printf("$%02X %s distance %.1f\n", nearby.Index, hex_color(p[nearby.Index]), nearby.Distance)
+		}
+	}
+	return 0
+}
+
+// Runs the lookup command given in the arguments
+func run_lookup() int {
+	pflag.Parse()
+	args := pflag.Args()
+
+	if len(args) == 1 {
+		log.Printf("%s: missing NES palette index\n", ex)
+		return 2
+	}
+
+	index, err := parse_nes_index(args[1])
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	var pals []NamedPalette
+	if len(args) == 2 {
+		if pals, err = load_palettes(); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	for _, arg := range args[2:] {
+		p, name, err := load_named_palette(arg)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		pals = append(pals, NamedPalette{Name: name, Palette: p})
+	}
+
+	width := 0
+	for _, pal := range pals {
+		width = max(width, len(pal.Name))
+	}
+	for _, pal := range pals {
+		c := nespal.ToRGB(pal.Palette[index])
+		fmt.Printf("%-*s  %s  %3d %3d %3d\n", width, pal.Name, hex_color(c), c.R, c.G, c.B)
+	}
+	return 0
+}
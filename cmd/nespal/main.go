@@ -0,0 +1,855 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+type Command struct {
+	Desc  string
+	Usage string
+	Doc   string
+}
+
+const (
+	IDENTIFY  = "identify"
+	REMAP     = "remap"
+	LIST      = "list"
+	BAKE      = "bake"
+	BENCH     = "bench"
+	PALETTE   = "palette"
+	PIPELINE  = "pipeline"
+	EXPORT    = "export"
+	INFO      = "info"
+	PICK      = "pick"
+	WEB       = "web"
+	UNDITHER  = "undither"
+	CLOSEST   = "closest"
+	LOOKUP    = "lookup"
+	EMPHASIZE = "emphasize"
+	CACHE     = "cache"
+	RANK      = "rank"
+	SAVESTATE = "savestate"
+	VIDEO     = "video"
+	GRID      = "grid"
+	COMPOSE   = "compose"
+	REPLACE   = "replace"
+	HELP      = "help"
+)
+
+var (
+	ex string
+	// Directories given with --palette-dir
+	palette_dirs []string
+	// Whether outputs must be byte-identical across runs and machines
+	reproducible bool
+)
+
+// Parses a NES palette index written in hexadecimal, like "$0F", "0x0F"
+// or "0F"
+func parse_nes_index(value string) (int, error) {
+	digits := strings.TrimSpace(value)
+	if strings.HasPrefix(digits, "#") {
+		return 0, fmt.Errorf("%s: '%s' is a color, expected a NES palette index like $0F", ex, value)
+	}
+	for _, prefix := range []string{"$", "0x", "0X"} {
+		if rest, found := strings.CutPrefix(digits, prefix); found {
+			digits = rest
+			break
+		}
+	}
+
+	i, err := strconv.ParseUint(digits, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid NES palette index '%s', expected hexadecimal like $0F, 0x0F or 0F", ex, value)
+	}
+	if i >= nespal.PALETTE_SIZE {
+		return 0, fmt.Errorf("%s: NES palette index '%s' is out of range, expected $00 to $%02X", ex, value, nespal.PALETTE_SIZE-1)
+	}
+	return int(i), nil
+}
+
+// Parses a list of NES palette indexes written in hexadecimal
+func parse_nes_indices(values []string) ([]int, error) {
+	indices := make([]int, 0, len(values))
+	for _, v := range values {
+		i, err := parse_nes_index(v)
+		if err != nil {
+			return nil, err
+		}
+		indices = append(indices, i)
+	}
+	return indices, nil
+}
+
+func get_commands() map[string]Command {
+	// TODO: Make so that LIST can differentiate the variant palettes
+	// TODO: Complete the documentation of each command
+	cmds := map[string]Command{
+		IDENTIFY: {
+			Desc:  "analyzes an image and identifies the color palette used",
+			Usage: fmt.Sprintf("%s %s <image|dir>... [palette...]", ex, IDENTIFY),
+			Doc: fmt.Sprintf(strings.TrimSuffix(strings.ReplaceAll(`
+					Analyzes an image and identifies the color palette used.
+					The output is the found color palette in the default palette list,
+					this list can be shown with '%s %s'.
+					Optionally, you may enter one or more palettes to match instead of the
+					default palette list.
+					The palette comes with a confidence, lower when the image uses few
+					colors or when another palette has almost every one of them.
+					Several images can be given, or directories standing for the images
+					in them; they are analyzed '--jobs' at a time, by default as many as
+					there are CPUs, and fewer when they would take more memory than
+					'--max-memory 2G'. Sets of images too large to be given as arguments
+					are read from a file listing them with '--files-from list.txt', one
+					per line, or from the standard input with '--files-from -'; with
+					'-0' they are separated by NUL bytes, like 'find -print0' writes them.
+					'--results results.jsonl' writes the result of every image as a line
+					of JSON as soon as it is done, with the image, the palette, how long
+					it took, its status, 'done', 'failed' or 'canceled', and its error;
+					'--results -' writes them to the standard output.
+					With '--format table' or '--format csv' the results
+					are summed up as a table or as CSV, with the file, the palette and
+					the confidence.
+					Palettes with emphasis colors, like 'pc10emph', are also matched with
+					each combination of the emphasis bits, so screenshots taken during
+					emphasis effects are identified along with the bits that were set.
+					Every frame of animated GIFs and PNGs, and every page of TIFF files, is
+					identified on its own, telling whether the palette is the same in
+					every frame or which frames it changes in; the tables have a row for
+					every run of frames with the same palette. Animations are not cached.
+					Screenshots scaled 2x, 3x or up to 8x, even with a mild filtering
+					smoothing their pixels, can be identified with '--unscale', which
+					finds the scale and takes the dominant color of every block.
+					Areas like emulator overlays, watermarks or the interface of the game
+					can be left out of the matching with '--ignore x,y,w,h', which can be
+					repeated, or with '--mask mask.png', leaving out the pixels that are
+					not black in the mask. Results are not cached with them.
+					Raw framebuffers, as dumped by headless emulators and capture cards,
+					are read with '--raw 256x240:rgb', giving their size and the layout
+					of their pixels: 'rgb', 'rgba' or 'bgr'. The image '-' is then read
+					from the standard input. Results are not cached with it either.
+					The default palette list can be restricted to the palettes made for
+					a region with '--region ntsc', 'pal', 'dendy' or 'vs', told by their
+					names: the ones naming PAL or EU are PAL palettes and the ones naming
+					Dendy are Dendy palettes, which also matches the PAL ones as Dendy
+					consoles output PAL video; the ones naming the RP2C03 or RP2C04 PPUs,
+					Vs. or PlayChoice are the ones of the Vs. System and PlayChoice-10
+					arcade machines; every other palette is an NTSC one. Screenshots of
+					the arcade machines are told as such, along with their PPU.
+					The results are cached by the content of the images and the palettes
+					matched, so images identified before are not read again; '--no-cache'
+					identifies them anyway, and '%s %s %s' empties the cache.
+				`, "\t", ""), "\n"), ex, IDENTIFY, ex, CACHE, CLEAR)[1:],
+		},
+		REMAP: {
+			Desc:  "replaces the colors in a image using a color palette",
+			Usage: fmt.Sprintf("%s %s <image>... [flags] <palette> <output_image|output_dir>", ex, REMAP),
+			Doc: fmt.Sprintf(strings.TrimSuffix(strings.ReplaceAll(`
+					Replaces the colors in a image using a color palette
+					Several images can be remapped at once into an output directory,
+					where each is saved as a PNG named after the image; they are
+					remapped '--jobs' at a time, by default as many as there are CPUs.
+					Images whose names only differ by their directory or extension,
+					like 'a/title.png' and 'b/title.png', would be saved as the same PNG,
+					which is an error.
+					'--max-memory 2G' also bounds the memory the images remapped at the
+					same time take, fewer of them being remapped at once when they are
+					large; the PNGs whose colors are only remapped take a band of rows,
+					and an image larger than the budget, or whose size can not be told
+					without decoding it, is remapped alone; a TIFF file takes the memory
+					of all its pages.
+					The images not changed since the last batch into the same directory,
+					remapped with the same palette, flags and '--map' and '--script'
+					files, are skipped, as told by the manifest kept in the directory,
+					unless one of their outputs, like a page of a TIFF file, was removed;
+					'--force' remaps them anyway.
+					The manifest is saved once the batch is done or interrupted; with
+					'--resume' a journal of the images remapped is also kept as they are
+					done, so when a batch is killed, running it again with '--resume'
+					only remaps the images it had not done yet.
+					The images can also be listed in a file, one per line, given with
+					'--files-from list.txt', or on the standard input with
+					'--files-from -'; '-0' reads them separated by NUL bytes, so
+					'find frames -name "*.png" -print0 | %s %s --files-from - -0 ...'
+					works for any number of images. Listed images are always remapped
+					into an output directory, so the ones found in several directories
+					must still have different names.
+					The result of every image of a batch is written as a line of JSON
+					with '--results results.jsonl', or to the standard output with
+					'--results -', as soon as it is done: the image, the output, the
+					palette, how long it took in seconds, its status, 'done', 'skipped',
+					'failed' or 'canceled', and its error, so partial failures can be
+					tracked.
+					Raw framebuffers are read with '--raw 256x240:rgb', 'rgba' or 'bgr',
+					the image '-' being read from the standard input.
+					Every page of a TIFF image with several pages is remapped, into
+					outputs numbered like 'out-1.png', and so are its '--index-map' and
+					exports.
+					The colors used can be restricted to a set of NES palette indexes
+					with '--indices 0F,00,10,20', or some of them can be excluded
+					with '--exclude 0D,2D,3D'.
+					'--safe-colors' never uses $0D, darker than black, which some CRTs
+					and NTSC decoders take for the sync signal; the pixels closest to it
+					get the nearest safe color instead, and how many is reported.
+					Unlike excluded ones, the indexes reserved by the project, like the
+					colors of flashing effects, with '--forbid 16,26' can not be kept,
+					be the backdrop nor be in the sub-palettes either.
+					They can also be restricted to the colors a frame shows with four
+					background sub-palettes, with '--subpals 0F,21,11,30;0F,16,27,18';
+					the first color of the first sub-palette is the backdrop, the first
+					colors of the others are not shown, like on the NES.
+					Specific colors can be pinned to NES palette indexes regardless of
+					their distance with '--keep '#000000=>$0F,#FFFFFF=>$30'', or with a
+					JSON file like '{"#000000": "$0F"}' given with '--map mapping.json'.
+					The image can be dithered with '--dither', using 'floyd-steinberg',
+					'ordered' or 'noise', the noise is seeded with '--seed' so runs with
+					the same inputs give the same output.
+					The closest colors are picked with the 'weighted' RGB distance, or
+					with '--metric euclidean', 'redmean' or 'cie76'.
+					The output can show how the remapped colors are seen with a color
+					vision deficiency with '--simulate protanopia', 'deuteranopia' or
+					'tritanopia', to check they can still be told apart.
+					Noise, like JPEG artifacts, can be reduced before anything else with
+					'--denoise', using a median filter, or with '--denoise=bilateral',
+					followed by a strength from 1 to 10 like '--denoise=bilateral:2'.
+					The colors of the image can be stretched to the full range, also
+					removing color casts, with '--auto-levels', before anything else
+					but the noise reduction.
+					Pre-passes can be applied to the image before remapping with '--pre':
+					  grayscale[:luma|average]  converts the image to grayscale
+					  equalize[:global|clahe]   spreads the brightness of the image
+					                            over the full range, for dark
+					                            screenshots and photos, keeping its
+					                            hues; 'clahe' equalizes every area on
+					                            its own, limiting the contrast
+					  kuwahara[:radius]         flattens the image into regions of even
+					                            color keeping their edges, for photos
+					                            and 3D renders, the radius is 4 by
+					                            default and up to 16
+					The colors can be restricted to the grays of the NES palette with
+					'--gray-column'.
+					The brightness, contrast and saturation can be adjusted after the
+					pre-passes with '--brightness', '--contrast' and '--saturation', as
+					percentages from -100 to 100, and the hue can be rotated by some
+					degrees with '--hue-shift'.
+					The NES palette index of every pixel can be written with
+					'--index-map out.idx' as raw bytes, or as a PGM image if the file
+					ends in '.pgm'.
+					The used palette indexes and the index of every pixel can be
+					exported as C arrays with '--export-c out.h' or as ca65 '.byte'
+					tables with '--export-asm out.s'.
+					The output can be a PNG, JPEG or GIF image. With
+					'--preserve-index-order' PNG and GIF outputs are paletted images
+					whose palette is the whole NES palette in index order, so the pixel
+					bytes are the NES palette indexes.
+					Semi-transparent pixels are matched as their color blended over
+					black, or over another background with '--matte', given a color like
+					'--matte '#FFFFFF'' or a NES palette index like '--matte '$21'' whose
+					color is taken from the palette. With '--alpha-threshold 128' the
+					pixels whose alpha is at least 128 are matched as their opaque color
+					and the others are transparent in PNG and GIF outputs, but with
+					'--preserve-index-order'.
+					Only an area of the image can be remapped with '--roi x,y,w,h', the
+					rest passing through untouched, or everything but it with '--outside',
+					for mockups mixing NES gameplay with a modern interface.
+					One-off behaviors can be scripted in Starlark, a dialect of Python,
+					with '--script transform.star', defining any of these functions:
+					  adjust(color)          returns the color a color of the image is
+					                         matched as, after the pre-passes
+					  veto(index, color)     returns True for the NES palette indexes
+					                         never used, like '--exclude'
+					  post(x, y, index)      returns the NES palette index of a pixel
+					                         once remapped
+					  post_tile(x, y, rows)  returns the rows of NES palette indexes of
+					                         the 8x8 tile at column x and row y once
+					                         remapped, or None to leave them
+					Colors are (r, g, b) tuples, and can be returned as strings like
+					"#E04040"; 'print' writes to the log. Scripts running for too long,
+					like ones that never return, are stopped with an error.
+					Images are turned upright following their EXIF orientation. Their
+					text, resolution and EXIF metadata can be copied into the output
+					with '--keep-metadata'.
+					The output of a single image can be shown in the terminal once written
+					with '--preview sixel', on terminals showing Sixel graphics like
+					xterm, mlterm or WezTerm, '--preview kitty', with the graphics
+					protocol of kitty and Ghostty, or '--preview iterm', with the inline
+					images of iTerm2 and WezTerm. '--preview auto' tells the protocol
+					from the environment of the terminal.
+				`, "\t", ""), "\n"), ex, REMAP)[1:],
+		},
+		BAKE: {
+			Desc:  "converts an image into the files of a NES background",
+			Usage: fmt.Sprintf("%s %s <image> [flags] <palette> <output_dir>", ex, BAKE),
+			Doc: fmt.Sprintf(strings.TrimSuffix(strings.ReplaceAll(`
+					Converts an image into the files of a NES background, all named after
+					the image: the pattern table tiles (.chr), the nametable with its
+					attribute table (.nam), the attribute table alone (.atr) and the
+					four sub-palettes as NES palette indexes (.pal).
+					The image is remapped so every 16x16 area uses at most three colors
+					plus the shared backdrop color, out of four sub-palettes. It fails
+					when the image can not fit in these constraints, in a 256x240
+					nametable or in the 256 tiles of a pattern table.
+					The backdrop color is the most used one, unless it is locked to a
+					NES palette index with '--backdrop 0F'.
+					'--optimize' searches the backdrop and the four sub-palettes that
+					lose the least of the image, taking the ones its blocks would pick
+					for themselves and then trying every color in every entry, instead
+					of the first ones the most used colors of the blocks fit in. It is
+					slower, and never fails on too many colors.
+					Like in remap, the palette can be a pre-built one with '--palette',
+					and '--safe-colors' keeps $0D out of the sub-palettes.
+					The areas sharing a sub-palette can be 8x8 with '--attr-size 8', for
+					the MMC5 extended attributes, written to an .exram file instead of
+					the attribute table, or larger. Other grids, like the ones of frames
+					scrolled mid-tile with '--grid-offset x,y' or with another
+					'--tile-size', can be checked with '%s %s' but not baked.
+					Which sub-palette every attribute block uses can be drawn with
+					'--attr-map map.png', tinting each block with the color of its
+					sub-palette, and written with '--attr-table', as a grid of the
+					sub-palette numbers or, for .json files, as JSON.
+					How the 13 background colors are spread across the sub-palettes, and
+					how many blocks use each of them, is written with '--subpal-stats',
+					as text or, for .json files, as JSON, and printed with
+					'--subpal-stats -'. An image already NES-legal is baked as it is, so
+					this reports its own sub-palettes.
+					The number of unique tiles is reported. It can not go over the 256 of
+					a pattern table, or what '--tile-budget' sets, up to 512 with
+					'--attr-size 8' where the extended attributes also pick the 4K bank
+					of every tile. With '--merge-tiles', the tiles whose colors change
+					the least are merged into similar ones until they fit, and how many
+					pixels changed is reported.
+					With '--nesst', the files are written so NES Screen Tool and NEXXT
+					open them: the tiles as a whole 4K pattern table, the nametable with
+					its attribute table, and the sub-palettes, without the separate
+					attribute table. Their extended attributes not being supported,
+					'--attr-size 8' can not be used with it.
+					Every page of a TIFF image with several pages is baked, into files
+					numbered like 'image-1.chr', and so are its attribute maps and tables.
+					With '--alpha-threshold 128', the pixels whose alpha is below 128 are
+					transparent and take the backdrop color, like the transparent pixels
+					of sprites, and the others are opaque.
+				`, "\t", ""), "\n"), ex, INFO)[1:],
+		},
+		BENCH: {
+			Desc:  "measures the speed of loading palettes, matching colors and remapping",
+			Usage: fmt.Sprintf("%s %s [--image <image>]", ex, BENCH),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Measures how long it takes to load the default palette list, to find
+					the nearest color of a palette and to remap an image with every
+					number of CPUs up to the available ones, printing a table.
+					The image is a generated 256x240 one, unless one is given with
+					'--image'.
+				`, "\t", ""), "\n")[1:],
+		},
+		PALETTE: {
+			Desc:  "inspects and converts color palettes",
+			Usage: fmt.Sprintf("%s %s <command> [flags] <palette> [output]", ex, PALETTE),
+			Doc: fmt.Sprintf(strings.TrimSuffix(strings.ReplaceAll(`
+					Inspects and converts color palettes, given either as a .pal file or
+					as a name of the default palette list.
+					The commands are:
+					  %-10s  checks a palette for duplicate entries, a $0D darker than
+					              black, columns getting darker with each row, colors out
+					              of the NES gamut and files of the wrong size; the
+					              findings are printed as text or, with '--format json',
+					              as JSON, and the exit status is 1 when there are any
+					  %-10s  writes the palette in another format to the output file
+					              or to the terminal; with '--csv' as CSV, a row per color
+					              with its NES index, hex code and red, green and blue
+					              components; with '--mesen' for Mesen2, as the JSON of
+					              its settings.json or, for .pal outputs, as a .pal file,
+					              with the emphasis colors when the palette has them
+					  %-10s  fixes a .pal file into the output .pal file; with
+					              '--swap-rb' the red and blue of every color are swapped,
+					              for the dumps in BGR order; with '--ppu 2C04-0001' the
+					              colors of the RP2C04 in the order of the NES are moved
+					              to the scrambled indexes of a version, 0001 to 0004,
+					              and with '--from-ppu' the colors of a version are moved
+					              back to the order of the NES, so both convert between
+					              the versions
+					  %-10s  computes the emphasis colors of a palette into the
+					              output .pal file, the 512 colors of its 8 banks, every
+					              emphasis bit dimming the other two channels to %g of
+					              their value, but for the blacks of $xE and $xF; the
+					              bits of red and green are swapped for PAL and Dendy
+					              palettes, like on their PPUs
+					  %-10s  compares every available palette with each other and
+					              lists the identical ones, with '=', and the
+					              near-identical ones, with '~', whose colors all differ
+					              by at most a delta E of '--threshold', %g by default
+					  %-10s  proposes '--count' sub-palettes, four by default, sharing
+					              the backdrop, $0F unless given another with '--backdrop',
+					              each made of the three colors that stay the most
+					              distinguishable with normal vision and with protanopia,
+					              deuteranopia and tritanopia; the smallest delta E of
+					              each is printed along with the vision it is found in;
+					              the indexes given with '--forbid' are never proposed
+					  %-10s  prints the mean delta E between the colors of every pair
+					              of the given palettes, or of every available palette,
+					              as a table or, with '--format csv', as CSV
+					  %-10s  groups the available palettes into families whose mean
+					              delta E is at most '--threshold', %g by default, and
+					              prints each family starting with its most
+					              representative palette, the largest families first
+					  %-10s  draws the palette as a chart image of 16 colors per row,
+					              each cell '--cell' pixels wide; with '--labels' every
+					              cell shows its NES index, and with '--hex' its color
+					              code too, in black or white to stand out
+					  %-10s  bundles palettes into a single '%s' file, given the
+					              output and then the palettes, with a manifest of their
+					              names, regions and whether they have emphasis colors,
+					              along with the '--author' and '--license' given
+					  %-10s  writes the palettes and manifest of a pack into the
+					              output directory, named after the pack by default
+					  %-10s  writes a new key pair to sign packs with, the private
+					              key to <name>.key and the public one to <name>.pub
+					  %-10s  downloads the curated palette pack at '--url', or at
+					              NESPAL_UPDATE_URL, into the user palette directory,
+					              where its palettes shadow the outdated pre-built ones,
+					              unless the installed pack has the same version; with
+					              '--check' it only reports whether the installed pack
+					              is outdated, with the exit status 1 when it is
+					Palette packs can be given to '--palette-dir' or put in a palette
+					directory, their palettes are then listed and used like the others,
+					with the region of their manifest.
+					Packs made with '--sign-key <name>.key' are signed. With
+					'--verify-key <name>.pub', every pack must be signed with the key and
+					have the palettes it was signed with, or it is an error; palettes
+					outside of packs are not checked.
+				`, "\t", ""), "\n"), LINT, EXPORT, CONVERT, EMPHASIZE, EMPHASIS_ATTENUATION, DUPES, DUPES_THRESHOLD, ACCESSIBLE, MATRIX, CLUSTERS, float64(CLUSTERS_THRESHOLD), SWATCH, PACK, PACK_EXT, UNPACK, KEYGEN, UPDATE)[1:],
+		},
+		INFO: {
+			Desc:  "reports whether an image is already NES-legal",
+			Usage: fmt.Sprintf("%s %s <image> [palette]", ex, INFO),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Reports the size of an image, how many colors it uses, which palettes
+					of the default palette list have every one of them, or whether the
+					given palette has them, and whether every 16x16 area fits the NES
+					background constraints: at most three colors plus the shared backdrop
+					color, out of four sub-palettes.
+					The grid of these areas can be changed with '--attr-size 8' for the
+					MMC5 extended attributes, with '--tile-size' and with
+					'--grid-offset x,y', the pixel where the grid starts in frames
+					scrolled mid-tile.
+					'--violations out.png' counts the areas breaking the constraints and
+					draws them over the faded image, the ones with more than four colors
+					in red and the ones whose colors need a fifth sub-palette in yellow.
+					The exit status is 1 when the image is not NES-legal.
+				`, "\t", ""), "\n")[1:],
+		},
+		PICK: {
+			Desc:  "picks a palette by looking at the image remapped to each",
+			Usage: fmt.Sprintf("%s %s <image> [flags] [output_image]", ex, PICK),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Shows the available palettes a few at a time, each with a thumbnail
+					of the image remapped to it drawn in the terminal, and asks which one
+					to pick: enter goes to the next page, 'p' to the previous one, '/text'
+					only shows the palettes whose name has the text and 'q' quits.
+					The name of the picked palette is printed, and the image remapped to
+					it is written to the output image when given.
+					The thumbnails and the output are remapped with the flags of remap.
+				`, "\t", ""), "\n")[1:],
+		},
+		REPLACE: {
+			Desc:  "replaces the NES palette index colors of an image are remapped to",
+			Usage: fmt.Sprintf("%s %s <image> [flags] <palette> <mapping.json> [output_image]", ex, REPLACE),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Shows the image remapped to the palette in the terminal along with
+					its colors, the most used first, and the NES palette indexes they
+					are remapped to, and asks for the ones to replace: a color, given
+					by its number in the list or like '#E04040', followed by an index
+					like '$16' is remapped to it, or back to its closest index with '-'
+					instead. A color alone shows its pixels over the rest of the image
+					faded, 'l 50' lists the 50 most used colors and 'q' quits.
+					The image is remapped again after every change, and the mapping is
+					written to the JSON file, which remap and the other commands read
+					with '--map mapping.json', so the fixes apply to whole batches. An
+					existing mapping file is loaded first, so a session can go on where
+					the last one stopped. The remapped image is also written to the
+					output image when given, which image viewers reloading files can
+					show as it changes.
+					The previews are drawn with text unless given a graphics protocol
+					with '--preview', like for remap, and the image is remapped with
+					the flags of remap.
+				`, "\t", ""), "\n")[1:],
+		},
+		WEB: {
+			Desc:  "serves a web page to remap images from the browser",
+			Usage: fmt.Sprintf("%s %s [--addr <host:port>] [--timeout <duration>]", ex, WEB),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Serves a web page where images can be dropped, remapped to the chosen
+					palette with the chosen dithering and metric, previewed next to the
+					original and downloaded as PNG.
+					It listens on localhost:8080 unless given another address with
+					'--addr'; everything runs on this machine, no image is sent anywhere
+					else.
+					Remaps taking longer than '--timeout', like '30s', are stopped, and
+					so are the ones whose page is closed before they are done.
+					'--max-memory 1G' bounds the memory the images remapped at the same
+					time take, the others waiting for theirs in order; PNGs too large for
+					it are remapped band by band when their options allow it.
+				`, "\t", ""), "\n")[1:],
+		},
+		UNDITHER: {
+			Desc:  "smooths dithered images back into flat colors",
+			Usage: fmt.Sprintf("%s %s <image> [flags] <output_image>", ex, UNDITHER),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Finds the areas of an image where two colors alternate like in a
+					checkerboard or an ordered dithering pattern and smooths them into
+					the flat colors they stand for, printing how much of the image was
+					dithered. This recovers art already converted to another palette
+					before remapping it again.
+					The smoothed image is remapped when given a palette with '--palette',
+					which takes a pre-built palette name or a .pal file, along with the
+					flags of remap.
+				`, "\t", ""), "\n")[1:],
+		},
+		RANK: {
+			Desc:  "ranks the palettes by how well they fit an image",
+			Usage: fmt.Sprintf("%s %s <image> [flags] [palette...]", ex, RANK),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Ranks the given palettes, or every available palette, by the mean
+					delta E between the pixels of the image and their closest colors,
+					printing a table of the best fitting ones first, along with the
+					largest delta E of a pixel. Unlike identify, it tells which palette
+					converting the image to loses the least, not which one it was made
+					with.
+					The available palettes can be restricted to the ones made for a
+					region with '--region', only the first '--count' palettes can be
+					printed, and '--format csv' prints them as CSV.
+				`, "\t", ""), "\n")[1:],
+		},
+		VIDEO: {
+			Desc:  "remaps every frame of a video using a color palette",
+			Usage: fmt.Sprintf("%s %s <video> [flags] <palette> <output_video>", ex, VIDEO),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Remaps every frame of a video to the palette, a pre-built palette
+					name or a .pal file, so footage looks like it came out of a NES.
+					The video is decoded and encoded by 'ffmpeg', which must be
+					installed along with 'ffprobe', the frames passing through pipes as
+					raw pixels; the audio is copied as is. The output format follows its
+					extension, MP4, MKV, MOV and WebM outputs being written in 4:2:0 so
+					every player can play them.
+					The frames are remapped '--jobs' at a time, by default as many as
+					there are CPUs, and take the same flags as 'remap', like '--dither'
+					or '--metric'; noise dithering is seeded the same for every frame, so
+					still areas do not flicker.
+				`, "\t", ""), "\n")[1:],
+		},
+		SAVESTATE: {
+			Desc:  "extracts the frame and the palette RAM of an emulator savestate",
+			Usage: fmt.Sprintf("%s %s <savestate> [flags] <palette> <output_image>", ex, SAVESTATE),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Extracts the frame shown when a FCEUX (.fcs) or Mesen 2 (.mss)
+					savestate was made, rendering it with the palette, a pre-built
+					palette name or a .pal file, so it can be identified or used as
+					the exact frame of the game. Pixels drawn with the emphasis bits set
+					take the emphasis colors of the palette when it has them.
+					The contents of the palette RAM, when the savestate has them, are
+					printed as the background and the sprite sub-palettes.
+					The NES palette index of every pixel can be written with
+					'--index-map out.idx' as raw bytes, or as a PGM image if the file
+					ends in '.pgm'.
+					Mesen 1 savestates (.mst) are not supported: they keep no frame, and
+					their fields are written one after the other without names, in a
+					layout that changed with every version, so not even the palette RAM
+					can be read from them. Load the game in Mesen 2 and save the state
+					there instead.
+				`, "\t", ""), "\n")[1:],
+		},
+		GRID: {
+			Desc:  "overlays the tile and attribute grids on an image",
+			Usage: fmt.Sprintf("%s %s <image> [flags] <output_image>", ex, GRID),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Draws the lines of the 8x8 tiles and of the 16x16 areas sharing a
+					sub-palette over an image, so artists can align their work with the
+					hardware before converting it. The lines are blended over the
+					pixels, which still show through them.
+					The grid can be moved with '--grid-offset x,y' and resized with
+					'--tile-size' and '--attr-size', like for 'info' and 'bake'; its
+					colors are set with '--tile-color' and '--attr-color', like
+					'#00FF00'. Small images can be scaled up with '--scale 4' so the
+					lines do not hide the pixels.
+				`, "\t", ""), "\n")[1:],
+		},
+		COMPOSE: {
+			Desc:  "renders a NES frame from the memories of the PPU",
+			Usage: fmt.Sprintf("%s %s --chr <chr> --nam <nametable> --pal <palette_ram> [flags] <palette> <output_image>", ex, COMPOSE),
+			Doc: fmt.Sprintf(strings.TrimSuffix(strings.ReplaceAll(`
+					Renders the 256x240 frame the PPU would show from the files of a
+					homebrew project, with the colors of the palette, a pre-built palette
+					name or a .pal file: the pattern tables of '--chr', the nametable and
+					attribute table of '--nam', 1024 bytes, and the palette RAM of
+					'--pal', the 16 bytes of the background sub-palettes or the 32 with
+					the sprite ones, like the files 'bake' writes.
+					The sprites of the 256 bytes of OAM given with '--oam' are drawn over
+					the background, or behind it with their priority bit, where it is not
+					the backdrop. Like on the PPU, only the first %d sprites of a
+					scanline are drawn, the first opaque sprite at a pixel hides the
+					ones after it even when it is behind the background, and the sprites
+					show a scanline below their Y.
+					The background and the sprites take their tiles from the pattern
+					table 0 unless given '--bg-table 1' or '--sprite-table 1', and
+					'--tall-sprites' draws 8x16 sprites, taking their pattern table from
+					the first bit of their tile.
+					The MMC5 extended attributes of '--exram', written by 'bake' with
+					'--attr-size 8', replace the attribute table, their low bits giving
+					the 4K bank of the tiles.
+					The emphasis bits of '--bits', any of 'r', 'g' and 'b', render the
+					frame with the emphasis colors of the palette.
+				`, "\t", ""), "\n"), SPRITES_PER_LINE)[1:],
+		},
+		CLOSEST: {
+			Desc:  "finds the NES palette index closest to a color",
+			Usage: fmt.Sprintf("%s %s <color>... [--palette <palette>]", ex, CLOSEST),
+			Doc: fmt.Sprintf(strings.TrimSuffix(strings.ReplaceAll(`
+					Prints the NES palette index closest to each color, written like
+					'#7C3F9F', along with its color and how far it is.
+					The index is looked up in the %s palette, or in the one given with
+					'--palette', which takes a pre-built palette name or a .pal file.
+					The distance is measured like remap does, with '--metric' picking
+					another way, and '--count 3' also prints the next closest indexes.
+				`, "\t", ""), "\n"), DEFAULT_PALETTE)[1:],
+		},
+		LOOKUP: {
+			Desc:  "shows the color of a NES palette index in several palettes",
+			Usage: fmt.Sprintf("%s %s <index> [palette...]", ex, LOOKUP),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Prints the color a NES palette index, like '$21', has in each of the
+					given palettes, pre-built palette names or .pal files, or in every
+					available palette when none is given, to compare how they render
+					the same hardware color.
+				`, "\t", ""), "\n")[1:],
+		},
+		EMPHASIZE: {
+			Desc:  "renders an image already in a palette with color emphasis",
+			Usage: fmt.Sprintf("%s %s <image> --bits <r,g,b> <palette> <output_image>", ex, EMPHASIZE),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Renders an image whose colors are all in a palette with the emphasis
+					bits of the PPU set, like games do for flashes or underwater tints.
+					The NES palette index of every pixel is recovered from the palette
+					and its color is taken from the emphasis colors of the bits given
+					with '--bits', any of 'r', 'g' and 'b'.
+					The palette, a pre-built palette name or a .pal file, must have its
+					emphasis colors, the 512 colors of the palettes like 'pc10emph'.
+				`, "\t", ""), "\n")[1:],
+		},
+		CACHE: {
+			Desc:  "manages the cache of identify results",
+			Usage: fmt.Sprintf("%s %s %s", ex, CACHE, CLEAR),
+			Doc: fmt.Sprintf(strings.TrimSuffix(strings.ReplaceAll(`
+					Manages the cache of the results of identify, kept in the user cache
+					directory, like ~/.cache/nespal on Linux.
+					The commands are:
+					  %-10s removes every cached result
+				`, "\t", ""), "\n"), CLEAR)[1:],
+		},
+		EXPORT: {
+			Desc:  "exports an image in other formats, remapped if given a palette",
+			Usage: fmt.Sprintf("%s %s <format> <image> [flags] [palette] [output]", ex, EXPORT),
+			Doc: fmt.Sprintf(strings.TrimSuffix(strings.ReplaceAll(`
+					Exports an image in other formats. The image is first remapped when
+					given a palette with '--palette', which takes a pre-built palette
+					name or a .pal file, along with the flags of remap.
+					The formats are:
+					  %s  24-bit ANSI art made of half blocks, two rows of pixels per
+					        line of text, written to the output file or to the terminal
+					  %s  a self-contained HTML page with the original and remapped
+					        images, the palette with its NES indexes and how many pixels
+					        use each color, the palette being given after the image
+				`, "\t", ""), "\n"), ANSI, HTML)[1:],
+		},
+		PIPELINE: {
+			Desc:  "chains operations on an image without writing it in between",
+			Usage: fmt.Sprintf("%s %s <step> [flags] [args] -- <step>... | <spec>", ex, PIPELINE),
+			Doc: fmt.Sprintf(strings.TrimSuffix(strings.ReplaceAll(`
+					Runs steps on an image one after the other, keeping it in memory
+					between them, so it is only decoded and encoded once. The steps are
+					separated by '--', or written one per line in a spec file, where
+					blank lines and lines starting with '#' are skipped.
+					The steps are:
+					  %s <image>              decodes the image, must come first
+					  %s <width>x<height>   resizes the image, averaging pixels; either
+					                            side can be left out to keep the aspect ratio
+					  %s [flags]            applies the adjustment flags of remap, like
+					                            '--brightness' or '--pre'
+					  %s [flags] <palette>   remaps the image like remap, the palette
+					                            is a .pal file or a name in the palette list
+					  %s <factor>            enlarges the image keeping pixels sharp
+					  %s <output_image>     writes the image as PNG or JPEG, with the
+					                            metadata of the loaded image when given
+					                            '--keep-metadata'
+					For example:
+					  %s %s load in.png -- resize 256x -- remap --dither ordered 2C02 -- scale 2 -- encode out.png
+				`, "\t", ""), "\n"), STEP_LOAD, STEP_RESIZE, STEP_ADJUST, STEP_REMAP, STEP_SCALE, STEP_ENCODE, ex, PIPELINE)[1:],
+		},
+		LIST: {
+			Desc:  "displays the default palette list",
+			Usage: fmt.Sprintf("%s %s", ex, LIST),
+			Doc: strings.TrimSuffix(strings.ReplaceAll(`
+					Displays the default palette list, made of the palettes found, in
+					order, in the directories given with '--palette-dir', in the ones of
+					the NESPAL_PALETTE_PATH environment variable, in the user palette
+					directory and in the pre-built palettes. A palette hides the ones
+					with the same name found after it.
+					The directories can also be zip archives of .pal files, like the
+					palette packs shared online, read without unpacking them.
+					Every command that takes a palette name accepts '--palette-dir'.
+					A .pal file shorter than its 64 colors, or in another format like
+					JASC-PAL or RIFF palettes, is an error telling where it went wrong;
+					data past the colors is warned about and ignored, or is an error
+					with '--strict-palettes'.
+					Some palette dumps have their colors in BGR order instead of RGB. They
+					are told apart by their blues looking red, and loaded with red and
+					blue swapped along with a warning; '--channel-order rgb' or 'bgr'
+					loads them in that order instead.
+					With '--reproducible', so outputs are the same on every machine,
+					only the directories given with '--palette-dir' and the pre-built
+					palettes are searched.
+				`, "\t", ""), "\n")[1:],
+		},
+	}
+	return cmds
+}
+
+func get_help(cmds map[string]Command) string {
+	cmd_list := make([]string, 0, len(cmds))
+
+	max_padding := 0
+	for k := range cmds {
+		if len(k) > max_padding {
+			max_padding = len(k)
+		}
+	}
+
+	for k, cmd := range cmds {
+		cmd_list = append(cmd_list, k+strings.Repeat(" ", max_padding-len(k)+2)+cmd.Desc)
+	}
+
+	sort.Strings(cmd_list)
+
+	return strings.TrimSuffix(fmt.Sprintf(`
+Nespal is a tool for manipulating images using color palettes from the Nintendo Entertainment System (NES) emulation ecosystem
+
+Usage: %s <command> <image>... [options] [output]
+
+The commands are:
+	%s
+
+Use "%s %s <command>" for more information about a command
+	`, ex, strings.Join(cmd_list, "\n\t"), ex, HELP), "\n\t")[1:]
+}
+
+func run() int {
+	cmds := get_commands()
+	help := get_help(cmds)
+	try_help := fmt.Sprintf("Try: %s %s", ex, HELP)
+	args := os.Args[1:]
+	pflag.StringArrayVar(&palette_dirs, "palette-dir", nil, "Directory to search palettes in before the default ones")
+	pflag.IntVarP(&jobs, "jobs", "j", jobs, "Number of images processed at the same time")
+	pflag.StringVar(&max_memory, "max-memory", "", "Memory the images processed at the same time can take, like '512M' or '2G'")
+	pflag.BoolVar(&reproducible, "reproducible", false, "Write byte-identical outputs across runs and machines")
+	pflag.BoolVar(&strict_palettes, "strict-palettes", false, "Reject .pal files with data past their colors instead of warning")
+	pflag.StringVar(&channel_order, "channel-order", CHANNELS_AUTO, "Order of the channels of .pal files: auto, rgb or bgr")
+	pflag.StringVar(&verify_key, "verify-key", "", "Public key file every palette pack must be signed with")
+	log_flags(pflag.CommandLine)
+	if err := setup_logging(args); err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if len(args) == 0 {
+		println(help)
+		log.Printf("\n%s: missing command\n", ex)
+		return 2
+	}
+
+	if _, ok := cmds[args[0]]; !ok && args[0] != HELP {
+		log.Printf("%s: unknown command \"%s\"\n", ex, os.Args[1])
+		log.Println(try_help)
+		return 2
+	}
+
+	switch args[0] {
+	case IDENTIFY:
+		return run_identify()
+	case REMAP:
+		return run_remap()
+	case VIDEO:
+		return run_video()
+	case SAVESTATE:
+		return run_savestate()
+	case GRID:
+		return run_grid()
+	case COMPOSE:
+		return run_compose()
+	case RANK:
+		return run_rank()
+	case CLOSEST:
+		return run_closest()
+	case LOOKUP:
+		return run_lookup()
+	case EMPHASIZE:
+		return run_emphasize()
+	case UNDITHER:
+		return run_undither()
+	case BAKE:
+		return run_bake()
+	case BENCH:
+		return run_bench()
+	case LIST:
+		return run_list()
+	case INFO:
+		return run_info()
+	case PALETTE:
+		return run_palette()
+	case CACHE:
+		return run_cache()
+	case PICK:
+		return run_pick()
+	case REPLACE:
+		return run_replace()
+	case WEB:
+		return run_web()
+	case EXPORT:
+		return run_export()
+	case PIPELINE:
+		return run_pipeline()
+	case HELP:
+		if len(os.Args) == 2 {
+			println(help)
+			return 0
+		}
+
+		cmd, ok := cmds[os.Args[2]]
+		if !ok {
+			log.Printf("%s: unknown help topic \"%s\"\n", ex, os.Args[2])
+			log.Println(try_help)
+			return 2
+		}
+
+		fmt.Printf("Usage: %s\n\n", cmd.Usage)
+		println(cmd.Doc)
+		return 0
+	}
+
+	return 0
+}
+
+func init() {
+	log.SetFlags(0)
+	ex = filepath.Base(os.Args[0])
+}
+
+func main() {
+	os.Exit(run())
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+)
+
+// Name of the manifest kept in the output directories of batches
+const MANIFEST_NAME = ".nespal-manifest.json"
+
+// Name of the journal of the outputs made, kept by the batches run with
+// --resume until their manifest is saved
+const JOURNAL_NAME = ".nespal-journal.jsonl"
+
+// Flags that change how a batch runs but not its outputs
+var manifest_ignored_flags = []string{"jobs", "force", "log-file", "log-format", "files-from", "null", "results", "resume", "max-memory"}
+
+// Flags naming files read for every output, whose content is part of the
+// settings along with the name, so editing them makes the outputs again
+var manifest_file_flags = []string{"map", "script"}
+
+// The source and settings an output was made from
+type ManifestEntry struct {
+	Source  string
+	Size    int64
+	ModTime time.Time
+	// hash of the content of the source
+	Hash string
+	// hash of the palette and flags
+	Settings string
+	// files made from the source in the directory of the manifest when they
+	// are not the output itself, like the pages of a TIFF file
+	Outputs []string `json:",omitempty"`
+}
+
+// An output recorded in the journal
+type JournalRecord struct {
+	Output string
+	ManifestEntry
+}
+
+// Records what every output of a directory was made from, so a batch can
+// skip the outputs whose source and settings have not changed
+type Manifest struct {
+	path    string
+	mu      sync.Mutex
+	Entries map[string]ManifestEntry
+	// journal the outputs are appended to as they are made, nil unless the
+	// batch can be resumed
+	journal *os.File
+}
+
+// Loads the manifest of dir, empty when there is none or when it cannot
+// be read, which only means every output is made again
+func load_manifest(dir string) *Manifest {
+	m := &Manifest{path: filepath.Join(dir, MANIFEST_NAME), Entries: map[string]ManifestEntry{}}
+	data, err := os.ReadFile(m.path)
+	if err != nil {
+		return m
+	}
+	if err := json.Unmarshal(data, &m.Entries); err != nil || m.Entries == nil {
+		m.Entries = map[string]ManifestEntry{}
+	}
+	return m
+}
+
+// Replays the journal left in the directory of the manifest by a batch that
+// was killed before saving it, so its outputs are not made again, then keeps
+// a journal of the outputs made from now on. A record cut short by the kill
+// ends the replay
+func (m *Manifest) resume() error {
+	path := filepath.Join(filepath.Dir(m.path), JOURNAL_NAME)
+	if data, err := os.ReadFile(path); err == nil {
+		for line := range bytes.Lines(data) {
+			var record JournalRecord
+			if json.Unmarshal(line, &record) != nil || record.Output == "" {
+				break
+			}
+			m.Entries[record.Output] = record.ManifestEntry
+		}
+	}
+
+	journal, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	m.journal = journal
+	return nil
+}
+
+// Returns the hash of the flags set in flags, with the content of the files
+// they name, and of data, like the content of a palette
+func settings_hash(flags *pflag.FlagSet, data ...[]byte) string {
+	h := sha256.New()
+	set := []string{}
+	flags.Visit(func(f *pflag.Flag) {
+		for _, ignored := range manifest_ignored_flags {
+			if f.Name == ignored {
+				return
+			}
+		}
+		setting := fmt.Sprintf("%s=%s", f.Name, f.Value)
+		if slices.Contains(manifest_file_flags, f.Name) {
+			// a file that cannot be read fails the batch when it is used
+			if content, err := os.ReadFile(f.Value.String()); err == nil {
+				setting += fmt.Sprintf(" %x", sha256.Sum256(content))
+			}
+		}
+		set = append(set, setting)
+	})
+	sort.Strings(set)
+	for _, s := range set {
+		fmt.Fprintf(h, "%s\x00", s)
+	}
+	for _, d := range data {
+		h.Write(d)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Checks whether the output dst, a path in the directory of the manifest,
+// was made from src with the settings and every file made along with it is
+// still there. The source is only hashed when its size or modification
+// time changed. Returns the entry to record once dst is made again
+func (m *Manifest) up_to_date(src string, dst string, settings string) (bool, ManifestEntry, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return false, ManifestEntry{}, err
+	}
+	entry := ManifestEntry{Source: src, Size: info.Size(), ModTime: info.ModTime(), Settings: settings}
+
+	m.mu.Lock()
+	old, found := m.Entries[filepath.Base(dst)]
+	m.mu.Unlock()
+	outputs := []string{dst}
+	if len(old.Outputs) > 0 {
+		outputs = outputs[:0]
+		for _, name := range old.Outputs {
+			outputs = append(outputs, filepath.Join(filepath.Dir(dst), name))
+		}
+	}
+	for _, path := range outputs {
+		if _, err := os.Stat(path); err != nil {
+			found = false
+		}
+	}
+
+	if found && old.Source == src && old.Settings == settings && old.Size == entry.Size && old.ModTime.Equal(entry.ModTime) {
+		entry.Hash, entry.Outputs = old.Hash, old.Outputs
+		return true, entry, nil
+	}
+
+	if entry.Hash, err = file_hash(src); err != nil {
+		return false, entry, err
+	}
+	return found && old.Source == src && old.Settings == settings && old.Hash == entry.Hash, entry, nil
+}
+
+// Records that dst was made as described by entry, in the journal too when
+// there is one
+func (m *Manifest) record(dst string, entry ManifestEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Entries[filepath.Base(dst)] = entry
+	if m.journal == nil {
+		return nil
+	}
+
+	// written at once, so a kill can only cut the last record short
+	data, err := json.Marshal(JournalRecord{filepath.Base(dst), entry})
+	if err != nil {
+		return err
+	}
+	_, err = m.journal.Write(append(data, '\n'))
+	return err
+}
+
+// Forgets dst, which could not be made
+func (m *Manifest) forget(dst string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.Entries, filepath.Base(dst))
+}
+
+// Writes the manifest back to its directory, removing the journal it now
+// holds the records of
+func (m *Manifest) save() error {
+	data, err := json.MarshalIndent(m.Entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(m.path, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	if m.journal == nil {
+		return nil
+	}
+	m.journal.Close()
+	return os.Remove(m.journal.Name())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Areas of the images left out of the matching, like emulator overlays,
+// watermarks or the interface of the game. Coordinates start at the top
+// left pixel of the images
+type Mask struct {
+	Rects []image.Rectangle
+	// Image whose pixels that are not black are left out, if any
+	Image image.Image
+}
+
+// Parses an area written as "x,y,w,h"
+func parse_rect(value string) (image.Rectangle, error) {
+	fields := strings.Split(value, ",")
+	if len(fields) != 4 {
+		return image.Rectangle{}, fmt.Errorf("%s: invalid area '%s', expected 'x,y,w,h'", ex, value)
+	}
+
+	var n [4]int
+	for i, field := range fields {
+		v, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || v < 0 {
+			return image.Rectangle{}, fmt.Errorf("%s: invalid area '%s', expected 'x,y,w,h'", ex, value)
+		}
+		n[i] = v
+	}
+	return image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3]), nil
+}
+
+// Builds the mask of the areas given with --ignore and of the image given
+// with --mask, nil when there are none
+func load_mask(areas []string, path string) (*Mask, error) {
+	if len(areas) == 0 && path == "" {
+		return nil, nil
+	}
+
+	mask := &Mask{}
+	for _, area := range areas {
+		r, err := parse_rect(area)
+		if err != nil {
+			return nil, err
+		}
+		mask.Rects = append(mask.Rects, r)
+	}
+
+	if path != "" {
+		img, err := load_image(path)
+		if err != nil {
+			return nil, err
+		}
+		mask.Image = img
+	}
+	return mask, nil
+}
+
+// Whether the pixel at x, y is left out
+func (m *Mask) ignored(x, y int) bool {
+	if m == nil {
+		return false
+	}
+
+	p := image.Pt(x, y)
+	for _, r := range m.Rects {
+		if p.In(r) {
+			return true
+		}
+	}
+
+	if m.Image != nil {
+		bounds := m.Image.Bounds()
+		p = p.Add(bounds.Min)
+		if p.In(bounds) {
+			c := nespal.ToRGB(m.Image.At(p.X, p.Y))
+			return c.R != 0 || c.G != 0 || c.B != 0
+		}
+	}
+	return false
+}
+
+// Reads the rows of an image without the pixels a mask leaves out
+type masked_rows struct {
+	nespal.RowReader
+	mask *Mask
+	y    int
+	row  []color.RGBA
+}
+
+func (r *masked_rows) NextRow() ([]color.RGBA, error) {
+	row, err := r.RowReader.NextRow()
+	if err != nil {
+		return nil, err
+	}
+
+	r.row = r.row[:0]
+	for x, c := range row {
+		if !r.mask.ignored(x, r.y) {
+			r.row = append(r.row, c)
+		}
+	}
+	r.y++
+	return r.row, nil
+}
+
+// Leaves the pixels of rows that mask ignores out, rows is returned as is
+// when there is no mask
+func mask_rows(rows nespal.RowReader, mask *Mask) nespal.RowReader {
+	if mask == nil {
+		return rows
+	}
+	return &masked_rows{RowReader: rows, mask: mask}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Bytes taken by every pixel of an image decoded whole: the decoded image,
+// the copy the pre-passes and the remap work on and the remapped image
+const BYTES_PER_PIXEL = 12
+
+// Memory the decoded images of batches and of the web UI can take at the
+// same time, as given with --max-memory
+var max_memory string
+
+// Budget of --max-memory, nil when there is no limit
+var memory_budget *MemoryBudget
+
+// Sets up the budget given with --max-memory, if any
+func setup_memory_budget() error {
+	if max_memory == "" {
+		return nil
+	}
+	total, ok := parse_bytes(max_memory)
+	if !ok {
+		return fmt.Errorf("%s: invalid value '%s' for '--max-memory' flag, expected bytes or a size like '512M' or '2G'", ex, max_memory)
+	}
+	memory_budget = new_memory_budget(total)
+	return nil
+}
+
+// Parses a size in bytes, with an optional K, M or G suffix for KiB, MiB
+// and GiB, like "512M" or "2G"
+func parse_bytes(value string) (int64, bool) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B")
+	s = strings.TrimSuffix(s, "I")
+	unit := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			unit = 1 << 10
+		case 'M':
+			unit = 1 << 20
+		case 'G':
+			unit = 1 << 30
+		}
+		if unit > 1 {
+			s = s[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n <= 0 || n > (1<<62)/unit {
+		return 0, false
+	}
+	return n * unit, true
+}
+
+// Memory shared by the images processed at the same time. Images wait in
+// order for the memory they take, so a large one is not starved by the
+// smaller ones behind it
+type MemoryBudget struct {
+	mu      sync.Mutex
+	free    int64
+	total   int64
+	waiters []*memory_waiter
+}
+
+type memory_waiter struct {
+	n     int64
+	ready chan struct{}
+}
+
+func new_memory_budget(total int64) *MemoryBudget {
+	return &MemoryBudget{free: total, total: total}
+}
+
+// Takes n bytes of the budget, waiting until they are free or ctx is done.
+// Images larger than the whole budget take all of it, so they are
+// processed alone. Returns the function giving the memory back
+func (b *MemoryBudget) acquire(ctx context.Context, n int64) (func(), error) {
+	n = min(max(n, 1), b.total)
+	release := func() { b.release(n) }
+
+	b.mu.Lock()
+	if len(b.waiters) == 0 && b.free >= n {
+		b.free -= n
+		b.mu.Unlock()
+		return release, nil
+	}
+	w := &memory_waiter{n, make(chan struct{})}
+	b.waiters = append(b.waiters, w)
+	b.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return release, nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		select {
+		case <-w.ready:
+			// granted while ctx was done
+			b.free += n
+		default:
+			i := slices.Index(b.waiters, w)
+			b.waiters = slices.Delete(b.waiters, i, i+1)
+		}
+		// the waiters behind it may fit now
+		b.grant()
+		b.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+func (b *MemoryBudget) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.free += n
+	b.grant()
+}
+
+// Gives the free memory to the waiters in order, with the lock held
+func (b *MemoryBudget) grant() {
+	for len(b.waiters) > 0 && b.free >= b.waiters[0].n {
+		w := b.waiters[0]
+		b.free -= w.n
+		b.waiters = b.waiters[1:]
+		close(w.ready)
+	}
+}
+
+// Returns the memory an image of size takes, only a band of rows when
+// streamed
+func image_memory(size image.Point, streamed bool) int64 {
+	rows := int64(size.Y)
+	if streamed {
+		rows = min(rows, nespal.BAND_ROWS)
+	}
+	return int64(size.X) * rows * BYTES_PER_PIXEL
+}
+
+// Takes the memory an image of size needs from the budget, waiting for it
+// when there is a budget. An image whose size can not be told, zero, takes
+// the whole budget
+func reserve_memory(ctx context.Context, size image.Point, streamed bool) (func(), error) {
+	if memory_budget == nil {
+		return func() {}, nil
+	}
+	n := image_memory(size, streamed)
+	if size.X <= 0 || size.Y <= 0 {
+		n = memory_budget.total
+	}
+	return memory_budget.acquire(ctx, n)
+}
+
+// Returns the size of the image at path without decoding it, zero when it
+// can not be told, and whether it can be read row by row. TIFF files are as
+// large as all their pages, which are decoded together
+func image_size(path string) (image.Point, bool) {
+	if raw_format != nil {
+		return image.Pt(raw_format.Width, raw_format.Height), true
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".tif" || ext == ".tiff" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return image.Point{}, false
+		}
+		return tiff_size(data), false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return image.Point{}, false
+	}
+	defer file.Close()
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return image.Point{}, false
+	}
+	// only PNGs are decoded while read
+	return image.Pt(config.Width, config.Height), strings.ToLower(filepath.Ext(path)) == ".png"
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageSize(t *testing.T) {
+	dir := t.TempDir()
+	tiff := filepath.Join(dir, "scan.tif")
+	write_tiff(t, tiff, 0, 128, 255)
+	unknown := filepath.Join(dir, "sprite.bin")
+	if err := os.WriteFile(unknown, []byte("not an image"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// every page of a TIFF file is decoded at once
+	if size, _ := image_size(tiff); size != image.Pt(4, 12) {
+		t.Fatalf("%s: got %v, want (4,12)", tiff, size)
+	}
+	if size, _ := image_size(unknown); size != (image.Point{}) {
+		t.Fatalf("%s: got %v, want zero", unknown, size)
+	}
+}
+
+func TestReserveMemoryUnknownSize(t *testing.T) {
+	memory_budget = new_memory_budget(1 << 20)
+	t.Cleanup(func() { memory_budget = nil })
+
+	release, err := reserve_memory(context.Background(), image.Point{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if memory_budget.free != 0 {
+		t.Fatalf("%d bytes left free, want the whole budget taken", memory_budget.free)
+	}
+
+	// so even a small image waits for it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := reserve_memory(ctx, image.Pt(4, 4), false); err == nil {
+		t.Fatal("got memory while the whole budget was taken")
+	}
+	release()
+	release, err = reserve_memory(context.Background(), image.Pt(4, 4), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if memory_budget.free != memory_budget.total {
+		t.Fatalf("%d bytes free, want %d", memory_budget.free, memory_budget.total)
+	}
+}
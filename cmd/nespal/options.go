@@ -0,0 +1,421 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"maps"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Parses a RGB color written in hexadecimal, like "#7C3F9F"
+func parse_hex_color(value string) (color.RGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(value), "#")
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil || len(hex) != 6 {
+		return color.RGBA{}, fmt.Errorf("%s: invalid color '%s', expected '#RRGGBB'", ex, value)
+	}
+	return color.RGBA{uint8(n >> 16), uint8(n >> 8), uint8(n), 255}, nil
+}
+
+// Parses the value of --matte, a color like "#FFFFFF" or a NES palette index
+// like "$0F"
+func parse_matte(value string) (*nespal.Matte, error) {
+	digits := strings.TrimSpace(value)
+	if strings.HasPrefix(digits, "#") || len(digits) == 6 {
+		c, err := parse_hex_color(digits)
+		if err != nil {
+			return nil, err
+		}
+		return &nespal.Matte{Index: -1, Color: c}, nil
+	}
+
+	i, err := parse_nes_index(digits)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid value '%s' for '--matte' flag, expected a color like '#FFFFFF' or a NES palette index like '$0F'", ex, value)
+	}
+	return &nespal.Matte{Index: i}, nil
+}
+
+// Parses pairs of source color and NES palette index, like "#000000=>$0F"
+func parse_keep(values []string) (map[color.RGBA]uint8, error) {
+	keep := make(map[color.RGBA]uint8, len(values))
+	for _, v := range values {
+		src, dst, found := strings.Cut(v, "=>")
+		if !found {
+			return nil, fmt.Errorf("%s: invalid value '%s' for '--keep' flag, expected '#RRGGBB=>$XX'", ex, v)
+		}
+
+		c, err := parse_hex_color(src)
+		if err != nil {
+			return nil, err
+		}
+		i, err := parse_nes_index(dst)
+		if err != nil {
+			return nil, err
+		}
+		keep[c] = uint8(i)
+	}
+	return keep, nil
+}
+
+// Loads a JSON object mapping source colors to NES palette indexes, like
+// {"#000000": "$0F", "#FFFFFF": 48}
+func load_color_map(path string) (map[color.RGBA]uint8, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries map[string]any
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("%s: invalid color mapping file '%s': %w", ex, path, err)
+	}
+
+	mapping := make(map[color.RGBA]uint8, len(entries))
+	for src, dst := range entries {
+		c, err := parse_hex_color(src)
+		if err != nil {
+			return nil, err
+		}
+
+		var i int
+		switch v := dst.(type) {
+		case string:
+			if i, err = parse_nes_index(v); err != nil {
+				return nil, err
+			}
+		case float64:
+			if v != math.Trunc(v) || v < 0 || v >= nespal.PALETTE_SIZE {
+				return nil, fmt.Errorf("%s: invalid NES palette index '%v' for color '%s'", ex, v, src)
+			}
+			i = int(v)
+		default:
+			return nil, fmt.Errorf("%s: invalid NES palette index '%v' for color '%s'", ex, dst, src)
+		}
+		mapping[c] = uint8(i)
+	}
+	return mapping, nil
+}
+
+// Parses background sub-palettes separated by ';', each a list of NES
+// palette indexes like "0F,21,11,30", into the indexes a frame using them
+// can show: the backdrop, the first color of the first sub-palette, and the
+// three other colors of every sub-palette. As on the NES, the first colors
+// of the other sub-palettes are not shown
+func parse_subpals(value string) ([]int, error) {
+	specs := strings.Split(value, ";")
+	if len(specs) > SUBPALETTES {
+		return nil, fmt.Errorf("%s: invalid value '%s' for '--subpals' flag, expected at most %d sub-palettes", ex, value, SUBPALETTES)
+	}
+
+	indices := []int{}
+	for i, spec := range specs {
+		subpal, err := parse_nes_indices(strings.Split(spec, ","))
+		if err != nil {
+			return nil, err
+		}
+		if len(subpal) != 4 {
+			return nil, fmt.Errorf("%s: invalid sub-palette '%s', expected 4 NES palette indexes", ex, spec)
+		}
+		if i > 0 {
+			subpal = subpal[1:]
+		}
+		for _, c := range subpal {
+			if !slices.Contains(indices, c) {
+				indices = append(indices, c)
+			}
+		}
+	}
+	return indices, nil
+}
+
+// Keeps the grays of the NES palette in indices, or of every NES palette
+// index when indices is empty: the $x0 and $xD columns and the $0F black
+func gray_indices(indices []int) []int {
+	if len(indices) == 0 {
+		for i := range nespal.PALETTE_SIZE {
+			indices = append(indices, i)
+		}
+	}
+
+	res := make([]int, 0, 9)
+	for _, i := range indices {
+		if i&0x0F == 0x00 || i&0x0F == 0x0D || i == 0x0F {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// Removes the excluded indexes from indices, or from every NES palette
+// index when indices is empty
+func exclude_indices(indices []int, excluded []int) ([]int, error) {
+	if len(indices) == 0 {
+		for i := range nespal.PALETTE_SIZE {
+			indices = append(indices, i)
+		}
+	}
+
+	res := make([]int, 0, len(indices))
+	for _, i := range indices {
+		if !slices.Contains(excluded, i) {
+			res = append(res, i)
+		}
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("%s: every NES palette index is excluded", ex)
+	}
+	return res, nil
+}
+
+// NES palette indexes that upset real hardware: $0D is darker than black,
+// which some CRTs and NTSC decoders take for the sync signal and lose the
+// picture over
+var unsafe_indices = []int{0x0D}
+
+// Returns the flag keeping the NES palette index i out of remaps, if any
+func (opts RemapOptions) unusable(i int) string {
+	if slices.Contains(opts.Forbidden, i) {
+		return "--forbid"
+	}
+	if slices.Contains(opts.Unsafe, i) {
+		return "--safe-colors"
+	}
+	return ""
+}
+
+// Defines the flags of the grid of the NES background constraints, the
+// returned function builds it once the flags are parsed
+func grid_flags(flags *pflag.FlagSet) func() (Grid, error) {
+	tile := flags.Int("tile-size", TILE_SIZE, "Size in pixels of the background tiles")
+	attr := flags.Int("attr-size", ATTR_SIZE, "Size in pixels of the areas sharing a sub-palette, 8 for MMC5 ExAttributes")
+	offset := flags.String("grid-offset", "0,0", "Pixel where the grid starts, as 'x,y', for frames scrolled mid-tile")
+
+	return func() (Grid, error) {
+		if *tile <= 0 {
+			return Grid{}, fmt.Errorf("%s: invalid value %d for '--tile-size' flag", ex, *tile)
+		}
+		if *attr <= 0 || *attr%*tile != 0 {
+			return Grid{}, fmt.Errorf("%s: invalid value %d for '--attr-size' flag, expected a multiple of the %d tile size", ex, *attr, *tile)
+		}
+
+		x, y, found := strings.Cut(*offset, ",")
+		ox, err_x := strconv.Atoi(strings.TrimSpace(x))
+		oy, err_y := strconv.Atoi(strings.TrimSpace(y))
+		if !found || err_x != nil || err_y != nil || ox < 0 || oy < 0 {
+			return Grid{}, fmt.Errorf("%s: invalid value '%s' for '--grid-offset' flag, expected 'x,y'", ex, *offset)
+		}
+		return Grid{*tile, *attr, image.Pt(ox, oy)}, nil
+	}
+}
+
+// Defines the flags adjusting an image before its colors are matched, the
+// returned function builds the pre-passes once the flags are parsed
+func pre_flags(flags *pflag.FlagSet) func() ([]nespal.PrePass, error) {
+	pre := flags.StringSlice("pre", nil, "Pre-passes applied before remapping, like 'grayscale:luma'")
+	brightness := flags.Float64("brightness", 0, "Brightness adjustment in percent, from -100 to 100")
+	contrast := flags.Float64("contrast", 0, "Contrast adjustment in percent, from -100 to 100")
+	saturation := flags.Float64("saturation", 0, "Saturation adjustment in percent, from -100 to 100")
+	levels := flags.Bool("auto-levels", false, "Stretch the colors to the full range and remove color casts")
+	hue_shift := flags.Float64("hue-shift", 0, "Hue rotation in degrees")
+	denoise := flags.String("denoise", "", "Reduce noise before anything else, as a strength from 1 to 10, 'median' or 'bilateral', like '--denoise=bilateral:2'")
+	flags.Lookup("denoise").NoOptDefVal = DENOISE_MEDIAN
+
+	return func() ([]nespal.PrePass, error) {
+		passes := []nespal.PrePass{}
+		// noise would skew the levels and every other pass
+		if *denoise != "" {
+			pass, err := parse_denoise(*denoise)
+			if err != nil {
+				return nil, err
+			}
+			passes = append(passes, pass)
+		}
+		if *levels {
+			passes = append(passes, auto_levels)
+		}
+
+		for _, spec := range *pre {
+			pass, err := parse_pre_pass(spec)
+			if err != nil {
+				return nil, err
+			}
+			passes = append(passes, pass)
+		}
+
+		for _, adjustment := range []struct {
+			name  string
+			value float64
+		}{{"brightness", *brightness}, {"contrast", *contrast}, {"saturation", *saturation}} {
+			if adjustment.value < -100 || adjustment.value > 100 {
+				return nil, fmt.Errorf("%s: value %v for '--%s' flag is out of the -100 to 100 range", ex, adjustment.value, adjustment.name)
+			}
+		}
+		if *brightness != 0 || *contrast != 0 || *saturation != 0 {
+			passes = append(passes, adjust_pass(*brightness, *contrast, *saturation))
+		}
+		if *hue_shift != 0 {
+			passes = append(passes, hue_shift_pass(*hue_shift))
+		}
+
+		return passes, nil
+	}
+}
+
+// Defines the flags shared by the commands that remap images, the
+// returned function builds the options once the flags are parsed
+func remap_flags(flags *pflag.FlagSet) func() (RemapOptions, error) {
+	indices := flags.StringSlice("indices", nil, "Only remap to these NES palette indexes")
+	exclude := flags.StringSlice("exclude", nil, "Never remap to these NES palette indexes")
+	forbid := flags.StringSlice("forbid", nil, "NES palette indexes reserved by the project, never used nor kept")
+	subpals := flags.String("subpals", "", "Only remap to the colors of background sub-palettes, like '0F,21,11,30;0F,16,27,18'")
+	keep := flags.StringSlice("keep", nil, "Always remap a color to a NES palette index, like '#000000=>$0F'")
+	mapping := flags.String("map", "", "JSON file mapping colors to NES palette indexes")
+	dither := flags.String("dither", nespal.DITHER_NONE, "Dithering method: none, floyd-steinberg, ordered or noise")
+	seed := flags.Uint64("seed", 0, "Seed of the dithering noise")
+	metric := flags.String("metric", nespal.DEFAULT_METRIC, "Color distance metric: "+strings.Join(nespal.MetricNames(), ", "))
+	gray_column := flags.Bool("gray-column", false, "Only remap to the grays of the NES palette")
+	safe_colors := flags.Bool("safe-colors", false, "Never remap to $0D, which upsets real hardware")
+	simulate := flags.String("simulate", "", "Show the output as seen with a color vision deficiency: "+strings.Join(nespal.Deficiencies, ", "))
+	matte := flags.String("matte", "", "Color or NES palette index the image is composited over before matching, like '#FFFFFF' or '$0F'")
+	alpha_threshold := flags.Int("alpha-threshold", 0, "Alpha from 1 to 255 from which pixels are opaque, the ones below are transparent")
+	pre_passes := pre_flags(flags)
+
+	return func() (RemapOptions, error) {
+		var err error
+		opts := RemapOptions{Options: nespal.Options{Dither: *dither, Seed: *seed, Simulate: *simulate}}
+
+		switch *dither {
+		case nespal.DITHER_NONE, nespal.DITHER_FLOYD_STEINBERG, nespal.DITHER_ORDERED, nespal.DITHER_NOISE:
+		default:
+			return opts, fmt.Errorf("%s: invalid value '%s' for '--dither' flag", ex, *dither)
+		}
+
+		if *simulate != "" && !slices.Contains(nespal.Deficiencies, *simulate) {
+			return opts, fmt.Errorf("%s: invalid value '%s' for '--simulate' flag, expected one of: %s", ex, *simulate, strings.Join(nespal.Deficiencies, ", "))
+		}
+
+		if opts.Metric, err = nespal.GetMetric(*metric); err != nil {
+			return opts, err
+		}
+
+		if len(*indices) > 0 && *subpals != "" {
+			return opts, fmt.Errorf("%s: flags '--indices' and '--subpals' can not be used together", ex)
+		}
+
+		if len(*indices) > 0 {
+			if opts.Indices, err = parse_nes_indices(*indices); err != nil {
+				return opts, err
+			}
+		}
+
+		if *subpals != "" {
+			if opts.Indices, err = parse_subpals(*subpals); err != nil {
+				return opts, err
+			}
+		}
+
+		if *gray_column {
+			opts.Indices = gray_indices(opts.Indices)
+		}
+
+		if len(*exclude) > 0 {
+			excluded, err := parse_nes_indices(*exclude)
+			if err != nil {
+				return opts, err
+			}
+			if opts.Indices, err = exclude_indices(opts.Indices, excluded); err != nil {
+				return opts, err
+			}
+		}
+
+		if len(*forbid) > 0 {
+			if opts.Forbidden, err = parse_nes_indices(*forbid); err != nil {
+				return opts, err
+			}
+			if *subpals != "" {
+				for _, i := range opts.Indices {
+					if slices.Contains(opts.Forbidden, i) {
+						return opts, fmt.Errorf("%s: sub-palettes use $%02X, which '--forbid' reserves", ex, i)
+					}
+				}
+			}
+			if opts.Indices, err = exclude_indices(opts.Indices, opts.Forbidden); err != nil {
+				return opts, err
+			}
+		}
+
+		if *safe_colors {
+			// the unsafe indexes still matter to count the pixels that would
+			// have used them
+			for _, i := range unsafe_indices {
+				if len(opts.Indices) == 0 || slices.Contains(opts.Indices, i) {
+					opts.Unsafe = append(opts.Unsafe, i)
+				}
+			}
+			if opts.Indices, err = exclude_indices(opts.Indices, unsafe_indices); err != nil {
+				return opts, err
+			}
+		}
+
+		if opts.Pre, err = pre_passes(); err != nil {
+			return opts, err
+		}
+
+		if *matte != "" {
+			if flags.Changed("alpha-threshold") {
+				return opts, fmt.Errorf("%s: flags '--matte' and '--alpha-threshold' can not be used together", ex)
+			}
+			if opts.Matte, err = parse_matte(*matte); err != nil {
+				return opts, err
+			}
+		}
+
+		if flags.Changed("alpha-threshold") {
+			if *alpha_threshold < 1 || *alpha_threshold > 255 {
+				return opts, fmt.Errorf("%s: value %d for '--alpha-threshold' flag is out of the 1 to 255 range", ex, *alpha_threshold)
+			}
+			threshold := uint8(*alpha_threshold)
+			opts.AlphaThreshold = &threshold
+			// before the other passes, which keep the alpha of the pixels
+			opts.Pre = append([]nespal.PrePass{alpha_threshold_pass(threshold)}, opts.Pre...)
+		}
+
+		if *mapping != "" {
+			if opts.Keep, err = load_color_map(*mapping); err != nil {
+				return opts, err
+			}
+		}
+
+		// the colors given in the command line take precedence over the file
+		if len(*keep) > 0 {
+			keep, err := parse_keep(*keep)
+			if err != nil {
+				return opts, err
+			}
+			if opts.Keep == nil {
+				opts.Keep = keep
+			} else {
+				maps.Copy(opts.Keep, keep)
+			}
+		}
+
+		for c, i := range opts.Keep {
+			if flag := opts.unusable(int(i)); flag != "" {
+				return opts, fmt.Errorf("%s: color '#%02X%02X%02X' is kept as $%02X, which '%s' never uses", ex, c.R, c.G, c.B, i, flag)
+			}
+		}
+
+		return opts, nil
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+const (
+	PACK   = "pack"
+	UNPACK = "unpack"
+	KEYGEN = "keygen"
+)
+
+// Extension of palette packs, zip archives of .pal files along with a
+// manifest describing them
+const PACK_EXT = ".nespalpack"
+
+// Name of the manifest of palette packs
+const PACK_MANIFEST = "manifest.json"
+
+// Name of the ed25519 signature of the manifest of signed palette packs
+const PACK_SIGNATURE = "manifest.sig"
+
+// Public key the packs must be signed with, if any, set with --verify-key
+var verify_key string
+
+// A palette of a pack, stored in the pack as its name followed by .pal
+type PackPalette struct {
+	Name    string `json:"name"`
+	Author  string `json:"author,omitempty"`
+	License string `json:"license,omitempty"`
+	// TV system the palette was made for: ntsc, pal, dendy or vs
+	Region string `json:"region,omitempty"`
+	// Whether the file has the 8 emphasis banks after the 64 colors
+	Emphasis bool `json:"emphasis,omitempty"`
+	// Hash of the .pal file, so a signed manifest covers the palettes too
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// The manifest of a palette pack
+type PackManifest struct {
+	Name string `json:"name"`
+	// Version of the pack, compared by palette update
+	Version  string        `json:"version,omitempty"`
+	Author   string        `json:"author,omitempty"`
+	License  string        `json:"license,omitempty"`
+	Palettes []PackPalette `json:"palettes"`
+}
+
+// Reads an ed25519 key written as base64 in the file at path, size bytes
+// long once decoded
+func read_key(path string, size int) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != size {
+		return nil, fmt.Errorf("%s: invalid key '%s', expected %d bytes in base64", ex, path, size)
+	}
+	return key, nil
+}
+
+// Writes a new key pair, the private key to name.key and the public one to
+// name.pub
+func keygen(name string) error {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(name+".key", []byte(base64.StdEncoding.EncodeToString(private.Seed())+"\n"), 0o600); err != nil {
+		return err
+	}
+	return os.WriteFile(name+".pub", []byte(base64.StdEncoding.EncodeToString(public)+"\n"), 0o644)
+}
+
+// Reads and checks the manifest of the pack in fsys, named name, and the
+// hashes of its palettes. With --verify-key, the manifest must be signed
+// with the key
+func read_pack_manifest(fsys fs.FS, name string) (*PackManifest, error) {
+	data, err := fs.ReadFile(fsys, PACK_MANIFEST)
+	if err != nil {
+		return nil, fmt.Errorf("%s: palette pack '%s' has no %s: %w", ex, name, PACK_MANIFEST, err)
+	}
+
+	if verify_key != "" {
+		public, err := read_key(verify_key, ed25519.PublicKeySize)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := fs.ReadFile(fsys, PACK_SIGNATURE)
+		if err != nil {
+			return nil, fmt.Errorf("%s: palette pack '%s' is not signed", ex, name)
+		}
+		if !ed25519.Verify(public, data, signature) {
+			return nil, fmt.Errorf("%s: palette pack '%s' is not signed with the key '%s'", ex, name, verify_key)
+		}
+	}
+
+	var manifest PackManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("%s: palette pack '%s': invalid %s: %w", ex, name, PACK_MANIFEST, err)
+	}
+	for _, p := range manifest.Palettes {
+		if p.Name == "" || filepath.Base(p.Name) != p.Name || p.Name == ".." {
+			return nil, fmt.Errorf("%s: palette pack '%s': invalid palette name '%s'", ex, name, p.Name)
+		}
+		if p.Region != "" && !slices.Contains(regions, p.Region) {
+			return nil, fmt.Errorf("%s: palette pack '%s': invalid region '%s' for '%s', expected one of: %s", ex, name, p.Region, p.Name, strings.Join(regions, ", "))
+		}
+		content, err := fs.ReadFile(fsys, p.Name+".pal")
+		if err != nil {
+			return nil, fmt.Errorf("%s: palette pack '%s': missing palette '%s'", ex, name, p.Name)
+		}
+		if p.SHA256 != "" && p.SHA256 != fmt.Sprintf("%x", sha256.Sum256(content)) {
+			return nil, fmt.Errorf("%s: palette pack '%s': palette '%s' does not match its hash", ex, name, p.Name)
+		}
+		if verify_key != "" && p.SHA256 == "" {
+			return nil, fmt.Errorf("%s: palette pack '%s': palette '%s' has no hash to verify", ex, name, p.Name)
+		}
+	}
+	return &manifest, nil
+}
+
+// The palettes of a pack listed in its manifest, the other files of the
+// pack can not be opened, so they are never loaded unverified
+type pack_fs struct {
+	fsys     fs.FS
+	manifest *PackManifest
+}
+
+// Returns the palette of the manifest stored in the file name, if any
+func (p pack_fs) palette(name string) (PackPalette, bool) {
+	for _, pal := range p.manifest.Palettes {
+		if pal.Name+".pal" == name {
+			return pal, true
+		}
+	}
+	return PackPalette{}, false
+}
+
+func (p pack_fs) Open(name string) (fs.File, error) {
+	if _, ok := p.palette(name); !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return p.fsys.Open(name)
+}
+
+func (p pack_fs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries, err := fs.ReadDir(p.fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(entries, func(e fs.DirEntry) bool {
+		_, ok := p.palette(e.Name())
+		return e.IsDir() || !ok
+	}), nil
+}
+
+// Returns the region the manifest gives the palette stored in the file
+// name, if any
+func (p pack_fs) region(name string) string {
+	pal, _ := p.palette(name)
+	return pal.Region
+}
+
+// Returns the palettes of the pack in fsys, named name, once its manifest
+// is checked
+func open_pack(fsys fs.FS, name string) fs.FS {
+	manifest, err := read_pack_manifest(fsys, name)
+	if err != nil {
+		return error_fs{err}
+	}
+	return pack_fs{fsys, manifest}
+}
+
+// Writes a pack of the palettes in manifest, whose .pal files are in data
+// in the same order, with the manifest signed with key unless it is nil
+func write_pack(w io.Writer, manifest PackManifest, data [][]byte, key ed25519.PrivateKey) error {
+	encoded, err := json.MarshalIndent(manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	encoded = append(encoded, '\n')
+
+	zw := zip.NewWriter(w)
+	file, err := zw.Create(PACK_MANIFEST)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(encoded); err != nil {
+		return err
+	}
+
+	if key != nil {
+		file, err := zw.Create(PACK_SIGNATURE)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(ed25519.Sign(key, encoded)); err != nil {
+			return err
+		}
+	}
+
+	for i, p := range manifest.Palettes {
+		file, err := zw.Create(p.Name + ".pal")
+		if err != nil {
+			return err
+		}
+		if _, err := file.Write(data[i]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Makes the pack at path from the palettes given by name or as .pal
+// files, with the name, author and license of the pack given to each of
+// them. The pack is signed with the private key at key_path, if given
+func make_pack(path string, args []string, manifest PackManifest, key_path string) error {
+	var key ed25519.PrivateKey
+	if key_path != "" {
+		seed, err := read_key(key_path, ed25519.SeedSize)
+		if err != nil {
+			return err
+		}
+		key = ed25519.NewKeyFromSeed(seed)
+	}
+
+	data := make([][]byte, 0, len(args))
+	for _, arg := range args {
+		pal, name, err := open_palette(arg)
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(pal)
+		pal.Close()
+		if err != nil {
+			return err
+		}
+		// packs are only made of palettes that read the same everywhere
+		if _, _, err := parse_palette(content, true); err != nil {
+			if perr, ok := err.(*PaletteError); ok {
+				perr.Name = name
+			}
+			return err
+		}
+
+		for _, p := range manifest.Palettes {
+			if strings.EqualFold(p.Name, name) {
+				return fmt.Errorf("%s: palette '%s' is given twice", ex, name)
+			}
+		}
+		manifest.Palettes = append(manifest.Palettes, PackPalette{
+			Name:     name,
+			Author:   manifest.Author,
+			License:  manifest.License,
+			Region:   palette_arg_region(arg, name),
+			Emphasis: len(content) == nespal.PALETTE_SIZE*3*EMPHASIS_BANKS,
+			SHA256:   fmt.Sprintf("%x", sha256.Sum256(content)),
+		})
+		data = append(data, content)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := write_pack(file, manifest, data, key); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Writes the manifest and palettes of the pack at path into dir
+func unpack(path string, dir string) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	manifest, err := read_pack_manifest(archive, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	files := []string{PACK_MANIFEST}
+	if _, err := fs.Stat(archive, PACK_SIGNATURE); err == nil {
+		files = append(files, PACK_SIGNATURE)
+	}
+	for _, p := range manifest.Palettes {
+		files = append(files, p.Name+".pal")
+	}
+	for _, name := range files {
+		data, err := fs.ReadFile(archive, name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
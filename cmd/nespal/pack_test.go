@@ -0,0 +1,171 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Writes a pack of files along with the manifest, signed with key unless
+// it is nil, to a temporary directory and returns its path
+func build_pack(t *testing.T, manifest PackManifest, files map[string][]byte, key ed25519.PrivateKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test"+PACK_EXT)
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := map[string][]byte{PACK_MANIFEST: encoded}
+	if key != nil {
+		contents[PACK_SIGNATURE] = ed25519.Sign(key, encoded)
+	}
+	for name, data := range files {
+		contents[name] = data
+	}
+
+	zw := zip.NewWriter(file)
+	for name, data := range contents {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Writes a public key as read_key reads it and returns its path
+func write_public_key(t *testing.T, key ed25519.PublicKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.pub")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPackVerification(t *testing.T) {
+	pal, _, err := open_palette("FCEUX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, nespal.PALETTE_SIZE*3)
+	_, err = pal.Read(data)
+	pal.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	evil := slices.Repeat([]byte{0xFF, 0, 0xFF}, nespal.PALETTE_SIZE)
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest := PackManifest{Name: "test", Palettes: []PackPalette{{Name: "Custom", Region: REGION_PAL, SHA256: sum}}}
+	unhashed := PackManifest{Name: "test", Palettes: []PackPalette{{Name: "Custom"}}}
+
+	tests := []struct {
+		name     string
+		manifest PackManifest
+		files    map[string][]byte
+		sign     bool
+		verify   ed25519.PublicKey
+		// palettes listed from the pack, or the error
+		want []string
+		err  string
+	}{
+		{"signed", manifest, map[string][]byte{"Custom.pal": data}, true, public, []string{"Custom"}, ""},
+		{"unsigned", manifest, map[string][]byte{"Custom.pal": data}, false, nil, []string{"Custom"}, ""},
+		{"unlisted palette", manifest, map[string][]byte{"Custom.pal": data, "evil.pal": evil}, true, public, []string{"Custom"}, ""},
+		{"unlisted palette unsigned", manifest, map[string][]byte{"Custom.pal": data, "sub/evil.pal": evil, "evil.pal": evil}, false, nil, []string{"Custom"}, ""},
+		{"not signed", manifest, map[string][]byte{"Custom.pal": data}, false, public, nil, "is not signed"},
+		{"other key", manifest, map[string][]byte{"Custom.pal": data}, true, other, nil, "is not signed with the key"},
+		{"changed palette", manifest, map[string][]byte{"Custom.pal": evil}, true, public, nil, "does not match its hash"},
+		{"no hash", unhashed, map[string][]byte{"Custom.pal": data}, true, public, nil, "has no hash to verify"},
+		{"missing palette", manifest, map[string][]byte{"evil.pal": evil}, true, public, nil, "missing palette 'Custom'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var key ed25519.PrivateKey
+			if test.sign {
+				key = private
+			}
+			path := build_pack(t, test.manifest, test.files, key)
+
+			verify_key = ""
+			if test.verify != nil {
+				verify_key = write_public_key(t, test.verify)
+			}
+			saved_dirs, saved_reproducible := palette_dirs, reproducible
+			palette_dirs, reproducible = []string{path}, true
+			t.Cleanup(func() {
+				verify_key, palette_dirs, reproducible = "", saved_dirs, saved_reproducible
+			})
+
+			entries, err := available_palettes()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error '%v', want '%s'", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := []string{}
+			for _, entry := range entries {
+				if entry.fsys == palette_dir(path) {
+					got = append(got, entry.Name)
+					if entry.Region != REGION_PAL {
+						t.Errorf("region of %s is '%s', want '%s'", entry.Name, entry.Region, REGION_PAL)
+					}
+				}
+			}
+			if !slices.Equal(got, test.want) {
+				t.Errorf("palettes %v, want %v", got, test.want)
+			}
+
+			fsys := palette_dir(path)
+			if _, err := fsys.Open("evil.pal"); err == nil {
+				t.Error("unlisted palette opened")
+			}
+			if file, err := find_palette("evil"); err != nil || file != nil {
+				t.Errorf("unlisted palette found: %v", err)
+			}
+
+			// the region of the manifest only applies to the palette of the
+			// pack, not to the others of the same name
+			if region := palette_region("Custom"); region != REGION_NTSC {
+				t.Errorf("region told by the name is '%s', want '%s'", region, REGION_NTSC)
+			}
+		})
+	}
+}
@@ -0,0 +1,1179 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+const (
+	LINT       = "lint"
+	DUPES      = "dupes"
+	ACCESSIBLE = "accessible"
+	MATRIX     = "matrix"
+	CLUSTERS   = "clusters"
+	SWATCH     = "swatch"
+	CONVERT    = "convert"
+)
+
+// Delta E below which two palettes are reported as near-identical by
+// palette dupes, about the smallest difference the eye can notice
+const DUPES_THRESHOLD = 2.3
+
+// Mean delta E below which palettes are grouped in a family by palette
+// clusters
+const CLUSTERS_THRESHOLD = 10
+
+// TV systems palettes are made for
+const (
+	REGION_NTSC  = "ntsc"
+	REGION_PAL   = "pal"
+	REGION_DENDY = "dendy"
+	// The arcade machines built on the NES, the Vs. System and the
+	// PlayChoice-10, whose RGB PPUs have palettes of their own
+	REGION_VS = "vs"
+)
+
+var regions = []string{REGION_NTSC, REGION_PAL, REGION_DENDY, REGION_VS}
+
+// Returns the region a palette was made for, told by the words of its
+// name, like "PAL", "PAL30" or "EU", or an arcade PPU, like "2C04" or
+// "PC10", as .pal files carry no region of their own. Palettes naming no
+// region are NTSC ones, like the NES itself
+func palette_region(name string) string {
+	if arcade_ppu(name) != "" {
+		return REGION_VS
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	region := REGION_NTSC
+	for _, word := range words {
+		if word == "dendy" {
+			return REGION_DENDY
+		}
+		if rest, found := strings.CutPrefix(word, "pal"); (found && strings.Trim(rest, "0123456789") == "") || word == "eu" {
+			region = REGION_PAL
+		}
+	}
+	return region
+}
+
+// Whether a palette made for pal_region can be used for region. Dendy
+// consoles output PAL video, so the PAL palettes can be used for them too
+func region_matches(region string, pal_region string) bool {
+	return pal_region == region || (region == REGION_DENDY && pal_region == REGION_PAL)
+}
+
+// A color palette and the name it is known by
+type NamedPalette struct {
+	Name    string
+	Palette color.Palette
+	// Colors of the emphasis banks 1 to 7, when the palette has them
+	Emphasis []color.Palette
+	// Region given by the manifest of the pack of the palette, if any
+	Region string
+}
+
+// Returns the region the palette was made for, the one of its pack or
+// else the one told by its name
+func (p NamedPalette) region() string {
+	if p.Region != "" {
+		return p.Region
+	}
+	return palette_region(p.Name)
+}
+
+// A palette file found in the palette search path
+type PaletteEntry struct {
+	Name string
+	// Region given by the manifest of the pack of the palette, if any
+	Region string
+	fsys   fs.FS
+	path   string
+}
+
+func (e PaletteEntry) Open() (fs.File, error) { return e.fsys.Open(e.path) }
+
+// A palette directory that could not be opened, failing when read
+type error_fs struct {
+	err error
+}
+
+func (e error_fs) Open(name string) (fs.File, error) { return nil, e.err }
+
+var (
+	// zip archives of palettes opened so far, kept open until the end
+	zip_dirs    = map[string]fs.FS{}
+	zip_dirs_mu sync.Mutex
+)
+
+// Returns the palettes of dir, a directory, a zip archive of .pal files or
+// a palette pack
+func palette_dir(dir string) fs.FS {
+	ext := strings.ToLower(filepath.Ext(dir))
+	if ext != ".zip" && ext != PACK_EXT {
+		return os.DirFS(dir)
+	}
+
+	return open_archive(dir, func() (*zip.Reader, error) {
+		archive, err := zip.OpenReader(dir)
+		if err != nil {
+			return nil, err
+		}
+		return &archive.Reader, nil
+	})
+}
+
+// Returns the palettes of the archive called name, a zip archive of .pal
+// files or a palette pack, opened with open the first time only. Zip
+// archives whose .pal files are all in a single directory, as they are
+// often distributed, are read from that directory
+func open_archive(name string, open func() (*zip.Reader, error)) fs.FS {
+	zip_dirs_mu.Lock()
+	defer zip_dirs_mu.Unlock()
+	if fsys, ok := zip_dirs[name]; ok {
+		return fsys
+	}
+
+	var fsys fs.FS
+	archive, err := open()
+	if err != nil {
+		fsys = error_fs{err}
+	} else if strings.EqualFold(filepath.Ext(name), PACK_EXT) {
+		fsys = open_pack(archive, filepath.Base(name))
+	} else {
+		fsys = archive
+		for {
+			entries, err := fs.ReadDir(fsys, ".")
+			if err != nil || len(entries) != 1 || !entries[0].IsDir() {
+				break
+			}
+			if fsys, err = fs.Sub(fsys, entries[0].Name()); err != nil {
+				fsys = error_fs{err}
+				break
+			}
+		}
+	}
+	zip_dirs[name] = fsys
+	return fsys
+}
+
+// Returns where palettes are searched, in order: the directories given with
+// --palette-dir, the ones in NESPAL_PALETTE_PATH, the user palette directory
+// and at last the default palette list. With --reproducible only the
+// directories of the command line and the default palette list are used,
+// as the others change from machine to machine
+func palette_sources() []fs.FS {
+	sources := []fs.FS{}
+	for _, dir := range palette_dirs {
+		sources = append(sources, palette_dir(dir))
+	}
+
+	embedded, _ := fs.Sub(nespal.Palettes, "palettes")
+	if reproducible {
+		return append(sources, embedded)
+	}
+
+	for _, dir := range filepath.SplitList(os.Getenv("NESPAL_PALETTE_PATH")) {
+		if dir != "" {
+			sources = append(sources, palette_dir(dir))
+		}
+	}
+
+	if dir, err := user_palette_dir(); err == nil {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			sources = append(sources, os.DirFS(dir))
+		}
+	}
+
+	return append(sources, embedded)
+}
+
+// Returns every palette of the search path, the first palette found with a
+// name shadows the ones with the same name, ignoring case, found after it.
+// The palettes of the packs in a directory come after the .pal files of
+// the directory
+func available_palettes() ([]PaletteEntry, error) {
+	res := []PaletteEntry{}
+	seen := map[string]bool{}
+
+	for i, source := range palette_sources() {
+		entries, err := fs.ReadDir(source, ".")
+		if err != nil {
+			return nil, err
+		}
+
+		dirs := []fs.FS{source}
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.EqualFold(filepath.Ext(entry.Name()), PACK_EXT) {
+				continue
+			}
+			dirs = append(dirs, open_archive(fmt.Sprintf("%d/%s", i, entry.Name()), func() (*zip.Reader, error) {
+				data, err := fs.ReadFile(source, entry.Name())
+				if err != nil {
+					return nil, err
+				}
+				return zip.NewReader(bytes.NewReader(data), int64(len(data)))
+			}))
+		}
+
+		for _, fsys := range dirs {
+			entries, err := fs.ReadDir(fsys, ".")
+			if err != nil {
+				return nil, err
+			}
+
+			for _, entry := range entries {
+				name, found := strings.CutSuffix(entry.Name(), ".pal")
+				if entry.IsDir() || !found || seen[strings.ToLower(name)] {
+					continue
+				}
+				seen[strings.ToLower(name)] = true
+				pal := PaletteEntry{Name: name, fsys: fsys, path: entry.Name()}
+				if pack, ok := fsys.(pack_fs); ok {
+					pal.Region = pack.region(pal.path)
+				}
+				res = append(res, pal)
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// Loads every palette of the search path
+func load_palettes() ([]NamedPalette, error) {
+	entries, err := available_palettes()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]NamedPalette, 0, len(entries))
+	for _, entry := range entries {
+		file, err := entry.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		p, banks, err := load_palette_banks(file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, NamedPalette{entry.Name, p, banks, entry.Region})
+	}
+
+	return res, nil
+}
+
+// Returns the palette of the search path named name, ignoring case, nil
+// if there is no such palette
+func find_palette_entry(name string) (*PaletteEntry, error) {
+	entries, err := available_palettes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if strings.EqualFold(name, entry.Name) {
+			return &entry, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Opens the palette of the search path named name, ignoring case, returns
+// nil if there is no such palette
+func find_palette(name string) (fs.File, error) {
+	entry, err := find_palette_entry(name)
+	if err != nil || entry == nil {
+		return nil, err
+	}
+	return entry.Open()
+}
+
+// Returns the region of a palette given as arg to open_palette, which
+// named it name: the region of its pack for the palettes of the search
+// path, or else the one told by its name
+func palette_arg_region(arg string, name string) string {
+	if filepath.Ext(arg) != ".pal" {
+		if entry, err := find_palette_entry(strings.TrimSpace(arg)); err == nil && entry != nil && entry.Region != "" {
+			return entry.Region
+		}
+	}
+	return palette_region(name)
+}
+
+// Number of edits between a and b: inserted, deleted or replaced runes
+func edit_distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := range ra {
+		cur[0] = i + 1
+		for j := range rb {
+			cost := 1
+			if ra[i] == rb[j] {
+				cost = 0
+			}
+			cur[j+1] = min(prev[j+1]+1, cur[j]+1, prev[j]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(rb)]
+}
+
+// Returns the names of the palette search path closest to name, ignoring
+// case, at most max_suggestions of them, the closest first
+func suggest_palettes(name string) []string {
+	const max_suggestions = 3
+
+	entries, err := available_palettes()
+	if err != nil {
+		return nil
+	}
+
+	name = strings.ToLower(strings.TrimSpace(name))
+	// typos get more room the longer the name
+	limit := max(2, len([]rune(name))/3)
+	type suggestion struct {
+		name     string
+		distance int
+	}
+	suggestions := []suggestion{}
+	for _, entry := range entries {
+		candidate := strings.ToLower(entry.Name)
+		distance := edit_distance(name, candidate)
+		if distance > limit && name != "" && strings.Contains(candidate, name) {
+			// a part of a longer name, like "sony" for "PVM Style - D65 (FBX)"
+			distance = limit
+		}
+		if distance <= limit {
+			suggestions = append(suggestions, suggestion{entry.Name, distance})
+		}
+	}
+	sort.SliceStable(suggestions, func(a, b int) bool { return suggestions[a].distance < suggestions[b].distance })
+
+	names := []string{}
+	for _, s := range suggestions[:min(len(suggestions), max_suggestions)] {
+		names = append(names, s.name)
+	}
+	return names
+}
+
+// Returns the error of a palette name not in the palette search path,
+// suggesting the closest names
+func unknown_palette(name string) error {
+	suggestions := suggest_palettes(name)
+	if len(suggestions) == 0 {
+		return fmt.Errorf("%s: palette '%s' not in the palette list", ex, name)
+	}
+	return fmt.Errorf("%s: palette '%s' not in the palette list, did you mean: %s?", ex, name, strings.Join(suggestions, ", "))
+}
+
+// Opens a palette given either as a .pal file or as a name in the palette
+// search path, returns it along with its name
+func open_palette(arg string) (io.ReadCloser, string, error) {
+	if filepath.Ext(arg) == ".pal" {
+		file, err := os.Open(arg)
+		if err != nil {
+			return nil, "", err
+		}
+		return file, strings.TrimSuffix(filepath.Base(arg), ".pal"), nil
+	}
+
+	file, err := find_palette(strings.TrimSpace(arg))
+	if err != nil {
+		return nil, "", err
+	}
+	if file == nil {
+		return nil, "", unknown_palette(arg)
+	}
+	return file, arg, nil
+}
+
+// Loads a palette given either as a .pal file or as a name in the palette
+// search path, returns it along with its name
+func load_named_palette(arg string) (color.Palette, string, error) {
+	pal, name, err := open_palette(arg)
+	if err != nil {
+		return nil, "", err
+	}
+	defer pal.Close()
+
+	p, err := load_palette(pal)
+	if err != nil {
+		return nil, "", err
+	}
+	return p, name, nil
+}
+
+// A problem found in a palette
+type Finding struct {
+	// NES palette index of the entry with the problem, if any
+	Index string `json:"index,omitempty"`
+	Check string `json:"check"`
+	Msg   string `json:"message"`
+}
+
+// Chroma, in the YIQ color space, past which a color can not come out of
+// the composite video of the NES, only out of the RGB PPUs
+const MAX_NES_CHROMA = 150
+
+// Checks a palette file for problems commonly found in community palettes
+func lint_palette(data []byte) []Finding {
+	findings := []Finding{}
+
+	if format := foreign_format(data); format != "" {
+		return append(findings, Finding{Check: "format", Msg: fmt.Sprintf("file looks like %s, not a NES .pal file", format)})
+	}
+	if len(data) != nespal.PALETTE_SIZE*3 && len(data) != nespal.PALETTE_SIZE*3*8 {
+		findings = append(findings, Finding{
+			Check: "size",
+			Msg:   fmt.Sprintf("file has %d bytes, expected %d or %d with emphasis", len(data), nespal.PALETTE_SIZE*3, nespal.PALETTE_SIZE*3*8),
+		})
+	}
+	if len(data) < nespal.PALETTE_SIZE*3 {
+		return findings
+	}
+
+	p := make([]color.RGBA, nespal.PALETTE_SIZE)
+	for i := range p {
+		p[i] = color.RGBA{data[i*3], data[i*3+1], data[i*3+2], 255}
+	}
+	index := func(i int) string { return fmt.Sprintf("$%02X", i) }
+	lumas := make([]float64, nespal.PALETTE_SIZE)
+	for i, c := range p {
+		lumas[i] = luma(float64(c.R), float64(c.G), float64(c.B))
+	}
+
+	// the $xE and $xF columns are black, $0D is darker than black which
+	// upsets real TVs and the brightest colors are often clipped to white,
+	// so only duplicates of the other colors count
+	for i := range p {
+		col := i & 0x0F
+		if col == 0x0E || col == 0x0F {
+			if p[i].R > 0x20 || p[i].G > 0x20 || p[i].B > 0x20 {
+				findings = append(findings, Finding{index(i), "black-column", fmt.Sprintf("%s should be black, the palette may be shifted", hex_color(p[i]))})
+			}
+			continue
+		}
+		if col == 0x0D {
+			continue
+		}
+
+		for j := range i {
+			clipped := p[i].R >= 0xF0 && p[i].G >= 0xF0 && p[i].B >= 0xF0
+			if j&0x0F < 0x0D && p[i] == p[j] && !clipped {
+				findings = append(findings, Finding{index(i), "duplicate", fmt.Sprintf("same color as %s, %s", index(j), hex_color(p[i]))})
+				break
+			}
+		}
+	}
+
+	if lumas[0x0D] < lumas[0x0F] {
+		findings = append(findings, Finding{index(0x0D), "forbidden", "darker than the $0F black, $0D is blacker than black and upsets real TVs"})
+	}
+
+	for col := range 0x0D {
+		for row := 1; row < 4; row++ {
+			i := row<<4 | col
+			if lumas[i] < lumas[i-0x10] {
+				findings = append(findings, Finding{index(i), "brightness", fmt.Sprintf("darker than %s, the brightness of a column should go up with each row", index(i-0x10))})
+			}
+		}
+	}
+
+	for i, c := range p {
+		r, g, b := float64(c.R), float64(c.G), float64(c.B)
+		chroma := math.Hypot(0.596*r-0.274*g-0.322*b, 0.211*r-0.523*g+0.312*b)
+		if chroma > MAX_NES_CHROMA {
+			findings = append(findings, Finding{index(i), "gamut", fmt.Sprintf("%s is more saturated than the NES video can be", hex_color(c))})
+		}
+	}
+
+	return findings
+}
+
+// Formats a color as "#RRGGBB"
+func hex_color(c color.Color) string {
+	rgb := nespal.ToRGB(c)
+	return fmt.Sprintf("#%02X%02X%02X", rgb.R, rgb.G, rgb.B)
+}
+
+// Writes the palette as CSV, a row per color with its NES index, its hex
+// code and its red, green and blue components
+func write_palette_csv(p color.Palette, w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"index", "hex", "red", "green", "blue"})
+	for i, c := range p {
+		rgb := nespal.ToRGB(c)
+		cw.Write([]string{
+			fmt.Sprintf("$%02X", i),
+			hex_color(c),
+			strconv.Itoa(int(rgb.R)),
+			strconv.Itoa(int(rgb.G)),
+			strconv.Itoa(int(rgb.B)),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// Settings of Mesen2 giving it a user palette, to be merged into its
+// settings.json
+type MesenSettings struct {
+	Nes struct {
+		// Colors as 0xAARRGGBB, the 64 colors followed by the emphasis ones
+		UserPalette        []uint32
+		IsFullColorPalette bool
+	}
+}
+
+// Writes the palette, with its emphasis banks if any, for Mesen2: as the
+// raw .pal file it loads when raw, or else as the JSON of its settings
+func write_palette_mesen(p color.Palette, banks []color.Palette, w io.Writer, raw bool) error {
+	colors := slices.Concat(append([]color.Palette{p}, banks...)...)
+	if raw {
+		data := make([]byte, 0, len(colors)*3)
+		for _, c := range colors {
+			rgb := nespal.ToRGB(c)
+			data = append(data, rgb.R, rgb.G, rgb.B)
+		}
+		_, err := w.Write(data)
+		return err
+	}
+
+	var settings MesenSettings
+	settings.Nes.IsFullColorPalette = len(banks) > 0
+	for _, c := range colors {
+		rgb := nespal.ToRGB(c)
+		settings.Nes.UserPalette = append(settings.Nes.UserPalette, 0xFF000000|uint32(rgb.R)<<16|uint32(rgb.G)<<8|uint32(rgb.B))
+	}
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Returns the colors of every palette in CIELAB
+func palette_labs(pals []NamedPalette) [][][3]float64 {
+	labs := make([][][3]float64, len(pals))
+	for i, pal := range pals {
+		labs[i] = make([][3]float64, len(pal.Palette))
+		for j, c := range pal.Palette {
+			labs[i][j] = nespal.ToLab(c)
+		}
+	}
+	return labs
+}
+
+// Returns the mean CIE76 delta E between the colors of every pair of
+// palettes, entry by entry
+func distance_matrix(pals []NamedPalette) [][]float64 {
+	labs := palette_labs(pals)
+	cie76 := nespal.CIE76{}
+	matrix := make([][]float64, len(pals))
+	for i := range matrix {
+		matrix[i] = make([]float64, len(pals))
+	}
+
+	for i := range pals {
+		for j := i + 1; j < len(pals); j++ {
+			n := min(len(labs[i]), len(labs[j]))
+			sum := 0.0
+			for k := range n {
+				sum += cie76.Compare(labs[i][k], labs[j][k])
+			}
+			matrix[i][j] = sum / float64(max(n, 1))
+			matrix[j][i] = matrix[i][j]
+		}
+	}
+	return matrix
+}
+
+// Groups the palettes whose mean delta E, averaged between the members of
+// two groups, is at most threshold. Returns the indexes of the members of
+// every group, the largest groups first, each starting with its most
+// representative member: the closest to the others
+func cluster_palettes(matrix [][]float64, threshold float64) [][]int {
+	clusters := make([][]int, len(matrix))
+	for i := range clusters {
+		clusters[i] = []int{i}
+	}
+
+	linkage := func(a, b []int) float64 {
+		sum := 0.0
+		for _, i := range a {
+			for _, j := range b {
+				sum += matrix[i][j]
+			}
+		}
+		return sum / float64(len(a)*len(b))
+	}
+
+	// merges the two closest groups until none are close enough
+	for len(clusters) > 1 {
+		best_a, best_b, best := -1, -1, 0.0
+		for a := range clusters {
+			for b := a + 1; b < len(clusters); b++ {
+				if d := linkage(clusters[a], clusters[b]); best_a < 0 || d < best {
+					best_a, best_b, best = a, b, d
+				}
+			}
+		}
+		if best > threshold {
+			break
+		}
+		clusters[best_a] = append(clusters[best_a], clusters[best_b]...)
+		clusters = slices.Delete(clusters, best_b, best_b+1)
+	}
+
+	for _, cluster := range clusters {
+		sort.Ints(cluster)
+		sums := make(map[int]float64, len(cluster))
+		for _, i := range cluster {
+			for _, j := range cluster {
+				sums[i] += matrix[i][j]
+			}
+		}
+		sort.SliceStable(cluster, func(a, b int) bool { return sums[cluster[a]] < sums[cluster[b]] })
+	}
+	sort.SliceStable(clusters, func(a, b int) bool { return len(clusters[a]) > len(clusters[b]) })
+	return clusters
+}
+
+// Two palettes with the most different of their colors, as a CIE76 delta E
+type Dupe struct {
+	A, B     string
+	Distance float64
+}
+
+// Compares every pair of palettes, returning the ones whose colors all
+// differ by at most threshold
+func find_dupes(pals []NamedPalette, threshold float64) []Dupe {
+	labs := palette_labs(pals)
+	cie76 := nespal.CIE76{}
+	dupes := []Dupe{}
+	for i := range pals {
+		for j := i + 1; j < len(pals); j++ {
+			if len(labs[i]) != len(labs[j]) {
+				continue
+			}
+
+			distance := 0.0
+			for k := range labs[i] {
+				distance = max(distance, cie76.Compare(labs[i][k], labs[j][k]))
+				if distance > threshold {
+					break
+				}
+			}
+			if distance <= threshold {
+				dupes = append(dupes, Dupe{pals[i].Name, pals[j].Name, distance})
+			}
+		}
+	}
+	return dupes
+}
+
+// Runs the palette subcommand given in the arguments
+func run_palette() int {
+	if len(os.Args) == 2 {
+		log.Printf("%s: missing palette command\n", ex)
+		log.Printf("Try: %s %s %s\n", ex, HELP, PALETTE)
+		return 2
+	}
+
+	switch os.Args[2] {
+	case LINT:
+		format := pflag.String("format", "text", "Format of the findings: text or json")
+		pflag.Parse()
+		args := pflag.Args()
+
+		if *format != "text" && *format != "json" {
+			log.Printf("%s: invalid value '%s' for '--format' flag", ex, *format)
+			return 2
+		}
+
+		if len(args) == 2 {
+			log.Printf("%s: missing color palette\n", ex)
+			return 2
+		}
+
+		pal, name, err := open_palette(args[2])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		data, err := io.ReadAll(pal)
+		pal.Close()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		findings := lint_palette(data)
+		if *format == "json" {
+			out, err := json.MarshalIndent(findings, "", "  ")
+			if err != nil {
+				log.Println(err)
+				return 1
+			}
+			fmt.Println(string(out))
+		} else {
+			for _, f := range findings {
+				if f.Index != "" {
+					fmt.Printf("%s: %s: %s: %s\n", name, f.Index, f.Check, f.Msg)
+				} else {
+					fmt.Printf("%s: %s: %s\n", name, f.Check, f.Msg)
+				}
+			}
+		}
+
+		if len(findings) > 0 {
+			return 1
+		}
+	case ACCESSIBLE:
+		backdrop := pflag.String("backdrop", "0F", "NES palette index used as the backdrop color")
+		count := pflag.Int("count", SUBPALETTES, "Number of sub-palettes to propose")
+		forbid := pflag.StringSlice("forbid", nil, "NES palette indexes reserved by the project, never proposed")
+		pflag.Parse()
+		args := pflag.Args()
+
+		if len(args) == 2 {
+			log.Printf("%s: missing color palette\n", ex)
+			return 2
+		}
+
+		i, err := parse_nes_index(*backdrop)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		forbidden, err := parse_nes_indices(*forbid)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		if slices.Contains(forbidden, i) {
+			log.Printf("%s: backdrop $%02X is never used with '--forbid'\n", ex, i)
+			return 2
+		}
+
+		p, _, err := load_named_palette(args[2])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		for _, subpal := range accessible_subpalettes(p, uint8(i), *count, forbidden) {
+			fmt.Printf("%s: delta E %.1f (%s)\n", format_indices(subpal.Colors[:]), subpal.Distance, subpal.Vision)
+		}
+	case MATRIX:
+		format := pflag.String("format", "text", "Format of the matrix: text or csv")
+		pflag.Parse()
+		args := pflag.Args()
+
+		if *format != "text" && *format != "csv" {
+			log.Printf("%s: invalid value '%s' for '--format' flag", ex, *format)
+			return 2
+		}
+
+		var pals []NamedPalette
+		if len(args) == 2 {
+			var err error
+			if pals, err = load_palettes(); err != nil {
+				log.Println(err)
+				return 1
+			}
+		}
+		for _, arg := range args[2:] {
+			p, name, err := load_named_palette(arg)
+			if err != nil {
+				log.Println(err)
+				return 1
+			}
+			pals = append(pals, NamedPalette{Name: name, Palette: p})
+		}
+
+		matrix := distance_matrix(pals)
+		if *format == "csv" {
+			cw := csv.NewWriter(os.Stdout)
+			header := []string{""}
+			for _, pal := range pals {
+				header = append(header, pal.Name)
+			}
+			cw.Write(header)
+			for i, row := range matrix {
+				record := []string{pals[i].Name}
+				for _, d := range row {
+					record = append(record, strconv.FormatFloat(d, 'f', 2, 64))
+				}
+				cw.Write(record)
+			}
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				log.Println(err)
+				return 1
+			}
+		} else {
+			// the columns are numbered like the rows, the names being too long
+			fmt.Printf("%4s", "")
+			for j := range pals {
+				fmt.Printf("%7d", j+1)
+			}
+			fmt.Println()
+			for i, row := range matrix {
+				fmt.Printf("%4d", i+1)
+				for _, d := range row {
+					fmt.Printf("%7.1f", d)
+				}
+				fmt.Printf("  %s\n", pals[i].Name)
+			}
+		}
+	case CLUSTERS:
+		threshold := pflag.Float64("threshold", CLUSTERS_THRESHOLD, "Largest mean delta E between the palettes of a family")
+		pflag.Parse()
+
+		if *threshold < 0 {
+			log.Printf("%s: invalid value '%g' for '--threshold' flag, expected a delta E of 0 or more\n", ex, *threshold)
+			return 2
+		}
+
+		pals, err := load_palettes()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		for _, cluster := range cluster_palettes(distance_matrix(pals), *threshold) {
+			names := make([]string, 0, len(cluster)-1)
+			for _, i := range cluster[1:] {
+				names = append(names, pals[i].Name)
+			}
+
+			if len(names) == 0 {
+				fmt.Println(pals[cluster[0]].Name)
+			} else {
+				fmt.Printf("%s (%d palettes): %s\n", pals[cluster[0]].Name, len(cluster), strings.Join(names, ", "))
+			}
+		}
+	case SWATCH:
+		labels := pflag.Bool("labels", false, "Draw the NES index of every color")
+		hex := pflag.Bool("hex", false, "Also draw the hex code of every color, with '--labels'")
+		cell := pflag.Int("cell", SWATCH_CELL, "Size in pixels of the cell of every color")
+		pflag.Parse()
+		args := pflag.Args()
+
+		if *cell < 8 {
+			log.Printf("%s: invalid value '%d' for '--cell' flag, expected 8 or more\n", ex, *cell)
+			return 2
+		}
+		if len(args) == 2 {
+			log.Printf("%s: missing color palette\n", ex)
+			return 2
+		}
+		if len(args) == 3 {
+			log.Printf("%s: missing output image\n", ex)
+			return 2
+		}
+
+		p, _, err := load_named_palette(args[2])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		if status, err := write_image(render_swatch(p, *cell, *labels, *hex), args[3], nil); err != nil {
+			log.Println(err)
+			return status
+		}
+	case DUPES:
+		threshold := pflag.Float64("threshold", DUPES_THRESHOLD, "Largest delta E between the colors of near-identical palettes")
+		pflag.Parse()
+
+		if *threshold < 0 {
+			log.Printf("%s: invalid value '%g' for '--threshold' flag, expected a delta E of 0 or more\n", ex, *threshold)
+			return 2
+		}
+
+		pals, err := load_palettes()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		for _, dupe := range find_dupes(pals, *threshold) {
+			if dupe.Distance == 0 {
+				fmt.Printf("%s = %s\n", dupe.A, dupe.B)
+			} else {
+				fmt.Printf("%s ~ %s: delta E %.2f\n", dupe.A, dupe.B, dupe.Distance)
+			}
+		}
+	case PACK:
+		name := pflag.String("name", "", "Name of the pack, the name of the output file by default")
+		author := pflag.String("author", "", "Author of the palettes")
+		license := pflag.String("license", "", "License of the palettes, like 'CC0-1.0'")
+		sign_key := pflag.String("sign-key", "", "Private key file to sign the pack with, made by palette keygen")
+		version := pflag.String("pack-version", "", "Version of the pack, like '2024.1'")
+		pflag.Parse()
+		args := pflag.Args()
+
+		if len(args) == 2 {
+			log.Printf("%s: missing output pack\n", ex)
+			return 2
+		}
+		if !strings.EqualFold(filepath.Ext(args[2]), PACK_EXT) {
+			log.Printf("%s: unsupported pack file format for '%s', expected '%s'\n", ex, args[2], PACK_EXT)
+			return 2
+		}
+		if len(args) == 3 {
+			log.Printf("%s: missing color palette\n", ex)
+			return 2
+		}
+
+		manifest := PackManifest{Name: *name, Version: *version, Author: *author, License: *license}
+		if manifest.Name == "" {
+			manifest.Name = strings.TrimSuffix(filepath.Base(args[2]), filepath.Ext(args[2]))
+		}
+		if err := make_pack(args[2], args[3:], manifest, *sign_key); err != nil {
+			log.Println(err)
+			return 1
+		}
+	case UPDATE:
+		url := pflag.String("url", os.Getenv("NESPAL_UPDATE_URL"), "URL of the curated palette pack, NESPAL_UPDATE_URL by default")
+		check := pflag.Bool("check", false, "Only report whether the installed palettes are outdated")
+		pflag.Parse()
+
+		if *url == "" {
+			log.Printf("%s: missing URL of the palette pack, given with '--url' or NESPAL_UPDATE_URL\n", ex)
+			return 2
+		}
+
+		status, err := update_palettes(*url, *check)
+		if err != nil {
+			log.Println(err)
+		}
+		return status
+	case KEYGEN:
+		pflag.Parse()
+		args := pflag.Args()
+
+		if len(args) == 2 {
+			log.Printf("%s: missing key name\n", ex)
+			return 2
+		}
+		if err := keygen(args[2]); err != nil {
+			log.Println(err)
+			return 1
+		}
+	case UNPACK:
+		pflag.Parse()
+		args := pflag.Args()
+
+		if len(args) == 2 {
+			log.Printf("%s: missing palette pack\n", ex)
+			return 2
+		}
+		dir := strings.TrimSuffix(args[2], filepath.Ext(args[2]))
+		if len(args) > 3 {
+			dir = args[3]
+		}
+
+		if err := unpack(args[2], dir); err != nil {
+			log.Println(err)
+			return 1
+		}
+	case CONVERT:
+		swap := pflag.Bool("swap-rb", false, "Swap the red and blue of every color")
+		to_ppu := pflag.String("ppu", "", "Move the colors to the indexes of an RP2C04 version, like '2C04-0001'")
+		from_ppu := pflag.String("from-ppu", "", "Move the colors of a palette of an RP2C04 version back to the order of the NES")
+		pflag.Parse()
+		args := pflag.Args()
+
+		if !*swap && *to_ppu == "" && *from_ppu == "" {
+			log.Printf("%s: missing conversion, such as '--swap-rb' or '--ppu'\n", ex)
+			return 2
+		}
+		var from, to PPU
+		for _, flag := range []struct {
+			value string
+			ppu   *PPU
+		}{{*from_ppu, &from}, {*to_ppu, &to}} {
+			if flag.value == "" {
+				continue
+			}
+			var err error
+			if *flag.ppu, err = parse_ppu(flag.value); err != nil {
+				log.Println(err)
+				return 2
+			}
+		}
+		if len(args) == 2 {
+			log.Printf("%s: missing color palette\n", ex)
+			return 2
+		}
+		if len(args) == 3 {
+			log.Printf("%s: missing output palette\n", ex)
+			return 2
+		}
+
+		pal, name, err := open_palette(args[2])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		data, err := io.ReadAll(pal)
+		pal.Close()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		// the file is converted as it is, whatever its channels look like
+		if _, _, err := parse_palette(data, strict_palettes); err != nil {
+			if perr, ok := err.(*PaletteError); ok {
+				perr.Name = name
+			}
+			log.Println(err)
+			return 1
+		}
+
+		if *swap {
+			data = swap_rb(data)
+		}
+		data = scramble_palette(unscramble_palette(data, from), to)
+		if err := os.WriteFile(args[3], data, 0o644); err != nil {
+			log.Println(err)
+			return 1
+		}
+	case EMPHASIZE:
+		pflag.Parse()
+		args := pflag.Args()
+
+		if len(args) == 2 {
+			log.Printf("%s: missing color palette\n", ex)
+			return 2
+		}
+		if len(args) == 3 {
+			log.Printf("%s: missing output palette\n", ex)
+			return 2
+		}
+
+		p, name, err := load_named_palette(args[2])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		region := palette_arg_region(args[2], name)
+		if err := os.WriteFile(args[3], generate_emphasis(p, region == REGION_PAL || region == REGION_DENDY), 0o644); err != nil {
+			log.Println(err)
+			return 1
+		}
+	case EXPORT:
+		as_csv := pflag.Bool("csv", false, "Export as CSV")
+		mesen := pflag.Bool("mesen", false, "Export for Mesen2, as JSON settings or as a .pal file")
+		pflag.Parse()
+		args := pflag.Args()
+
+		if !*as_csv && !*mesen {
+			log.Printf("%s: missing export format, such as '--csv' or '--mesen'\n", ex)
+			return 2
+		}
+		if *as_csv && *mesen {
+			log.Printf("%s: flags '--csv' and '--mesen' can not be used together\n", ex)
+			return 2
+		}
+		if len(args) == 2 {
+			log.Printf("%s: missing color palette\n", ex)
+			return 2
+		}
+
+		pal, _, err := open_palette(args[2])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		p, banks, err := load_palette_banks(pal)
+		pal.Close()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		out := io.Writer(os.Stdout)
+		if len(args) > 3 {
+			file, err := os.Create(args[3])
+			if err != nil {
+				log.Println(err)
+				return 1
+			}
+			defer file.Close()
+			out = file
+		}
+
+		if *mesen {
+			err = write_palette_mesen(p, banks, out, len(args) > 3 && strings.EqualFold(filepath.Ext(args[3]), ".pal"))
+		} else {
+			err = write_palette_csv(p, out)
+		}
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		if file, ok := out.(*os.File); ok && file != os.Stdout {
+			if err := file.Close(); err != nil {
+				log.Println(err)
+				return 1
+			}
+		}
+	default:
+		log.Printf("%s: unknown palette command \"%s\"\n", ex, os.Args[2])
+		log.Printf("Try: %s %s %s\n", ex, HELP, PALETTE)
+		return 2
+	}
+
+	return 0
+}
+
+// Runs the list command given in the arguments
+func run_list() int {
+	pflag.Parse()
+
+	entries, err := available_palettes()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	for _, entry := range entries {
+		println(entry.Name)
+	}
+	return 0
+}
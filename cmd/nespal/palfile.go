@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"slices"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Sizes in bytes of the layouts of .pal files: the 64 colors, 256 colors
+// of which the first 64 are used, and the 64 colors in the 8 emphasis banks
+var palette_layouts = []int{nespal.PALETTE_SIZE * 3, 256 * 3, nespal.PALETTE_SIZE * 3 * EMPHASIS_BANKS}
+
+// Whether palettes with trailing data are rejected instead of warned
+// about, set with --strict-palettes
+var strict_palettes bool
+
+// Orders of the channels of the colors of .pal files
+const (
+	// RGB, unless the colors look like they are in BGR
+	CHANNELS_AUTO = "auto"
+	CHANNELS_RGB  = "rgb"
+	CHANNELS_BGR  = "bgr"
+)
+
+// Order of the channels of .pal files, set with --channel-order
+var channel_order = CHANNELS_AUTO
+
+// A problem with the content of a .pal file
+type PaletteError struct {
+	// Name of the file, if known
+	Name string
+	// Byte of the file where the problem is
+	Offset   int
+	Expected string
+	Found    string
+	// Format the file seems to be in instead, if any
+	Format string
+}
+
+func (e *PaletteError) Error() string {
+	name := ""
+	if e.Name != "" {
+		name = fmt.Sprintf(" '%s'", e.Name)
+	}
+	msg := fmt.Sprintf("%s: palette%s at byte %d: expected %s, found %s", ex, name, e.Offset, e.Expected, e.Found)
+	if e.Format != "" {
+		msg += fmt.Sprintf("; it looks like %s, not a NES .pal file", e.Format)
+	}
+	return msg
+}
+
+// Returns the format of data when it is a known palette format other than
+// NES .pal files, empty otherwise
+func foreign_format(data []byte) string {
+	switch {
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "PAL ":
+		return "a RIFF palette"
+	case bytes.HasPrefix(data, []byte("JASC-PAL")):
+		return "a JASC-PAL text palette"
+	case bytes.HasPrefix(data, []byte("GIMP Palette")):
+		return "a GIMP palette"
+	case len(data) == 256*3+4:
+		return "an Adobe color table"
+	}
+
+	// NES palettes always have bytes outside of printable text, like the
+	// 0x00 of black
+	text := bytes.IndexByte(data, '\n') >= 0
+	for _, b := range data {
+		if (b < ' ' || b > '~') && b != '\n' && b != '\r' && b != '\t' {
+			text = false
+			break
+		}
+	}
+	if text {
+		return "a text file"
+	}
+	return ""
+}
+
+// Parses the content of a .pal file. Data past the known layouts is an
+// error when strict and a warning otherwise, returned separately
+func parse_palette(data []byte, strict bool) (color.Palette, *PaletteError, error) {
+	if format := foreign_format(data); format != "" {
+		return nil, nil, &PaletteError{Offset: 0, Expected: "RGB colors", Found: fmt.Sprintf("%q", data[:min(8, len(data))]), Format: format}
+	}
+
+	if len(data) < nespal.PALETTE_SIZE*3 {
+		found := "the end of the file"
+		if len(data)%3 != 0 {
+			found += fmt.Sprintf(", in the middle of the color %d", len(data)/3)
+		}
+		return nil, nil, &PaletteError{
+			Offset:   len(data),
+			Expected: fmt.Sprintf("%d bytes, the RGB values of %d colors", nespal.PALETTE_SIZE*3, nespal.PALETTE_SIZE),
+			Found:    found,
+		}
+	}
+
+	var warning *PaletteError
+	if !slices.Contains(palette_layouts, len(data)) {
+		// the longest layout that fits is the one the file was meant to have
+		end := 0
+		for _, size := range palette_layouts {
+			if size <= len(data) {
+				end = size
+			}
+		}
+		warning = &PaletteError{
+			Offset:   end,
+			Expected: "the end of the file",
+			Found:    fmt.Sprintf("%d more bytes", len(data)-end),
+		}
+		if strict {
+			return nil, nil, warning
+		}
+	}
+
+	palette := make(color.Palette, nespal.PALETTE_SIZE)
+	for i := range nespal.PALETTE_SIZE {
+		palette[i] = color.RGBA{data[i*3], data[i*3+1], data[i*3+2], 255}
+	}
+	return palette, warning, nil
+}
+
+// Returns the name of the file pal reads from, if it is one
+func reader_name(pal io.Reader) string {
+	switch file := pal.(type) {
+	case interface{ Name() string }:
+		return filepath.Base(file.Name())
+	case fs.File:
+		if info, err := file.Stat(); err == nil {
+			return info.Name()
+		}
+	}
+	return ""
+}
+
+// Extracts the color palette from an NES/FAMICOM pal file
+// will not work with pal files for other uses. With --strict-palettes,
+// data past the colors is an error, otherwise it is warned about
+func load_palette(pal io.Reader) (color.Palette, error) {
+	p, _, err := load_palette_banks(pal)
+	return p, err
+}
+
+// Reads a .pal file like load_palette, also returning the colors of its
+// emphasis banks 1 to 7 when it has them
+func load_palette_banks(pal io.Reader) (color.Palette, []color.Palette, error) {
+	data, err := io.ReadAll(pal)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, warning, err := parse_palette(data, strict_palettes)
+	if perr, ok := err.(*PaletteError); ok {
+		perr.Name = reader_name(pal)
+		return nil, nil, perr
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	if warning != nil {
+		warning.Name = reader_name(pal)
+		log.Printf("warning: %s, ignored\n", warning)
+	}
+	if data, err = rgb_order(data, reader_name(pal)); err != nil {
+		return nil, nil, err
+	}
+	return emphasis_bank(data, 0), emphasis_banks(data), nil
+}
+
+// Returns the content of a .pal file with its colors in RGB order, as
+// given with --channel-order. When it is auto, the colors are swapped if
+// they look like BGR, warning about the palette called name
+func rgb_order(data []byte, name string) ([]byte, error) {
+	switch channel_order {
+	case CHANNELS_RGB:
+		return data, nil
+	case CHANNELS_BGR:
+		return swap_rb(data), nil
+	case CHANNELS_AUTO:
+		if !looks_bgr(data) {
+			return data, nil
+		}
+		if name != "" {
+			name = fmt.Sprintf(" '%s'", name)
+		}
+		log.Printf("warning: palette%s looks like it has its colors in BGR order, loaded with red and blue swapped; '--channel-order rgb' loads it as it is\n", name)
+		return swap_rb(data), nil
+	}
+	return nil, fmt.Errorf("%s: invalid value '%s' for '--channel-order' flag, expected %s, %s or %s", ex, channel_order, CHANNELS_AUTO, CHANNELS_RGB, CHANNELS_BGR)
+}
+
+// Returns a copy of the content of a .pal file with the red and blue of
+// every color swapped
+func swap_rb(data []byte) []byte {
+	res := bytes.Clone(data)
+	for i := 0; i+2 < len(res); i += 3 {
+		res[i], res[i+2] = res[i+2], res[i]
+	}
+	return res
+}
+
+// Whether the colors of a .pal file look like they are in BGR order: in
+// the darker rows of every NES palette, the columns $x1 and $x2 are blues
+// and the columns $x6 and $x7 are reds and oranges, so nearly all of them
+// having the other channel higher gives the swap away. Negative palettes,
+// whose first row is the brightest, turn blues into yellows instead
+func looks_bgr(data []byte) bool {
+	brightness := func(row int) int {
+		total := 0
+		for _, c := range data[row*16*3 : (row*16+13)*3] {
+			total += int(c)
+		}
+		return total
+	}
+	if brightness(0) >= brightness(2) {
+		return false
+	}
+
+	agree, disagree := 0, 0
+	for row := range 3 {
+		for _, col := range []int{1, 2, 6, 7} {
+			i := (row*16 + col) * 3
+			r, b := int(data[i]), int(data[i+2])
+			if col >= 6 {
+				r, b = b, r
+			}
+			// the blues have more blue than red in RGB order
+			switch {
+			case b > r:
+				agree++
+			case r > b:
+				disagree++
+			}
+		}
+	}
+	return disagree >= 10 && agree <= 1
+}
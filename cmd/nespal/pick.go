@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+const (
+	// Width in pixels, and so in characters, of the thumbnails of pick
+	THUMB_WIDTH = 48
+	// Number of palettes shown at once by pick
+	PICK_PAGE = 4
+)
+
+// Lets the user pick a palette by looking at thumbnails of img remapped to
+// each of pals, a page at a time. The pages and prompts are written to ui
+// and the answers read from in. Returns the picked palette, nil when the
+// user quits
+func pick(img image.Image, pals []NamedPalette, opts RemapOptions, in io.Reader, ui io.Writer) (*NamedPalette, error) {
+	bounds := img.Bounds()
+	w, h, err := parse_size(fmt.Sprintf("%dx", min(THUMB_WIDTH, bounds.Dx())), bounds)
+	if err != nil {
+		return nil, err
+	}
+	thumb := resize_image(img, w, h)
+
+	scanner := bufio.NewScanner(in)
+	shown := pals
+	page := 0
+	for {
+		pages := max(1, (len(shown)+PICK_PAGE-1)/PICK_PAGE)
+		page = min(max(page, 0), pages-1)
+		start := page * PICK_PAGE
+		for i, pal := range shown[start:min(start+PICK_PAGE, len(shown))] {
+			fmt.Fprintf(ui, "%d. %s\n", start+i+1, pal.Name)
+			if err := write_ansi(remap_image(preprocess(thumb, pal.Palette, opts), pal.Palette, opts), ui); err != nil {
+				return nil, err
+			}
+		}
+		if len(shown) == 0 {
+			fmt.Fprintln(ui, "No palette matches the filter")
+		}
+
+		fmt.Fprintf(ui, "Page %d/%d: enter to go on, p to go back, a number to pick, /text to filter, q to quit: ", page+1, pages)
+		if !scanner.Scan() {
+			fmt.Fprintln(ui)
+			return nil, scanner.Err()
+		}
+
+		answer := strings.TrimSpace(scanner.Text())
+		switch {
+		case answer == "" || answer == "n":
+			page = (page + 1) % pages
+		case answer == "p":
+			page = (page - 1 + pages) % pages
+		case answer == "q":
+			return nil, nil
+		case strings.HasPrefix(answer, "/"):
+			filter := strings.ToLower(strings.TrimSpace(answer[1:]))
+			shown = []NamedPalette{}
+			for _, pal := range pals {
+				if strings.Contains(strings.ToLower(pal.Name), filter) {
+					shown = append(shown, pal)
+				}
+			}
+			page = 0
+		default:
+			n, err := strconv.Atoi(answer)
+			if err != nil || n < 1 || n > len(shown) {
+				fmt.Fprintf(ui, "Invalid answer '%s'\n", answer)
+				continue
+			}
+			return &shown[n-1], nil
+		}
+	}
+}
+
+// Runs the pick command given in the arguments
+func run_pick() int {
+	remap_opts := remap_flags(pflag.CommandLine)
+	pflag.Parse()
+	args := pflag.Args()
+
+	opts, err := remap_opts()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if len(args) == 1 {
+		log.Printf("%s: missing image file\n", ex)
+		return 2
+	}
+
+	img, err := load_image(args[1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	pals, err := load_palettes()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	// the pages go to stderr so only the picked name is printed to stdout
+	picked, err := pick(img, pals, opts, os.Stdin, os.Stderr)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if picked == nil {
+		return 1
+	}
+	fmt.Println(picked.Name)
+
+	if len(args) > 2 {
+		pal, _, err := open_palette(picked.Name)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer pal.Close()
+		p, err := load_palette(pal)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		if status, err := remap(img, p, args[2], opts); err != nil {
+			log.Println(err)
+			return status
+		}
+	}
+	return 0
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Steps of a pipeline
+const (
+	STEP_LOAD   = "load"
+	STEP_RESIZE = "resize"
+	STEP_ADJUST = "adjust"
+	STEP_REMAP  = "remap"
+	STEP_SCALE  = "scale"
+	STEP_ENCODE = "encode"
+)
+
+var pipeline_steps = []string{STEP_LOAD, STEP_RESIZE, STEP_ADJUST, STEP_REMAP, STEP_SCALE, STEP_ENCODE}
+
+// A step of a pipeline and its arguments
+type Step struct {
+	Name string
+	Args []string
+}
+
+// Splits the arguments into steps separated by "--"
+func split_steps(args []string) []Step {
+	steps := []Step{}
+	start := 0
+	for i := 0; i <= len(args); i++ {
+		if i < len(args) && args[i] != "--" {
+			continue
+		}
+		if i > start {
+			steps = append(steps, Step{args[start], args[start+1 : i]})
+		}
+		start = i + 1
+	}
+	return steps
+}
+
+// Reads the steps of a spec file, one per line with its arguments, blank
+// lines and lines starting with '#' are skipped
+func parse_spec(r io.Reader) ([]Step, error) {
+	steps := []Step{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		steps = append(steps, Step{fields[0], fields[1:]})
+	}
+	return steps, scanner.Err()
+}
+
+// Parses a size like "256x240", either side can be left out to keep the
+// aspect ratio of bounds
+func parse_size(value string, bounds image.Rectangle) (int, int, error) {
+	w_str, h_str, found := strings.Cut(value, "x")
+	invalid := fmt.Errorf("%s: invalid size '%s', expected WIDTHxHEIGHT", ex, value)
+	if !found || (w_str == "" && h_str == "") {
+		return 0, 0, invalid
+	}
+
+	w, h := 0, 0
+	var err error
+	if w_str != "" {
+		if w, err = strconv.Atoi(w_str); err != nil || w <= 0 {
+			return 0, 0, invalid
+		}
+	}
+	if h_str != "" {
+		if h, err = strconv.Atoi(h_str); err != nil || h <= 0 {
+			return 0, 0, invalid
+		}
+	}
+
+	if w == 0 {
+		w = max(1, bounds.Dx()*h/bounds.Dy())
+	}
+	if h == 0 {
+		h = max(1, bounds.Dy()*w/bounds.Dx())
+	}
+	return w, h, nil
+}
+
+// Resizes img to w by h, every pixel is the average of the area it covers
+func resize_image(img image.Image, w, h int) *image.RGBA {
+	bounds := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, w, h))
+
+	for y := range h {
+		y0 := bounds.Min.Y + y*bounds.Dy()/h
+		y1 := max(y0+1, bounds.Min.Y+(y+1)*bounds.Dy()/h)
+		for x := range w {
+			x0 := bounds.Min.X + x*bounds.Dx()/w
+			x1 := max(x0+1, bounds.Min.X+(x+1)*bounds.Dx()/w)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			res.SetRGBA(x, y, color.RGBA{to_8bit(uint16(r / n)), to_8bit(uint16(g / n)), to_8bit(uint16(b / n)), to_8bit(uint16(a / n))})
+		}
+	}
+	return res
+}
+
+// Enlarges img by an integer factor, keeping pixels sharp
+func scale_image(img image.Image, factor int) *image.RGBA {
+	bounds := img.Bounds()
+	res := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*factor, bounds.Dy()*factor))
+
+	for y := range res.Rect.Dy() {
+		for x := range res.Rect.Dx() {
+			res.Set(x, y, img.At(bounds.Min.X+x/factor, bounds.Min.Y+y/factor))
+		}
+	}
+	return res
+}
+
+// Runs the steps in order, keeping the image in memory between them
+func pipeline(steps []Step) (int, error) {
+	if len(steps) == 0 {
+		return 2, fmt.Errorf("%s: empty pipeline", ex)
+	}
+
+	var (
+		img  image.Image
+		meta *nespal.Metadata
+	)
+	for _, step := range steps {
+		if !slices.Contains(pipeline_steps, step.Name) {
+			return 2, fmt.Errorf("%s: unknown pipeline step '%s', expected one of: %s", ex, step.Name, strings.Join(pipeline_steps, ", "))
+		}
+		if img == nil && step.Name != STEP_LOAD {
+			return 2, fmt.Errorf("%s: step '%s' has no image, start the pipeline with '%s'", ex, step.Name, STEP_LOAD)
+		}
+
+		flags := pflag.NewFlagSet(step.Name, pflag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		var (
+			pre_passes    func() ([]nespal.PrePass, error)
+			remap_opts    func() (RemapOptions, error)
+			keep_metadata *bool
+		)
+		switch step.Name {
+		case STEP_ADJUST:
+			pre_passes = pre_flags(flags)
+		case STEP_REMAP:
+			remap_opts = remap_flags(flags)
+		case STEP_ENCODE:
+			keep_metadata = flags.Bool("keep-metadata", false, "Copy the metadata of the loaded image")
+		}
+		if err := flags.Parse(step.Args); err != nil {
+			return 2, fmt.Errorf("%s: step '%s': %w", ex, step.Name, err)
+		}
+
+		args := flags.Args()
+		if step.Name != STEP_ADJUST && len(args) != 1 {
+			return 2, fmt.Errorf("%s: step '%s' takes one argument, got %d", ex, step.Name, len(args))
+		}
+
+		switch step.Name {
+		case STEP_LOAD:
+			var err error
+			if img, err = load_image(args[0]); err != nil {
+				return 1, err
+			}
+			if meta, err = nespal.ReadMetadata(args[0]); err != nil {
+				return 1, err
+			}
+		case STEP_RESIZE:
+			w, h, err := parse_size(args[0], img.Bounds())
+			if err != nil {
+				return 2, err
+			}
+			img = resize_image(img, w, h)
+		case STEP_ADJUST:
+			passes, err := pre_passes()
+			if err != nil {
+				return 2, err
+			}
+			img = preprocess(img, nil, RemapOptions{Options: nespal.Options{Pre: passes}})
+		case STEP_REMAP:
+			opts, err := remap_opts()
+			if err != nil {
+				return 2, err
+			}
+
+			p, _, err := load_named_palette(args[0])
+			if err != nil {
+				return 1, err
+			}
+			img = remap_image(preprocess(img, p, opts), p, opts)
+		case STEP_SCALE:
+			factor, err := strconv.Atoi(args[0])
+			if err != nil || factor < 1 {
+				return 2, fmt.Errorf("%s: invalid scale factor '%s'", ex, args[0])
+			}
+			img = scale_image(img, factor)
+		case STEP_ENCODE:
+			out_meta := meta
+			if !*keep_metadata {
+				out_meta = nil
+			}
+			if status, err := write_image(img, args[0], out_meta); err != nil {
+				return status, err
+			}
+		}
+	}
+
+	return 0, nil
+}
+
+// Runs the pipeline command given in the arguments
+func run_pipeline() int {
+	// the steps have flags of their own, so only the flags before the
+	// first step belong to the pipeline
+	pflag.CommandLine.SetInterspersed(false)
+	if err := pflag.CommandLine.Parse(os.Args[2:]); err != nil {
+		log.Println(err)
+		return 2
+	}
+	args := pflag.Args()
+
+	if len(args) == 0 {
+		log.Printf("%s: missing pipeline steps\n", ex)
+		return 2
+	}
+
+	var steps []Step
+	if len(args) == 1 && !slices.Contains(pipeline_steps, args[0]) {
+		spec, err := os.Open(args[0])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		steps, err = parse_spec(spec)
+		spec.Close()
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+	} else {
+		steps = split_steps(args)
+	}
+
+	if status, err := pipeline(steps); err != nil {
+		log.Println(err)
+		return status
+	}
+	return 0
+}
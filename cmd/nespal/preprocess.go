@@ -0,0 +1,393 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Returns a copy of img with f applied to every pixel, alpha is kept as is
+func map_pixels(img image.Image, f func(c color.NRGBA) color.NRGBA) *image.NRGBA {
+	bounds := img.Bounds()
+	res := image.NewNRGBA(bounds)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			a := c.A
+			c = f(c)
+			c.A = a
+			res.SetNRGBA(x, y, c)
+		}
+	}
+	return res
+}
+
+// Makes every pixel of an image either opaque or transparent: the ones
+// whose alpha is at least threshold, from 1, take their color at full
+// opacity, the others become transparent. Without it semi-transparent pixels are matched
+// as their color blended over black
+func alpha_threshold_pass(threshold uint8) nespal.PrePass {
+	return func(img image.Image) image.Image {
+		bounds := img.Bounds()
+		res := image.NewNRGBA(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				if c.A >= threshold {
+					c.A = 0xFF
+				} else {
+					c = color.NRGBA{}
+				}
+				res.SetNRGBA(x, y, c)
+			}
+		}
+		return res
+	}
+}
+
+// Whether the pixel of img at x, y is fully transparent
+func transparent(img image.Image, x, y int) bool {
+	_, _, _, a := img.At(x, y).RGBA()
+	return a == 0
+}
+
+// Returns the Rec. 601 luma of a color, the same the NES video signal is based on
+func luma(r, g, b float64) float64 {
+	return 0.299*r + 0.587*g + 0.114*b
+}
+
+// Adjusts the brightness, contrast and saturation of an image, each one is
+// a percentage where 0 leaves the image unchanged
+func adjust_pass(brightness, contrast, saturation float64) nespal.PrePass {
+	return func(img image.Image) image.Image {
+		return map_pixels(img, func(c color.NRGBA) color.NRGBA {
+			rgb := [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+
+			for i := range rgb {
+				rgb[i] += brightness * 255 / 100
+				rgb[i] = (rgb[i]-128)*(1+contrast/100) + 128
+			}
+
+			y := luma(rgb[0], rgb[1], rgb[2])
+			for i := range rgb {
+				rgb[i] = y + (rgb[i]-y)*(1+saturation/100)
+			}
+
+			return color.NRGBA{clamp8(rgb[0]), clamp8(rgb[1]), clamp8(rgb[2]), 0}
+		})
+	}
+}
+
+// Stretches every channel of an image to the full range, ignoring the
+// darkest and brightest 0.5% of the pixels, which also removes color casts
+func auto_levels(img image.Image) image.Image {
+	const CLIP = 0.005
+
+	bounds := img.Bounds()
+	var hist [3][256]int
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			hist[0][c.R]++
+			hist[1][c.G]++
+			hist[2][c.B]++
+		}
+	}
+
+	clip := int(float64(bounds.Dx()*bounds.Dy()) * CLIP)
+	var low, high [3]float64
+	for ch := range hist {
+		sum, lo := 0, 0
+		for ; lo < 255 && sum+hist[ch][lo] <= clip; lo++ {
+			sum += hist[ch][lo]
+		}
+		sum, hi := 0, 255
+		for ; hi > lo && sum+hist[ch][hi] <= clip; hi-- {
+			sum += hist[ch][hi]
+		}
+		low[ch], high[ch] = float64(lo), float64(hi)
+	}
+
+	return map_pixels(img, func(c color.NRGBA) color.NRGBA {
+		rgb := [3]uint8{c.R, c.G, c.B}
+		for ch, v := range rgb {
+			if high[ch] > low[ch] {
+				rgb[ch] = clamp8((float64(v) - low[ch]) * 255 / (high[ch] - low[ch]))
+			}
+		}
+		return color.NRGBA{rgb[0], rgb[1], rgb[2], 0}
+	})
+}
+
+// Rotates the hue of an image by degrees, in the YIQ color space the NES
+// video signal is encoded in, so the brightness of the colors is kept
+func hue_shift_pass(degrees float64) nespal.PrePass {
+	sin, cos := math.Sincos(-degrees * math.Pi / 180)
+
+	return func(img image.Image) image.Image {
+		return map_pixels(img, func(c color.NRGBA) color.NRGBA {
+			r, g, b := float64(c.R), float64(c.G), float64(c.B)
+
+			y := luma(r, g, b)
+			i := 0.596*r - 0.274*g - 0.322*b
+			q := 0.211*r - 0.523*g + 0.312*b
+			i, q = i*cos-q*sin, i*sin+q*cos
+
+			return color.NRGBA{
+				clamp8(y + 0.956*i + 0.621*q),
+				clamp8(y - 0.272*i - 0.647*q),
+				clamp8(y - 1.106*i + 1.703*q),
+				0,
+			}
+		})
+	}
+}
+
+// Tiles across and down the image the clahe equalization works on, and the
+// times the mean count of a bin their histograms are clipped at, which
+// limits how much the contrast is raised in flat areas
+const (
+	CLAHE_TILES = 8
+	CLAHE_CLIP  = 4.0
+)
+
+// Maps the luma of the pixels counted in hist to the full range, so every
+// level is about as used as the others. Bins above clip times the mean
+// count are clipped and the excess spread over all of them, when clip is
+// above 0
+func equalize_levels(hist [256]float64, clip float64) [256]float64 {
+	total := 0.0
+	for _, n := range hist {
+		total += n
+	}
+	if clip > 0 {
+		limit, excess := max(clip*total/256, 1), 0.0
+		for v, n := range hist {
+			if n > limit {
+				excess += n - limit
+				hist[v] = limit
+			}
+		}
+		for v := range hist {
+			hist[v] += excess / 256
+		}
+	}
+
+	var levels [256]float64
+	cdf, first := 0.0, -1.0
+	for v, n := range hist {
+		cdf += n
+		if first < 0 && n > 0 {
+			first = cdf
+		}
+		levels[v] = cdf
+	}
+	for v := range levels {
+		// images of a single level are left as they are
+		if total-first <= 0 {
+			levels[v] = float64(v)
+		} else {
+			levels[v] = max(levels[v]-first, 0) * 255 / (total - first)
+		}
+	}
+	return levels
+}
+
+// Spreads the luma of an image over the full range by equalizing its
+// histogram, so dark screenshots and photos reach the brightness steps of
+// the NES palette. Only the luma changes, every channel being shifted by
+// the same amount, so the hue and saturation are kept. With clahe, the
+// histograms are the ones of tiles, clipped to limit the contrast, and
+// every pixel blends the levels of the four tiles around it, bringing out
+// the details of the dark and bright areas alike. Transparent pixels are
+// left out of the histograms
+func equalize_pass(clahe bool) nespal.PrePass {
+	return func(img image.Image) image.Image {
+		bounds := img.Bounds()
+		width, height := bounds.Dx(), bounds.Dy()
+		lumas := make([]uint8, width*height)
+		for y := range height {
+			for x := range width {
+				c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+				lumas[y*width+x] = clamp8(luma(float64(c.R), float64(c.G), float64(c.B)))
+			}
+		}
+
+		// the whole image is a single tile without clahe
+		tile_w, tile_h, clip := max(width, 1), max(height, 1), 0.0
+		if clahe {
+			tile_w, tile_h, clip = max((width+CLAHE_TILES-1)/CLAHE_TILES, 1), max((height+CLAHE_TILES-1)/CLAHE_TILES, 1), CLAHE_CLIP
+		}
+		cols, rows := (width+tile_w-1)/tile_w, (height+tile_h-1)/tile_h
+		hists := make([][256]float64, cols*rows)
+		for y := range height {
+			for x := range width {
+				if !transparent(img, bounds.Min.X+x, bounds.Min.Y+y) {
+					hists[(y/tile_h)*cols+x/tile_w][lumas[y*width+x]]++
+				}
+			}
+		}
+		levels := make([][256]float64, len(hists))
+		for i, hist := range hists {
+			levels[i] = equalize_levels(hist, clip)
+		}
+
+		// the tiles on both sides of a pixel, between their centers, and how
+		// far it is from the first one
+		around := func(v, size, count int) (int, int, float64) {
+			f := (float64(v)+0.5)/float64(size) - 0.5
+			first := min(max(int(math.Floor(f)), 0), count-1)
+			return first, min(first+1, count-1), min(max(f-float64(first), 0), 1)
+		}
+
+		res := image.NewNRGBA(bounds)
+		for y := range height {
+			y0, y1, fy := around(y, tile_h, rows)
+			for x := range width {
+				x0, x1, fx := around(x, tile_w, cols)
+				l := lumas[y*width+x]
+				top := levels[y0*cols+x0][l]*(1-fx) + levels[y0*cols+x1][l]*fx
+				bottom := levels[y1*cols+x0][l]*(1-fx) + levels[y1*cols+x1][l]*fx
+				shift := top*(1-fy) + bottom*fy - float64(l)
+
+				c := color.NRGBAModel.Convert(img.At(bounds.Min.X+x, bounds.Min.Y+y)).(color.NRGBA)
+				res.SetNRGBA(bounds.Min.X+x, bounds.Min.Y+y, color.NRGBA{
+					clamp8(float64(c.R) + shift),
+					clamp8(float64(c.G) + shift),
+					clamp8(float64(c.B) + shift),
+					c.A,
+				})
+			}
+		}
+		return res
+	}
+}
+
+// Radius of the kuwahara pre-pass when not given
+const KUWAHARA_RADIUS = 4
+
+// Largest radius of the kuwahara pre-pass
+const MAX_KUWAHARA = 16
+
+// Flattens an image into regions of even color while keeping their edges
+// sharp, the Kuwahara filter: every pixel takes the mean color of the
+// quadrant of the radius around it whose brightness varies the least.
+// Photos and 3D renders come out like cel shading, with their gradients and
+// textures in patches that match few NES colors
+func kuwahara_pass(radius int) nespal.PrePass {
+	return func(img image.Image) image.Image {
+		src, at := clamped_reader(img)
+		bounds := src.Rect
+		width, height := bounds.Dx(), bounds.Dy()
+
+		// summed area tables of the channels, the luma and its square over
+		// the image padded by the radius, so the quadrants cost the same
+		// whatever their size
+		stride := width + 2*radius + 1
+		var sums [5][]float64
+		for i := range sums {
+			sums[i] = make([]float64, stride*(height+2*radius+1))
+		}
+		for y := 1; y <= height+2*radius; y++ {
+			for x := 1; x <= width+2*radius; x++ {
+				c := at(bounds.Min.X+x-1-radius, bounds.Min.Y+y-1-radius)
+				r, g, b := float64(c.R), float64(c.G), float64(c.B)
+				l := luma(r, g, b)
+				for i, v := range [5]float64{r, g, b, l, l * l} {
+					sums[i][y*stride+x] = v + sums[i][(y-1)*stride+x] + sums[i][y*stride+x-1] - sums[i][(y-1)*stride+x-1]
+				}
+			}
+		}
+		// sum of a table over the quadrant from x0, y0 to x1, y1 included,
+		// in the coordinates of the padded image
+		area := func(i, x0, y0, x1, y1 int) float64 {
+			s := sums[i]
+			return s[(y1+1)*stride+x1+1] - s[y0*stride+x1+1] - s[(y1+1)*stride+x0] + s[y0*stride+x0]
+		}
+
+		res := image.NewNRGBA(bounds)
+		n := float64((radius + 1) * (radius + 1))
+		for y := range height {
+			for x := range width {
+				cx, cy := x+radius, y+radius
+				best, best_var := 0, math.Inf(1)
+				quadrants := [4][2]int{{cx - radius, cy - radius}, {cx, cy - radius}, {cx - radius, cy}, {cx, cy}}
+				for q, p := range quadrants {
+					mean := area(3, p[0], p[1], p[0]+radius, p[1]+radius) / n
+					variance := area(4, p[0], p[1], p[0]+radius, p[1]+radius)/n - mean*mean
+					if variance < best_var {
+						best, best_var = q, variance
+					}
+				}
+
+				p := quadrants[best]
+				var rgb [3]uint8
+				for i := range rgb {
+					rgb[i] = clamp8(area(i, p[0], p[1], p[0]+radius, p[1]+radius) / n)
+				}
+				res.SetNRGBA(bounds.Min.X+x, bounds.Min.Y+y, color.NRGBA{rgb[0], rgb[1], rgb[2], src.NRGBAAt(bounds.Min.X+x, bounds.Min.Y+y).A})
+			}
+		}
+		return res
+	}
+}
+
+// Parses a pre-pass written as name[:argument], like "grayscale:luma"
+func parse_pre_pass(spec string) (nespal.PrePass, error) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+
+	switch name {
+	case "grayscale":
+		switch arg {
+		case "", "luma":
+			return func(img image.Image) image.Image {
+				return map_pixels(img, func(c color.NRGBA) color.NRGBA {
+					y := clamp8(luma(float64(c.R), float64(c.G), float64(c.B)))
+					return color.NRGBA{y, y, y, 0}
+				})
+			}, nil
+		case "average":
+			return func(img image.Image) image.Image {
+				return map_pixels(img, func(c color.NRGBA) color.NRGBA {
+					y := uint8((int(c.R) + int(c.G) + int(c.B)) / 3)
+					return color.NRGBA{y, y, y, 0}
+				})
+			}, nil
+		}
+	case "equalize":
+		switch arg {
+		case "", "global":
+			return equalize_pass(false), nil
+		case "clahe":
+			return equalize_pass(true), nil
+		}
+	case "kuwahara":
+		radius := KUWAHARA_RADIUS
+		if arg != "" {
+			n, err := strconv.Atoi(arg)
+			if err != nil || n < 1 || n > MAX_KUWAHARA {
+				return nil, fmt.Errorf("%s: invalid radius '%s' for '--pre kuwahara', expected 1 to %d", ex, arg, MAX_KUWAHARA)
+			}
+			radius = n
+		}
+		return kuwahara_pass(radius), nil
+	}
+
+	return nil, fmt.Errorf("%s: invalid value '%s' for '--pre' flag", ex, spec)
+}
+
+// Rounds v to the nearest byte, clamping it to 0-255
+func clamp8(v float64) uint8 {
+	if v < 0 {
+		return 0
+	} else if v > 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
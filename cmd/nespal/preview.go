@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Protocols the remapped images can be previewed with in terminals
+const (
+	PREVIEW_AUTO  = "auto"
+	PREVIEW_SIXEL = "sixel"
+	PREVIEW_KITTY = "kitty"
+	PREVIEW_ITERM = "iterm"
+)
+
+var preview_protocols = []string{PREVIEW_AUTO, PREVIEW_SIXEL, PREVIEW_KITTY, PREVIEW_ITERM}
+
+// Most color registers of sixel terminals
+const SIXEL_COLORS = 256
+
+// Largest payload of a kitty graphics escape, in base64 bytes
+const KITTY_CHUNK = 4096
+
+// Parses the value of --preview, telling the protocol of the terminal
+// when it is "auto"
+func parse_preview(value string) (string, error) {
+	if !slices.Contains(preview_protocols, value) {
+		return "", fmt.Errorf("%s: invalid value '%s' for '--preview' flag, expected one of: %s", ex, value, strings.Join(preview_protocols, ", "))
+	}
+	if value != PREVIEW_AUTO {
+		return value, nil
+	}
+	if protocol := terminal_protocol(os.Getenv); protocol != "" {
+		return protocol, nil
+	}
+	return "", fmt.Errorf("%s: could not tell the graphics protocol of the terminal, give it with '--preview sixel', 'kitty' or 'iterm'", ex)
+}
+
+// Tells the graphics protocol of the terminal from the environment it
+// sets, empty when it is not known to show images
+func terminal_protocol(getenv func(string) string) string {
+	term, program := getenv("TERM"), getenv("TERM_PROGRAM")
+	switch {
+	case getenv("KITTY_WINDOW_ID") != "" || term == "xterm-kitty" || term == "xterm-ghostty" || program == "ghostty":
+		return PREVIEW_KITTY
+	case program == "iTerm.app" || program == "WezTerm" || getenv("LC_TERMINAL") == "iTerm2":
+		return PREVIEW_ITERM
+	}
+
+	// terminals whose terminfo entry is named after them
+	for _, name := range []string{"mlterm", "foot", "contour", "yaft"} {
+		if strings.HasPrefix(term, name) {
+			return PREVIEW_SIXEL
+		}
+	}
+	return ""
+}
+
+// Shows the image at path in the terminal with the protocol
+func preview_image(path string, protocol string) error {
+	img, err := load_image(path)
+	if err != nil {
+		return err
+	}
+	return write_preview(os.Stdout, img, protocol)
+}
+
+// Shows img in the terminal written to by out with the protocol
+func write_preview(out io.Writer, img image.Image, protocol string) error {
+	w := bufio.NewWriter(out)
+	var err error
+	switch protocol {
+	case PREVIEW_SIXEL:
+		err = write_sixel(w, img)
+	case PREVIEW_KITTY:
+		err = write_kitty(w, img)
+	case PREVIEW_ITERM:
+		err = write_iterm(w, img)
+	}
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// Writes img as sixels, six rows of pixels at a time. The colors of
+// remapped images fit in the color registers, the others are reduced to 3
+// bits of red and green and 2 of blue. Transparent pixels are left out so
+// the background of the terminal shows through
+func write_sixel(w io.Writer, img image.Image) error {
+	bounds := img.Bounds()
+	colors := map[color.RGBA]int{}
+	palette := []color.RGBA{}
+	pixels := make([]int, bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			i := (y-bounds.Min.Y)*bounds.Dx() + x - bounds.Min.X
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			if c.A < 128 {
+				pixels[i] = -1
+				continue
+			}
+			c.A = 255
+			n, found := colors[c]
+			if !found {
+				n = len(palette)
+				colors[c] = n
+				palette = append(palette, c)
+			}
+			pixels[i] = n
+		}
+	}
+
+	if len(palette) > SIXEL_COLORS {
+		reduced := map[color.RGBA]int{}
+		reduced_palette := []color.RGBA{}
+		for i, n := range pixels {
+			if n < 0 {
+				continue
+			}
+			c := palette[n]
+			c = color.RGBA{c.R&0xE0 | 0x10, c.G&0xE0 | 0x10, c.B&0xC0 | 0x20, 255}
+			m, found := reduced[c]
+			if !found {
+				m = len(reduced_palette)
+				reduced[c] = m
+				reduced_palette = append(reduced_palette, c)
+			}
+			pixels[i] = m
+		}
+		palette = reduced_palette
+	}
+
+	// pixels not drawn keep the background of the terminal
+	fmt.Fprintf(w, "\x1bP0;1q\"1;1;%d;%d", bounds.Dx(), bounds.Dy())
+	for n, c := range palette {
+		fmt.Fprintf(w, "#%d;2;%d;%d;%d", n, int(c.R)*100/255, int(c.G)*100/255, int(c.B)*100/255)
+	}
+
+	width := bounds.Dx()
+	bits := make([]byte, width)
+	for top := 0; top < bounds.Dy(); top += 6 {
+		// the colors in the band, each drawn over the band in turn
+		used := map[int]bool{}
+		for y := top; y < min(top+6, bounds.Dy()); y++ {
+			for _, n := range pixels[y*width : (y+1)*width] {
+				if n >= 0 {
+					used[n] = true
+				}
+			}
+		}
+		first := true
+		for n := range palette {
+			if !used[n] {
+				continue
+			}
+			clear(bits)
+			for y := top; y < min(top+6, bounds.Dy()); y++ {
+				for x, m := range pixels[y*width : (y+1)*width] {
+					if m == n {
+						bits[x] |= 1 << (y - top)
+					}
+				}
+			}
+
+			if !first {
+				io.WriteString(w, "$")
+			}
+			first = false
+			fmt.Fprintf(w, "#%d", n)
+			write_sixel_runs(w, bits)
+		}
+		io.WriteString(w, "-")
+	}
+	_, err := io.WriteString(w, "\x1b\\")
+	return err
+}
+
+// Writes a row of sixels, the runs of the same sixel as repeats. The empty
+// sixels at the end of the row are left out
+func write_sixel_runs(w io.Writer, bits []byte) {
+	end := len(bits)
+	for end > 0 && bits[end-1] == 0 {
+		end--
+	}
+	for x := 0; x < end; {
+		run := 1
+		for x+run < end && bits[x+run] == bits[x] {
+			run++
+		}
+		c := string(rune('?' + bits[x]))
+		if run > 3 {
+			fmt.Fprintf(w, "!%d%s", run, c)
+		} else {
+			io.WriteString(w, strings.Repeat(c, run))
+		}
+		x += run
+	}
+}
+
+// Writes img with the kitty graphics protocol, as a PNG sent in chunks
+func write_kitty(w io.Writer, img image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	data := base64.StdEncoding.EncodeToString(buf.Bytes())
+
+	for start := 0; start < len(data) || start == 0; start += KITTY_CHUNK {
+		end := min(start+KITTY_CHUNK, len(data))
+		more := 0
+		if end < len(data) {
+			more = 1
+		}
+		// only the first chunk carries the keys of the image
+		keys := fmt.Sprintf("m=%d", more)
+		if start == 0 {
+			keys = "a=T,f=100," + keys
+		}
+		if _, err := fmt.Fprintf(w, "\x1b_G%s;%s\x1b\\", keys, data[start:end]); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// Writes img as an iTerm2 inline image, a PNG in a single escape
+func write_iterm(w io.Writer, img image.Image) error {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "\x1b]1337;File=inline=1;size=%d;preserveAspectRatio=1:%s\a\n", buf.Len(), base64.StdEncoding.EncodeToString(buf.Bytes()))
+	return err
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// How well a palette fits an image
+type PaletteRank struct {
+	Name string
+	// Mean CIE76 delta E between the pixels and their closest colors
+	Mean float64
+	// Largest delta E between a pixel and its closest color
+	Worst float64
+}
+
+// Ranks the palettes by the mean delta E between the pixels of img and
+// their closest colors in each, the best fitting first. The palettes are
+// measured jobs at a time
+func rank_palettes(ctx context.Context, img image.Image, pals []NamedPalette) ([]PaletteRank, error) {
+	// every distinct color is measured once, weighted by its pixels
+	counts := map[color.RGBA]int{}
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			counts[nespal.ToRGB(img.At(x, y))]++
+		}
+	}
+	labs := make([][3]float64, 0, len(counts))
+	weights := make([]int, 0, len(counts))
+	for c, n := range counts {
+		labs = append(labs, nespal.ToLab(c))
+		weights = append(weights, n)
+	}
+
+	cie76 := nespal.CIE76{}
+	pal_labs := palette_labs(pals)
+	names := make([]string, len(pals))
+	for i, pal := range pals {
+		names[i] = pal.Name
+	}
+
+	res := make([]PaletteRank, len(pals))
+	run_jobs(ctx, names, func(i int, _ *BatchResult) (int, error) {
+		sum, worst := 0.0, 0.0
+		for j, lab := range labs {
+			best := -1.0
+			for _, pc := range pal_labs[i] {
+				if d := cie76.Compare(lab, pc); best < 0 || d < best {
+					best = d
+				}
+			}
+			sum += best * float64(weights[j])
+			worst = max(worst, best)
+		}
+		res[i] = PaletteRank{pals[i].Name, sum / float64(max(1, bounds.Dx()*bounds.Dy())), worst}
+		return 0, nil
+	})
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(res, func(a, b int) bool { return res[a].Mean < res[b].Mean })
+	return res, nil
+}
+
+// Runs the rank command given in the arguments
+func run_rank() int {
+	region := pflag.String("region", "", "Only rank the palettes made for a region: ntsc, pal, dendy or vs")
+	count := pflag.Int("count", 0, "Number of palettes printed, all when 0")
+	format := pflag.String("format", "text", "Format of the ranking: text or csv")
+	pflag.Parse()
+	args := pflag.Args()
+
+	if *region != "" && !slices.Contains(regions, *region) {
+		log.Printf("%s: invalid value '%s' for '--region' flag, expected one of: %s\n", ex, *region, strings.Join(regions, ", "))
+		return 2
+	}
+	if *format != "text" && *format != "csv" {
+		log.Printf("%s: invalid value '%s' for '--format' flag", ex, *format)
+		return 2
+	}
+	if len(args) == 1 {
+		log.Printf("%s: missing image file\n", ex)
+		return 2
+	}
+
+	img, err := load_image(args[1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	var pals []NamedPalette
+	if len(args) == 2 {
+		if pals, err = load_palettes(); err != nil {
+			log.Println(err)
+			return 1
+		}
+		if *region != "" {
+			pals = slices.DeleteFunc(pals, func(p NamedPalette) bool { return !region_matches(*region, p.region()) })
+		}
+	}
+	for _, arg := range args[2:] {
+		p, name, err := load_named_palette(arg)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		pals = append(pals, NamedPalette{Name: name, Palette: p})
+	}
+
+	ranks, err := rank_palettes(context.Background(), img, pals)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	if *count > 0 && *count < len(ranks) {
+		ranks = ranks[:*count]
+	}
+
+	if *format == "csv" {
+		cw := csv.NewWriter(os.Stdout)
+		cw.Write([]string{"rank", "palette", "mean", "worst"})
+		for i, rank := range ranks {
+			cw.Write([]string{strconv.Itoa(i + 1), rank.Name, strconv.FormatFloat(rank.Mean, 'f', 2, 64), strconv.FormatFloat(rank.Worst, 'f', 2, 64)})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Println(err)
+			return 1
+		}
+		return 0
+	}
+
+	width := len("PALETTE")
+	for _, rank := range ranks {
+		width = max(width, len(rank.Name))
+	}
+	fmt.Printf("%4s  %-*s  %8s  %8s\n", "RANK", width, "PALETTE", "MEAN", "WORST")
+	for i, rank := range ranks {
+		fmt.Printf("%4d  %-*s  %8.2f  %8.2f\n", i+1, width, rank.Name, rank.Mean, rank.Worst)
+	}
+	return 0
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Layouts of the pixels of raw framebuffers
+const (
+	RAW_RGB  = "rgb"
+	RAW_RGBA = "rgba"
+	RAW_BGR  = "bgr"
+)
+
+var raw_layouts = []string{RAW_RGB, RAW_RGBA, RAW_BGR}
+
+// Size and pixel layout of raw framebuffers, as dumped by headless
+// emulators and capture cards, 8 bits per channel with no padding
+type RawFormat struct {
+	Width, Height int
+	Layout        string
+}
+
+// Format of the framebuffers given with --raw, images are read as encoded
+// files when nil
+var raw_format *RawFormat
+
+// Parses a raw framebuffer format written as WxH:layout, like "256x240:rgb"
+func parse_raw(value string) (*RawFormat, error) {
+	size, layout, found := strings.Cut(strings.TrimSpace(value), ":")
+	w, h, found_x := strings.Cut(size, "x")
+	width, err_w := strconv.Atoi(w)
+	height, err_h := strconv.Atoi(h)
+	if !found || !found_x || err_w != nil || err_h != nil || width < 1 || height < 1 {
+		return nil, fmt.Errorf("%s: invalid value '%s' for '--raw' flag, expected 'WxH:layout' like '256x240:rgb'", ex, value)
+	}
+	if !slices.Contains(raw_layouts, layout) {
+		return nil, fmt.Errorf("%s: invalid layout '%s' for '--raw' flag, expected one of: %s", ex, layout, strings.Join(raw_layouts, ", "))
+	}
+	return &RawFormat{width, height, layout}, nil
+}
+
+// Bytes of every pixel of the framebuffers
+func (f *RawFormat) bytes_per_pixel() int {
+	if f.Layout == RAW_RGBA {
+		return 4
+	}
+	return 3
+}
+
+// Reads the rows of a raw framebuffer
+type raw_rows struct {
+	r      io.ReadCloser
+	format *RawFormat
+	y      int
+	buf    []byte
+	row    []color.RGBA
+}
+
+// Opens the raw framebuffer at path, or the one written to the standard
+// input when path is "-", to be read row by row
+func open_raw_rows(path string, format *RawFormat) (nespal.RowReader, error) {
+	var r io.ReadCloser = io.NopCloser(os.Stdin)
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		r = file
+	}
+	return &raw_rows{
+		r:      r,
+		format: format,
+		buf:    make([]byte, format.Width*format.bytes_per_pixel()),
+		row:    make([]color.RGBA, format.Width),
+	}, nil
+}
+
+func (r *raw_rows) Bounds() image.Rectangle {
+	return image.Rect(0, 0, r.format.Width, r.format.Height)
+}
+
+func (r *raw_rows) NextRow() ([]color.RGBA, error) {
+	if r.y == r.format.Height {
+		return nil, io.EOF
+	}
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("%s: raw framebuffer ends at row %d of %d, check the size given with '--raw'", ex, r.y, r.format.Height)
+		}
+		return nil, err
+	}
+	r.y++
+
+	for x := range r.row {
+		switch r.format.Layout {
+		case RAW_RGB:
+			r.row[x] = color.RGBA{r.buf[x*3], r.buf[x*3+1], r.buf[x*3+2], 255}
+		case RAW_BGR:
+			r.row[x] = color.RGBA{r.buf[x*3+2], r.buf[x*3+1], r.buf[x*3], 255}
+		case RAW_RGBA:
+			a := r.buf[x*4+3]
+			r.row[x] = color.RGBA{premultiply(r.buf[x*4], a), premultiply(r.buf[x*4+1], a), premultiply(r.buf[x*4+2], a), 255}
+		}
+	}
+	return r.row, nil
+}
+
+func (r *raw_rows) Close() error {
+	return r.r.Close()
+}
+
+// Multiplies the sample v by the alpha a, both 8 bits
+func premultiply(v, a byte) byte {
+	return byte((int(v) * 0x101 * int(a) / 0xff) >> 8)
+}
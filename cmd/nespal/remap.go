@@ -0,0 +1,668 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Options of the commands remapping images: the ones of the remap itself
+// and the ones of the files written along with it
+type RemapOptions struct {
+	nespal.Options
+	// Path to write the NES palette index of every pixel, if any
+	IndexMap string
+	// Paths to export the palette and indexes as C arrays or ca65 tables, if any
+	ExportC   string
+	ExportAsm string
+	// NES palette index forced as the backdrop color when following the
+	// NES background constraints, the most used color when nil
+	Backdrop *uint8
+	// Grid of the NES background constraints, the one of the NES PPU when
+	// zero
+	Grid Grid
+	// Paths to write which sub-palette every attribute block uses, as an
+	// image and as a table, if any
+	AttrMap   string
+	AttrTable string
+	// Path to write how the sub-palettes are used, stdout when '-', if any
+	SubpalStats string
+	// Whether the backdrop and sub-palettes are searched to lose the least
+	// of the image, instead of being the first ones its colors fit in
+	Optimize bool
+	// Whether the files are written in the layouts NES Screen Tool and
+	// NEXXT open
+	NESST bool
+	// Most unique tiles of a baked background, a pattern table when zero,
+	// and whether the most similar tiles are merged to fit in it
+	TileBudget int
+	MergeTiles bool
+	// Area of the image remapped, or the one left untouched with Outside,
+	// the whole image is remapped when nil. It starts at the top left pixel
+	ROI     *image.Rectangle
+	Outside bool
+	// NES palette indexes reserved by the project, left out of Indices and
+	// never kept nor used as the backdrop
+	Forbidden []int
+	// NES palette indexes left out of Indices by '--safe-colors', the pixels
+	// closest to them are counted as substituted
+	Unsafe []int
+	// Alpha from which pixels are opaque, the ones below are transparent in
+	// the output and the backdrop when baked. Semi-transparent pixels are
+	// blended over black when nil
+	AlphaThreshold *uint8
+	// Starlark hooks called while remapping, none when nil
+	Script *Script
+}
+
+// Maps every pixel of img to the index of its closest color in p, like
+// nespal.Remap without a context
+func remap_image(img image.Image, p color.Palette, opts RemapOptions) *image.Paletted {
+	remapped, _ := nespal.Remap(context.Background(), img, p, opts.Options)
+	return remapped
+}
+
+// Applies the matte and pre-passes of opts to img, like nespal.Preprocess
+func preprocess(img image.Image, p color.Palette, opts RemapOptions) image.Image {
+	return nespal.Preprocess(img, p, opts.Options)
+}
+
+// Copies the pixels of src out of opts.ROI over dst, or the ones in it with
+// opts.Outside, so they pass through untouched
+func pass_through(dst *image.RGBA, src image.Image, opts RemapOptions) {
+	if opts.ROI == nil {
+		return
+	}
+
+	bounds := src.Bounds()
+	roi := opts.ROI.Add(bounds.Min)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if image.Pt(x, y).In(roi) == opts.Outside {
+				dst.Set(x, y, src.At(x, y))
+			}
+		}
+	}
+}
+
+// Makes the pixels of dst transparent where img is, when opts has an alpha
+// threshold
+func clear_transparent(dst *image.RGBA, img image.Image, opts RemapOptions) {
+	if opts.AlphaThreshold == nil {
+		return
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if transparent(img, x, y) {
+				dst.SetRGBA(x, y, color.RGBA{})
+			}
+		}
+	}
+}
+
+// Counts the pixels of img whose closest color in p is one of opts.Unsafe,
+// which were remapped to the nearest safe color instead
+func unsafe_pixels(img image.Image, p color.Palette, opts RemapOptions) int {
+	if len(opts.Unsafe) == 0 {
+		return 0
+	}
+
+	// in index order, so ties go to the same index as without the flag
+	indices := slices.Sorted(slices.Values(slices.Concat(opts.Indices, opts.Unsafe)))
+	matcher := nespal.NewMatcher(p, opts.Metric)
+	bounds := img.Bounds()
+	count := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := img.At(x, y)
+			if _, ok := opts.Keep[nespal.ToRGB(c)]; ok {
+				continue
+			}
+			if slices.Contains(opts.Unsafe, matcher.Closest(c, indices)) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// Logs how many pixels of img '--safe-colors' moved away from an unsafe
+// color, if any
+func report_unsafe(img image.Image, p color.Palette, opts RemapOptions, name string) {
+	if n := unsafe_pixels(img, p, opts); n > 0 {
+		log.Printf("%s: %s: %d pixels remapped to the nearest safe color\n", ex, name, n)
+	}
+}
+
+// Writes the palette index of every pixel, row by row, as raw bytes
+// or as a PGM image when dst_path ends in .pgm
+func write_index_map(m *image.Paletted, dst_path string) error {
+	f, err := os.Create(dst_path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bounds := m.Bounds()
+	if strings.EqualFold(filepath.Ext(dst_path), ".pgm") {
+		_, err = fmt.Fprintf(f, "P5\n%d %d\n%d\n", bounds.Dx(), bounds.Dy(), nespal.PALETTE_SIZE-1)
+		if err != nil {
+			return err
+		}
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		i := m.PixOffset(bounds.Min.X, y)
+		if _, err := f.Write(m.Pix[i : i+bounds.Dx()]); err != nil {
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// Encodes img into dst_path, in the format given by its extension, along
+// with meta if it is not nil
+func write_image(img image.Image, dst_path string, meta *nespal.Metadata) (int, error) {
+	ext := strings.ToLower(filepath.Ext(dst_path))
+	if ext != ".png" && ext != ".jpg" && ext != ".jpeg" && ext != ".gif" {
+		return 2, errors.New("Output type is not a supported format")
+	}
+
+	f, err := os.Create(dst_path)
+	if err != nil {
+		return 1, err
+	}
+	defer f.Close()
+
+	if err := nespal.EncodeImage(f, img, ext, meta); err != nil {
+		return 1, err
+	}
+
+	if err := f.Close(); err != nil {
+		return 1, err
+	}
+	return 0, nil
+}
+
+// Decodes the image at path, turned upright, or reads it as a raw
+// framebuffer when given --raw
+func load_image(path string) (image.Image, error) {
+	if raw_format != nil {
+		rows, err := open_raw_rows(path, raw_format)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		return nespal.ReadImage(rows)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return nespal.DecodeImage(file)
+}
+
+// Opens an image to be read row by row, PNGs are decoded while read and
+// other formats, or PNGs with an EXIF orientation, are decoded all at once.
+// Raw framebuffers given with --raw are read while they arrive
+func open_rows(path string) (nespal.RowReader, error) {
+	if raw_format != nil {
+		return open_raw_rows(path, raw_format)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := nespal.NewPNGRows(file, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if rows != nil {
+		return rows, nil
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	defer file.Close()
+
+	img, err := nespal.DecodeImage(file)
+	if err != nil {
+		return nil, err
+	}
+	return nespal.NewImageRows(img), nil
+}
+
+// Whether the remap can be done band by band, like nespal.CanStream tells,
+// with no outputs other than the remapped image, no pixels to count for
+// '--safe-colors' nor passing through, and no script to call
+func can_stream(opts RemapOptions) bool {
+	outputs := opts.IndexMap == "" && opts.ExportC == "" && opts.ExportAsm == ""
+	return nespal.CanStream(opts.Options) && len(opts.Unsafe) == 0 && opts.ROI == nil && opts.Script == nil && outputs
+}
+
+// Remaps the image read from rows into dst_path like remap does, a band of
+// rows at a time
+func remap_stream(rows nespal.RowReader, p color.Palette, dst_path string, opts RemapOptions) (int, error) {
+	s := nespal.NewStreamedRemap(context.Background(), rows, p, opts.Options)
+	status, err := write_image(s, dst_path, opts.Metadata)
+	if s.Err() != nil {
+		return 1, s.Err()
+	}
+	return status, err
+}
+
+func remap(img image.Image, p color.Palette, dst_path string, opts RemapOptions) (int, error) {
+	// the paletted image has the whole NES palette in index order, so its
+	// pixels are the NES palette indexes
+	source := img
+	img = preprocess(img, p, opts)
+	if opts.Script != nil {
+		var err error
+		if opts, err = opts.Script.veto(p, opts); err != nil {
+			return 1, err
+		}
+		if img, err = opts.Script.adjust(img); err != nil {
+			return 1, err
+		}
+	}
+	indexed := remap_image(img, p, opts)
+	if opts.Script != nil {
+		if err := opts.Script.post(indexed, opts); err != nil {
+			return 1, err
+		}
+	}
+	report_unsafe(img, p, opts, dst_path)
+	var remapped image.Image = indexed
+	if !opts.PreserveIndexOrder {
+		rgba := image.NewRGBA(indexed.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), indexed, indexed.Bounds().Min, draw.Src)
+		clear_transparent(rgba, img, opts)
+		pass_through(rgba, source, opts)
+		remapped = rgba
+	}
+
+	if status, err := write_image(remapped, dst_path, opts.Metadata); err != nil {
+		return status, err
+	}
+
+	if opts.IndexMap != "" {
+		if err := write_index_map(indexed, opts.IndexMap); err != nil {
+			return 1, err
+		}
+	}
+
+	if opts.ExportC != "" {
+		if err := write_export_c(indexed, opts.ExportC); err != nil {
+			return 1, err
+		}
+	}
+
+	if opts.ExportAsm != "" {
+		if err := write_export_asm(indexed, opts.ExportAsm); err != nil {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
+
+// Runs the remap command given in the arguments
+func run_remap() int {
+	chosen_pal := pflag.StringP("palette", "p", "", "Color palette to remap image to")
+	index_map := pflag.String("index-map", "", "Write the NES palette index of every pixel to a file")
+	export_c := pflag.String("export-c", "", "Export the palette and indexes as C arrays")
+	export_asm := pflag.String("export-asm", "", "Export the palette and indexes as ca65 .byte tables")
+	keep_metadata := pflag.Bool("keep-metadata", false, "Copy the text, resolution and EXIF metadata of the image")
+	preserve_order := pflag.Bool("preserve-index-order", false, "Write a paletted image with the whole NES palette in index order")
+	force := pflag.Bool("force", false, "Remap every image of a batch, even the ones not changed since the last run")
+	preview := pflag.String("preview", "", "Show the remapped image in the terminal with a graphics protocol: auto, sixel, kitty or iterm")
+	resume := pflag.Bool("resume", false, "Keep a journal of the images remapped, to resume the batch where a killed run stopped")
+	roi := pflag.String("roi", "", "Only remap an area of the image, as 'x,y,w,h', the rest passes through untouched")
+	outside := pflag.Bool("outside", false, "Remap everything but the area of '--roi'")
+	raw := pflag.String("raw", "", "Read the images as raw framebuffers, like '256x240:rgb', '-' being the standard input")
+	script := pflag.String("script", "", "Starlark file defining hooks called while remapping, like 'adjust(color)'")
+	files_from := files_from_flags(pflag.CommandLine)
+	open_results := results_flags(pflag.CommandLine)
+	remap_opts := remap_flags(pflag.CommandLine)
+	pflag.Parse()
+	args := pflag.Args()
+
+	opts, err := remap_opts()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	if err := setup_memory_budget(); err != nil {
+		log.Println(err)
+		return 2
+	}
+	if *preview != "" {
+		if *preview, err = parse_preview(*preview); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+	if *raw != "" {
+		if raw_format, err = parse_raw(*raw); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+	if *script != "" {
+		if opts.Script, err = load_script(*script); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+	opts.IndexMap, opts.ExportC, opts.ExportAsm = *index_map, *export_c, *export_asm
+	opts.PreserveIndexOrder = *preserve_order
+
+	if *outside && *roi == "" {
+		log.Printf("%s: flag '--outside' requires '--roi'\n", ex)
+		return 2
+	}
+	if *roi != "" {
+		// the pixels passing through have no NES palette index
+		if opts.IndexMap != "" || opts.ExportC != "" || opts.ExportAsm != "" || opts.PreserveIndexOrder {
+			log.Printf("%s: flag '--roi' can not be used with '--index-map', '--export-c', '--export-asm' nor '--preserve-index-order'\n", ex)
+			return 2
+		}
+		r, err := parse_rect(*roi)
+		if err != nil {
+			log.Println(err)
+			return 2
+		}
+		opts.ROI, opts.Outside = &r, *outside
+	}
+
+	// listed images are always remapped into an output directory
+	listed, err := files_from()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if len(args) == 1 && listed == nil {
+		log.Printf("%s: missing image file\n", ex)
+		return 2
+	}
+
+	var (
+		pal      io.Reader
+		pal_name string
+		images   []string
+	)
+	if *chosen_pal != "" {
+		res := make([]rune, 0, len(*chosen_pal))
+		for _, r := range *chosen_pal {
+			if !unicode.IsSpace(r) {
+				res = append(res, r)
+			}
+		}
+		if string(res) == "" {
+			log.Printf("%s: empty value for '--palette' flag", ex)
+			return 2
+		}
+
+		if strings.Contains(*chosen_pal, ".") {
+			log.Printf("%s: invalid value '%s' for '--palette' flag", ex, *chosen_pal)
+			return 2
+		}
+
+		file, err := find_palette(*chosen_pal)
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+
+		if file == nil {
+			log.Println(unknown_palette(*chosen_pal))
+			return 2
+		}
+		defer file.Close()
+
+		if len(args) == 2 && listed == nil || len(args) == 1 {
+			log.Printf("%s: missing output image\n", ex)
+			return 2
+		}
+		pal, pal_name, images = file, *chosen_pal, args[1:len(args)-1]
+	} else {
+		if len(args) == 2 && listed == nil || len(args) == 1 {
+			log.Printf("%s: missing color palette\n", ex)
+			return 2
+		}
+
+		// the palette comes right before the output, after every image
+		pal_arg := len(args) - 2
+		if len(args) == 3 && listed == nil || filepath.Ext(args[len(args)-1]) == ".pal" {
+			pal_arg = len(args) - 1
+		}
+		if filepath.Ext(args[pal_arg]) != ".pal" {
+			log.Printf("%s: usupported palette file format for '%s', expected '.pal'\n", ex, args[pal_arg])
+			return 2
+		}
+
+		if pal_arg == len(args)-1 {
+			log.Printf("%s: missing output image\n", ex)
+			return 2
+		}
+
+		file, err := os.Open(args[pal_arg])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		defer file.Close()
+		pal, pal_name, images = file, strings.TrimSuffix(filepath.Base(args[pal_arg]), ".pal"), args[1:pal_arg]
+	}
+	output := args[len(args)-1]
+	images = append(images, listed...)
+
+	// every image is remapped with the same palette, read once so its
+	// problems are only reported once
+	p, err := load_palette(pal)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	pal_data := make([]byte, 0, len(p)*3)
+	for _, c := range p {
+		rgb := nespal.ToRGB(c)
+		pal_data = append(pal_data, rgb.R, rgb.G, rgb.B)
+	}
+
+	// the outputs of a single image are shown in the terminal with
+	// '--preview' once written
+	show := func(path string) error {
+		if *preview == "" {
+			return nil
+		}
+		return preview_image(path, *preview)
+	}
+
+	do_remap := func(src_path string, dst_path string) ([]string, int, error) {
+		// every page of a TIFF file is remapped, into numbered outputs
+		pages, err := tiff_pages(src_path)
+		if err != nil {
+			return nil, 1, err
+		}
+		if len(pages) > 1 {
+			outputs := make([]string, len(pages))
+			for i, page := range pages {
+				opts := opts
+				for _, path := range []*string{&opts.IndexMap, &opts.ExportC, &opts.ExportAsm} {
+					if *path != "" {
+						*path = page_path(*path, i+1)
+					}
+				}
+				outputs[i] = page_path(dst_path, i+1)
+				if status, err := remap(page, p, outputs[i], opts); err != nil {
+					return nil, status, err
+				}
+				if err := show(outputs[i]); err != nil {
+					return nil, 1, err
+				}
+			}
+			return outputs, 0, nil
+		}
+
+		opts := opts
+		if *keep_metadata {
+			meta, err := nespal.ReadMetadata(src_path)
+			if err != nil {
+				return nil, 1, err
+			}
+			opts.Metadata = meta
+		}
+
+		// images that only need their colors remapped are streamed in bands
+		if can_stream(opts) {
+			rows, err := open_rows(src_path)
+			if err != nil {
+				return nil, 1, err
+			}
+			defer rows.Close()
+			if status, err := remap_stream(rows, p, dst_path, opts); err != nil {
+				return nil, status, err
+			}
+			return []string{dst_path}, 0, show(dst_path)
+		}
+
+		source, err := load_image(src_path)
+		if err != nil {
+			return nil, 1, err
+		}
+		if status, err := remap(source, p, dst_path, opts); err != nil {
+			return nil, status, err
+		}
+		return []string{dst_path}, 0, show(dst_path)
+	}
+
+	if len(images) == 1 && listed == nil {
+		if _, status, err := do_remap(images[0], output); err != nil {
+			log.Println(err)
+			return status
+		}
+		return 0
+	}
+
+	// several images are written to the output directory, as PNGs named
+	// after them
+	if opts.IndexMap != "" || opts.ExportC != "" || opts.ExportAsm != "" || *preview != "" {
+		log.Printf("%s: flags '--index-map', '--export-c', '--export-asm' and '--preview' take a single image\n", ex)
+		return 2
+	}
+	dsts, err := batch_outputs(images, output)
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	if err := os.MkdirAll(output, 0o755); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := open_results(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if batch_results != nil {
+		defer batch_results.Close()
+	}
+
+	// outputs whose image and settings did not change since the last run
+	// are skipped. An interrupt stops starting images, so the manifest
+	// still records the ones done
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	manifest := load_manifest(output)
+	if *resume {
+		if err := manifest.resume(); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	settings := settings_hash(pflag.CommandLine, pal_data)
+	status := run_jobs(ctx, images, func(i int, result *BatchResult) (int, error) {
+		dst := dsts[i]
+		result.Output, result.Palette = dst, pal_name
+
+		done, entry, err := manifest.up_to_date(images[i], dst, settings)
+		if err != nil {
+			return 1, err
+		}
+		if done && !*force {
+			result.skipped = true
+			return 0, nil
+		}
+
+		// the images wait for the memory they take under --max-memory
+		size, by_rows := image_size(images[i])
+		release, err := reserve_memory(ctx, size, by_rows && can_stream(opts))
+		if err != nil {
+			return 1, err
+		}
+		defer release()
+
+		outputs, status, err := do_remap(images[i], dst)
+		if err != nil {
+			manifest.forget(dst)
+			return status, err
+		}
+		// the pages of a TIFF file are made instead of dst
+		entry.Outputs = nil
+		if len(outputs) != 1 || outputs[0] != dst {
+			for _, path := range outputs {
+				entry.Outputs = append(entry.Outputs, filepath.Base(path))
+			}
+		}
+		if err := manifest.record(dst, entry); err != nil {
+			return 1, err
+		}
+		return status, nil
+	})
+	if err := manifest.save(); err != nil {
+		log.Println(err)
+		status = max(status, 1)
+	}
+	return status
+}
+
+// Returns the PNG every image of a batch is remapped into, named after the
+// image in the output directory. Images only told apart by their directory
+// or extension would be remapped into the same one, which is an error
+func batch_outputs(images []string, output string) ([]string, error) {
+	dsts := make([]string, len(images))
+	seen := map[string]int{}
+	for i, path := range images {
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		dsts[i] = filepath.Join(output, name+".png")
+		if j, ok := seen[dsts[i]]; ok {
+			return nil, fmt.Errorf("%s: images '%s' and '%s' would both be remapped into '%s'", ex, images[j], path, dsts[i])
+		}
+		seen[dsts[i]] = i
+	}
+	return dsts, nil
+}
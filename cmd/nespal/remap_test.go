@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Runs the command line with args, with flags parsed afresh, and returns
+// its exit code
+func run_command(t *testing.T, args ...string) int {
+	t.Helper()
+	saved_args, saved_flags := os.Args, pflag.CommandLine
+	defer func() { os.Args, pflag.CommandLine = saved_args, saved_flags }()
+	os.Args = append([]string{ex}, args...)
+	pflag.CommandLine = pflag.NewFlagSet(ex, pflag.ContinueOnError)
+	return run()
+}
+
+// Writes an image filled with c as a PNG at path
+func write_png(t *testing.T, path string, rect image.Rectangle, c color.Color) {
+	t.Helper()
+	m := image.NewRGBA(rect)
+	for i := 0; i < len(m.Pix); i += 4 {
+		rgb := nespal.ToRGB(c)
+		m.Pix[i], m.Pix[i+1], m.Pix[i+2], m.Pix[i+3] = rgb.R, rgb.G, rgb.B, 255
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := png.Encode(file, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads the image at path, failing the test when it cannot
+func read_png(t *testing.T, path string) image.Image {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	m, err := png.Decode(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestRemapChannelOrder(t *testing.T) {
+	p := test_named_palette(t, "FCEUX")
+	dir := t.TempDir()
+	var data []byte
+	for _, c := range p {
+		rgb := nespal.ToRGB(c)
+		data = append(data, rgb.B, rgb.G, rgb.R)
+	}
+	pal := filepath.Join(dir, "bgr.pal")
+	if err := os.WriteFile(pal, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "blue.png")
+	write_png(t, src, image.Rect(0, 0, 8, 8), p[0x12])
+
+	for _, order := range []string{CHANNELS_BGR, CHANNELS_AUTO} {
+		for _, args := range [][]string{{}, {"--dither", nespal.DITHER_FLOYD_STEINBERG}} {
+			dst := filepath.Join(dir, "out.png")
+			args = append([]string{"remap", src, "--channel-order", order}, args...)
+			if status := run_command(t, append(args, pal, dst)...); status != 0 {
+				t.Fatalf("%v: exit status %d", args, status)
+			}
+			if c := nespal.ToRGB(read_png(t, dst).At(0, 0)); c != nespal.ToRGB(p[0x12]) {
+				t.Fatalf("%v: got %v, want the $12 blue %v", args, c, nespal.ToRGB(p[0x12]))
+			}
+		}
+	}
+}
+
+func TestRemapBatchCollisions(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{"a/title.png", "b/title.png", "title.jpg", "other.png"} {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		write_png(t, path, image.Rect(0, 0, 4, 4), color.White)
+	}
+	list := func(paths ...string) string {
+		file := filepath.Join(t.TempDir(), "list.txt")
+		var data []byte
+		for _, path := range paths {
+			data = append(append(data, filepath.Join(dir, path)...), 0)
+		}
+		if err := os.WriteFile(file, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+	}{
+		{"same name in two directories", []string{filepath.Join(dir, "a/title.png"), filepath.Join(dir, "b/title.png")}, 2},
+		{"same name with two extensions", []string{filepath.Join(dir, "a/title.png"), filepath.Join(dir, "title.jpg")}, 2},
+		{"listed", []string{"--files-from", list("a/title.png", "other.png", "b/title.png"), "-0"}, 2},
+		{"different names", []string{filepath.Join(dir, "a/title.png"), filepath.Join(dir, "other.png")}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "out")
+			args := append(append([]string{"remap"}, test.args...), "--palette", "FCEUX", output)
+			if status := run_command(t, args...); status != test.status {
+				t.Fatalf("exit status %d, want %d", status, test.status)
+			}
+			// nothing is remapped when two images collide
+			if _, err := os.Stat(output); test.status != 0 && !os.IsNotExist(err) {
+				t.Fatalf("output directory written: %v", err)
+			}
+		})
+	}
+}
+
+// Returns the status of every image in the --results file at path
+func read_statuses(t *testing.T, path string) map[string]string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]string{}
+	for line := range bytes.Lines(data) {
+		var result BatchResult
+		if err := json.Unmarshal(line, &result); err != nil {
+			t.Fatal(err)
+		}
+		statuses[filepath.Base(result.Input)] = result.Status
+	}
+	return statuses
+}
+
+func TestRemapBatchSettingsFiles(t *testing.T) {
+	p := test_named_palette(t, "FCEUX")
+	dir := t.TempDir()
+	for _, name := range []string{"a.png", "b.png"} {
+		write_png(t, filepath.Join(dir, name), image.Rect(0, 0, 4, 4), color.White)
+	}
+
+	tests := []struct {
+		flag    string
+		name    string
+		content func(index string) string
+	}{
+		{"--map", "map.json", func(index string) string { return fmt.Sprintf(`{"#FFFFFF": "%s"}`, index) }},
+		{"--script", "transform.star", func(index string) string {
+			return fmt.Sprintf("def post(x, y, index):\n    return 0%s\n", strings.Replace(index, "$", "x", 1))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.flag, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), test.name)
+			output := filepath.Join(t.TempDir(), "out")
+			results := filepath.Join(t.TempDir(), "results.jsonl")
+
+			// the outputs are skipped until the file changes
+			for _, run := range []struct {
+				index  string
+				status string
+			}{{"$30", "done"}, {"$30", "skipped"}, {"$16", "done"}} {
+				if err := os.WriteFile(file, []byte(test.content(run.index)), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				args := []string{"remap", filepath.Join(dir, "a.png"), filepath.Join(dir, "b.png"), test.flag, file, "--results", results, "--palette", "FCEUX", output}
+				if status := run_command(t, args...); status != 0 {
+					t.Fatalf("%s: exit status %d", run.index, status)
+				}
+				for name, status := range read_statuses(t, results) {
+					if status != run.status {
+						t.Fatalf("%s: %s was %s, want %s", run.index, name, status, run.status)
+					}
+				}
+				i, _ := parse_nes_index(run.index)
+				if c := nespal.ToRGB(read_png(t, filepath.Join(output, "a.png")).At(0, 0)); c != nespal.ToRGB(p[i]) {
+					t.Fatalf("%s: got %v, want %v", run.index, c, nespal.ToRGB(p[i]))
+				}
+			}
+		})
+	}
+}
+
+func TestSettingsHash(t *testing.T) {
+	mapping := filepath.Join(t.TempDir(), "map.json")
+	hash := func(content string, args ...string) string {
+		if err := os.WriteFile(mapping, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		flags := pflag.NewFlagSet(ex, pflag.ContinueOnError)
+		flags.String("raw", "", "")
+		flags.String("map", "", "")
+		flags.Int("jobs", 1, "")
+		if err := flags.Parse(append(args, "--map", mapping)); err != nil {
+			t.Fatal(err)
+		}
+		return settings_hash(flags, []byte("palette"))
+	}
+
+	base := hash(`{"#FFFFFF": 48}`, "--raw", "256x240:rgb")
+	for _, test := range []struct {
+		name    string
+		content string
+		args    []string
+		same    bool
+	}{
+		{"same", `{"#FFFFFF": 48}`, []string{"--raw", "256x240:rgb"}, true},
+		{"ignored flag", `{"#FFFFFF": 48}`, []string{"--raw", "256x240:rgb", "--jobs", "4"}, true},
+		{"raw format", `{"#FFFFFF": 48}`, []string{"--raw", "256x240:bgr"}, false},
+		{"mapping", `{"#FFFFFF": 22}`, []string{"--raw", "256x240:rgb"}, false},
+	} {
+		if got := hash(test.content, test.args...); (got == base) != test.same {
+			t.Errorf("%s: hash changed: %v, want %v", test.name, got != base, !test.same)
+		}
+	}
+}
+
+// Writes an uncompressed grayscale TIFF file at path with a page of every
+// gray, all of them 4x4
+func write_tiff(t *testing.T, path string, grays ...uint8) {
+	t.Helper()
+	data := []byte(TIFF_LE + "\x00\x00\x00\x00")
+	next := 4
+	for _, gray := range grays {
+		pixels := len(data)
+		data = append(data, bytes.Repeat([]byte{gray}, 16)...)
+		binary.LittleEndian.PutUint32(data[next:], uint32(len(data)))
+		fields := [][3]uint32{
+			{tiff_width, 3, 4}, {tiff_height, 3, 4}, {tiff_bits, 3, 8}, {tiff_compression, 3, 1},
+			{tiff_photometric, 3, 1}, {tiff_strip_offsets, 4, uint32(pixels)}, {tiff_samples, 3, 1}, {tiff_strip_counts, 4, 16},
+		}
+		data = binary.LittleEndian.AppendUint16(data, uint16(len(fields)))
+		for _, f := range fields {
+			data = binary.LittleEndian.AppendUint16(data, uint16(f[0]))
+			data = binary.LittleEndian.AppendUint16(data, uint16(f[1]))
+			data = binary.LittleEndian.AppendUint32(data, 1)
+			data = binary.LittleEndian.AppendUint32(data, f[2])
+		}
+		next = len(data)
+		data = binary.LittleEndian.AppendUint32(data, 0)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemapBatchPages(t *testing.T) {
+	dir := t.TempDir()
+	write_tiff(t, filepath.Join(dir, "scan.tif"), 0, 255)
+	write_png(t, filepath.Join(dir, "title.png"), image.Rect(0, 0, 4, 4), color.White)
+	output := filepath.Join(t.TempDir(), "out")
+	results := filepath.Join(t.TempDir(), "results.jsonl")
+	remap := func(want map[string]string) {
+		t.Helper()
+		args := []string{"remap", filepath.Join(dir, "scan.tif"), filepath.Join(dir, "title.png"), "--results", results, "--palette", "FCEUX", output}
+		if status := run_command(t, args...); status != 0 {
+			t.Fatalf("exit status %d", status)
+		}
+		if got := read_statuses(t, results); !maps.Equal(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+
+	remap(map[string]string{"scan.tif": "done", "title.png": "done"})
+	for _, name := range []string{"scan-1.png", "scan-2.png"} {
+		if _, err := os.Stat(filepath.Join(output, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	remap(map[string]string{"scan.tif": "skipped", "title.png": "skipped"})
+
+	// a page removed makes every page again
+	if err := os.Remove(filepath.Join(output, "scan-2.png")); err != nil {
+		t.Fatal(err)
+	}
+	remap(map[string]string{"scan.tif": "done", "title.png": "skipped"})
+	if _, err := os.Stat(filepath.Join(output, "scan-2.png")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+const (
+	// Width in pixels, and so in characters, of the previews of replace
+	// drawn with text
+	REPLACE_WIDTH = 80
+	// Number of source colors listed by replace unless asked for more
+	REPLACE_LIST = 16
+)
+
+// A color of an image and the number of its pixels
+type SourceColor struct {
+	Color  color.RGBA
+	Pixels int
+}
+
+// Returns the opaque colors of img, the most used first
+func source_colors(img image.Image) []SourceColor {
+	bounds := img.Bounds()
+	counts := map[color.RGBA]int{}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if c := img.At(x, y); opaque(c) {
+				counts[nespal.ToRGB(c)]++
+			}
+		}
+	}
+
+	colors := make([]SourceColor, 0, len(counts))
+	for c, n := range counts {
+		colors = append(colors, SourceColor{c, n})
+	}
+	slices.SortFunc(colors, func(a, b SourceColor) int {
+		if a.Pixels != b.Pixels {
+			return b.Pixels - a.Pixels
+		}
+		return strings.Compare(hex_color(a.Color), hex_color(b.Color))
+	})
+	return colors
+}
+
+// Writes a color mapping as load_color_map reads it
+func write_color_map(mapping map[color.RGBA]uint8, path string) error {
+	entries := make(map[string]string, len(mapping))
+	for c, i := range mapping {
+		entries[hex_color(c)] = fmt.Sprintf("$%02X", i)
+	}
+	data, err := json.MarshalIndent(entries, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o644)
+}
+
+// Draws the pixels of remapped whose color in src is c over the others
+// faded, so they can be found
+func highlight_color(remapped *image.Paletted, src image.Image, c color.RGBA) *image.RGBA {
+	bounds := remapped.Bounds()
+	res := image.NewRGBA(bounds)
+	gray := color.RGBA{128, 128, 128, 255}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			out := nespal.ToRGB(remapped.At(x, y))
+			if nespal.ToRGB(src.At(x, y)) != c {
+				out = blend_half(blend_half(out, gray), gray)
+			}
+			res.SetRGBA(x, y, out)
+		}
+	}
+	return res
+}
+
+// Lets the user pick the colors of img remapped to the wrong NES palette
+// index and replace it, showing the image remapped with every change. The
+// previews are drawn with the protocol, or as text when it is empty. The
+// mapping starts from opts.Keep and is written to map_path after every
+// change, along with the remapped image to output when given. The prompts
+// are written to ui and the answers read from in
+func replace_colors(img image.Image, p color.Palette, opts RemapOptions, map_path string, output string, protocol string, in io.Reader, ui io.Writer) error {
+	src := preprocess(img, p, opts)
+	colors := source_colors(src)
+	matcher := nespal.NewMatcher(p, opts.Metric)
+	mapping := maps.Clone(opts.Keep)
+	if mapping == nil {
+		mapping = map[color.RGBA]uint8{}
+	}
+	total := 0
+	for _, c := range colors {
+		total += c.Pixels
+	}
+
+	show := func(m image.Image) error {
+		if protocol != "" {
+			return write_preview(ui, m, protocol)
+		}
+		bounds := m.Bounds()
+		w, h, err := parse_size(fmt.Sprintf("%dx", min(REPLACE_WIDTH, bounds.Dx())), bounds)
+		if err != nil {
+			return err
+		}
+		return write_ansi(resize_image(m, w, h), ui)
+	}
+	list := func(n int) {
+		for i, c := range colors[:min(n, len(colors))] {
+			index, kept := mapping[c.Color]
+			if !kept {
+				index = uint8(matcher.Closest(c.Color, opts.Indices))
+			}
+			note := ""
+			if kept {
+				note = " (replaced)"
+			}
+			to := nespal.ToRGB(p[index])
+			fmt.Fprintf(ui, "%3d. \x1b[48;2;%d;%d;%dm  \x1b[0m %s %5.1f%% => \x1b[48;2;%d;%d;%dm  \x1b[0m $%02X %s%s\n",
+				i+1, c.Color.R, c.Color.G, c.Color.B, hex_color(c.Color), float64(c.Pixels)*100/float64(max(total, 1)),
+				to.R, to.G, to.B, index, hex_color(to), note)
+		}
+		if n < len(colors) {
+			fmt.Fprintf(ui, "     %d more colors, 'l %d' lists them all\n", len(colors)-n, len(colors))
+		}
+	}
+	// finds the source color of a number of the list or of a hex color
+	find := func(value string) (color.RGBA, error) {
+		if strings.HasPrefix(value, "#") {
+			return parse_hex_color(value)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > len(colors) {
+			return color.RGBA{}, fmt.Errorf("invalid color '%s', expected a number from 1 to %d or a color like #E04040", value, len(colors))
+		}
+		return colors[n-1].Color, nil
+	}
+
+	opts.Keep = mapping
+	remapped := remap_image(src, p, opts)
+	if err := show(remapped); err != nil {
+		return err
+	}
+	list(REPLACE_LIST)
+
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(ui, "Color by number or like #E04040, then an index like $16 to replace it or - to undo it, a color alone to show it, l [n] to list, q to quit: ")
+		if !scanner.Scan() {
+			fmt.Fprintln(ui)
+			return scanner.Err()
+		}
+
+		fields := strings.Fields(scanner.Text())
+		switch {
+		case len(fields) == 0:
+			continue
+		case fields[0] == "q":
+			return nil
+		case fields[0] == "l":
+			n := REPLACE_LIST
+			if len(fields) > 1 {
+				if v, err := strconv.Atoi(fields[1]); err == nil && v > 0 {
+					n = v
+				}
+			}
+			list(n)
+			continue
+		}
+
+		c, err := find(fields[0])
+		if err != nil {
+			fmt.Fprintln(ui, strings.TrimPrefix(err.Error(), ex+": "))
+			continue
+		}
+		if len(fields) == 1 {
+			if err := show(highlight_color(remapped, src, c)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if fields[1] == "-" {
+			delete(mapping, c)
+		} else {
+			i, err := parse_nes_index(fields[1])
+			if err != nil {
+				fmt.Fprintln(ui, strings.TrimPrefix(err.Error(), ex+": "))
+				continue
+			}
+			if flag := opts.unusable(i); flag != "" {
+				fmt.Fprintf(ui, "$%02X can not be used, '%s' leaves it out\n", i, flag)
+				continue
+			}
+			mapping[c] = uint8(i)
+		}
+
+		remapped = remap_image(src, p, opts)
+		if err := show(remapped); err != nil {
+			return err
+		}
+		if err := write_color_map(mapping, map_path); err != nil {
+			return err
+		}
+		if output != "" {
+			if _, err := write_image(remapped, output, nil); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Runs the replace command given in the arguments
+func run_replace() int {
+	preview := pflag.String("preview", "", "Draw the previews with a graphics protocol: auto, sixel, kitty or iterm")
+	remap_opts := remap_flags(pflag.CommandLine)
+	pflag.Parse()
+	args := pflag.Args()
+
+	opts, err := remap_opts()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+	if *preview != "" {
+		if *preview, err = parse_preview(*preview); err != nil {
+			log.Println(err)
+			return 2
+		}
+	}
+
+	if len(args) == 1 {
+		log.Printf("%s: missing image file\n", ex)
+		return 2
+	}
+	if len(args) == 2 {
+		log.Printf("%s: missing color palette\n", ex)
+		return 2
+	}
+	if len(args) == 3 {
+		log.Printf("%s: missing mapping file\n", ex)
+		return 2
+	}
+	output := ""
+	if len(args) > 4 {
+		output = args[4]
+	}
+
+	img, err := load_image(args[1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	p, _, err := load_named_palette(args[2])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	// the colors given in the command line take precedence over the file
+	if _, err := os.Stat(args[3]); err == nil {
+		mapping, err := load_color_map(args[3])
+		if err != nil {
+			log.Println(err)
+			return 1
+		}
+		maps.Copy(mapping, opts.Keep)
+		opts.Keep = mapping
+	}
+
+	if err := replace_colors(img, p, opts, args[3], output, *preview, os.Stdin, os.Stderr); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
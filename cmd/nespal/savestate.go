@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Size of the frames of the NES PPU
+const (
+	FRAME_WIDTH  = 256
+	FRAME_HEIGHT = 240
+)
+
+// Size of the palette RAM of the NES PPU, the backdrop and the background
+// sub-palettes followed by the sprite ones
+const PALETTE_RAM_SIZE = 32
+
+// Console type of the Mesen 2 savestates of NES games
+const MESEN_NES = 2
+
+// The frame and the palette RAM kept in an emulator savestate
+type Savestate struct {
+	// Emulator the savestate was made with
+	Emulator string
+	Width    int
+	Height   int
+	// NES palette index of every pixel, with its emphasis bits above the
+	// sixth bit like the PPU outputs them
+	Pixels []uint16
+	// Contents of the palette RAM, nil when the savestate does not have it
+	PaletteRAM []byte
+}
+
+// Reads the frame and the palette RAM of a FCEUX (.fcs) or Mesen 2 (.mss)
+// savestate
+func read_savestate(data []byte) (*Savestate, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("FCSX")):
+		return read_fcs(data)
+	case bytes.HasPrefix(data, []byte("MSS")):
+		return read_mss(data)
+	case bytes.HasPrefix(data, []byte("MST")):
+		return nil, fmt.Errorf("%s: Mesen 1 savestates (.mst) are not supported, they keep no frame and their fields have no names to find the palette RAM by; load the game in Mesen 2 and save the state there instead", ex)
+	case bytes.HasPrefix(data, []byte("FCS")):
+		return nil, fmt.Errorf("%s: savestates of FCEU versions before FCEUX keep no frame", ex)
+	}
+	return nil, fmt.Errorf("%s: unknown savestate format, expected a FCEUX or Mesen 2 savestate", ex)
+}
+
+// Reads a FCEUX savestate: a header followed by chunks, compressed with
+// zlib or not. The chunk 8 is the frame shown when it was saved, as NES
+// palette indexes in rows of 256 pixels, and the PPU chunk 3 holds the
+// palette RAM (PRAM) and the registers (PPUR), the emphasis bits being the
+// top ones of the mask register
+func read_fcs(data []byte) (*Savestate, error) {
+	if len(data) < 16 {
+		return nil, fmt.Errorf("%s: truncated FCEUX savestate", ex)
+	}
+	size, compressed := binary.LittleEndian.Uint32(data[4:]), binary.LittleEndian.Uint32(data[12:])
+	body := data[16:]
+	if compressed != 0xFFFFFFFF {
+		r, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid FCEUX savestate: %w", ex, err)
+		}
+		if body, err = io.ReadAll(io.LimitReader(r, int64(size))); err != nil {
+			return nil, fmt.Errorf("%s: invalid FCEUX savestate: %w", ex, err)
+		}
+	}
+
+	state := &Savestate{Emulator: "FCEUX", Width: FRAME_WIDTH, Height: FRAME_HEIGHT}
+	emphasis := uint16(0)
+	for len(body) >= 5 {
+		kind, n := body[0], int(binary.LittleEndian.Uint32(body[1:]))
+		if n > len(body)-5 {
+			return nil, fmt.Errorf("%s: truncated FCEUX savestate", ex)
+		}
+		chunk := body[5 : 5+n]
+		body = body[5+n:]
+
+		switch kind {
+		case 3:
+			for len(chunk) >= 8 {
+				desc, m := string(chunk[:4]), int(binary.LittleEndian.Uint32(chunk[4:]))
+				if m > len(chunk)-8 {
+					break
+				}
+				value := chunk[8 : 8+m]
+				chunk = chunk[8+m:]
+
+				switch {
+				case desc == "PRAM" && m == PALETTE_RAM_SIZE:
+					state.PaletteRAM = value
+				case desc == "PPUR" && m >= 2:
+					emphasis = uint16(value[1]>>5) << 6
+				}
+			}
+		case 8:
+			if n < FRAME_WIDTH*FRAME_HEIGHT {
+				return nil, fmt.Errorf("%s: truncated frame in FCEUX savestate", ex)
+			}
+			state.Pixels = make([]uint16, FRAME_WIDTH*FRAME_HEIGHT)
+			for i := range state.Pixels {
+				state.Pixels[i] = uint16(chunk[i] & 0x3F)
+			}
+		}
+	}
+
+	if state.Pixels == nil {
+		return nil, fmt.Errorf("%s: FCEUX savestate has no frame", ex)
+	}
+	for i := range state.Pixels {
+		state.Pixels[i] |= emphasis
+	}
+	return state, nil
+}
+
+// Reads a Mesen 2 savestate: a header with the frame shown when it was
+// saved, compressed with zlib as the 16 bits pixels the PPU outputs, then
+// the name of the game and the compressed state, where the palette RAM is
+// a field named after it
+func read_mss(data []byte) (*Savestate, error) {
+	r := bytes.NewReader(data[3:])
+	var header struct {
+		EmuVersion, FormatVersion, ConsoleType uint32
+		FrameSize, Width, Height, Scale        uint32
+		CompressedSize                         uint32
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("%s: truncated Mesen savestate", ex)
+	}
+	if header.ConsoleType != MESEN_NES || header.Width == 0 || header.Height == 0 || header.FrameSize != header.Width*header.Height*2 {
+		return nil, fmt.Errorf("%s: Mesen savestate is not of a NES game", ex)
+	}
+	if int64(header.CompressedSize) > int64(r.Len()) {
+		return nil, fmt.Errorf("%s: truncated Mesen savestate", ex)
+	}
+
+	compressed := make([]byte, header.CompressedSize)
+	r.Read(compressed)
+	frame, err := inflate(compressed, int(header.FrameSize))
+	if err != nil || len(frame) != int(header.FrameSize) {
+		return nil, fmt.Errorf("%s: invalid frame in Mesen savestate", ex)
+	}
+
+	state := &Savestate{Emulator: "Mesen", Width: int(header.Width), Height: int(header.Height)}
+	state.Pixels = make([]uint16, len(frame)/2)
+	for i := range state.Pixels {
+		state.Pixels[i] = binary.LittleEndian.Uint16(frame[i*2:]) & 0x1FF
+	}
+
+	// the palette RAM is only looked for, the layout of the state changes
+	// between versions of Mesen
+	var name_size uint32
+	if binary.Read(r, binary.LittleEndian, &name_size) == nil && int64(name_size) <= int64(r.Len()) {
+		r.Seek(int64(name_size), io.SeekCurrent)
+		var sizes [2]uint32
+		if binary.Read(r, binary.LittleEndian, &sizes) == nil && int64(sizes[1]) <= int64(r.Len()) {
+			compressed := make([]byte, sizes[1])
+			r.Read(compressed)
+			if body, err := inflate(compressed, int(sizes[0])); err == nil {
+				state.PaletteRAM = find_palette_ram(body)
+			}
+		}
+	}
+	return state, nil
+}
+
+// Decompresses zlib data, reading at most size bytes
+func inflate(data []byte, size int) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, int64(size)))
+}
+
+// Finds the palette RAM among the fields of a Mesen state, each written as
+// its name ended by a zero byte, its size and its value
+func find_palette_ram(body []byte) []byte {
+	const NAME = "paletteRam\x00"
+	for i := 0; ; {
+		j := bytes.Index(body[i:], []byte(NAME))
+		if j < 0 {
+			return nil
+		}
+		at := i + j + len(NAME)
+		if at+4+PALETTE_RAM_SIZE <= len(body) && binary.LittleEndian.Uint32(body[at:]) == PALETTE_RAM_SIZE {
+			return body[at+4 : at+4+PALETTE_RAM_SIZE]
+		}
+		i = at
+	}
+}
+
+// Returns the frame of a savestate as a paletted image of the NES palette
+// indexes, without the emphasis bits
+func (s *Savestate) indexed(p color.Palette) *image.Paletted {
+	m := image.NewPaletted(image.Rect(0, 0, s.Width, s.Height), p)
+	for i, v := range s.Pixels {
+		m.Pix[i] = uint8(v & 0x3F)
+	}
+	return m
+}
+
+// Renders the frame of a savestate with a palette, the emphasized pixels
+// with the colors of the emphasis banks of the palette when it has them
+func (s *Savestate) render(base color.Palette, banks []color.Palette) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, s.Width, s.Height))
+	for i, v := range s.Pixels {
+		p := base
+		if bits := int(v>>6) & 7; bits > 0 && len(banks) >= bits {
+			p = banks[bits-1]
+		}
+		m.SetRGBA(i%s.Width, i/s.Width, nespal.ToRGB(p[v&0x3F]))
+	}
+	return m
+}
+
+// Writes the palette RAM of a savestate as the background and the sprite
+// sub-palettes, like "Background: 0F,21,11,30 ..."
+func format_palette_ram(ram []byte) string {
+	var b strings.Builder
+	for half, name := range []string{"Background", "Sprites"} {
+		fmt.Fprintf(&b, "%s:", name)
+		for i := range SUBPALETTES {
+			start := half*16 + i*4
+			subpal := make([]uint8, 4)
+			for j := range subpal {
+				subpal[j] = ram[start+j] & 0x3F
+			}
+			// the first color of every sprite sub-palette mirrors the backdrop
+			subpal[0] = ram[0] & 0x3F
+			fmt.Fprintf(&b, " %s", format_indices(subpal))
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Runs the savestate command given in the arguments
+func run_savestate() int {
+	index_map := pflag.String("index-map", "", "Write the NES palette index of every pixel to a file")
+	pflag.Parse()
+	args := pflag.Args()
+
+	if len(args) == 1 {
+		log.Printf("%s: missing savestate\n", ex)
+		return 2
+	}
+	if len(args) == 2 {
+		log.Printf("%s: missing color palette\n", ex)
+		return 2
+	}
+	if len(args) == 3 {
+		log.Printf("%s: missing output image\n", ex)
+		return 2
+	}
+
+	data, err := os.ReadFile(args[1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	state, err := read_savestate(data)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	pal, _, err := open_palette(args[2])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	base, banks, err := load_palette_banks(pal)
+	pal.Close()
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	if status, err := write_image(state.render(base, banks), args[3], nil); err != nil {
+		log.Println(err)
+		return status
+	}
+	if *index_map != "" {
+		if err := write_index_map(state.indexed(base), *index_map); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	if state.PaletteRAM != nil {
+		fmt.Print(format_palette_ram(state.PaletteRAM))
+	}
+	return 0
+}
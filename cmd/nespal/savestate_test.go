@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Compresses data with zlib
+func deflate(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Returns a FCEUX savestate of frame, palette RAM ram and PPU mask, with
+// the chunks compressed or not
+func fcs_state(t *testing.T, frame []byte, ram []byte, mask byte, compressed bool) []byte {
+	t.Helper()
+	chunk := func(kind byte, data []byte) []byte {
+		return append(binary.LittleEndian.AppendUint32([]byte{kind}, uint32(len(data))), data...)
+	}
+	field := func(desc string, data []byte) []byte {
+		return append(binary.LittleEndian.AppendUint32([]byte(desc), uint32(len(data))), data...)
+	}
+
+	body := slices.Concat(
+		chunk(3, slices.Concat(field("PPUR", []byte{0, mask, 0, 0}), field("PRAM", ram))),
+		chunk(8, frame),
+	)
+	flag := uint32(0xFFFFFFFF)
+	size := uint32(len(body))
+	if compressed {
+		body = deflate(t, body)
+		flag = uint32(len(body))
+	}
+	header := binary.LittleEndian.AppendUint32([]byte("FCSX"), size)
+	header = binary.LittleEndian.AppendUint32(header, 22020)
+	header = binary.LittleEndian.AppendUint32(header, flag)
+	return append(header, body...)
+}
+
+// Returns a Mesen 2 savestate of a width by height frame of 16 bits pixels
+// and palette RAM ram, of a game of console type console
+func mss_state(t *testing.T, pixels []uint16, width, height int, ram []byte, console uint32) []byte {
+	t.Helper()
+	frame := []byte{}
+	for _, v := range pixels {
+		frame = binary.LittleEndian.AppendUint16(frame, v)
+	}
+	compressed := deflate(t, frame)
+
+	state := []byte("MSS")
+	for _, v := range []uint32{20000, 4, console, uint32(len(frame)), uint32(width), uint32(height), 1, uint32(len(compressed))} {
+		state = binary.LittleEndian.AppendUint32(state, v)
+	}
+	state = append(state, compressed...)
+
+	name := "game.nes"
+	state = binary.LittleEndian.AppendUint32(state, uint32(len(name)))
+	state = append(state, name...)
+
+	body := slices.Concat([]byte("ppu.frameCount\x00\x04\x00\x00\x00\x01\x00\x00\x00ppu.paletteRam\x00"), binary.LittleEndian.AppendUint32(nil, PALETTE_RAM_SIZE), ram)
+	compressed = deflate(t, body)
+	state = binary.LittleEndian.AppendUint32(state, uint32(len(body)))
+	state = binary.LittleEndian.AppendUint32(state, uint32(len(compressed)))
+	return append(state, compressed...)
+}
+
+func TestReadSavestate(t *testing.T) {
+	frame := make([]byte, FRAME_WIDTH*FRAME_HEIGHT)
+	for i := range frame {
+		// the top bits of the frame of FCEUX are not part of the index
+		frame[i] = byte(i%nespal.PALETTE_SIZE) | 0x40
+	}
+	ram := make([]byte, PALETTE_RAM_SIZE)
+	for i := range ram {
+		ram[i] = byte(0x0F + i)
+	}
+	pixels := []uint16{0x0F, 0x30 | 1<<6, 0x16 | 7<<6, 0x21 | 0xFE00}
+	mesen := mss_state(t, pixels, 2, 2, ram, MESEN_NES)
+	// the savestate up to its frame
+	mesen_frame := mesen[:bytes.Index(mesen, []byte("game.nes"))-4]
+
+	tests := []struct {
+		name     string
+		data     []byte
+		emulator string
+		width    int
+		// the first pixels, and whether the palette RAM is read
+		pixels []uint16
+		ram    bool
+		err    string
+	}{
+		{"fceux", fcs_state(t, frame, ram, 0, false), "FCEUX", FRAME_WIDTH, []uint16{0, 1, 2, 3}, true, ""},
+		{"fceux compressed", fcs_state(t, frame, ram, 0, true), "FCEUX", FRAME_WIDTH, []uint16{0, 1, 2, 3}, true, ""},
+		{"fceux emphasis", fcs_state(t, frame, ram, 0xA0, true), "FCEUX", FRAME_WIDTH, []uint16{5 << 6, 1 | 5<<6, 2 | 5<<6, 3 | 5<<6}, true, ""},
+		{"fceux truncated", fcs_state(t, frame[:100], ram, 0, false), "", 0, nil, false, "truncated frame"},
+		{"fceux no frame", fcs_state(t, frame, ram, 0, false)[:16+5+8+4+8+PALETTE_RAM_SIZE], "", 0, nil, false, "has no frame"},
+		{"mesen", mesen, "Mesen", 2, []uint16{0x0F, 0x30 | 1<<6, 0x16 | 7<<6, 0x21}, true, ""},
+		{"mesen without palette RAM", mesen_frame, "Mesen", 2, pixels[:1], false, ""},
+		{"mesen other console", mss_state(t, pixels, 2, 2, ram, 1), "", 0, nil, false, "not of a NES game"},
+		{"mesen truncated", mesen[:20], "", 0, nil, false, "truncated Mesen savestate"},
+		{"mesen 1", []byte("MST\x01\x00\x00\x00"), "", 0, nil, false, "Mesen 1 savestates (.mst) are not supported"},
+		{"fceu", []byte("FCS\xff"), "", 0, nil, false, "FCEU versions before FCEUX"},
+		{"unknown", []byte("PNG"), "", 0, nil, false, "unknown savestate format"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			state, err := read_savestate(test.data)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("error '%v', want '%s'", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if state.Emulator != test.emulator || state.Width != test.width {
+				t.Errorf("%s savestate %d pixels wide, want %s %d", state.Emulator, state.Width, test.emulator, test.width)
+			}
+			if !slices.Equal(state.Pixels[:len(test.pixels)], test.pixels) {
+				t.Errorf("pixels %X, want %X", state.Pixels[:len(test.pixels)], test.pixels)
+			}
+			if test.ram && !bytes.Equal(state.PaletteRAM, ram) {
+				t.Errorf("palette RAM %X, want %X", state.PaletteRAM, ram)
+			} else if !test.ram && state.PaletteRAM != nil {
+				t.Errorf("palette RAM %X, want none", state.PaletteRAM)
+			}
+		})
+	}
+}
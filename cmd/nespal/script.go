@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Functions a Starlark script given with '--script' can define, called
+// while remapping
+const (
+	// adjust(color) returns the color a color of the image is matched as
+	HOOK_ADJUST = "adjust"
+	// veto(index, color) returns whether a NES palette index is never used
+	HOOK_VETO = "veto"
+	// post(x, y, index) returns the NES palette index of a remapped pixel
+	HOOK_POST = "post"
+	// post_tile(x, y, rows) returns the NES palette indexes of a remapped
+	// tile, given as lists of rows, the tile being at column x and row y
+	HOOK_POST_TILE = "post_tile"
+)
+
+var script_hooks = []string{HOOK_ADJUST, HOOK_VETO, HOOK_POST, HOOK_POST_TILE}
+
+// Most steps running the script, or a single call to one of its hooks, can
+// take before it is stopped, so a script that never returns cannot hang
+// a remap
+const SCRIPT_MAX_STEPS = 10_000_000
+
+// Hooks of a Starlark script, nil for the ones it does not define
+type Script struct {
+	path  string
+	hooks map[string]starlark.Callable
+}
+
+// Runs the Starlark script at path and keeps the hooks it defines
+func load_script(path string) (*Script, error) {
+	thread := script_thread(path)
+	thread.SetMaxExecutionSteps(SCRIPT_MAX_STEPS)
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, nil, nil)
+	if err != nil {
+		return nil, script_error(path, err)
+	}
+	globals.Freeze()
+
+	s := &Script{path: path, hooks: map[string]starlark.Callable{}}
+	for _, name := range script_hooks {
+		v, ok := globals[name]
+		if !ok {
+			continue
+		}
+		fn, ok := v.(starlark.Callable)
+		if !ok {
+			return nil, fmt.Errorf("%s: %s: '%s' is a %s, expected a function", ex, path, name, v.Type())
+		}
+		s.hooks[name] = fn
+	}
+	if len(s.hooks) == 0 {
+		return nil, fmt.Errorf("%s: %s: defines none of the hooks: %s", ex, path, strings.Join(script_hooks, ", "))
+	}
+	return s, nil
+}
+
+// Returns a thread to run the script at path, whose prints are logged
+func script_thread(path string) *starlark.Thread {
+	return &starlark.Thread{
+		Name: path,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("%s: %s: %s\n", ex, path, msg)
+		},
+	}
+}
+
+// Returns the error of the script at path with where it happened
+func script_error(path string, err error) error {
+	var eval *starlark.EvalError
+	if errors.As(err, &eval) {
+		return fmt.Errorf("%s: %s", ex, eval.Backtrace())
+	}
+	return fmt.Errorf("%s: %s: %w", ex, path, err)
+}
+
+// Calls the hook name with args, for at most SCRIPT_MAX_STEPS
+func (s *Script) call(thread *starlark.Thread, name string, args ...starlark.Value) (starlark.Value, error) {
+	thread.SetMaxExecutionSteps(thread.ExecutionSteps() + SCRIPT_MAX_STEPS)
+	v, err := starlark.Call(thread, s.hooks[name], args, nil)
+	if err != nil {
+		return nil, script_error(s.path, err)
+	}
+	return v, nil
+}
+
+// Returns a color as the (r, g, b) tuple the hooks take
+func color_value(c color.RGBA) starlark.Tuple {
+	return starlark.Tuple{starlark.MakeInt(int(c.R)), starlark.MakeInt(int(c.G)), starlark.MakeInt(int(c.B))}
+}
+
+// Parses a color returned by the hook name, an (r, g, b) tuple or a hex
+// string like "#E04040"
+func (s *Script) parse_color(name string, v starlark.Value) (color.RGBA, error) {
+	if str, ok := starlark.AsString(v); ok {
+		c, err := parse_hex_color(str)
+		if err != nil {
+			return c, fmt.Errorf("%s: %s: %s returned %s", ex, s.path, name, strings.TrimPrefix(err.Error(), ex+": "))
+		}
+		return c, nil
+	}
+
+	invalid := fmt.Errorf("%s: %s: %s returned %s, expected an (r, g, b) tuple from 0 to 255 or a color like \"#E04040\"", ex, s.path, name, v)
+	seq, ok := v.(starlark.Indexable)
+	if !ok || seq.Len() != 3 {
+		return color.RGBA{}, invalid
+	}
+	var rgb [3]uint8
+	for i := range rgb {
+		var channel int
+		if err := starlark.AsInt(seq.Index(i), &channel); err != nil || channel < 0 || channel > 255 {
+			return color.RGBA{}, invalid
+		}
+		rgb[i] = uint8(channel)
+	}
+	return color.RGBA{rgb[0], rgb[1], rgb[2], 255}, nil
+}
+
+// Parses a NES palette index returned by the hook name, checking opts
+// can use it
+func (s *Script) parse_index(name string, v starlark.Value, p color.Palette, opts RemapOptions) (uint8, error) {
+	var i int
+	if err := starlark.AsInt(v, &i); err != nil || i < 0 || i >= len(p) {
+		return 0, fmt.Errorf("%s: %s: %s returned %s, expected a NES palette index from 0 to %d", ex, s.path, name, v, len(p)-1)
+	}
+	if flag := opts.unusable(i); flag != "" {
+		return 0, fmt.Errorf("%s: %s: %s returned $%02X, which '%s' never uses", ex, s.path, name, i, flag)
+	}
+	return uint8(i), nil
+}
+
+// Leaves the NES palette indexes of p vetoed by the script out of
+// opts.Indices
+func (s *Script) veto(p color.Palette, opts RemapOptions) (RemapOptions, error) {
+	if s.hooks[HOOK_VETO] == nil {
+		return opts, nil
+	}
+
+	thread := script_thread(s.path)
+	vetoed := []int{}
+	for i := range min(len(p), nespal.PALETTE_SIZE) {
+		if len(opts.Indices) > 0 && !slices.Contains(opts.Indices, i) {
+			continue
+		}
+		v, err := s.call(thread, HOOK_VETO, starlark.MakeInt(i), color_value(nespal.ToRGB(p[i])))
+		if err != nil {
+			return opts, err
+		}
+		if v.Truth() {
+			vetoed = append(vetoed, i)
+		}
+	}
+
+	var err error
+	if len(vetoed) > 0 {
+		opts.Indices, err = exclude_indices(opts.Indices, vetoed)
+	}
+	return opts, err
+}
+
+// Returns img with every color adjusted by the script, alpha is kept as is
+func (s *Script) adjust(img image.Image) (image.Image, error) {
+	if s.hooks[HOOK_ADJUST] == nil {
+		return img, nil
+	}
+
+	// the hook is called once for every color
+	thread := script_thread(s.path)
+	adjusted := map[color.RGBA]color.RGBA{}
+	var err error
+	res := map_pixels(img, func(c color.NRGBA) color.NRGBA {
+		key := color.RGBA{c.R, c.G, c.B, 255}
+		out, ok := adjusted[key]
+		if !ok && err == nil {
+			var v starlark.Value
+			if v, err = s.call(thread, HOOK_ADJUST, color_value(key)); err == nil {
+				out, err = s.parse_color(HOOK_ADJUST, v)
+			}
+			adjusted[key] = out
+		}
+		return color.NRGBA{out.R, out.G, out.B, c.A}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Replaces the NES palette indexes of the pixels of remapped with the ones
+// the script returns for them, pixel by pixel and then tile by tile
+func (s *Script) post(remapped *image.Paletted, opts RemapOptions) error {
+	thread := script_thread(s.path)
+	bounds := remapped.Bounds()
+
+	if s.hooks[HOOK_POST] != nil {
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				i := remapped.Pix[remapped.PixOffset(x, y)]
+				v, err := s.call(thread, HOOK_POST, starlark.MakeInt(x-bounds.Min.X), starlark.MakeInt(y-bounds.Min.Y), starlark.MakeInt(int(i)))
+				if err != nil {
+					return err
+				}
+				if i, err = s.parse_index(HOOK_POST, v, remapped.Palette, opts); err != nil {
+					return err
+				}
+				remapped.Pix[remapped.PixOffset(x, y)] = i
+			}
+		}
+	}
+
+	if s.hooks[HOOK_POST_TILE] != nil {
+		for ty := 0; ty*TILE_SIZE < bounds.Dy(); ty++ {
+			for tx := 0; tx*TILE_SIZE < bounds.Dx(); tx++ {
+				tile := image.Rect(tx*TILE_SIZE, ty*TILE_SIZE, (tx+1)*TILE_SIZE, (ty+1)*TILE_SIZE).Add(bounds.Min).Intersect(bounds)
+				if err := s.post_tile(thread, remapped, tile, tx, ty, opts); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Calls post_tile on the pixels of remapped in tile, the tile at column tx
+// and row ty
+func (s *Script) post_tile(thread *starlark.Thread, remapped *image.Paletted, tile image.Rectangle, tx, ty int, opts RemapOptions) error {
+	rows := make([]starlark.Value, 0, tile.Dy())
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		row := make([]starlark.Value, 0, tile.Dx())
+		for x := tile.Min.X; x < tile.Max.X; x++ {
+			row = append(row, starlark.MakeInt(int(remapped.Pix[remapped.PixOffset(x, y)])))
+		}
+		rows = append(rows, starlark.NewList(row))
+	}
+
+	v, err := s.call(thread, HOOK_POST_TILE, starlark.MakeInt(tx), starlark.MakeInt(ty), starlark.NewList(rows))
+	if err != nil {
+		return err
+	}
+	if v == starlark.None {
+		return nil
+	}
+
+	invalid := fmt.Errorf("%s: %s: %s returned %s, expected %d rows of %d NES palette indexes", ex, s.path, HOOK_POST_TILE, v, tile.Dy(), tile.Dx())
+	out, ok := v.(starlark.Indexable)
+	if !ok || out.Len() != tile.Dy() {
+		return invalid
+	}
+	for y := range tile.Dy() {
+		row, ok := out.Index(y).(starlark.Indexable)
+		if !ok || row.Len() != tile.Dx() {
+			return invalid
+		}
+		for x := range tile.Dx() {
+			i, err := s.parse_index(HOOK_POST_TILE, row.Index(x), remapped.Palette, opts)
+			if err != nil {
+				return err
+			}
+			remapped.Pix[remapped.PixOffset(tile.Min.X+x, tile.Min.Y+y)] = i
+		}
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Writes a Starlark script and loads it
+func write_script(t *testing.T, src string) (*Script, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "transform.star")
+	if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return load_script(path)
+}
+
+// Loads a palette of the default palette list
+func test_named_palette(t *testing.T, name string) color.Palette {
+	t.Helper()
+	file, err := find_palette(name)
+	if err != nil || file == nil {
+		t.Fatalf("palette '%s' not found: %v", name, err)
+	}
+	defer file.Close()
+	p, err := load_palette(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestScript(t *testing.T) {
+	p := test_named_palette(t, "FCEUX")
+	s, err := write_script(t, `
+def adjust(color):
+    r, g, b = color
+    return "#FFFFFF" if r > 128 else (0, 0, 0)
+
+def veto(index, color):
+    return index >= 0x10 or index in (0x0D, 0x0E)
+
+def post(x, y, index):
+    return 0x0F if x == 0 else index
+
+def post_tile(x, y, rows):
+    if x == 1:
+        return [[0x16 for index in row] for row in rows]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := s.veto(p, RemapOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{}
+	for i := range 0x10 {
+		if i != 0x0D && i != 0x0E {
+			want = append(want, i)
+		}
+	}
+	if !slices.Equal(opts.Indices, want) {
+		t.Errorf("indexes left by veto %v, want %v", opts.Indices, want)
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 12, 4))
+	for x := range 12 {
+		for y := range 4 {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 20), 40, 40, 255})
+		}
+	}
+	adjusted, err := s.adjust(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := nespal.ToRGB(adjusted.At(11, 0)); c != (color.RGBA{255, 255, 255, 255}) {
+		t.Errorf("adjusted color %v, want white", c)
+	}
+
+	remapped := remap_image(adjusted, p, opts)
+	if err := s.post(remapped, opts); err != nil {
+		t.Fatal(err)
+	}
+	for x, want := range []uint8{0x0F, 0x0F, 0x0F, 0x0F, 0x0F, 0x0F, 0x0F, 0x00, 0x16, 0x16, 0x16, 0x16} {
+		if got := remapped.ColorIndexAt(x, 3); got != want {
+			t.Errorf("index of pixel %d is $%02X, want $%02X", x, got, want)
+		}
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	p := test_named_palette(t, "FCEUX")
+	remapped := image.NewPaletted(image.Rect(0, 0, 8, 8), p)
+
+	tests := []struct {
+		name string
+		src  string
+		opts RemapOptions
+		err  string
+	}{
+		{"no hooks", "x = 1", RemapOptions{}, "defines none of the hooks"},
+		{"not a function", "post = 1", RemapOptions{}, "expected a function"},
+		{"syntax", "def post(x, y, index)\n    return index", RemapOptions{}, "got newline"},
+		{"out of range", "def post(x, y, index):\n    return 64", RemapOptions{}, "returned 64"},
+		{"tile rows", "def post_tile(x, y, rows):\n    return rows[1:]", RemapOptions{}, "expected 8 rows"},
+		{"failing", "def post(x, y, index):\n    return index // 0", RemapOptions{}, "division by zero"},
+		{"endless", "def post(x, y, index):\n    for i in range(1 << 62):\n        pass", RemapOptions{}, "too many steps"},
+		{"endless when loaded", "def post(x, y, index):\n    return index\n[i for i in range(1 << 62)]", RemapOptions{}, "too many steps"},
+		{"forbidden", "def post(x, y, index):\n    return 0x16", RemapOptions{Forbidden: []int{0x16}}, "never uses"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := write_script(t, test.src)
+			if err == nil {
+				err = s.post(remapped, test.opts)
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error '%v', want '%s'", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Most used colors of the remapped image tried as the backdrop by the
+// sub-palette solver, when it is not locked
+const SOLVER_BACKDROPS = 4
+
+// Most passes of the local search of the sub-palette solver, each trying
+// every color in every entry of every sub-palette
+const SOLVER_PASSES = 20
+
+// The colors of an attribute block: how many pixels have each and how far
+// each is from every candidate color
+type block_colors struct {
+	counts []float64
+	dist   [][]float64
+}
+
+// Searches the sub-palettes losing the least of an image under the NES
+// background constraints. The colors are positions in candidates, and a
+// sub-palette holds the backdrop and three colors
+type subpal_solver struct {
+	candidates []int
+	blocks     []block_colors
+}
+
+// Returns how much is lost drawing the block b with the colors of subpal:
+// the distance of every pixel to the closest of them
+func (s *subpal_solver) cost(b int, subpal [4]int) float64 {
+	block := &s.blocks[b]
+	total := 0.0
+	for u, n := range block.counts {
+		d := block.dist[u]
+		total += n * min(d[subpal[0]], d[subpal[1]], d[subpal[2]], d[subpal[3]])
+	}
+	return total
+}
+
+// Returns the sub-palette the block would pick for itself with the
+// backdrop, adding the color losing the least three times
+func (s *subpal_solver) ideal(b int, backdrop int) [4]int {
+	subpal := [4]int{backdrop, backdrop, backdrop, backdrop}
+	for slot := 1; slot < 4; slot++ {
+		best, best_cost := backdrop, s.cost(b, subpal)
+		for k := range s.candidates {
+			if slices.Contains(subpal[:slot], k) {
+				continue
+			}
+			subpal[slot] = k
+			if c := s.cost(b, subpal); c < best_cost {
+				best, best_cost = k, c
+			}
+		}
+		subpal[slot] = best
+	}
+	sort.Ints(subpal[1:])
+	return subpal
+}
+
+// Returns the sub-palettes losing the least with the backdrop and their
+// total loss. The sub-palettes the blocks would pick for themselves are
+// taken greedily, the one lowering the loss the most first, then every
+// entry of every sub-palette is given every color while it lowers the loss
+func (s *subpal_solver) solve(backdrop int) ([][4]int, float64) {
+	empty := [4]int{backdrop, backdrop, backdrop, backdrop}
+	current := make([]float64, len(s.blocks))
+	for b := range s.blocks {
+		current[b] = s.cost(b, empty)
+	}
+
+	ideals := [][4]int{}
+	for b := range s.blocks {
+		if subpal := s.ideal(b, backdrop); !slices.Contains(ideals, subpal) {
+			ideals = append(ideals, subpal)
+		}
+	}
+	costs := make([][]float64, len(ideals))
+	for t, subpal := range ideals {
+		costs[t] = make([]float64, len(s.blocks))
+		for b := range s.blocks {
+			costs[t][b] = s.cost(b, subpal)
+		}
+	}
+
+	subpals := [][4]int{}
+	for len(subpals) < SUBPALETTES {
+		best, best_gain := -1, 0.0
+		for t := range ideals {
+			gain := 0.0
+			for b, c := range costs[t] {
+				gain += max(current[b]-c, 0)
+			}
+			if gain > best_gain {
+				best, best_gain = t, gain
+			}
+		}
+		if best < 0 {
+			break
+		}
+		subpals = append(subpals, ideals[best])
+		for b, c := range costs[best] {
+			current[b] = min(current[b], c)
+		}
+	}
+	if len(subpals) == 0 {
+		subpals = append(subpals, empty)
+	}
+
+	// the loss of every block with the sub-palettes other than j, and the
+	// distance of its colors to the closest of the entries of j other than
+	// the one changed
+	others := make([]float64, len(s.blocks))
+	rest := make([][]float64, len(s.blocks))
+	for b := range s.blocks {
+		rest[b] = make([]float64, len(s.blocks[b].counts))
+	}
+	// the total loss with k in the changed entry, stopping once it goes over
+	// limit
+	total_with := func(k int, limit float64) float64 {
+		total := 0.0
+		for b := range s.blocks {
+			block := &s.blocks[b]
+			cost := 0.0
+			for u, n := range block.counts {
+				cost += n * min(rest[b][u], block.dist[u][k])
+			}
+			if total += min(others[b], cost); total >= limit {
+				break
+			}
+		}
+		return total
+	}
+	for range SOLVER_PASSES {
+		improved := false
+		for j := range subpals {
+			for b := range s.blocks {
+				others[b] = math.MaxFloat64
+				for i, subpal := range subpals {
+					if i != j {
+						others[b] = min(others[b], s.cost(b, subpal))
+					}
+				}
+			}
+			for slot := 1; slot < 4; slot++ {
+				for b := range s.blocks {
+					for u, d := range s.blocks[b].dist {
+						rest[b][u] = math.MaxFloat64
+						for i, k := range subpals[j] {
+							if i != slot {
+								rest[b][u] = min(rest[b][u], d[k])
+							}
+						}
+					}
+				}
+				best := total_with(subpals[j][slot], math.MaxFloat64)
+				for k := range s.candidates {
+					if k == backdrop || slices.Contains(subpals[j][:], k) {
+						continue
+					}
+					// ignores the gains lost to rounding
+					if total := total_with(k, best*(1-1e-9)); total < best*(1-1e-9) {
+						subpals[j][slot], best = k, total
+						improved = true
+					}
+				}
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+
+	total := 0.0
+	for b := range s.blocks {
+		cost := math.MaxFloat64
+		for _, subpal := range subpals {
+			cost = min(cost, s.cost(b, subpal))
+		}
+		total += cost
+	}
+	return subpals, total
+}
+
+// Remaps img to p while following the NES background constraints like
+// constrain, but with the backdrop and four sub-palettes found to lose the
+// least of the image instead of the first ones the colors fit in, so it
+// never fails
+func constrain_optimal(img image.Image, p color.Palette, opts RemapOptions) *Frame {
+	grid := opts.Grid
+	if grid.Attr == 0 {
+		grid = default_grid
+	}
+
+	indexed := remap_image(img, p, opts)
+	bounds := indexed.Bounds()
+	blocks, cols, rows := attr_blocks(bounds, grid)
+	skip := func(x, y int) bool { return opts.AlphaThreshold != nil && transparent(img, x, y) }
+
+	// the same color is only a candidate once, like the many blacks, the
+	// locked backdrop first
+	s := &subpal_solver{}
+	allowed := opts.Indices
+	if len(allowed) == 0 {
+		allowed = make([]int, len(p))
+		for i := range allowed {
+			allowed[i] = i
+		}
+	}
+	if opts.Backdrop != nil {
+		allowed = append([]int{int(*opts.Backdrop)}, allowed...)
+	}
+	seen := map[color.RGBA]bool{}
+	for _, i := range allowed {
+		if c := nespal.ToRGB(p[i]); !seen[c] {
+			seen[c] = true
+			s.candidates = append(s.candidates, i)
+		}
+	}
+
+	matcher := nespal.NewMatcher(p, opts.Metric)
+	s.blocks = make([]block_colors, len(blocks))
+	for b, block := range blocks {
+		counts := map[color.RGBA]int{}
+		colors := []color.RGBA{}
+		for y := block.Min.Y; y < block.Max.Y; y++ {
+			for x := block.Min.X; x < block.Max.X; x++ {
+				if skip(x, y) {
+					continue
+				}
+				c := nespal.ToRGB(img.At(x, y))
+				if counts[c] == 0 {
+					colors = append(colors, c)
+				}
+				counts[c]++
+			}
+		}
+		for _, c := range colors {
+			s.blocks[b].counts = append(s.blocks[b].counts, float64(counts[c]))
+			s.blocks[b].dist = append(s.blocks[b].dist, matcher.Distances(c, s.candidates))
+		}
+	}
+
+	// the most used colors of the remapped image are tried as the backdrop
+	backdrops := []int{}
+	if opts.Backdrop != nil {
+		backdrops = append(backdrops, 0)
+	} else {
+		for _, i := range by_usage(count_indices(indexed, bounds)) {
+			k := slices.IndexFunc(s.candidates, func(j int) bool { return p[j] == p[i] })
+			if k >= 0 && !slices.Contains(backdrops, k) {
+				backdrops = append(backdrops, k)
+			}
+			if len(backdrops) == SOLVER_BACKDROPS {
+				break
+			}
+		}
+	}
+	// every backdrop is solved on its own, jobs at a time
+	solved := make([][][4]int, len(backdrops))
+	totals := make([]float64, len(backdrops))
+	slots := make(chan struct{}, max(jobs, 1))
+	var wg sync.WaitGroup
+	for i, k := range backdrops {
+		slots <- struct{}{}
+		wg.Go(func() {
+			defer func() { <-slots }()
+			solved[i], totals[i] = s.solve(k)
+		})
+	}
+	wg.Wait()
+	best := 0
+	for i := range backdrops {
+		if totals[i] < totals[best] {
+			best = i
+		}
+	}
+	backdrop, subpals := backdrops[best], solved[best]
+
+	frame := &Frame{
+		Indexed:  indexed,
+		Backdrop: uint8(s.candidates[backdrop]),
+		Attrs:    make([]int, len(blocks)),
+		AttrCols: cols,
+		AttrRows: rows,
+		Grid:     grid,
+	}
+
+	// every block takes the sub-palette losing the least of it, and its
+	// pixels the closest of its colors
+	used := make([][]uint8, len(subpals))
+	for b, block := range blocks {
+		best, best_cost := 0, math.MaxFloat64
+		for j, subpal := range subpals {
+			if c := s.cost(b, subpal); c < best_cost {
+				best, best_cost = j, c
+			}
+		}
+		frame.Attrs[b] = best
+
+		colors := []int{int(frame.Backdrop)}
+		for _, k := range subpals[best][1:] {
+			colors = append(colors, s.candidates[k])
+		}
+		for y := block.Min.Y; y < block.Max.Y; y++ {
+			for x := block.Min.X; x < block.Max.X; x++ {
+				if skip(x, y) {
+					indexed.SetColorIndex(x, y, frame.Backdrop)
+					continue
+				}
+				if !slices.Contains(colors, int(indexed.ColorIndexAt(x, y))) {
+					indexed.SetColorIndex(x, y, uint8(matcher.Closest(img.At(x, y), colors)))
+				}
+				if p[indexed.ColorIndexAt(x, y)] == p[frame.Backdrop] {
+					indexed.SetColorIndex(x, y, frame.Backdrop)
+				}
+				if c := indexed.ColorIndexAt(x, y); c != frame.Backdrop && !slices.Contains(used[best], c) {
+					used[best] = append(used[best], c)
+				}
+			}
+		}
+	}
+
+	// the sub-palettes keep the colors their blocks use, the ones no block
+	// uses are dropped
+	renumber := make([]int, len(subpals))
+	for j := range subpals {
+		renumber[j] = -1
+		if !slices.Contains(frame.Attrs, j) {
+			continue
+		}
+		subpal := Subpalette{frame.Backdrop, frame.Backdrop, frame.Backdrop, frame.Backdrop}
+		n := 1
+		for _, k := range subpals[j][1:] {
+			if slices.Contains(used[j], uint8(s.candidates[k])) {
+				subpal[n] = uint8(s.candidates[k])
+				n++
+			}
+		}
+		renumber[j] = len(frame.Subpals)
+		frame.Subpals = append(frame.Subpals, subpal)
+	}
+	for b := range frame.Attrs {
+		frame.Attrs[b] = renumber[frame.Attrs[b]]
+	}
+	return frame
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+const (
+	// Number of cells in a row of a swatch, the 16 columns of the NES palette
+	SWATCH_COLUMNS = 16
+	// Size in pixels of a cell of a swatch, unless given another
+	SWATCH_CELL = 48
+)
+
+// Glyphs of the labels of swatches, 3 by 5 pixels
+var glyphs = map[rune][5]string{
+	'0': {"###", "#.#", "#.#", "#.#", "###"},
+	'1': {".#.", "##.", ".#.", ".#.", "###"},
+	'2': {"###", "..#", "###", "#..", "###"},
+	'3': {"###", "..#", "###", "..#", "###"},
+	'4': {"#.#", "#.#", "###", "..#", "..#"},
+	'5': {"###", "#..", "###", "..#", "###"},
+	'6': {"###", "#..", "###", "#.#", "###"},
+	'7': {"###", "..#", "..#", ".#.", ".#."},
+	'8': {"###", "#.#", "###", "#.#", "###"},
+	'9': {"###", "#.#", "###", "..#", "###"},
+	'A': {".#.", "#.#", "###", "#.#", "#.#"},
+	'B': {"##.", "#.#", "##.", "#.#", "##."},
+	'C': {".##", "#..", "#..", "#..", ".##"},
+	'D': {"##.", "#.#", "#.#", "#.#", "##."},
+	'E': {"###", "#..", "##.", "#..", "###"},
+	'F': {"###", "#..", "##.", "#..", "#.."},
+	'$': {".##", "#..", ".#.", "..#", "##."},
+	'#': {"#.#", "###", "#.#", "###", "#.#"},
+}
+
+// Width in pixels of text drawn by draw_text, a pixel between glyphs
+func text_width(text string, scale int) int {
+	return max(len(text)*4-1, 0) * scale
+}
+
+// Draws text with its top left corner at x, y, every pixel of the glyphs
+// being scale by scale pixels
+func draw_text(img *image.RGBA, x, y int, text string, scale int, c color.RGBA) {
+	for _, r := range text {
+		for gy, row := range glyphs[r] {
+			for gx, px := range row {
+				if px == '#' {
+					rect := image.Rect(x+gx*scale, y+gy*scale, x+(gx+1)*scale, y+(gy+1)*scale)
+					draw.Draw(img, rect, image.NewUniform(c), image.Point{}, draw.Src)
+				}
+			}
+		}
+		x += 4 * scale
+	}
+}
+
+// Renders the colors of p as a chart of cells, a row per 16 colors like
+// the NES palette is laid out. With labels, every cell shows its NES index
+// and, with hex too, its color code, in black or white so they stand out
+func render_swatch(p color.Palette, cell int, labels, hex bool) *image.RGBA {
+	rows := (len(p) + SWATCH_COLUMNS - 1) / SWATCH_COLUMNS
+	img := image.NewRGBA(image.Rect(0, 0, SWATCH_COLUMNS*cell, rows*cell))
+
+	for i, c := range p {
+		x, y := i%SWATCH_COLUMNS*cell, i/SWATCH_COLUMNS*cell
+		rgb := nespal.ToRGB(c)
+		draw.Draw(img, image.Rect(x, y, x+cell, y+cell), image.NewUniform(rgb), image.Point{}, draw.Src)
+		if !labels {
+			continue
+		}
+
+		ink := color.RGBA{255, 255, 255, 255}
+		if luma(float64(rgb.R), float64(rgb.G), float64(rgb.B)) > 128 {
+			ink = color.RGBA{0, 0, 0, 255}
+		}
+
+		// the index is drawn as large as the cell allows, the code below it
+		index := fmt.Sprintf("$%02X", i)
+		scale := max(1, (cell-4)/text_width(index, 1)/2)
+		draw_text(img, x+(cell-text_width(index, scale))/2, y+2*scale, index, scale, ink)
+		if hex {
+			code := hex_color(rgb)
+			hex_scale := max(1, (cell-2)/text_width(code, 1))
+			draw_text(img, x+(cell-text_width(code, hex_scale))/2, y+cell-7*hex_scale, code, hex_scale, ink)
+		}
+	}
+	return img
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Signatures of TIFF files, in little and big endian
+const (
+	TIFF_LE = "II*\x00"
+	TIFF_BE = "MM\x00*"
+)
+
+// Largest number of pages read from a TIFF file, so a loop in the chain of
+// pages can not go on forever
+const MAX_TIFF_PAGES = 4096
+
+// TIFF tags read by decode_tiff_pages
+const (
+	tiff_subfile_type  = 254
+	tiff_width         = 256
+	tiff_height        = 257
+	tiff_bits          = 258
+	tiff_compression   = 259
+	tiff_photometric   = 262
+	tiff_strip_offsets = 273
+	tiff_orientation   = 274
+	tiff_samples       = 277
+	tiff_strip_counts  = 279
+	tiff_planar        = 284
+	tiff_predictor     = 317
+	tiff_color_map     = 320
+	tiff_tile_width    = 322
+	tiff_extra_samples = 338
+)
+
+// Size in bytes of the values of every TIFF field type, by type number
+var tiff_type_sizes = []int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+// A directory of a TIFF file, the fields of a page by tag
+type tiff_ifd map[uint16][]uint32
+
+// Returns the first value of a field, def when the page has none
+func (ifd tiff_ifd) get(tag uint16, def uint32) uint32 {
+	if values := ifd[tag]; len(values) > 0 {
+		return values[0]
+	}
+	return def
+}
+
+// Decodes every page of a TIFF file, turned upright following its
+// orientation. Reduced resolution copies of the pages, like the thumbnails
+// scanners add, are left out. Supports the
+// uncompressed, PackBits, LZW and Deflate strips of bilevel, grayscale,
+// paletted and RGB images
+func decode_tiff_pages(data []byte) ([]image.Image, error) {
+	if len(data) < 8 {
+		return nil, errors.New("tiff: truncated header")
+	}
+	var order binary.ByteOrder
+	switch string(data[:4]) {
+	case TIFF_LE:
+		order = binary.LittleEndian
+	case TIFF_BE:
+		order = binary.BigEndian
+	default:
+		return nil, errors.New("tiff: invalid header")
+	}
+
+	pages := []image.Image{}
+	offset := order.Uint32(data[4:])
+	for offset != 0 && len(pages) < MAX_TIFF_PAGES {
+		ifd, next, err := read_tiff_ifd(data, offset, order)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+
+		if ifd.get(tiff_subfile_type, 0)&1 != 0 {
+			continue
+		}
+		page, err := decode_tiff_page(data, ifd)
+		if err != nil {
+			return nil, fmt.Errorf("tiff: page %d: %w", len(pages)+1, err)
+		}
+		pages = append(pages, nespal.Orient(page, int(ifd.get(tiff_orientation, 1))))
+	}
+
+	if len(pages) == 0 {
+		return nil, errors.New("tiff: no pages")
+	}
+	return pages, nil
+}
+
+// Returns the size of the pages of a TIFF file stacked, as wide as the
+// widest and as tall as all of them, without decoding them. Zero when it
+// can not be told
+func tiff_size(data []byte) image.Point {
+	if len(data) < 8 || (string(data[:4]) != TIFF_LE && string(data[:4]) != TIFF_BE) {
+		return image.Point{}
+	}
+	order := tiff_order(data)
+	size := image.Point{}
+	offset := order.Uint32(data[4:])
+	for pages := 0; offset != 0 && pages < MAX_TIFF_PAGES; {
+		ifd, next, err := read_tiff_ifd(data, offset, order)
+		if err != nil {
+			return image.Point{}
+		}
+		offset = next
+		if ifd.get(tiff_subfile_type, 0)&1 != 0 {
+			continue
+		}
+		pages++
+
+		// pages turned upright swap their sides
+		width, height := int(ifd.get(tiff_width, 0)), int(ifd.get(tiff_height, 0))
+		if ifd.get(tiff_orientation, 1) > 4 {
+			width, height = height, width
+		}
+		size.X, size.Y = max(size.X, width), size.Y+height
+	}
+	return size
+}
+
+// Reads the directory of a page at offset, returning it with the offset of
+// the next one, 0 after the last page
+func read_tiff_ifd(data []byte, offset uint32, order binary.ByteOrder) (tiff_ifd, uint32, error) {
+	if int64(offset)+2 > int64(len(data)) {
+		return nil, 0, errors.New("tiff: truncated directory")
+	}
+	count := int(order.Uint16(data[offset:]))
+	end := int64(offset) + 2 + int64(count)*12
+	if end+4 > int64(len(data)) {
+		return nil, 0, errors.New("tiff: truncated directory")
+	}
+
+	ifd := tiff_ifd{}
+	for i := range count {
+		entry := data[int(offset)+2+i*12:]
+		tag, kind, n := order.Uint16(entry), order.Uint16(entry[2:]), order.Uint32(entry[4:])
+		if int(kind) >= len(tiff_type_sizes) || tiff_type_sizes[kind] == 0 {
+			continue
+		}
+		size := tiff_type_sizes[kind]
+		if uint64(n)*uint64(size) > uint64(len(data)) {
+			return nil, 0, errors.New("tiff: invalid field")
+		}
+
+		raw := entry[8:12]
+		if int(n)*size > 4 {
+			at := order.Uint32(entry[8:])
+			if int64(at)+int64(n)*int64(size) > int64(len(data)) {
+				return nil, 0, errors.New("tiff: truncated field")
+			}
+			raw = data[at : int(at)+int(n)*size]
+		}
+
+		values := make([]uint32, n)
+		for j := range values {
+			switch size {
+			case 1:
+				values[j] = uint32(raw[j])
+			case 2:
+				values[j] = uint32(order.Uint16(raw[j*2:]))
+			case 4:
+				values[j] = order.Uint32(raw[j*4:])
+			default:
+				// rationals are never needed to decode the pixels
+				values[j] = order.Uint32(raw[j*8:])
+			}
+		}
+		ifd[tag] = values
+	}
+	return ifd, order.Uint32(data[end:]), nil
+}
+
+// Decodes the pixels of a page
+func decode_tiff_page(data []byte, ifd tiff_ifd) (image.Image, error) {
+	width, height := int(ifd.get(tiff_width, 0)), int(ifd.get(tiff_height, 0))
+	if width <= 0 || height <= 0 || width > 1<<16 || height > 1<<16 {
+		return nil, errors.New("invalid size")
+	}
+	if _, tiled := ifd[tiff_tile_width]; tiled {
+		return nil, errors.New("tiled images are not supported")
+	}
+	if ifd.get(tiff_planar, 1) != 1 {
+		return nil, errors.New("separate color planes are not supported")
+	}
+
+	samples := int(ifd.get(tiff_samples, 1))
+	bits := int(ifd.get(tiff_bits, 1))
+	for _, b := range ifd[tiff_bits] {
+		if int(b) != bits {
+			return nil, errors.New("samples of different sizes are not supported")
+		}
+	}
+	photometric := ifd.get(tiff_photometric, 1)
+	switch {
+	case (photometric == 0 || photometric == 1) && (samples == 1 || samples == 2):
+	case photometric == 2 && (samples == 3 || samples == 4):
+	case photometric == 3 && samples == 1 && bits <= 8:
+	default:
+		return nil, fmt.Errorf("photometric interpretation %d with %d samples is not supported", photometric, samples)
+	}
+	if bits != 8 && bits != 16 && (samples > 1 || bits > 8 || bits == 0) {
+		return nil, fmt.Errorf("%d bits samples are not supported", bits)
+	}
+
+	// every row starts on a byte
+	stride := (width*samples*bits + 7) / 8
+	pix, err := read_tiff_strips(data, ifd, stride*height)
+	if err != nil {
+		return nil, err
+	}
+
+	order := tiff_order(data)
+	if ifd.get(tiff_predictor, 1) == 2 {
+		if bits != 8 && bits != 16 {
+			return nil, errors.New("the horizontal predictor needs 8 or 16 bits samples")
+		}
+		step := samples * bits / 8
+		for y := range height {
+			row := pix[y*stride : (y+1)*stride]
+			if bits == 8 {
+				for x := step; x < len(row); x++ {
+					row[x] += row[x-step]
+				}
+				continue
+			}
+			// 16 bits samples are added in the byte order of the file
+			for x := step; x+1 < len(row); x += 2 {
+				order.PutUint16(row[x:], order.Uint16(row[x:])+order.Uint16(row[x-step:]))
+			}
+		}
+	}
+
+	// returns the sample at index i of a row, scaled to 8 bits
+	sample := func(row []byte, i int) uint8 {
+		switch bits {
+		case 8:
+			return row[i]
+		case 16:
+			return to_8bit(order.Uint16(row[i*2:]))
+		}
+		v := row[i*bits/8] >> (8 - bits - i*bits%8) & (1<<bits - 1)
+		return v * uint8(255/(1<<bits-1))
+	}
+
+	bounds := image.Rect(0, 0, width, height)
+	if photometric == 3 {
+		cmap := ifd[tiff_color_map]
+		colors := 1 << bits
+		if len(cmap) != colors*3 {
+			return nil, errors.New("invalid color map")
+		}
+		p := make(color.Palette, colors)
+		for i := range p {
+			p[i] = color.RGBA{uint8(cmap[i] >> 8), uint8(cmap[colors+i] >> 8), uint8(cmap[2*colors+i] >> 8), 0xFF}
+		}
+		m := image.NewPaletted(bounds, p)
+		for y := range height {
+			row := pix[y*stride:]
+			for x := range width {
+				i := row[x*bits/8]
+				if bits < 8 {
+					i = i >> (8 - bits - x*bits%8) & (1<<bits - 1)
+				}
+				m.Pix[y*m.Stride+x] = i
+			}
+		}
+		return m, nil
+	}
+
+	// associated alpha is already multiplied into the colors
+	premultiplied := ifd.get(tiff_extra_samples, 0) == 1
+	m := image.NewNRGBA(bounds)
+	for y := range height {
+		row := pix[y*stride:]
+		for x := range width {
+			var c color.NRGBA
+			switch samples {
+			case 1, 2:
+				v := sample(row, x*samples)
+				if photometric == 0 {
+					v = 0xFF - v
+				}
+				c = color.NRGBA{v, v, v, 0xFF}
+				if samples == 2 {
+					c.A = sample(row, x*samples+1)
+				}
+			default:
+				c = color.NRGBA{sample(row, x*samples), sample(row, x*samples+1), sample(row, x*samples+2), 0xFF}
+				if samples == 4 {
+					c.A = sample(row, x*samples+3)
+				}
+			}
+			if premultiplied && c.A > 0 && c.A < 0xFF {
+				rgba := color.RGBA{c.R, c.G, c.B, c.A}
+				c = color.NRGBAModel.Convert(rgba).(color.NRGBA)
+			}
+			m.SetNRGBA(x, y, c)
+		}
+	}
+	return m, nil
+}
+
+// Returns the byte order of a TIFF file
+func tiff_order(data []byte) binary.ByteOrder {
+	if string(data[:4]) == TIFF_BE {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// Decompresses the strips of a page into size bytes of pixels
+func read_tiff_strips(data []byte, ifd tiff_ifd, size int) ([]byte, error) {
+	offsets, counts := ifd[tiff_strip_offsets], ifd[tiff_strip_counts]
+	if len(offsets) == 0 || len(offsets) != len(counts) {
+		return nil, errors.New("invalid strips")
+	}
+
+	pix := make([]byte, 0, size)
+	for i, offset := range offsets {
+		if int64(offset)+int64(counts[i]) > int64(len(data)) {
+			return nil, errors.New("truncated strip")
+		}
+		strip := data[offset : offset+counts[i]]
+
+		var err error
+		switch compression := ifd.get(tiff_compression, 1); compression {
+		case 1:
+			pix = append(pix, strip...)
+		case 5:
+			pix, err = unlzw_tiff(pix, strip)
+		case 8, 32946:
+			var r io.ReadCloser
+			if r, err = zlib.NewReader(bytes.NewReader(strip)); err == nil {
+				var b []byte
+				b, err = io.ReadAll(r)
+				pix = append(pix, b...)
+			}
+		case 32773:
+			pix, err = unpack_bits(pix, strip)
+		default:
+			return nil, fmt.Errorf("compression %d is not supported", compression)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(pix) >= size {
+			break
+		}
+	}
+
+	if len(pix) < size {
+		return nil, errors.New("truncated pixels")
+	}
+	return pix[:size], nil
+}
+
+// Appends the PackBits compressed src to dst
+func unpack_bits(dst, src []byte) ([]byte, error) {
+	for i := 0; i < len(src); {
+		n := int(int8(src[i]))
+		i++
+		switch {
+		case n >= 0:
+			if i+n+1 > len(src) {
+				return nil, errors.New("truncated PackBits run")
+			}
+			dst = append(dst, src[i:i+n+1]...)
+			i += n + 1
+		case n != -128:
+			if i >= len(src) {
+				return nil, errors.New("truncated PackBits run")
+			}
+			for range 1 - n {
+				dst = append(dst, src[i])
+			}
+			i++
+		}
+	}
+	return dst, nil
+}
+
+// Appends the LZW compressed src to dst. The codes of TIFF files grow a code
+// earlier than the ones of GIF files, so compress/lzw can not read them
+func unlzw_tiff(dst, src []byte) ([]byte, error) {
+	const CLEAR, EOI = 256, 257
+
+	table := make([][]byte, 258, 4096)
+	reset := func() {
+		table = table[:258]
+		for i := range 256 {
+			table[i] = []byte{byte(i)}
+		}
+	}
+	reset()
+
+	width, acc, nbits, pos := 9, uint32(0), 0, 0
+	var prev []byte
+	for {
+		for nbits < width {
+			if pos >= len(src) {
+				// some writers leave out the end of information code
+				return dst, nil
+			}
+			acc = acc<<8 | uint32(src[pos])
+			pos++
+			nbits += 8
+		}
+		code := int(acc>>(nbits-width)) & (1<<width - 1)
+		nbits -= width
+
+		switch {
+		case code == CLEAR:
+			reset()
+			width, prev = 9, nil
+			continue
+		case code == EOI:
+			return dst, nil
+		}
+
+		var entry []byte
+		switch {
+		case code < len(table):
+			entry = table[code]
+		case code == len(table) && prev != nil:
+			entry = append(prev[:len(prev):len(prev)], prev[0])
+		default:
+			return nil, errors.New("invalid LZW code")
+		}
+		dst = append(dst, entry...)
+
+		if prev != nil && len(table) < 4096 {
+			table = append(table, append(prev[:len(prev):len(prev)], entry[0]))
+		}
+		prev = entry
+
+		// the early change of TIFF files
+		if len(table)+1 >= 1<<width && width < 12 {
+			width++
+		}
+	}
+}
+
+// Decodes the pages of the TIFF file at path, nil when it is not a TIFF file
+func tiff_pages(path string) ([]image.Image, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".tif" && ext != ".tiff" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pages, err := decode_tiff_pages(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %w", ex, path, err)
+	}
+	return pages, nil
+}
+
+// Decodes the pages of the image at path, every page of a TIFF file and the
+// image itself for other formats
+func load_pages(path string) ([]image.Image, error) {
+	pages, err := tiff_pages(path)
+	if err != nil || pages != nil {
+		return pages, err
+	}
+	img, err := load_image(path)
+	if err != nil {
+		return nil, err
+	}
+	return []image.Image{img}, nil
+}
+
+// Returns path with the number of a page before its extension, like
+// "out-2.png"
+func page_path(path string, page int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), page, ext)
+}
+
+func init() {
+	decode := func(r io.Reader) (image.Image, error) {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		pages, err := decode_tiff_pages(data)
+		if err != nil {
+			return nil, err
+		}
+		return pages[0], nil
+	}
+	config := func(r io.Reader) (image.Config, error) {
+		img, err := decode(r)
+		if err != nil {
+			return image.Config{}, err
+		}
+		return image.Config{ColorModel: img.ColorModel(), Width: img.Bounds().Dx(), Height: img.Bounds().Dy()}, nil
+	}
+	image.RegisterFormat("tiff", TIFF_LE, decode, config)
+	image.RegisterFormat("tiff", TIFF_BE, decode, config)
+}
+
+// Scales a 16 bits sample down to 8 bits, rounding to the nearest value
+func to_8bit(v uint16) uint8 {
+	return uint8((uint32(v)*255 + 0xFFFF/2) / 0xFFFF)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"log"
+
+	"github.com/spf13/pflag"
+)
+
+// Size in pixels of the windows dithering is looked for in, the size of
+// the Bayer matrix of ordered dithering so its patterns average out
+const UNDITHER_WINDOW = 4
+
+// Fewest changes of color between neighbors, out of the 24 of a window,
+// for two colors to count as dithered rather than two flat areas
+const UNDITHER_CHANGES = 8
+
+// Smooths the dithered areas of img, where two colors alternate like in a
+// checkerboard or an ordered pattern, into the flat colors they stand for.
+// Every other pixel is kept. Returns the smoothed image and the share of
+// its pixels found dithered
+func undither(img image.Image) (*image.RGBA, float64) {
+	bounds := img.Bounds()
+	src := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			src.SetRGBA(x, y, color.RGBAModel.Convert(img.At(x, y)).(color.RGBA))
+		}
+	}
+
+	res := image.NewRGBA(bounds)
+	count := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			// the window around the pixel, kept inside the image
+			wx := min(max(x-UNDITHER_WINDOW/2+1, bounds.Min.X), bounds.Max.X-UNDITHER_WINDOW)
+			wy := min(max(y-UNDITHER_WINDOW/2+1, bounds.Min.Y), bounds.Max.Y-UNDITHER_WINDOW)
+			window := image.Rect(wx, wy, wx+UNDITHER_WINDOW, wy+UNDITHER_WINDOW).Intersect(bounds)
+			if !is_dithered(src, window) {
+				res.SetRGBA(x, y, src.RGBAAt(x, y))
+				continue
+			}
+
+			var r, g, b, a int
+			for sy := window.Min.Y; sy < window.Max.Y; sy++ {
+				for sx := window.Min.X; sx < window.Max.X; sx++ {
+					c := src.RGBAAt(sx, sy)
+					r, g, b, a = r+int(c.R), g+int(c.G), b+int(c.B), a+int(c.A)
+				}
+			}
+			n := window.Dx() * window.Dy()
+			res.SetRGBA(x, y, color.RGBA{uint8((r + n/2) / n), uint8((g + n/2) / n), uint8((b + n/2) / n), uint8((a + n/2) / n)})
+			count++
+		}
+	}
+	return res, float64(count) / float64(max(1, bounds.Dx()*bounds.Dy()))
+}
+
+// Whether the window of img is made of two colors alternating often enough
+// to be dithering
+func is_dithered(img *image.RGBA, window image.Rectangle) bool {
+	a := img.RGBAAt(window.Min.X, window.Min.Y)
+	b, has_b := a, false
+	changes := 0
+	for y := window.Min.Y; y < window.Max.Y; y++ {
+		for x := window.Min.X; x < window.Max.X; x++ {
+			c := img.RGBAAt(x, y)
+			if c != a {
+				if !has_b {
+					b, has_b = c, true
+				} else if c != b {
+					return false
+				}
+			}
+			if x > window.Min.X && c != img.RGBAAt(x-1, y) {
+				changes++
+			}
+			if y > window.Min.Y && c != img.RGBAAt(x, y-1) {
+				changes++
+			}
+		}
+	}
+	return has_b && changes >= UNDITHER_CHANGES
+}
+
+// Runs the undither command given in the arguments
+func run_undither() int {
+	chosen_pal := pflag.StringP("palette", "p", "", "Color palette to remap the smoothed image to")
+	remap_opts := remap_flags(pflag.CommandLine)
+	pflag.Parse()
+	args := pflag.Args()
+
+	opts, err := remap_opts()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if len(args) == 1 {
+		log.Printf("%s: missing image file\n", ex)
+		return 2
+	}
+	if len(args) == 2 {
+		log.Printf("%s: missing output image\n", ex)
+		return 2
+	}
+
+	img, err := load_image(args[1])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	smooth, share := undither(img)
+	fmt.Printf("Dithered: %.1f%% of the image\n", share*100)
+
+	if *chosen_pal == "" {
+		if status, err := write_image(smooth, args[2], nil); err != nil {
+			log.Println(err)
+			return status
+		}
+		return 0
+	}
+
+	pal, _, err := open_palette(*chosen_pal)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer pal.Close()
+	p, err := load_palette(pal)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	if status, err := remap(smooth, p, args[2], opts); err != nil {
+		log.Println(err)
+		return status
+	}
+	return 0
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+
+	"github.com/StarFilledDonut/nespal"
+)
+
+// Largest integer scale looked for in screenshots
+const MAX_SCALE = 8
+
+// Share of the color changes along an axis that must fall between blocks
+// of a scale for the axis to be scaled by it. Filtering spreads the changes
+// over the pixels next to the edges of the blocks, so it is not 1
+const SCALE_SHARE = 0.6
+
+// Reads rows of colors already gathered, which can have any length
+type color_rows struct {
+	bounds image.Rectangle
+	rows   [][]color.RGBA
+}
+
+func (r *color_rows) Bounds() image.Rectangle { return r.bounds }
+
+func (r *color_rows) NextRow() ([]color.RGBA, error) {
+	if len(r.rows) == 0 {
+		return nil, io.EOF
+	}
+	row := r.rows[0]
+	r.rows = r.rows[1:]
+	return row, nil
+}
+
+func (r *color_rows) Close() error { return nil }
+
+// Returns the integer scale of an axis whose color changes between a pixel
+// and the one before are edges, and the offset of its first whole block.
+// The scale is the largest whose blocks have most changes on their edges,
+// 1 when there is none
+func detect_scale(edges []float64) (int, int) {
+	total := 0.0
+	for _, e := range edges {
+		total += e
+	}
+	if total == 0 {
+		return 1, 0
+	}
+
+	// divisors of the scale also have every change on their edges, so the
+	// largest scales are tried first; multiples have half of them at most
+	for scale := MAX_SCALE; scale >= 2; scale-- {
+		if len(edges) < scale*2 {
+			continue
+		}
+		phases := make([]float64, scale)
+		for x, e := range edges {
+			phases[x%scale] += e
+		}
+
+		best := 0
+		for phase := range phases {
+			if phases[phase] > phases[best] {
+				best = phase
+			}
+		}
+		if phases[best]/total >= SCALE_SHARE {
+			return scale, best
+		}
+	}
+	return 1, 0
+}
+
+// Undoes the integer scaling of img, and the mild filtering smoothing it,
+// giving the rows of the dominant color of each block. Blocks with no
+// color in more than half of their pixels are blends of the edges of the
+// filtering and are left out, and so are partial blocks on the borders and
+// the pixels mask ignores
+func unscale(img image.Image, mask *Mask) nespal.RowReader {
+	bounds := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(rgba, rgba.Bounds(), img, bounds.Min, draw.Src)
+	width, height := rgba.Rect.Dx(), rgba.Rect.Dy()
+
+	// squared, so the sharp changes between blocks outweigh the soft ones
+	// filtering spreads around them
+	distance := func(a, b color.RGBA) float64 {
+		d := abs(int(a.R)-int(b.R)) + abs(int(a.G)-int(b.G)) + abs(int(a.B)-int(b.B))
+		return float64(d * d)
+	}
+	cols, rows := make([]float64, width), make([]float64, height)
+	for y := range height {
+		for x := range width {
+			if mask.ignored(x, y) {
+				continue
+			}
+			c := rgba.RGBAAt(x, y)
+			if x > 0 && !mask.ignored(x-1, y) {
+				cols[x] += distance(rgba.RGBAAt(x-1, y), c)
+			}
+			if y > 0 && !mask.ignored(x, y-1) {
+				rows[y] += distance(rgba.RGBAAt(x, y-1), c)
+			}
+		}
+	}
+	scale_x, offset_x := detect_scale(cols)
+	scale_y, offset_y := detect_scale(rows)
+
+	res := &color_rows{bounds: image.Rect(0, 0, (width-offset_x)/scale_x, (height-offset_y)/scale_y)}
+	colors := make([]color.RGBA, 0, scale_x*scale_y)
+	counts := make([]int, 0, scale_x*scale_y)
+	for by := offset_y; by+scale_y <= height; by += scale_y {
+		row := []color.RGBA{}
+		for bx := offset_x; bx+scale_x <= width; bx += scale_x {
+			colors, counts = colors[:0], counts[:0]
+			for y := by; y < by+scale_y; y++ {
+				for x := bx; x < bx+scale_x; x++ {
+					if mask.ignored(x, y) {
+						continue
+					}
+					c := rgba.RGBAAt(x, y)
+					found := false
+					for i := range colors {
+						if colors[i] == c {
+							counts[i]++
+							found = true
+							break
+						}
+					}
+					if !found {
+						colors = append(colors, c)
+						counts = append(counts, 1)
+					}
+				}
+			}
+
+			best := 0
+			for i := range counts {
+				if counts[i] > counts[best] {
+					best = i
+				}
+			}
+			if len(counts) > 0 && counts[best]*2 > scale_x*scale_y {
+				row = append(row, colors[best])
+			}
+		}
+		res.rows = append(res.rows, row)
+	}
+	return res
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
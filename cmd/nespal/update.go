@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const UPDATE = "update"
+
+// Name of the curated palette pack downloaded by palette update into the
+// user palette directory
+const UPDATE_PACK = "curated" + PACK_EXT
+
+// Largest palette pack downloaded by palette update, in bytes
+const MAX_PACK = 64 << 20
+
+// Returns the user palette directory, searched before the pre-built palettes
+func user_palette_dir() (string, error) {
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(config, "nespal", "palettes"), nil
+}
+
+// Downloads the palette pack at url
+func download_pack(url string) ([]byte, error) {
+	client := http.Client{Timeout: time.Minute}
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: downloading '%s': %s", ex, url, res.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(res.Body, MAX_PACK+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MAX_PACK {
+		return nil, fmt.Errorf("%s: palette pack at '%s' is larger than %d bytes", ex, url, MAX_PACK)
+	}
+	return data, nil
+}
+
+// Reads the manifest of the pack in data, named name
+func pack_manifest(data []byte, name string) (*PackManifest, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: palette pack '%s': %w", ex, name, err)
+	}
+	return read_pack_manifest(archive, name)
+}
+
+// Downloads the curated palette pack at url into the user palette
+// directory, where its palettes shadow the pre-built ones of the same
+// name. Only checks whether the installed pack is the latest one when
+// check is true, the status is then 1 if it is not
+func update_palettes(url string, check bool) (int, error) {
+	data, err := download_pack(url)
+	if err != nil {
+		return 1, err
+	}
+	latest, err := pack_manifest(data, url)
+	if err != nil {
+		return 1, err
+	}
+	if latest.Version == "" {
+		return 1, fmt.Errorf("%s: palette pack at '%s' has no version", ex, url)
+	}
+
+	dir, err := user_palette_dir()
+	if err != nil {
+		return 1, err
+	}
+	path := filepath.Join(dir, UPDATE_PACK)
+
+	installed := ""
+	if current, err := os.ReadFile(path); err == nil {
+		if manifest, err := pack_manifest(current, path); err == nil {
+			installed = manifest.Version
+		}
+	}
+
+	if installed == latest.Version {
+		fmt.Printf("The palettes are up to date, version %s\n", installed)
+		return 0, nil
+	}
+	if check {
+		if installed == "" {
+			fmt.Printf("The palettes are not installed, the latest version is %s\n", latest.Version)
+		} else {
+			fmt.Printf("The palettes are outdated, version %s is installed and the latest is %s\n", installed, latest.Version)
+		}
+		return 1, nil
+	}
+
+	// written aside and then moved, so a failed update keeps the old pack
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 1, err
+	}
+	tmp, err := os.CreateTemp(dir, "*.tmp")
+	if err != nil {
+		return 1, err
+	}
+	_, err = tmp.Write(data)
+	if close_err := tmp.Close(); err == nil {
+		err = close_err
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 1, err
+	}
+
+	fmt.Printf("Installed version %s of the palettes, %d in the pack\n", latest.Version, len(latest.Palettes))
+	return 0, nil
+}
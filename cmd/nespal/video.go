@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Containers whose players expect 4:2:0 video, which ffmpeg does not pick
+// on its own for RGB frames
+var yuv420_containers = []string{".mp4", ".m4v", ".mov", ".mkv", ".webm"}
+
+// Size and frame rate of a video
+type VideoInfo struct {
+	Width, Height int
+	// As ffmpeg writes it, like "30000/1001"
+	Rate string
+}
+
+// Tells the size and frame rate of the first video stream of path with
+// ffprobe
+func probe_video(ctx context.Context, ffprobe string, path string) (VideoInfo, error) {
+	out, err := exec.CommandContext(ctx, ffprobe,
+		"-v", "error", "-select_streams", "v:0",
+		"-show_entries", "stream=width,height,r_frame_rate", "-of", "csv=p=0", path,
+	).CombinedOutput()
+	if err != nil {
+		return VideoInfo{}, fmt.Errorf("%s: 'ffprobe' could not read '%s': %s", ex, path, strings.TrimSpace(string(out)))
+	}
+
+	fields := strings.Split(strings.TrimSpace(string(out)), ",")
+	if len(fields) < 3 {
+		return VideoInfo{}, fmt.Errorf("%s: '%s' has no video stream", ex, path)
+	}
+	w, err_w := strconv.Atoi(fields[0])
+	h, err_h := strconv.Atoi(fields[1])
+	if err_w != nil || err_h != nil || w <= 0 || h <= 0 {
+		return VideoInfo{}, fmt.Errorf("%s: 'ffprobe' gave an invalid size for '%s': %s", ex, path, strings.TrimSpace(string(out)))
+	}
+	return VideoInfo{w, h, fields[2]}, nil
+}
+
+// A frame of a video as RGB bytes, numbered from 0
+type video_frame struct {
+	n    int
+	data []byte
+}
+
+// Remaps every frame of the video at src_path to p into dst_path, jobs
+// frames at a time. ffmpeg decodes and encodes the frames, passing them as
+// raw RGB through pipes, and copies the audio. Returns the number of frames
+func remap_video(ctx context.Context, src_path string, dst_path string, p color.Palette, opts RemapOptions) (int, error) {
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return 0, fmt.Errorf("%s: videos are decoded and encoded with 'ffmpeg', install it to remap them", ex)
+	}
+	ffprobe, err := exec.LookPath("ffprobe")
+	if err != nil {
+		return 0, fmt.Errorf("%s: videos are read with 'ffprobe', which comes with 'ffmpeg', install it to remap them", ex)
+	}
+	info, err := probe_video(ctx, ffprobe, src_path)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var dec_log, enc_log bytes.Buffer
+	dec := exec.CommandContext(ctx, ffmpeg, "-v", "error", "-i", src_path, "-map", "0:v:0", "-f", "rawvideo", "-pix_fmt", "rgb24", "-")
+	dec.Stderr = &dec_log
+	frames_out, err := dec.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+
+	enc_args := []string{
+		"-v", "error", "-y",
+		"-f", "rawvideo", "-pix_fmt", "rgb24", "-s", fmt.Sprintf("%dx%d", info.Width, info.Height), "-r", info.Rate, "-i", "-",
+		"-i", src_path, "-map", "0:v", "-map", "1:a?", "-c:a", "copy",
+	}
+	for _, ext := range yuv420_containers {
+		if strings.ToLower(filepath.Ext(dst_path)) == ext {
+			enc_args = append(enc_args, "-pix_fmt", "yuv420p")
+		}
+	}
+	enc := exec.CommandContext(ctx, ffmpeg, append(enc_args, dst_path)...)
+	enc.Stderr = &enc_log
+	frames_in, err := enc.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := dec.Start(); err != nil {
+		return 0, err
+	}
+	if err := enc.Start(); err != nil {
+		cancel(err)
+		dec.Wait()
+		return 0, err
+	}
+
+	// at most twice as many frames as jobs are in memory, the ones waiting
+	// for the frames before them to be written included
+	tokens := make(chan struct{}, 2*max(jobs, 1))
+	todo, done := make(chan video_frame), make(chan video_frame)
+	size := info.Width * info.Height * 3
+
+	// the frames are only read until the decoder is waited for
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		defer close(todo)
+		for n := 0; ; n++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			data := make([]byte, size)
+			if _, err := io.ReadFull(frames_out, data); err != nil {
+				if err != io.EOF {
+					cancel(fmt.Errorf("%s: frame %d of '%s' is cut short", ex, n+1, src_path))
+				}
+				return
+			}
+			select {
+			case todo <- video_frame{n, data}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range max(jobs, 1) {
+		wg.Go(func() {
+			for frame := range todo {
+				if err := remap_frame(ctx, frame.data, info, p, opts); err != nil {
+					cancel(err)
+					return
+				}
+				select {
+				case done <- frame:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	// the frames are written in order, the ones done early wait for the
+	// ones before them
+	pending := map[int][]byte{}
+	next := 0
+	// whether the encoder stopped taking frames, its log tells why once it
+	// is waited for
+	stopped := false
+	for frame := range done {
+		if ctx.Err() != nil {
+			continue
+		}
+		pending[frame.n] = frame.data
+		for data, ok := pending[next]; ok; data, ok = pending[next] {
+			delete(pending, next)
+			if _, err := frames_in.Write(data); err != nil {
+				stopped = true
+				cancel(err)
+				break
+			}
+			next++
+			<-tokens
+		}
+	}
+	frames_in.Close()
+	<-read
+
+	dec_err, enc_err := dec.Wait(), enc.Wait()
+	if stopped {
+		return next, fmt.Errorf("%s: 'ffmpeg' stopped encoding '%s': %s", ex, dst_path, strings.TrimSpace(enc_log.String()))
+	}
+	if err := context.Cause(ctx); err != nil {
+		return next, err
+	}
+	if dec_err != nil {
+		return next, fmt.Errorf("%s: 'ffmpeg' could not decode '%s': %s", ex, src_path, strings.TrimSpace(dec_log.String()))
+	}
+	if enc_err != nil {
+		return next, fmt.Errorf("%s: 'ffmpeg' could not encode '%s': %s", ex, dst_path, strings.TrimSpace(enc_log.String()))
+	}
+	if next == 0 {
+		return 0, fmt.Errorf("%s: '%s' has no frames", ex, src_path)
+	}
+	return next, nil
+}
+
+// Remaps a frame of RGB bytes in place
+func remap_frame(ctx context.Context, data []byte, info VideoInfo, p color.Palette, opts RemapOptions) error {
+	img := image.NewRGBA(image.Rect(0, 0, info.Width, info.Height))
+	for i := range info.Width * info.Height {
+		copy(img.Pix[i*4:], data[i*3:i*3+3])
+		img.Pix[i*4+3] = 255
+	}
+
+	indexed, err := nespal.Remap(ctx, preprocess(img, p, opts), p, opts.Options)
+	if err != nil {
+		return err
+	}
+	colors := make([]color.RGBA, len(indexed.Palette))
+	for i, c := range indexed.Palette {
+		colors[i] = nespal.ToRGB(c)
+	}
+	for i, index := range indexed.Pix {
+		c := colors[index]
+		data[i*3], data[i*3+1], data[i*3+2] = c.R, c.G, c.B
+	}
+	return nil
+}
+
+// Runs the video command given in the arguments
+func run_video() int {
+	remap_opts := remap_flags(pflag.CommandLine)
+	pflag.Parse()
+	args := pflag.Args()
+
+	opts, err := remap_opts()
+	if err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	if len(args) == 1 {
+		log.Printf("%s: missing video file\n", ex)
+		return 2
+	}
+	if len(args) == 2 {
+		log.Printf("%s: missing color palette\n", ex)
+		return 2
+	}
+	if len(args) == 3 {
+		log.Printf("%s: missing output video\n", ex)
+		return 2
+	}
+
+	p, _, err := load_named_palette(args[2])
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if _, err := remap_video(ctx, args[1], args[3], p, opts); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/StarFilledDonut/nespal"
+	"github.com/spf13/pflag"
+)
+
+// Largest image accepted by the web UI, in bytes
+const MAX_UPLOAD = 64 << 20
+
+//go:embed web
+var web_assets embed.FS
+
+// Serves the web UI: its page, the available palettes, dithering methods
+// and metrics, and remapping the posted images, each remap stopped past
+// timeout unless it is 0
+func web_handler(timeout time.Duration) (http.Handler, error) {
+	assets, err := fs.Sub(web_assets, "web")
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /", http.FileServerFS(assets))
+	mux.HandleFunc("GET /options", serve_options)
+	mux.Handle("POST /remap", with_timeout(http.HandlerFunc(serve_remap), timeout))
+	if structured_log() {
+		return log_requests(mux), nil
+	}
+	return mux, nil
+}
+
+// Records the status code written to a response
+type status_writer struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *status_writer) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Logs the outcome and duration of every request handled by h
+func log_requests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &status_writer{w, http.StatusOK}
+		h.ServeHTTP(sw, r)
+		slog.Info("request", "method", r.Method, "path", r.URL.Path, "status", sw.status, "duration", time.Since(start))
+	})
+}
+
+// Cancels the context of the requests handled by h past timeout, unless it
+// is 0
+func with_timeout(h http.Handler, timeout time.Duration) http.Handler {
+	if timeout == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Writes the choices of the page as JSON
+func serve_options(w http.ResponseWriter, r *http.Request) {
+	entries, err := available_palettes()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]string{
+		"palettes": names,
+		"dithers":  {nespal.DITHER_NONE, nespal.DITHER_FLOYD_STEINBERG, nespal.DITHER_ORDERED, nespal.DITHER_NOISE},
+		"metrics":  nespal.MetricNames(),
+	})
+}
+
+// Remaps the image in the body of the request to the palette named in the
+// query and writes it as a PNG. The other query parameters are the flags
+// of remap, like "dither=ordered", so the page and the command line share
+// their options
+func serve_remap(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	name := query.Get("palette")
+	if name == "" || filepath.Ext(name) == ".pal" {
+		http.Error(w, fmt.Sprintf("%s: missing palette name", ex), http.StatusBadRequest)
+		return
+	}
+	query.Del("palette")
+
+	flags := pflag.NewFlagSet("remap", pflag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	remap_opts := remap_flags(flags)
+	args := []string{}
+	for key, values := range query {
+		// the JSON mapping is read from the disk of the server, not sent
+		if key == "map" {
+			http.Error(w, fmt.Sprintf("%s: option '%s' is not available in the web UI", ex, key), http.StatusBadRequest)
+			return
+		}
+		for _, value := range values {
+			args = append(args, "--"+key+"="+value)
+		}
+	}
+	if err := flags.Parse(args); err != nil {
+		http.Error(w, fmt.Sprintf("%s: %s", ex, err), http.StatusBadRequest)
+		return
+	}
+	opts, err := remap_opts()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	p, _, err := load_named_palette(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	// the remap stops once the client goes away or the timeout is over
+	ctx := r.Context()
+	data, err := io.ReadAll(context_reader{ctx, http.MaxBytesReader(w, r.Body, MAX_UPLOAD)})
+	if ctx.Err() != nil {
+		http.Error(w, fmt.Sprintf("%s: %s", ex, ctx.Err()), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(w, fmt.Sprintf("%s: %s", ex, err), http.StatusBadRequest)
+		return
+	}
+
+	// under --max-memory, the images waiting for their memory are queued
+	// and PNGs too large for the budget are remapped band by band
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s: %s", ex, err), http.StatusBadRequest)
+		return
+	}
+	size := image.Pt(config.Width, config.Height)
+	streamed := memory_budget != nil && format == "png" && can_stream(opts) && image_memory(size, false) > memory_budget.total
+	release, err := reserve_memory(ctx, size, streamed)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s: %s", ex, err), http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+
+	if streamed {
+		var buf bytes.Buffer
+		err := nespal.RemapStream(ctx, bytes.NewReader(data), &buf, nespal.StreamOptions{Options: opts.Options, Palette: p, Format: "png"})
+		if ctx.Err() != nil {
+			http.Error(w, fmt.Sprintf("%s: %s", ex, ctx.Err()), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("%s: %s", ex, err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+		return
+	}
+
+	img, err := nespal.DecodeImage(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s: %s", ex, err), http.StatusBadRequest)
+		return
+	}
+	indexed, err := nespal.Remap(ctx, preprocess(img, p, opts), p, opts.Options)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s: %s", ex, err), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, indexed); err != nil {
+		log.Println(err)
+	}
+}
+
+// Reads from r until ctx is done, so uploads stop with the error of ctx
+type context_reader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r context_reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Runs the web command given in the arguments
+func run_web() int {
+	addr := pflag.String("addr", "localhost:8080", "Address to listen on")
+	timeout := pflag.Duration("timeout", 0, "Longest time a remap can take, like '30s', no limit when 0")
+	pflag.Parse()
+
+	if err := setup_memory_budget(); err != nil {
+		log.Println(err)
+		return 2
+	}
+
+	handler, err := web_handler(*timeout)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	log.Printf("%s: serving on http://%s\n", ex, *addr)
+	if err := http.ListenAndServe(*addr, handler); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
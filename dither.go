@@ -0,0 +1,101 @@
+package nespal
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"math/rand/v2"
+)
+
+const (
+	DITHER_NONE            = "none"
+	DITHER_FLOYD_STEINBERG = "floyd-steinberg"
+	DITHER_ORDERED         = "ordered"
+	DITHER_NOISE           = "noise"
+)
+
+// How far, in 8 bits color values, the ordered and noise dithering can
+// push a color away from its original value
+const DITHER_SPREAD = 32
+
+var bayer4x4 = [4][4]float64{
+	{0, 8, 2, 10},
+	{12, 4, 14, 6},
+	{3, 11, 1, 9},
+	{15, 7, 13, 5},
+}
+
+func clamp8(v float64) uint8 {
+	if v < 0 {
+		return 0
+	} else if v > 255 {
+		return 255
+	}
+	return uint8(v + 0.5)
+}
+
+// Maps every pixel of img to an index of p like Remap does, but
+// dithering the colors with the method in opts.Dither. The noise comes
+// from opts.Seed, so the same inputs always give the same output. Stops
+// with the error of ctx once it is done
+func dither_image(ctx context.Context, img image.Image, p color.Palette, opts Options) (*image.Paletted, error) {
+	bounds := img.Bounds()
+	remapped := image.NewPaletted(bounds, p)
+	rng := rand.New(rand.NewPCG(opts.Seed, opts.Seed))
+	matcher := NewMatcher(p, opts.Metric)
+
+	// quantization error carried to the current and next rows
+	width := bounds.Dx()
+	current := make([][3]float64, width+2)
+	next := make([][3]float64, width+2)
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			src := img.At(x, y)
+			c := ToRGB(src)
+			if i, ok := opts.Keep[c]; ok {
+				remapped.SetColorIndex(x, y, i)
+				continue
+			}
+
+			// the offsets are rounded with float64() so they are never fused
+			// with the sum below, which some CPUs would round differently
+			offset := [3]float64{}
+			switch opts.Dither {
+			case DITHER_FLOYD_STEINBERG:
+				offset = current[x-bounds.Min.X+1]
+			case DITHER_ORDERED:
+				v := float64((bayer4x4[y&3][x&3]/16 - 0.5) * DITHER_SPREAD)
+				offset = [3]float64{v, v, v}
+			case DITHER_NOISE:
+				v := float64((rng.Float64() - 0.5) * DITHER_SPREAD)
+				offset = [3]float64{v, v, v}
+			}
+
+			want := [3]float64{float64(c.R) + offset[0], float64(c.G) + offset[1], float64(c.B) + offset[2]}
+			target := color.RGBA{clamp8(want[0]), clamp8(want[1]), clamp8(want[2]), 255}
+			i := matcher.Closest(target, opts.Indices)
+			remapped.SetColorIndex(x, y, uint8(i))
+
+			if opts.Dither == DITHER_FLOYD_STEINBERG {
+				got := ToRGB(p[i])
+				err := [3]float64{want[0] - float64(got.R), want[1] - float64(got.G), want[2] - float64(got.B)}
+				col := x - bounds.Min.X + 1
+				for ch := range 3 {
+					current[col+1][ch] += err[ch] * 7 / 16
+					next[col-1][ch] += err[ch] * 3 / 16
+					next[col][ch] += err[ch] * 5 / 16
+					next[col+1][ch] += err[ch] * 1 / 16
+				}
+			}
+		}
+
+		current, next = next, current
+		clear(next)
+	}
+
+	return remapped, nil
+}
@@ -1,5 +1,10 @@
-module nespal
+module github.com/StarFilledDonut/nespal
 
 go 1.25.3
 
-require github.com/spf13/pflag v1.0.10 // indirect
+require (
+	github.com/spf13/pflag v1.0.10
+	go.starlark.net v0.0.0-20260908191801-89a6a09411d5
+)
+
+require golang.org/x/sys v0.42.0 // indirect
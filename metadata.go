@@ -0,0 +1,299 @@
+package nespal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"io"
+	"os"
+	"strings"
+)
+
+// EXIF tag of the orientation of the image
+const EXIF_ORIENTATION = 0x0112
+
+// Metadata of an image worth carrying over to the images made from it
+type Metadata struct {
+	// Text entries, from the tEXt chunks of a PNG or the comments of a JPEG
+	Text [][2]string
+	// Resolution in pixels per meter, zero when unknown
+	ResX, ResY uint32
+	// EXIF data, as the TIFF structure it is stored in
+	Exif []byte
+}
+
+// Returns the orientation of the image in the EXIF data, 1 when it is upright
+// or unknown. Also returns where the value is stored in exif
+func ExifOrientation(exif []byte) (int, int) {
+	if len(exif) < 8 {
+		return 1, -1
+	}
+
+	var order binary.ByteOrder
+	switch string(exif[:4]) {
+	case "II*\x00":
+		order = binary.LittleEndian
+	case "MM\x00*":
+		order = binary.BigEndian
+	default:
+		return 1, -1
+	}
+
+	ifd := int(order.Uint32(exif[4:8]))
+	if ifd < 8 || ifd+2 > len(exif) {
+		return 1, -1
+	}
+	count := int(order.Uint16(exif[ifd:]))
+	for i := range count {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(exif) {
+			break
+		}
+		if order.Uint16(exif[entry:]) == EXIF_ORIENTATION {
+			o := int(order.Uint16(exif[entry+8:]))
+			if o < 1 || o > 8 {
+				return 1, -1
+			}
+			return o, entry + 8
+		}
+	}
+	return 1, -1
+}
+
+// Turns img upright, given its EXIF orientation
+func Orient(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	res := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		for x := range dw {
+			// the source pixel of each output pixel
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = w - 1 - x
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sy = h - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			res.Set(x, y, img.At(bounds.Min.X+sx, bounds.Min.Y+sy))
+		}
+	}
+	return res
+}
+
+// Reads the metadata of a PNG or JPEG, stopping where the image data starts.
+// Other formats have no metadata
+func ParseMetadata(r io.Reader) (*Metadata, error) {
+	br := bufio.NewReader(r)
+	meta := &Metadata{}
+
+	head, err := br.Peek(len(PNG_SIGNATURE))
+	if err == nil && string(head) == PNG_SIGNATURE {
+		br.Discard(len(PNG_SIGNATURE))
+		for {
+			var header [8]byte
+			if _, err := io.ReadFull(br, header[:]); err != nil {
+				return nil, err
+			}
+			length := binary.BigEndian.Uint32(header[:4])
+			kind := string(header[4:])
+			if kind == "IDAT" || kind == "IEND" {
+				return meta, nil
+			}
+
+			data := make([]byte, length)
+			if _, err := io.ReadFull(br, data); err != nil {
+				return nil, err
+			}
+			if _, err := br.Discard(4); err != nil {
+				return nil, err
+			}
+
+			switch kind {
+			case "tEXt":
+				if key, value, found := bytes.Cut(data, []byte{0}); found {
+					meta.Text = append(meta.Text, [2]string{string(key), string(value)})
+				}
+			case "pHYs":
+				if len(data) == 9 && data[8] == 1 {
+					meta.ResX, meta.ResY = binary.BigEndian.Uint32(data[0:4]), binary.BigEndian.Uint32(data[4:8])
+				}
+			case "eXIf":
+				meta.Exif = data
+			}
+		}
+	}
+
+	head, err = br.Peek(2)
+	if err != nil || head[0] != 0xFF || head[1] != 0xD8 {
+		return meta, nil
+	}
+	br.Discard(2)
+	for {
+		var marker [4]byte
+		if _, err := io.ReadFull(br, marker[:]); err != nil {
+			return nil, err
+		}
+		// the image data comes right after the start of scan
+		if marker[0] != 0xFF || marker[1] == 0xDA || marker[1] == 0xD9 {
+			return meta, nil
+		}
+
+		length := int(binary.BigEndian.Uint16(marker[2:]))
+		if length < 2 {
+			return meta, nil
+		}
+		data := make([]byte, length-2)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, err
+		}
+
+		switch marker[1] {
+		case 0xE0:
+			// JFIF density, in dots per inch or per centimeter
+			if len(data) >= 12 && string(data[:5]) == "JFIF\x00" {
+				x, y := uint32(binary.BigEndian.Uint16(data[8:10])), uint32(binary.BigEndian.Uint16(data[10:12]))
+				switch data[7] {
+				case 1:
+					meta.ResX, meta.ResY = (x*10000+127)/254, (y*10000+127)/254
+				case 2:
+					meta.ResX, meta.ResY = x*100, y*100
+				}
+			}
+		case 0xE1:
+			if exif, found := bytes.CutPrefix(data, []byte("Exif\x00\x00")); found {
+				meta.Exif = exif
+			}
+		case 0xFE:
+			meta.Text = append(meta.Text, [2]string{"Comment", string(data)})
+		}
+	}
+}
+
+// Reads the metadata of the image at path
+func ReadMetadata(path string) (*Metadata, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseMetadata(file)
+}
+
+// Appends a PNG chunk to buf
+func append_chunk(buf []byte, kind string, data []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(data)))
+	start := len(buf)
+	buf = append(buf, kind...)
+	buf = append(buf, data...)
+	return binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf[start:]))
+}
+
+// Appends a JPEG segment to buf, unless data is too large for one
+func append_segment(buf []byte, marker byte, data []byte) []byte {
+	if len(data)+2 > 0xFFFF {
+		return buf
+	}
+	buf = append(buf, 0xFF, marker)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(data)+2))
+	return append(buf, data...)
+}
+
+// Encodes the metadata the way the format given by ext stores it. The pixels
+// are already upright, so the EXIF orientation is reset
+func (meta *Metadata) encode(ext string) []byte {
+	exif := meta.Exif
+	if _, at := ExifOrientation(exif); at >= 0 {
+		exif = bytes.Clone(exif)
+		if string(exif[:2]) == "II" {
+			binary.LittleEndian.PutUint16(exif[at:], 1)
+		} else {
+			binary.BigEndian.PutUint16(exif[at:], 1)
+		}
+	}
+
+	var buf []byte
+	if ext == ".png" {
+		if meta.ResX != 0 && meta.ResY != 0 {
+			phys := binary.BigEndian.AppendUint32(nil, meta.ResX)
+			phys = binary.BigEndian.AppendUint32(phys, meta.ResY)
+			buf = append_chunk(buf, "pHYs", append(phys, 1))
+		}
+		for _, entry := range meta.Text {
+			buf = append_chunk(buf, "tEXt", []byte(entry[0]+"\x00"+entry[1]))
+		}
+		if len(exif) > 0 {
+			buf = append_chunk(buf, "eXIf", exif)
+		}
+		return buf
+	}
+
+	if meta.ResX != 0 && meta.ResY != 0 {
+		// JFIF 1.02, the density in dots per centimeter
+		jfif := []byte("JFIF\x00\x01\x02\x02")
+		jfif = binary.BigEndian.AppendUint16(jfif, uint16(min(meta.ResX/100, 0xFFFF)))
+		jfif = binary.BigEndian.AppendUint16(jfif, uint16(min(meta.ResY/100, 0xFFFF)))
+		buf = append_segment(buf, 0xE0, append(jfif, 0, 0))
+	}
+	if len(exif) > 0 {
+		buf = append_segment(buf, 0xE1, append([]byte("Exif\x00\x00"), exif...))
+	}
+	for _, entry := range meta.Text {
+		text := entry[1]
+		if !strings.EqualFold(entry[0], "Comment") {
+			text = entry[0] + ": " + entry[1]
+		}
+		buf = append_segment(buf, 0xFE, []byte(text))
+	}
+	return buf
+}
+
+// Passes the encoded image through, inserting extra right after its first
+// head bytes, so metadata lands after the PNG header or the JPEG start marker
+type insert_writer struct {
+	w     io.Writer
+	head  int
+	extra []byte
+}
+
+func (iw *insert_writer) Write(p []byte) (int, error) {
+	n := 0
+	if iw.head > 0 {
+		k := min(iw.head, len(p))
+		if _, err := iw.w.Write(p[:k]); err != nil {
+			return 0, err
+		}
+		iw.head -= k
+		n, p = k, p[k:]
+		if iw.head > 0 {
+			return n, nil
+		}
+		if _, err := iw.w.Write(iw.extra); err != nil {
+			return n, err
+		}
+	}
+
+	m, err := iw.w.Write(p)
+	return n + m, err
+}
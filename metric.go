@@ -0,0 +1,280 @@
+package nespal
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A way of measuring how different two colors look
+type Metric interface {
+	Distance(a, b color.Color) float64
+}
+
+// Implemented by metrics comparing colors in another color space, so the
+// colors of a palette are converted once instead of on every comparison
+type SpaceMetric interface {
+	Metric
+	Convert(c color.Color) [3]float64
+	Compare(a, b [3]float64) float64
+}
+
+const DEFAULT_METRIC = "weighted"
+
+var (
+	metrics = map[string]Metric{}
+	// guards metrics, which can be registered while colors are matched
+	metrics_lock sync.RWMutex
+)
+
+// Makes a metric available by name to GetMetric
+func RegisterMetric(name string, m Metric) {
+	metrics_lock.Lock()
+	defer metrics_lock.Unlock()
+	metrics[name] = m
+}
+
+// Returns the registered metric called name
+func GetMetric(name string) (Metric, error) {
+	metrics_lock.RLock()
+	m, ok := metrics[name]
+	metrics_lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("nespal: unknown metric '%s', expected one of: %s", name, strings.Join(MetricNames(), ", "))
+	}
+	return m, nil
+}
+
+// Returns the names of the registered metrics, sorted
+func MetricNames() []string {
+	metrics_lock.RLock()
+	defer metrics_lock.RUnlock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the 8 bits RGB values of a color
+func rgb_floats(c color.Color) [3]float64 {
+	rgb := ToRGB(c)
+	return [3]float64{float64(rgb.R), float64(rgb.G), float64(rgb.B)}
+}
+
+// Euclidean distance in RGB, each channel weighted by how noticeable it is
+// to the human eye: green, red and then blue
+type Weighted struct{}
+
+func (Weighted) Convert(c color.Color) [3]float64 { return rgb_floats(c) }
+
+func (Weighted) Compare(a, b [3]float64) float64 {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return math.Sqrt(2*dr*dr + 3*dg*dg + 1*db*db)
+}
+
+func (m Weighted) Distance(a, b color.Color) float64 {
+	return m.Compare(m.Convert(a), m.Convert(b))
+}
+
+// Plain euclidean distance in RGB
+type Euclidean struct{}
+
+func (Euclidean) Convert(c color.Color) [3]float64 { return rgb_floats(c) }
+
+func (Euclidean) Compare(a, b [3]float64) float64 {
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return math.Sqrt(dr*dr + dg*dg + db*db)
+}
+
+func (m Euclidean) Distance(a, b color.Color) float64 {
+	return m.Compare(m.Convert(a), m.Convert(b))
+}
+
+// Euclidean distance in RGB with weights depending on how red the colors
+// are, a cheap approximation of how the eye sees differences
+type Redmean struct{}
+
+func (Redmean) Convert(c color.Color) [3]float64 { return rgb_floats(c) }
+
+func (Redmean) Compare(a, b [3]float64) float64 {
+	rmean := (a[0] + b[0]) / 2
+	dr, dg, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return math.Sqrt((2+rmean/256)*dr*dr + 4*dg*dg + (2+(255-rmean)/256)*db*db)
+}
+
+func (m Redmean) Distance(a, b color.Color) float64 {
+	return m.Compare(m.Convert(a), m.Convert(b))
+}
+
+// Euclidean distance in CIELAB, the CIE76 delta E
+type CIE76 struct{}
+
+func (CIE76) Convert(c color.Color) [3]float64 { return ToLab(c) }
+
+func (CIE76) Compare(a, b [3]float64) float64 {
+	dl, da, db := a[0]-b[0], a[1]-b[1], a[2]-b[2]
+	return math.Sqrt(dl*dl + da*da + db*db)
+}
+
+func (m CIE76) Distance(a, b color.Color) float64 {
+	return m.Compare(m.Convert(a), m.Convert(b))
+}
+
+// Converts a sRGB component, from 0 to 255, to linear light from 0 to 1
+func to_linear(v float64) float64 {
+	v /= 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+// Converts linear light, from 0 to 1, to a sRGB component
+func from_linear(v float64) uint8 {
+	v = min(max(v, 0), 1)
+	if v <= 0.0031308 {
+		v *= 12.92
+	} else {
+		v = 1.055*math.Pow(v, 1/2.4) - 0.055
+	}
+	return uint8(math.Round(v * 255))
+}
+
+// Converts a sRGB color to CIELAB, with a D65 white point
+func ToLab(c color.Color) [3]float64 {
+	rgb := rgb_floats(c)
+	r, g, b := to_linear(rgb[0]), to_linear(rgb[1]), to_linear(rgb[2])
+
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*b
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+
+	return [3]float64{116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)}
+}
+
+// Finds the closest colors of a palette under a metric
+type Matcher struct {
+	p      color.Palette
+	metric Metric
+	space  SpaceMetric
+	// colors of the palette converted to the space of the metric
+	points [][3]float64
+	// whether the palette is made of NES palettes, whose duplicate colors
+	// are told apart with tie_rank
+	nes bool
+}
+
+// Ranks the NES palette indexes of colors equally close to another, the
+// lowest first: the $0F black and the $30 white games use, then the
+// others, and last $0D, which is darker than black on real hardware even
+// when palettes draw it like $0F
+func TieRank(i int) int {
+	switch i % PALETTE_SIZE {
+	case 0x0F, 0x30:
+		return 0
+	case 0x0D:
+		return 2
+	}
+	return 1
+}
+
+// Prepares matching colors against p, with the default metric when metric is nil
+func NewMatcher(p color.Palette, metric Metric) *Matcher {
+	if metric == nil {
+		metric, _ = GetMetric(DEFAULT_METRIC)
+	}
+
+	m := &Matcher{p: p, metric: metric, nes: len(p) > 0 && len(p)%PALETTE_SIZE == 0}
+	if space, ok := metric.(SpaceMetric); ok {
+		m.space = space
+		m.points = make([][3]float64, len(p))
+		for i, c := range p {
+			m.points[i] = space.Convert(c)
+		}
+	}
+	return m
+}
+
+// Returns the index of the color of the palette closest to c and how far
+// it is, only the indexes in allowed are considered, unless allowed is
+// empty. Of the NES palette indexes with the same color, the one tie_rank
+// ranks first wins
+func (m *Matcher) Nearest(c color.Color, allowed []int) (int, float64) {
+	min_distance := math.MaxFloat64
+	closest := 0
+
+	var point [3]float64
+	if m.space != nil {
+		point = m.space.Convert(c)
+	}
+
+	check := func(i int) {
+		var distance float64
+		if m.space != nil {
+			distance = m.space.Compare(point, m.points[i])
+		} else {
+			distance = m.metric.Distance(c, m.p[i])
+		}
+
+		if distance < min_distance || distance == min_distance && m.nes && TieRank(i) < TieRank(closest) {
+			min_distance = distance
+			closest = i
+		}
+	}
+
+	if len(allowed) == 0 {
+		for i := range m.p {
+			check(i)
+		}
+	} else {
+		for _, i := range allowed {
+			check(i)
+		}
+	}
+
+	return closest, min_distance
+}
+
+// Returns how far c is from the colors of the palette at each of indices
+func (m *Matcher) Distances(c color.Color, indices []int) []float64 {
+	var point [3]float64
+	if m.space != nil {
+		point = m.space.Convert(c)
+	}
+	res := make([]float64, len(indices))
+	for j, i := range indices {
+		if m.space != nil {
+			res[j] = m.space.Compare(point, m.points[i])
+		} else {
+			res[j] = m.metric.Distance(c, m.p[i])
+		}
+	}
+	return res
+}
+
+// Returns the index of the color of the palette closest to c, only the
+// indexes in allowed are considered, unless allowed is empty
+func (m *Matcher) Closest(c color.Color, allowed []int) int {
+	i, _ := m.Nearest(c, allowed)
+	return i
+}
+
+func init() {
+	RegisterMetric("weighted", Weighted{})
+	RegisterMetric("euclidean", Euclidean{})
+	RegisterMetric("redmean", Redmean{})
+	RegisterMetric("cie76", CIE76{})
+}
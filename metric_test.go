@@ -0,0 +1,85 @@
+package nespal
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// A metric telling colors apart by their red alone
+type red_metric struct{}
+
+func (red_metric) Distance(a, b color.Color) float64 {
+	ra, _, _, _ := a.RGBA()
+	rb, _, _, _ := b.RGBA()
+	return float64(max(ra, rb) - min(ra, rb))
+}
+
+// Removes the metric called name from the registry
+func unregister_metric(name string) {
+	metrics_lock.Lock()
+	defer metrics_lock.Unlock()
+	delete(metrics, name)
+}
+
+func TestRegisterMetric(t *testing.T) {
+	RegisterMetric("red", red_metric{})
+	t.Cleanup(func() { unregister_metric("red") })
+	if !slices.Contains(MetricNames(), "red") {
+		t.Fatalf("MetricNames: got %v", MetricNames())
+	}
+	metric, err := GetMetric("red")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetMetric("blue"); err == nil {
+		t.Fatal("got no error for an unknown metric")
+	}
+
+	// blue by its red alone, so the closest color is the black
+	p := color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{200, 40, 40, 255}, color.RGBA{40, 40, 200, 255}}
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	img.Set(0, 0, color.RGBA{0, 0, 255, 255})
+	for _, opts := range []Options{{}, {Metric: metric}} {
+		want := uint8(2)
+		if opts.Metric != nil {
+			want = 0
+		}
+		if got := test_remap(t, img, p, opts).ColorIndexAt(0, 0); got != want {
+			t.Fatalf("metric %v: got index %d, want %d", opts.Metric, got, want)
+		}
+	}
+}
+
+func TestRegisterMetricConcurrently(t *testing.T) {
+	p := color.Palette{color.RGBA{0, 0, 0, 255}, color.RGBA{255, 255, 255, 255}}
+	var wg sync.WaitGroup
+	for i := range 8 {
+		name := fmt.Sprintf("red %d", i)
+		t.Cleanup(func() { unregister_metric(name) })
+		wg.Go(func() {
+			RegisterMetric(name, red_metric{})
+			metric, err := GetMetric(name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if i := NewMatcher(p, metric).Closest(color.RGBA{200, 0, 0, 255}, nil); i != 1 {
+				t.Errorf("%s: got index %d, want 1", name, i)
+			}
+			MetricNames()
+			NewMatcher(p, nil)
+		})
+	}
+	wg.Wait()
+
+	names := MetricNames()
+	for i := range 8 {
+		if !slices.Contains(names, fmt.Sprintf("red %d", i)) {
+			t.Fatalf("red %d missing from %v", i, names)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package nespal
+
+import "embed"
+
+// The .pal files of the palettes known by name, in the palettes directory
+//
+//go:embed palettes/**.pal
+var Palettes embed.FS
@@ -0,0 +1,193 @@
+package nespal
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+)
+
+// A palette whose colors are matched under a metric, which can stand in
+// for a color.Palette: Convert and Index pick the color remap would, among
+// the allowed indexes, instead of the closest in plain RGB
+type MetricPalette struct {
+	color.Palette
+	// Indexes of the palette colors can be matched to, all when empty
+	Indices []int
+	matcher *Matcher
+}
+
+// Returns p matched under metric, the default metric when nil
+func NewMetricPalette(p color.Palette, metric Metric, indices []int) *MetricPalette {
+	return &MetricPalette{Palette: p, Indices: indices, matcher: NewMatcher(p, metric)}
+}
+
+// Returns the palette color closest to c
+func (p *MetricPalette) Convert(c color.Color) color.Color {
+	if len(p.Palette) == 0 {
+		return nil
+	}
+	return p.Palette[p.Index(c)]
+}
+
+// Returns the index of the palette color closest to c
+func (p *MetricPalette) Index(c color.Color) int {
+	if p.matcher == nil {
+		p.matcher = NewMatcher(p.Palette, nil)
+	}
+	return p.matcher.Closest(c, p.Indices)
+}
+
+// Quantizes images to the colors of a NES palette, as remapped with the
+// options, so it can be given to image/draw or to the GIF encoder:
+//
+//	gif.Encode(w, img, &gif.Options{Quantizer: &Quantizer{Palette: p}})
+type Quantizer struct {
+	Palette color.Palette
+	Options Options
+}
+
+var _ draw.Quantizer = (*Quantizer)(nil)
+
+// Appends to p the colors of the palette m uses once remapped, the most
+// used first, as many as p has room for. Colors repeated in the palette,
+// like the blacks of NES palettes, are appended once
+func (q *Quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	opts := q.Options
+	opts.Dither = DITHER_NONE
+	remapped, _ := match_pixels(context.Background(), m, q.Palette, opts)
+
+	var counts [256]int
+	for _, i := range remapped.Pix {
+		counts[i]++
+	}
+	used := []int{}
+	for i, n := range counts {
+		if n > 0 {
+			used = append(used, i)
+		}
+	}
+	sort.SliceStable(used, func(a, b int) bool { return counts[used[a]] > counts[used[b]] })
+
+	seen := map[color.RGBA]bool{}
+	for _, i := range used {
+		c := ToRGB(q.Palette[i])
+		if len(p) == cap(p) {
+			break
+		}
+		if !seen[c] {
+			seen[c] = true
+			p = append(p, q.Palette[i])
+		}
+	}
+	return p
+}
+
+// Draws images with the colors of a NES palette, dithered like Remap does,
+// so it can be used like draw.FloydSteinberg but with the palette, metric
+// and dithering of the options:
+//
+//	gif.Encode(w, img, &gif.Options{Quantizer: q, Drawer: &Drawer{}})
+//
+// Options.Indices and Options.Keep are NES palette indexes of Palette. When
+// dst is paletted they are turned into the indexes of its palette with the
+// same colors, leaving out the ones it lacks, and they are ignored when
+// Palette is empty or none of their colors are in the palette of dst
+type Drawer struct {
+	// Colors drawn to images other than paletted ones, whose own palette
+	// is used instead
+	Palette color.Palette
+	// Floyd-Steinberg dithering is used when Options.Dither is empty
+	Options Options
+}
+
+var _ draw.Drawer = (*Drawer)(nil)
+
+// An image seen moved by an offset, so its pixel at p is the pixel of the
+// source at p plus the offset
+type offset_image struct {
+	image.Image
+	offset image.Point
+	bounds image.Rectangle
+}
+
+func (m offset_image) Bounds() image.Rectangle { return m.bounds }
+
+func (m offset_image) At(x, y int) color.Color {
+	return m.Image.At(x+m.offset.X, y+m.offset.Y)
+}
+
+// Draws the part of src starting at sp onto the rectangle r of dst,
+// replacing its pixels with the closest colors of the palette
+func (d *Drawer) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	// clipped to both images, like draw.Draw does
+	r = r.Intersect(dst.Bounds())
+	offset := sp.Sub(r.Min)
+	r = r.Intersect(src.Bounds().Sub(offset))
+	if r.Empty() {
+		return
+	}
+
+	p := d.Palette
+	paletted, is_paletted := dst.(*image.Paletted)
+	if is_paletted {
+		p = paletted.Palette
+	}
+	if len(p) == 0 {
+		return
+	}
+
+	opts := d.options(p)
+	m, _ := match_pixels(context.Background(), offset_image{src, offset, r}, p, opts)
+
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if is_paletted {
+				paletted.SetColorIndex(x, y, m.ColorIndexAt(x, y))
+			} else {
+				dst.Set(x, y, p[m.ColorIndexAt(x, y)])
+			}
+		}
+	}
+}
+
+// Returns the options to draw with the colors of p, with the NES palette
+// indexes of Options.Indices and Options.Keep turned into indexes of p, so
+// that they never index past the end of it
+func (d *Drawer) options(p color.Palette) Options {
+	opts := d.Options
+	if opts.Dither == "" {
+		opts.Dither = DITHER_FLOYD_STEINBERG
+	}
+
+	// the first index of p with the color of the NES palette index i
+	index := func(i int) (int, bool) {
+		if i < 0 || i >= len(d.Palette) {
+			return 0, false
+		}
+		c := ToRGB(d.Palette[i])
+		for j := range p {
+			if ToRGB(p[j]) == c {
+				return j, true
+			}
+		}
+		return 0, false
+	}
+
+	opts.Indices, opts.Keep = nil, nil
+	for _, i := range d.Options.Indices {
+		if j, ok := index(i); ok {
+			opts.Indices = append(opts.Indices, j)
+		}
+	}
+	for c, i := range d.Options.Keep {
+		if j, ok := index(int(i)); ok {
+			if opts.Keep == nil {
+				opts.Keep = map[color.RGBA]uint8{}
+			}
+			opts.Keep[c] = uint8(j)
+		}
+	}
+	return opts
+}
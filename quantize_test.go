@@ -0,0 +1,212 @@
+package nespal
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	"slices"
+	"testing"
+)
+
+// Colors the test images are remapped to
+var test_palette = color.Palette{
+	color.RGBA{0, 0, 0, 255},
+	color.RGBA{255, 255, 255, 255},
+	color.RGBA{200, 40, 40, 255},
+	color.RGBA{40, 40, 200, 255},
+	color.RGBA{40, 160, 40, 255},
+}
+
+// Returns a gradient whose pixels land on every color of test_palette
+func test_gradient(rect image.Rectangle) *image.RGBA {
+	m := image.NewRGBA(rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			m.SetRGBA(x, y, color.RGBA{uint8(x * 255 / rect.Dx()), uint8(y * 255 / rect.Dy()), uint8((x + y) * 7), 255})
+		}
+	}
+	return m
+}
+
+// Remaps img to p, failing the test on errors
+func test_remap(t *testing.T, img image.Image, p color.Palette, opts Options) *image.Paletted {
+	t.Helper()
+	m, err := Remap(context.Background(), img, p, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// Fails the test unless got has the colors of want at every pixel
+func compare_colors(t *testing.T, got, want image.Image) {
+	t.Helper()
+	if got.Bounds() != want.Bounds() {
+		t.Fatalf("bounds: got %v, want %v", got.Bounds(), want.Bounds())
+	}
+	bounds := want.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if g, w := ToRGB(got.At(x, y)), ToRGB(want.At(x, y)); g != w {
+				t.Fatalf("pixel (%d, %d): got %v, want %v", x, y, g, w)
+			}
+		}
+	}
+}
+
+func TestQuantizer(t *testing.T) {
+	// white twice, like the blacks of NES palettes
+	p := append(slices.Clone(test_palette), color.RGBA{255, 255, 255, 255})
+	img := image.NewRGBA(image.Rect(0, 0, 10, 1))
+	for x := range 10 {
+		switch {
+		case x < 5:
+			img.SetRGBA(x, 0, color.RGBA{220, 30, 30, 255})
+		case x < 8:
+			img.SetRGBA(x, 0, color.RGBA{250, 250, 250, 255})
+		default:
+			img.SetRGBA(x, 0, color.RGBA{10, 10, 10, 255})
+		}
+	}
+
+	tests := []struct {
+		name string
+		q    Quantizer
+		cap  int
+		want color.Palette
+	}{
+		{"most used first", Quantizer{Palette: p}, 256, color.Palette{p[2], p[1], p[0]}},
+		{"full", Quantizer{Palette: p}, 2, color.Palette{p[2], p[1]}},
+		{"allowed indexes", Quantizer{Palette: p, Options: Options{Indices: []int{0, 5}}}, 256, color.Palette{p[0], p[5]}},
+		{"dither ignored", Quantizer{Palette: p, Options: Options{Dither: DITHER_ORDERED}}, 256, color.Palette{p[2], p[1], p[0]}},
+		{"empty", Quantizer{Palette: p}, 0, color.Palette{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := test.q.Quantize(make(color.Palette, 0, test.cap), img)
+			if !slices.Equal(got, test.want) {
+				t.Fatalf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMetricPalette(t *testing.T) {
+	img := test_gradient(image.Rect(0, 0, 31, 17))
+	for _, opts := range []Options{{}, {Metric: CIE76{}}, {Indices: []int{0, 2, 4}}} {
+		want := test_remap(t, img, test_palette, opts)
+		p := NewMetricPalette(test_palette, opts.Metric, opts.Indices)
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if i := p.Index(img.At(x, y)); uint8(i) != want.ColorIndexAt(x, y) {
+					t.Fatalf("%+v: pixel (%d, %d): got index %d, want %d", opts, x, y, i, want.ColorIndexAt(x, y))
+				}
+				if c := p.Convert(img.At(x, y)); c != test_palette[want.ColorIndexAt(x, y)] {
+					t.Fatalf("%+v: pixel (%d, %d): got color %v", opts, x, y, c)
+				}
+			}
+		}
+	}
+
+	// the zero value matches with the default metric, an empty one matches nothing
+	if i := (&MetricPalette{Palette: test_palette}).Index(color.RGBA{250, 250, 250, 255}); i != 1 {
+		t.Fatalf("zero value: got index %d, want 1", i)
+	}
+	if c := (&MetricPalette{}).Convert(color.White); c != nil {
+		t.Fatalf("empty palette: got %v, want nil", c)
+	}
+}
+
+func TestDrawer(t *testing.T) {
+	img := test_gradient(image.Rect(0, 0, 31, 17))
+	for _, dither := range []string{DITHER_NONE, DITHER_FLOYD_STEINBERG, DITHER_ORDERED} {
+		opts := Options{Dither: dither}
+		want := test_remap(t, img, test_palette, opts)
+
+		rgba := image.NewRGBA(img.Bounds())
+		(&Drawer{Palette: test_palette, Options: opts}).Draw(rgba, rgba.Bounds(), img, image.Point{})
+		compare_colors(t, rgba, want)
+
+		paletted := image.NewPaletted(img.Bounds(), test_palette)
+		(&Drawer{Options: opts}).Draw(paletted, paletted.Bounds(), img, image.Point{})
+		compare_colors(t, paletted, want)
+	}
+
+	// a part of src drawn onto a part of dst, clipped to both
+	dst := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	(&Drawer{Palette: test_palette, Options: Options{Dither: DITHER_NONE}}).Draw(dst, image.Rect(4, 4, 12, 12), img, image.Pt(29, 0))
+	for y := range 8 {
+		for x := range 8 {
+			want := color.RGBA{}
+			if x >= 4 && y >= 4 && x < 6 {
+				want = ToRGB(test_palette[test_remap(t, img, test_palette, Options{}).ColorIndexAt(x+25, y-4)])
+			}
+			if got := dst.RGBAAt(x, y); got != want {
+				t.Fatalf("pixel (%d, %d): got %v, want %v", x, y, got, want)
+			}
+		}
+	}
+}
+
+func TestDrawerPalettedIndices(t *testing.T) {
+	img := test_gradient(image.Rect(0, 0, 31, 17))
+	// green, white and red, missing the black and blue of test_palette
+	own := color.Palette{test_palette[4], test_palette[1], test_palette[2]}
+
+	tests := []struct {
+		name    string
+		palette color.Palette
+		opts    Options
+		allowed []uint8
+	}{
+		{"translated", test_palette, Options{Indices: []int{1, 2, 3}}, []uint8{1, 2}},
+		{"none in dst", test_palette, Options{Indices: []int{0, 3}}, []uint8{0, 1, 2}},
+		{"no palette", nil, Options{Indices: []int{0x16, 0x30}}, []uint8{0, 1, 2}},
+		{"past the palette", test_palette, Options{Indices: []int{2, 0x30}}, []uint8{2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dst := image.NewPaletted(img.Bounds(), own)
+			(&Drawer{Palette: test.palette, Options: test.opts}).Draw(dst, dst.Bounds(), img, image.Point{})
+			for _, i := range dst.Pix {
+				if !slices.Contains(test.allowed, i) {
+					t.Fatalf("got index %d, want one of %v", i, test.allowed)
+				}
+			}
+		})
+	}
+
+	// kept colors get the index of their NES palette color in dst
+	kept := color.RGBA{0, 0, 0, 255}
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.SetRGBA(0, 0, kept)
+	src.SetRGBA(1, 0, color.RGBA{210, 30, 30, 255})
+	dst := image.NewPaletted(src.Bounds(), own)
+	opts := Options{Keep: map[color.RGBA]uint8{kept: 4, {210, 30, 30, 255}: 3}, Dither: DITHER_NONE}
+	(&Drawer{Palette: test_palette, Options: opts}).Draw(dst, dst.Bounds(), src, image.Point{})
+	if !slices.Equal(dst.Pix, []uint8{0, 2}) {
+		t.Fatalf("got indexes %v, want [0 2]", dst.Pix)
+	}
+}
+
+func TestDrawerGIF(t *testing.T) {
+	img := test_gradient(image.Rect(0, 0, 31, 17))
+	opts := Options{Indices: []int{0, 1, 3}, Dither: DITHER_NONE}
+	var buf bytes.Buffer
+	err := gif.Encode(&buf, img, &gif.Options{
+		NumColors: 256,
+		Quantizer: &Quantizer{Palette: test_palette, Options: opts},
+		Drawer:    &Drawer{Palette: test_palette, Options: opts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := gif.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compare_colors(t, got, test_remap(t, img, test_palette, opts))
+}
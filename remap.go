@@ -0,0 +1,164 @@
+package nespal
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"runtime"
+	"sync"
+)
+
+// NES color palettes have 64 colors in RGB format
+const PALETTE_SIZE = 64
+
+// Drops the alpha and the precision past 8 bits of a color
+func ToRGB(c color.Color) color.RGBA {
+	r, g, b, _ := c.RGBA()
+	return color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255}
+}
+
+// How an image is remapped to the colors of a palette
+type Options struct {
+	// NES palette indexes the image can be remapped to, all when empty
+	Indices []int
+	// Source colors always remapped to a NES palette index
+	Keep map[color.RGBA]uint8
+	// Transformations applied to the image before remapping
+	Pre []PrePass
+	// Background the image is composited over before anything else, none
+	// when nil
+	Matte *Matte
+	// Dithering method, none when empty, and the seed of its noise
+	Dither string
+	Seed   uint64
+	// How the closest colors are picked, the weighted metric when nil
+	Metric Metric
+	// Color vision deficiency the output is shown as seen with, if any
+	Simulate string
+	// Whether the output is a paletted image whose palette is the NES
+	// palette in index order, unused entries included
+	PreserveIndexOrder bool
+	// Metadata of the source image copied into the output, if any
+	Metadata *Metadata
+}
+
+// A transformation applied to an image before its colors are matched
+type PrePass func(image.Image) image.Image
+
+// Background an image is composited over before its colors are matched
+type Matte struct {
+	// NES palette index of the background, -1 when it is Color
+	Index int
+	Color color.RGBA
+}
+
+// Returns the color of the matte, the one of its NES palette index in p
+// if it has one
+func (m Matte) Resolve(p color.Palette) color.RGBA {
+	if m.Index >= 0 && m.Index < len(p) {
+		return ToRGB(p[m.Index])
+	}
+	return m.Color
+}
+
+// Applies the pre-passes of opts to img, in order, after compositing it over
+// the matte of opts, if any, whose NES palette index is a color of p
+func Preprocess(img image.Image, p color.Palette, opts Options) image.Image {
+	if opts.Matte != nil {
+		img = matte_pass(opts.Matte.Resolve(p))(img)
+	}
+	for _, pass := range opts.Pre {
+		img = pass(img)
+	}
+	return img
+}
+
+// Composites an image over a solid background, so its semi-transparent
+// pixels are blended with it and every pixel is opaque
+func matte_pass(bg color.RGBA) PrePass {
+	return func(img image.Image) image.Image {
+		bounds := img.Bounds()
+		res := image.NewNRGBA(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				blend := func(v, b uint8) uint8 {
+					return uint8((int(v)*int(c.A) + int(b)*(0xFF-int(c.A)) + 0x7F) / 0xFF)
+				}
+				res.SetNRGBA(x, y, color.NRGBA{blend(c.R, bg.R), blend(c.G, bg.G), blend(c.B, bg.B), 0xFF})
+			}
+		}
+		return res
+	}
+}
+
+// Maps every pixel of img to the index of its closest color in p, stopping
+// with the error of ctx once it is done. With a color vision deficiency to
+// simulate, the palette of the result shows the colors as seen with it
+func Remap(ctx context.Context, img image.Image, p color.Palette, opts Options) (*image.Paletted, error) {
+	remapped, err := match_pixels(ctx, img, p, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Simulate != "" {
+		remapped.Palette = SimulatePalette(p, opts.Simulate)
+	}
+	return remapped, nil
+}
+
+// Maps every pixel of img to the index of its closest color in p, checking
+// ctx between rows
+func match_pixels(ctx context.Context, img image.Image, p color.Palette, opts Options) (*image.Paletted, error) {
+	if opts.Dither != "" && opts.Dither != DITHER_NONE {
+		return dither_image(ctx, img, p, opts)
+	}
+
+	bounds := img.Bounds()
+	remapped := image.NewPaletted(bounds, p)
+	matcher := NewMatcher(p, opts.Metric)
+
+	// paletted images only need each color of their palette remapped once
+	if src, ok := img.(*image.Paletted); ok {
+		var lut [256]uint8
+		for i := range lut {
+			c := PaletteColor(src.Palette, uint8(i))
+			if k, ok := opts.Keep[c]; ok {
+				lut[i] = k
+			} else {
+				lut[i] = uint8(matcher.Closest(c, opts.Indices))
+			}
+		}
+
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			from, to := src.PixOffset(bounds.Min.X, y), remapped.PixOffset(bounds.Min.X, y)
+			for x := range bounds.Dx() {
+				remapped.Pix[to+x] = lut[src.Pix[from+x]]
+			}
+		}
+		return remapped, nil
+	}
+
+	// every pixel is remapped on its own, so the rows are split between CPUs
+	var wg sync.WaitGroup
+	workers := runtime.GOMAXPROCS(0)
+	for w := range workers {
+		wg.Go(func() {
+			for y := bounds.Min.Y + w; y < bounds.Max.Y && ctx.Err() == nil; y += workers {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					c := img.At(x, y)
+					if i, ok := opts.Keep[ToRGB(c)]; ok {
+						remapped.SetColorIndex(x, y, i)
+						continue
+					}
+					remapped.SetColorIndex(x, y, uint8(matcher.Closest(c, opts.Indices)))
+				}
+			}
+		})
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return remapped, nil
+}
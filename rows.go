@@ -0,0 +1,558 @@
+package nespal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"slices"
+)
+
+// Reads an image one row at a time, top to bottom
+type RowReader interface {
+	Bounds() image.Rectangle
+	// Returns the colors of the next row, or io.EOF after the last one,
+	// the returned slice is only valid until the next call
+	NextRow() ([]color.RGBA, error)
+	Close() error
+}
+
+// Implemented by row readers that can give the palette index of every pixel
+// instead of its color, when the image is paletted
+type IndexedRows interface {
+	RowReader
+	// Returns the palette of the image, nil if it is not paletted
+	Palette() color.Palette
+	// Returns the palette indexes of the next row, like NextRow
+	NextIndexRow() ([]uint8, error)
+}
+
+// Returns the color of a palette index, indexes past the end of the palette
+// are black, like the PNG decoder does
+func PaletteColor(p color.Palette, i uint8) color.RGBA {
+	if int(i) < len(p) {
+		return ToRGB(p[i])
+	}
+	return color.RGBA{0, 0, 0, 255}
+}
+
+// Reads the rows of an already decoded image
+type image_rows struct {
+	img image.Image
+	y   int
+	row []color.RGBA
+}
+
+func (r *image_rows) Bounds() image.Rectangle { return r.img.Bounds() }
+
+func (r *image_rows) NextRow() ([]color.RGBA, error) {
+	bounds := r.img.Bounds()
+	if r.y >= bounds.Max.Y {
+		return nil, io.EOF
+	}
+
+	for x := bounds.Min.X; x < bounds.Max.X; x++ {
+		r.row[x-bounds.Min.X] = ToRGB(r.img.At(x, r.y))
+	}
+	r.y++
+	return r.row, nil
+}
+
+func (r *image_rows) Close() error { return nil }
+
+func (r *image_rows) Palette() color.Palette {
+	if m, ok := r.img.(*image.Paletted); ok {
+		return m.Palette
+	}
+	return nil
+}
+
+func (r *image_rows) NextIndexRow() ([]uint8, error) {
+	m := r.img.(*image.Paletted)
+	if r.y >= m.Rect.Max.Y {
+		return nil, io.EOF
+	}
+
+	i := m.PixOffset(m.Rect.Min.X, r.y)
+	r.y++
+	return m.Pix[i : i+m.Rect.Dx()], nil
+}
+
+// Returns the rows of img, with its palette indexes when it is paletted
+func NewImageRows(img image.Image) IndexedRows {
+	return &image_rows{img: img, y: img.Bounds().Min.Y, row: make([]color.RGBA, img.Bounds().Dx())}
+}
+
+// Reads the rows of a non interlaced PNG while it is decoded
+type png_rows struct {
+	file      io.Closer
+	idat      *idat_reader
+	z         io.ReadCloser
+	width     int
+	height    int
+	depth     int
+	ctype     byte
+	plte      color.Palette
+	bpp       int
+	y         int
+	prev, cur []byte
+	row       []color.RGBA
+	indexes   []uint8
+}
+
+// First bytes of every PNG
+const PNG_SIGNATURE = "\x89PNG\r\n\x1a\n"
+
+// Largest chunk of a PNG other than IDAT read into memory, its data is
+// otherwise only checked and skipped
+const PNG_MAX_CHUNK = 16 << 20
+
+// Most pixels of a PNG read row by row, the 16384x16384 of the largest
+// images kept whole in memory take a gigabyte already
+const PNG_MAX_PIXELS = 1 << 28
+
+// Bit depths of the samples of every PNG color type, like image/png reads
+var png_depths = map[byte][]int{0: {1, 2, 4, 8, 16}, 2: {8, 16}, 3: {1, 2, 4, 8}, 4: {8, 16}, 6: {8, 16}}
+
+// Checks the size, bit depth and color type of a PNG before its rows are
+// allocated, with the errors of image/png
+func (r *png_rows) check_header() error {
+	if r.width <= 0 || r.height <= 0 {
+		return errors.New("png: invalid format: non-positive dimension")
+	}
+	if int64(r.width)*int64(r.height) > PNG_MAX_PIXELS {
+		return fmt.Errorf("png: unsupported feature: %dx%d image, more than %d pixels", r.width, r.height, PNG_MAX_PIXELS)
+	}
+	if !slices.Contains(png_depths[r.ctype], r.depth) {
+		return fmt.Errorf("png: unsupported feature: bit depth %d, color type %d", r.depth, r.ctype)
+	}
+	return nil
+}
+
+// Reads the CRC following the data of a PNG chunk and compares it with the
+// one computed while the chunk was read
+func check_crc(r io.Reader, crc hash.Hash32) error {
+	var sum [4]byte
+	if _, err := io.ReadFull(r, sum[:]); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(sum[:]) != crc.Sum32() {
+		return errors.New("png: invalid checksum")
+	}
+	return nil
+}
+
+// Reads the data of a PNG chunk and checks its CRC, returns the data when
+// keep or skips it otherwise
+func read_chunk(r *bufio.Reader, kind string, length uint32, keep bool) ([]byte, error) {
+	if keep && length > PNG_MAX_CHUNK {
+		return nil, fmt.Errorf("png: %s chunk of %d bytes is too large", kind, length)
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	var data bytes.Buffer
+	w := io.Writer(crc)
+	if keep {
+		w = io.MultiWriter(crc, &data)
+	}
+	if _, err := io.CopyN(w, r, int64(length)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if err := check_crc(r, crc); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// Reads the data of the IDAT chunks of a PNG, stopping at IEND
+type idat_reader struct {
+	r    *bufio.Reader
+	crc  hash.Hash32
+	left uint32
+	done bool
+	// error of the last chunk, returned again as the zlib reader may have
+	// not seen it, having already read the data it needed
+	err error
+}
+
+// Starts reading the data of an IDAT chunk of length bytes
+func (r *idat_reader) start(length uint32) error {
+	r.crc = crc32.NewIEEE()
+	r.crc.Write([]byte("IDAT"))
+	r.left = length
+	if length == 0 {
+		return check_crc(r.r, r.crc)
+	}
+	return nil
+}
+
+func (r *idat_reader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for r.left == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		var header [8]byte
+		if _, err := io.ReadFull(r.r, header[:]); err != nil {
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		kind := string(header[4:])
+
+		if kind == "IDAT" {
+			if err := r.start(length); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if _, err := read_chunk(r.r, kind, length, false); err != nil {
+			return 0, err
+		}
+		r.done = kind == "IEND"
+	}
+
+	if uint32(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.crc.Write(p[:n])
+	r.left -= uint32(n)
+	if r.left == 0 && err == nil {
+		err = check_crc(r.r, r.crc)
+		r.err = err
+	}
+	return n, err
+}
+
+// Starts decoding a PNG read from src, returns nil if it can only be
+// decoded all at once, like when it is interlaced or has a transparent
+// color other than in its palette. Closing the rows closes file
+func NewPNGRows(src io.Reader, file io.Closer) (IndexedRows, error) {
+	br := bufio.NewReader(src)
+
+	sig := make([]byte, len(PNG_SIGNATURE))
+	if _, err := io.ReadFull(br, sig); err != nil || string(sig) != PNG_SIGNATURE {
+		return nil, nil
+	}
+
+	r := &png_rows{file: file}
+	var alphas []byte
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return nil, err
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		kind := string(header[4:])
+
+		if kind == "IDAT" {
+			// the IDAT chunk is read again by the idat reader
+			idat := &idat_reader{r: br}
+			if err := idat.start(length); err != nil {
+				return nil, err
+			}
+			z, err := zlib.NewReader(idat)
+			if err != nil {
+				return nil, err
+			}
+			r.idat, r.z = idat, z
+			break
+		}
+
+		keep := kind == "IHDR" || kind == "PLTE" || kind == "tRNS" || kind == "eXIf"
+		data, err := read_chunk(br, kind, length, keep)
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case "IHDR":
+			if len(data) != 13 {
+				return nil, errors.New("png: invalid IHDR chunk")
+			}
+			r.width = int(int32(binary.BigEndian.Uint32(data[0:4])))
+			r.height = int(int32(binary.BigEndian.Uint32(data[4:8])))
+			r.depth = int(data[8])
+			r.ctype = data[9]
+			if data[12] != 0 {
+				return nil, nil
+			}
+		case "PLTE":
+			for i := 0; i+2 < len(data); i += 3 {
+				r.plte = append(r.plte, color.RGBA{data[i], data[i+1], data[i+2], 255})
+			}
+		case "tRNS":
+			// only the alpha of the palette is applied while reading, the
+			// transparent color of the other images is left to image/png
+			if r.ctype != 3 {
+				return nil, nil
+			}
+			alphas = data
+		case "eXIf":
+			// rotated images are turned upright all at once
+			if orientation, _ := ExifOrientation(data); orientation != 1 {
+				return nil, nil
+			}
+		case "IEND":
+			return nil, errors.New("png: no image data")
+		}
+	}
+
+	// the transparent entries of the palette become colors with alpha, like
+	// in the palettes of decoded images
+	for i, a := range alphas[:min(len(alphas), len(r.plte))] {
+		c := r.plte[i].(color.RGBA)
+		r.plte[i] = color.NRGBA{c.R, c.G, c.B, a}
+	}
+
+	if err := r.check_header(); err != nil {
+		return nil, err
+	}
+	channels := map[byte]int{0: 1, 2: 3, 3: 1, 4: 2, 6: 4}[r.ctype]
+	bits := channels * r.depth
+	r.bpp = max(1, bits/8)
+	stride := (r.width*bits + 7) / 8
+	r.prev = make([]byte, stride)
+	r.cur = make([]byte, stride+1)
+	r.row = make([]color.RGBA, r.width)
+	return r, nil
+}
+
+func (r *png_rows) Bounds() image.Rectangle { return image.Rect(0, 0, r.width, r.height) }
+
+// Reads and unfilters the samples of the next row
+func (r *png_rows) next_line() ([]byte, error) {
+	if r.y >= r.height {
+		return nil, r.finish()
+	}
+	if _, err := io.ReadFull(r.z, r.cur); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	filter, line := r.cur[0], r.cur[1:]
+	for i := range line {
+		var a, b, c byte
+		if i >= r.bpp {
+			a, c = line[i-r.bpp], r.prev[i-r.bpp]
+		}
+		b = r.prev[i]
+
+		switch filter {
+		case 0:
+		case 1:
+			line[i] += a
+		case 2:
+			line[i] += b
+		case 3:
+			line[i] += byte((int(a) + int(b)) / 2)
+		case 4:
+			line[i] += paeth(a, b, c)
+		default:
+			return nil, fmt.Errorf("png: invalid filter type %d", filter)
+		}
+	}
+
+	copy(r.prev, line)
+	r.y++
+	return line, nil
+}
+
+// Reads the rest of the PNG after the last row, up to IEND, so the
+// checksums of all of it are checked. Returns io.EOF when they match
+func (r *png_rows) finish() error {
+	if r.idat == nil {
+		return io.EOF
+	}
+	idat := r.idat
+	r.idat = nil
+	if _, err := io.Copy(io.Discard, r.z); err != nil {
+		return err
+	}
+	if _, err := io.Copy(io.Discard, idat); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (r *png_rows) NextRow() ([]color.RGBA, error) {
+	line, err := r.next_line()
+	if err != nil {
+		return nil, err
+	}
+
+	for x := range r.row {
+		r.row[x] = r.pixel(line, x)
+	}
+	return r.row, nil
+}
+
+func (r *png_rows) Palette() color.Palette {
+	if r.ctype == 3 {
+		return r.plte
+	}
+	return nil
+}
+
+func (r *png_rows) NextIndexRow() ([]uint8, error) {
+	line, err := r.next_line()
+	if err != nil {
+		return nil, err
+	}
+
+	if r.indexes == nil {
+		r.indexes = make([]uint8, r.width)
+	}
+	for x := range r.indexes {
+		r.indexes[x] = r.single_sample(line, x)
+	}
+	return r.indexes, nil
+}
+
+// Returns the 8 bits or lower sample of the pixel x of an unfiltered line
+// with a single sample per pixel, like a palette index
+func (r *png_rows) single_sample(line []byte, x int) uint8 {
+	if r.depth < 8 {
+		per_byte := 8 / r.depth
+		shift := uint(8 - r.depth*(x%per_byte+1))
+		return (line[x/per_byte] >> shift) & byte(1<<r.depth-1)
+	}
+	return line[x]
+}
+
+// Returns the color of the pixel x of an unfiltered line
+func (r *png_rows) pixel(line []byte, x int) color.RGBA {
+	// high bit depth samples are rounded the same way decoded images are
+	sample := func(i int) byte {
+		if r.depth == 16 {
+			return to_8bit(binary.BigEndian.Uint16(line[i*2:]))
+		}
+		return line[i]
+	}
+
+	switch r.ctype {
+	case 0:
+		if r.depth < 8 {
+			v := r.single_sample(line, x) * (255 / byte(1<<r.depth-1))
+			return color.RGBA{v, v, v, 255}
+		}
+		v := sample(x)
+		return color.RGBA{v, v, v, 255}
+	case 2:
+		return color.RGBA{sample(x * 3), sample(x*3 + 1), sample(x*3 + 2), 255}
+	case 3:
+		return PaletteColor(r.plte, r.single_sample(line, x))
+	case 4:
+		v := premultiply(sample(x*2), sample(x*2+1))
+		return color.RGBA{v, v, v, 255}
+	default:
+		a := sample(x*4 + 3)
+		return color.RGBA{premultiply(sample(x*4), a), premultiply(sample(x*4+1), a), premultiply(sample(x*4+2), a), 255}
+	}
+}
+
+// Applies alpha to a sample the same way decoded images do, so both ways
+// of reading an image give the same colors
+func premultiply(v, a byte) byte {
+	return byte((int(v) * 0x101 * int(a) / 0xff) >> 8)
+}
+
+func (r *png_rows) Close() error {
+	r.z.Close()
+	return r.file.Close()
+}
+
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// Scales a 16 bits sample down to 8 bits, rounding to the nearest value
+func to_8bit(v uint16) uint8 {
+	return uint8((uint32(v)*255 + 0xFFFF/2) / 0xFFFF)
+}
+
+// Converts images with 16 bits samples to 8 bits ones, rounding every
+// sample once, so the rest of the package works with 8 bits colors
+func normalize_depth(img image.Image) image.Image {
+	bounds := img.Bounds()
+	switch m := img.(type) {
+	case *image.Gray16:
+		res := image.NewGray(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				res.SetGray(x, y, color.Gray{to_8bit(m.Gray16At(x, y).Y)})
+			}
+		}
+		return res
+	case *image.RGBA64:
+		res := image.NewRGBA(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := m.RGBA64At(x, y)
+				res.SetRGBA(x, y, color.RGBA{to_8bit(c.R), to_8bit(c.G), to_8bit(c.B), to_8bit(c.A)})
+			}
+		}
+		return res
+	case *image.NRGBA64:
+		res := image.NewNRGBA(bounds)
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := m.NRGBA64At(x, y)
+				res.SetNRGBA(x, y, color.NRGBA{to_8bit(c.R), to_8bit(c.G), to_8bit(c.B), to_8bit(c.A)})
+			}
+		}
+		return res
+	}
+	return img
+}
+
+// Decodes an image with 8 bits samples, turned upright following its EXIF
+// orientation
+func DecodeImage(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	img = normalize_depth(img)
+
+	if meta, err := ParseMetadata(bytes.NewReader(data)); err == nil {
+		orientation, _ := ExifOrientation(meta.Exif)
+		img = Orient(img, orientation)
+	}
+	return img, nil
+}
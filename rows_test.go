@@ -0,0 +1,217 @@
+package nespal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Encodes img as a PNG
+func encode_png(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Returns the PNG data with a chunk inserted before its first IDAT chunk
+func insert_chunk(data []byte, kind string, payload []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, payload...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	i := bytes.Index(data, []byte("IDAT")) - 4
+	return slices.Concat(data[:i], chunk, data[i:])
+}
+
+// Sets every pixel of m to its color from set and returns m
+func test_image[T interface {
+	image.Image
+	Set(x, y int, c color.Color)
+}](m T, set func(x, y int) color.Color) T {
+	bounds := m.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			m.Set(x, y, set(x, y))
+		}
+	}
+	return m
+}
+
+func TestPNGRows(t *testing.T) {
+	rect := image.Rect(0, 0, 13, 7)
+	gradient := func(x, y int) color.Color {
+		return color.NRGBA{uint8(x * 19), uint8(y * 37), uint8(x*y*5 + 3), uint8(255 - x*y*4)}
+	}
+	indexed := func(n int) func(x, y int) color.Color {
+		return func(x, y int) color.Color { return color.RGBA{uint8((x + y*3) % n * 50), 0, 0, 255} }
+	}
+	palette := func(n int, alpha bool) color.Palette {
+		p := make(color.Palette, n)
+		for i := range p {
+			p[i] = color.RGBA{uint8(i * 50), 0, 0, 255}
+		}
+		if alpha {
+			p[0] = color.NRGBA{252, 252, 252, 0}
+			p[1] = color.NRGBA{200, 100, 50, 128}
+		}
+		return p
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		// whether the rows are read while the PNG is decoded
+		streamed bool
+	}{
+		{"gray", encode_png(t, test_image(image.NewGray(rect), gradient)), true},
+		{"gray16", encode_png(t, test_image(image.NewGray16(rect), gradient)), true},
+		{"rgb", encode_png(t, test_image(image.NewRGBA(rect), func(x, y int) color.Color {
+			return color.RGBA{uint8(x * 19), uint8(y * 37), 9, 255}
+		})), true},
+		{"rgba", encode_png(t, test_image(image.NewNRGBA(rect), gradient)), true},
+		{"rgba64", encode_png(t, test_image(image.NewNRGBA64(rect), gradient)), true},
+		{"1 bit palette", encode_png(t, test_image(image.NewPaletted(rect, palette(2, false)), indexed(2))), true},
+		{"2 bits palette", encode_png(t, test_image(image.NewPaletted(rect, palette(4, false)), indexed(4))), true},
+		{"4 bits palette", encode_png(t, test_image(image.NewPaletted(rect, palette(5, false)), indexed(5))), true},
+		{"palette with tRNS", encode_png(t, test_image(image.NewPaletted(rect, palette(5, true)), indexed(5))), true},
+		{"gray with tRNS", insert_chunk(encode_png(t, test_image(image.NewGray(rect), gradient)), "tRNS", []byte{0, 0}), false},
+		{"rgb with tRNS", insert_chunk(encode_png(t, test_image(image.NewRGBA(rect), func(x, y int) color.Color {
+			return color.RGBA{uint8(x * 19), 0, 0, 255}
+		})), "tRNS", []byte{0, 19, 0, 0, 0, 0}), false},
+		{"ancillary chunk", insert_chunk(encode_png(t, test_image(image.NewGray(rect), gradient)), "tEXt", []byte("Comment\x00nespal")), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want, err := DecodeImage(bytes.NewReader(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			streamed, err := NewPNGRows(bytes.NewReader(test.data), io.NopCloser(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (streamed != nil) != test.streamed {
+				t.Fatalf("rows read while decoded: %t, want %t", streamed != nil, test.streamed)
+			}
+
+			rows, err := decode_png_rows(bytes.NewReader(test.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			if rows.Bounds() != want.Bounds() {
+				t.Fatalf("bounds %v, want %v", rows.Bounds(), want.Bounds())
+			}
+			for y := range rect.Dy() {
+				row, err := rows.NextRow()
+				if err != nil {
+					t.Fatalf("row %d: %v", y, err)
+				}
+				for x, c := range row {
+					if expected := ToRGB(want.At(x, y)); c != expected {
+						t.Fatalf("pixel %d, %d is %v, want %v", x, y, c, expected)
+					}
+				}
+			}
+			if _, err := rows.NextRow(); err != io.EOF {
+				t.Errorf("read past the last row: %v", err)
+			}
+
+			// paletted images also give the indexes of their pixels
+			m, ok := want.(*image.Paletted)
+			if !ok || streamed == nil {
+				return
+			}
+			if !slices.Equal(streamed.Palette(), m.Palette[:len(streamed.Palette())]) {
+				t.Errorf("palette %v, want %v", streamed.Palette(), m.Palette)
+			}
+			for y := range rect.Dy() {
+				row, err := streamed.NextIndexRow()
+				if err != nil {
+					t.Fatalf("row %d: %v", y, err)
+				}
+				if i := m.PixOffset(0, y); !bytes.Equal(row, m.Pix[i:i+rect.Dx()]) {
+					t.Fatalf("indexes of row %d are %v, want %v", y, row, m.Pix[i:i+rect.Dx()])
+				}
+			}
+		})
+	}
+}
+
+func TestPNGRowsInvalid(t *testing.T) {
+	data := encode_png(t, test_image(image.NewGray(image.Rect(0, 0, 8, 8)), func(x, y int) color.Color {
+		return color.Gray{uint8(x * y)}
+	}))
+	idat := bytes.Index(data, []byte("IDAT"))
+
+	corrupt := func(i int) []byte {
+		res := slices.Clone(data)
+		res[i] ^= 0xFF
+		return res
+	}
+	// the IHDR chunk changed by edit, with its CRC computed again
+	header := func(edit func(ihdr []byte)) []byte {
+		res := slices.Clone(data)
+		edit(res[16:29])
+		binary.BigEndian.PutUint32(res[29:], crc32.ChecksumIEEE(res[12:29]))
+		return res
+	}
+	depth := func(depth, ctype byte) []byte {
+		return header(func(ihdr []byte) { ihdr[8], ihdr[9] = depth, ctype })
+	}
+	size := func(width, height uint32) []byte {
+		return header(func(ihdr []byte) {
+			binary.BigEndian.PutUint32(ihdr[0:], width)
+			binary.BigEndian.PutUint32(ihdr[4:], height)
+		})
+	}
+	// an EXIF chunk claiming a gigabyte
+	huge := insert_chunk(data, "eXIf", nil)
+	binary.BigEndian.PutUint32(huge[idat-4:], 1<<30)
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"IHDR checksum", corrupt(8 + 8 + 3), "invalid checksum"},
+		{"IDAT checksum", corrupt(idat + 6), ""},
+		{"IDAT CRC", corrupt(len(data) - 12 - 1), "invalid checksum"},
+		{"huge chunk", huge, "too large"},
+		{"gray depth 0", depth(0, 0), "png: unsupported feature: bit depth 0, color type 0"},
+		{"gray depth 3", depth(3, 0), "png: unsupported feature: bit depth 3, color type 0"},
+		{"RGB depth 4", depth(4, 2), "png: unsupported feature: bit depth 4, color type 2"},
+		{"paletted depth 16", depth(16, 3), "png: unsupported feature: bit depth 16, color type 3"},
+		{"color type 5", depth(8, 5), "png: unsupported feature: bit depth 8, color type 5"},
+		{"zero width", size(0, 8), "png: invalid format: non-positive dimension"},
+		{"negative height", size(8, 1<<31), "png: invalid format: non-positive dimension"},
+		{"huge", size(1<<31-1, 1<<31-1), "png: unsupported feature: 2147483647x2147483647 image"},
+		{"huge row", size(1<<30, 1), "png: unsupported feature: 1073741824x1 image"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rows, err := NewPNGRows(bytes.NewReader(test.data), io.NopCloser(nil))
+			for err == nil && rows != nil {
+				_, err = rows.NextRow()
+			}
+			if err == nil || err == io.EOF {
+				t.Fatal("no error")
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Errorf("error '%v', want '%s'", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package nespal
+
+import (
+	"image/color"
+)
+
+// Color vision Deficiencies that can be simulated
+const (
+	PROTANOPIA   = "protanopia"
+	DEUTERANOPIA = "deuteranopia"
+	TRITANOPIA   = "tritanopia"
+)
+
+var Deficiencies = []string{PROTANOPIA, DEUTERANOPIA, TRITANOPIA}
+
+// Matrices turning linear RGB into how it is seen with each deficiency, at
+// full severity, from Machado, Oliveira and Fernandes (2009)
+var deficiency_matrices = map[string][3][3]float64{
+	PROTANOPIA: {
+		{0.152286, 1.052583, -0.204868},
+		{0.114503, 0.786281, 0.099216},
+		{-0.003882, -0.048116, 1.051998},
+	},
+	DEUTERANOPIA: {
+		{0.367322, 0.860646, -0.227968},
+		{0.280085, 0.672501, 0.047413},
+		{-0.011820, 0.042940, 0.968881},
+	},
+	TRITANOPIA: {
+		{1.255528, -0.076749, -0.178779},
+		{-0.078411, 0.930809, 0.147602},
+		{0.004733, 0.691367, 0.303900},
+	},
+}
+
+// Returns c as seen with the deficiency
+func SimulateColor(c color.Color, deficiency string) color.RGBA {
+	m := deficiency_matrices[deficiency]
+	rgb := rgb_floats(c)
+	linear := [3]float64{to_linear(rgb[0]), to_linear(rgb[1]), to_linear(rgb[2])}
+
+	var res [3]uint8
+	for i, row := range m {
+		res[i] = from_linear(row[0]*linear[0] + row[1]*linear[1] + row[2]*linear[2])
+	}
+	return color.RGBA{res[0], res[1], res[2], 255}
+}
+
+// Returns the colors of p as seen with the deficiency
+func SimulatePalette(p color.Palette, deficiency string) color.Palette {
+	res := make(color.Palette, len(p))
+	for i, c := range p {
+		res[i] = SimulateColor(c, deficiency)
+	}
+	return res
+}
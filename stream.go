@@ -0,0 +1,300 @@
+package nespal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Reads and writes images of a format for RemapStream
+type Codec struct {
+	// First bytes of the images of the format, which tell it apart
+	Magic string
+	// Starts reading an image, row by row when the format allows it
+	Decode func(r io.Reader) (RowReader, error)
+	// Writes img along with meta, when not nil
+	Encode func(w io.Writer, img image.Image, meta *Metadata) error
+}
+
+var (
+	codecs = map[string]Codec{}
+	// guards codecs, which can be registered while images are remapped
+	codecs_lock sync.RWMutex
+)
+
+// Makes a format available by name to RemapStream
+func RegisterCodec(name string, c Codec) {
+	codecs_lock.Lock()
+	defer codecs_lock.Unlock()
+	codecs[name] = c
+}
+
+// Returns the registered codec called name
+func get_codec(name string) (Codec, bool) {
+	codecs_lock.RLock()
+	defer codecs_lock.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Returns the names of the registered codecs, sorted
+func CodecNames() []string {
+	codecs_lock.RLock()
+	defer codecs_lock.RUnlock()
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Keeps what is read while recording, so it can be read again
+type replay_reader struct {
+	r         io.Reader
+	buf       bytes.Buffer
+	recording bool
+}
+
+func (r *replay_reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.recording {
+		r.buf.Write(p[:n])
+	}
+	return n, err
+}
+
+// Reads a PNG row by row while it is decoded, or all at once when it
+// cannot be
+func decode_png_rows(r io.Reader) (RowReader, error) {
+	replay := &replay_reader{r: r, recording: true}
+	rows, err := NewPNGRows(replay, io.NopCloser(r))
+	if err != nil {
+		return nil, err
+	}
+	if rows != nil {
+		replay.recording = false
+		replay.buf = bytes.Buffer{}
+		return rows, nil
+	}
+
+	img, err := DecodeImage(io.MultiReader(&replay.buf, r))
+	if err != nil {
+		return nil, err
+	}
+	return NewImageRows(img), nil
+}
+
+// Reads an image all at once
+func decode_whole_rows(r io.Reader) (RowReader, error) {
+	img, err := DecodeImage(r)
+	if err != nil {
+		return nil, err
+	}
+	return NewImageRows(img), nil
+}
+
+// Quality of the JPEG outputs, from 1 to 100
+const JPEG_QUALITY = 75
+
+// Encodes img into f in the format of the extension ext, along with meta
+// if it is not nil
+func EncodeImage(f io.Writer, img image.Image, ext string, meta *Metadata) error {
+	w := f
+	if meta != nil && ext != ".gif" {
+		// after the PNG signature and IHDR chunk, or the JPEG start marker
+		head := 2
+		if ext == ".png" {
+			head = len(PNG_SIGNATURE) + 25
+		}
+		if extra := meta.encode(ext); len(extra) > 0 {
+			w = &insert_writer{w: f, head: head, extra: extra}
+		}
+	}
+
+	// the encoders write no timestamps nor ancillary chunks and their
+	// settings are fixed, so the same image always gives the same bytes
+	switch ext {
+	case ".png":
+		encoder := png.Encoder{CompressionLevel: png.DefaultCompression}
+		return encoder.Encode(w, img)
+	case ".gif":
+		// the GIF encoder would approximate the colors of other images
+		if _, ok := img.(*image.Paletted); !ok {
+			if m := ToPaletted(img); m != nil {
+				img = m
+			}
+		}
+		return gif.Encode(w, img, nil)
+	default:
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: JPEG_QUALITY})
+	}
+}
+
+// Returns img as a paletted image of the colors it uses, or nil if it has
+// more colors than a palette can hold
+func ToPaletted(img image.Image) *image.Paletted {
+	bounds := img.Bounds()
+	m := image.NewPaletted(bounds, nil)
+	indexes := map[color.RGBA]uint8{}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			i, ok := indexes[c]
+			if !ok {
+				if len(m.Palette) == 256 {
+					return nil
+				}
+				i = uint8(len(m.Palette))
+				indexes[c] = i
+				m.Palette = append(m.Palette, c)
+			}
+			m.SetColorIndex(x, y, i)
+		}
+	}
+	return m
+}
+
+// Returns a codec encoding images like EncodeImage does for the extension
+func encode_as(ext string) func(w io.Writer, img image.Image, meta *Metadata) error {
+	return func(w io.Writer, img image.Image, meta *Metadata) error {
+		return EncodeImage(w, img, ext, meta)
+	}
+}
+
+// Reads the rest of the rows into an image, a paletted one when the rows
+// have a palette
+func ReadImage(rows RowReader) (image.Image, error) {
+	bounds := rows.Bounds()
+	if indexed, ok := rows.(IndexedRows); ok && indexed.Palette() != nil {
+		m := image.NewPaletted(bounds, indexed.Palette())
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			row, err := indexed.NextIndexRow()
+			if err != nil {
+				return nil, err
+			}
+			copy(m.Pix[m.PixOffset(bounds.Min.X, y):], row)
+		}
+		return m, nil
+	}
+
+	m := image.NewRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row, err := rows.NextRow()
+		if err != nil {
+			return nil, err
+		}
+		for x, c := range row {
+			m.SetRGBA(bounds.Min.X+x, y, c)
+		}
+	}
+	return m, nil
+}
+
+// Reads from r until ctx is done, so decoding stops with the error of ctx
+type context_reader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r context_reader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Options of RemapStream
+type StreamOptions struct {
+	Options
+	// Colors the image is remapped to
+	Palette color.Palette
+	// Codec the output is written with, the one of the input when empty
+	Format string
+}
+
+// Remaps the image read from r into w like Preprocess and Remap do, without
+// files. The format of the input is told by its first bytes, and when
+// CanStream allows it the image is decoded, remapped and encoded a band of
+// rows at a time. Stops with the error of ctx once it is done
+func RemapStream(ctx context.Context, r io.Reader, w io.Writer, opts StreamOptions) error {
+	if len(opts.Palette) == 0 {
+		return errors.New("nespal: missing color palette")
+	}
+
+	br := bufio.NewReader(context_reader{ctx, r})
+	head, err := br.Peek(8)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var decoder Codec
+	format := ""
+	for _, name := range CodecNames() {
+		if c, ok := get_codec(name); ok && c.Magic != "" && bytes.HasPrefix(head, []byte(c.Magic)) {
+			decoder, format = c, name
+			break
+		}
+	}
+	if format == "" {
+		return fmt.Errorf("nespal: unknown image format, expected one of: %s", strings.Join(CodecNames(), ", "))
+	}
+
+	out := opts.Format
+	if out == "" {
+		out = format
+	}
+	codec, ok := get_codec(out)
+	if !ok {
+		return fmt.Errorf("nespal: unknown image format '%s', expected one of: %s", out, strings.Join(CodecNames(), ", "))
+	}
+
+	rows, err := decoder.Decode(br)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if CanStream(opts.Options) {
+		s := NewStreamedRemap(ctx, rows, opts.Palette, opts.Options)
+		err := codec.Encode(w, s, opts.Metadata)
+		if s.err != nil {
+			return s.err
+		}
+		return err
+	}
+
+	img, err := ReadImage(rows)
+	if err != nil {
+		return err
+	}
+	indexed, err := Remap(ctx, Preprocess(img, opts.Palette, opts.Options), opts.Palette, opts.Options)
+	if err != nil {
+		return err
+	}
+	var remapped image.Image = indexed
+	if !opts.PreserveIndexOrder {
+		rgba := image.NewRGBA(indexed.Bounds())
+		draw.Draw(rgba, rgba.Bounds(), indexed, indexed.Bounds().Min, draw.Src)
+		remapped = rgba
+	}
+	return codec.Encode(w, remapped, opts.Metadata)
+}
+
+func init() {
+	RegisterCodec("png", Codec{PNG_SIGNATURE, decode_png_rows, encode_as(".png")})
+	RegisterCodec("jpeg", Codec{"\xff\xd8", decode_whole_rows, encode_as(".jpg")})
+	RegisterCodec("gif", Codec{"GIF8", decode_whole_rows, encode_as(".gif")})
+}
@@ -0,0 +1,209 @@
+package nespal
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRemapStream(t *testing.T) {
+	img := test_gradient(image.Rect(0, 0, 37, 23))
+	encode := map[string]func(w io.Writer, img image.Image) error{
+		"png": func(w io.Writer, img image.Image) error { _, err := w.Write(encode_png(t, img)); return err },
+		"gif": func(w io.Writer, img image.Image) error {
+			return gif.Encode(w, img, &gif.Options{Quantizer: &Quantizer{Palette: test_palette}, Drawer: &Drawer{Options: Options{Dither: DITHER_NONE}}})
+		},
+		"jpeg": func(w io.Writer, img image.Image) error { return jpeg.Encode(w, img, nil) },
+	}
+
+	tests := []struct {
+		name     string
+		in, out  string
+		opts     Options
+		streamed bool
+	}{
+		{"png", "png", "", Options{}, true},
+		{"png to gif", "png", "gif", Options{}, true},
+		{"png dithered", "png", "png", Options{Dither: DITHER_FLOYD_STEINBERG}, false},
+		{"png keeping the index order", "png", "png", Options{PreserveIndexOrder: true}, false},
+		{"gif", "gif", "png", Options{Indices: []int{0, 1, 2}}, true},
+		{"jpeg", "jpeg", "png", Options{Metric: CIE76{}}, true},
+		{"jpeg to jpeg", "jpeg", "", Options{Matte: &Matte{Index: 1}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if CanStream(test.opts) != test.streamed {
+				t.Fatalf("CanStream: got %v, want %v", !test.streamed, test.streamed)
+			}
+
+			var in bytes.Buffer
+			if err := encode[test.in](&in, img); err != nil {
+				t.Fatal(err)
+			}
+			src, err := DecodeImage(bytes.NewReader(in.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test_remap(t, Preprocess(src, test_palette, test.opts), test_palette, test.opts)
+
+			var out bytes.Buffer
+			err = RemapStream(context.Background(), &in, &out, StreamOptions{Options: test.opts, Palette: test_palette, Format: test.out})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, format, err := image.Decode(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			switch {
+			case test.out == "" && format != test.in, test.out != "" && format != test.out:
+				t.Fatalf("got a %s image", format)
+			case format == "jpeg":
+				// lossy, only the size is kept exactly
+				if got.Bounds() != want.Bounds() {
+					t.Fatalf("bounds: got %v, want %v", got.Bounds(), want.Bounds())
+				}
+			default:
+				compare_colors(t, got, want)
+			}
+			if paletted, ok := got.(*image.Paletted); test.opts.PreserveIndexOrder && (!ok || len(paletted.Palette) != len(test_palette)) {
+				t.Fatal("the index order of the palette was not kept")
+			}
+		})
+	}
+}
+
+// A codec of images made of "TEST", their width and height as bytes, then
+// the RGB of every pixel
+var test_codec = Codec{
+	Magic: "TEST",
+	Decode: func(r io.Reader) (RowReader, error) {
+		head := make([]byte, 6)
+		if _, err := io.ReadFull(r, head); err != nil {
+			return nil, err
+		}
+		m := image.NewRGBA(image.Rect(0, 0, int(head[4]), int(head[5])))
+		for i := 0; i < len(m.Pix); i += 4 {
+			if _, err := io.ReadFull(r, m.Pix[i:i+3]); err != nil {
+				return nil, err
+			}
+			m.Pix[i+3] = 255
+		}
+		return NewImageRows(m), nil
+	},
+	Encode: func(w io.Writer, img image.Image, meta *Metadata) error {
+		bounds := img.Bounds()
+		data := []byte{'T', 'E', 'S', 'T', byte(bounds.Dx()), byte(bounds.Dy())}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				c := ToRGB(img.At(x, y))
+				data = append(data, c.R, c.G, c.B)
+			}
+		}
+		_, err := w.Write(data)
+		return err
+	},
+}
+
+// Removes the codec called name from the registry
+func unregister_codec(name string) {
+	codecs_lock.Lock()
+	defer codecs_lock.Unlock()
+	delete(codecs, name)
+}
+
+func TestRegisterCodec(t *testing.T) {
+	RegisterCodec("test", test_codec)
+	t.Cleanup(func() { unregister_codec("test") })
+	if names := CodecNames(); strings.Join(names, ",") != "gif,jpeg,png,test" {
+		t.Fatalf("CodecNames: got %v", names)
+	}
+
+	img := test_gradient(image.Rect(0, 0, 9, 5))
+	var in bytes.Buffer
+	if err := test_codec.Encode(&in, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := test_remap(t, img, test_palette, Options{})
+
+	for _, format := range []string{"", "png"} {
+		var out bytes.Buffer
+		if err := RemapStream(context.Background(), bytes.NewReader(in.Bytes()), &out, StreamOptions{Palette: test_palette, Format: format}); err != nil {
+			t.Fatal(err)
+		}
+		decode := test_codec.Decode
+		if format == "png" {
+			decode = decode_png_rows
+		}
+		rows, err := decode(&out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ReadImage(rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compare_colors(t, got, want)
+	}
+}
+
+func TestRegisterCodecConcurrently(t *testing.T) {
+	png_data := encode_png(t, test_gradient(image.Rect(0, 0, 8, 8)))
+	var wg sync.WaitGroup
+	for i := range 8 {
+		name := fmt.Sprintf("test %d", i)
+		t.Cleanup(func() { unregister_codec(name) })
+		wg.Go(func() {
+			RegisterCodec(name, test_codec)
+			if err := RemapStream(context.Background(), bytes.NewReader(png_data), io.Discard, StreamOptions{Palette: test_palette}); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+func TestRemapStreamErrors(t *testing.T) {
+	png_data := encode_png(t, test_gradient(image.Rect(0, 0, 8, 8)))
+	tests := []struct {
+		name string
+		data []byte
+		opts StreamOptions
+		err  string
+	}{
+		{"missing palette", png_data, StreamOptions{}, "nespal: missing color palette"},
+		{"unknown input", []byte("BM not an image"), StreamOptions{Palette: test_palette}, "nespal: unknown image format, expected one of: gif, jpeg, png"},
+		{"unknown output", png_data, StreamOptions{Palette: test_palette, Format: "bmp"}, "nespal: unknown image format 'bmp', expected one of: gif, jpeg, png"},
+		{"truncated", png_data[:len(png_data)/2], StreamOptions{Palette: test_palette}, "unexpected EOF"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := RemapStream(context.Background(), bytes.NewReader(test.data), io.Discard, test.opts)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestRemapStreamCanceled(t *testing.T) {
+	png_data := encode_png(t, test_gradient(image.Rect(0, 0, 8, 8)))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, dither := range []string{DITHER_NONE, DITHER_FLOYD_STEINBERG} {
+		err := RemapStream(ctx, bytes.NewReader(png_data), io.Discard, StreamOptions{Options: Options{Dither: dither}, Palette: test_palette})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: got error %v, want %v", dither, err, context.Canceled)
+		}
+	}
+}
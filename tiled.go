@@ -0,0 +1,143 @@
+package nespal
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"io"
+)
+
+// Number of rows remapped at once when streaming, a multiple of the 16
+// rows JPEG encodes at a time
+const BAND_ROWS = 64
+
+// Whether the remap can be done band by band, which needs every pixel to be
+// remapped on its own into an image in true colors
+func CanStream(opts Options) bool {
+	dither := opts.Dither == "" || opts.Dither == DITHER_NONE || opts.Dither == DITHER_ORDERED
+	return len(opts.Pre) == 0 && opts.Matte == nil && dither && !opts.PreserveIndexOrder
+}
+
+// An image remapped band by band while it is encoded, so neither the
+// source nor the remapped image are ever held whole in memory. The rows
+// must be read top to bottom, like the PNG and JPEG encoders do
+type StreamedRemap struct {
+	ctx    context.Context
+	rows   RowReader
+	p      color.Palette
+	opts   Options
+	bounds image.Rectangle
+	band   *image.Paletted
+	src    *image.RGBA
+	// source band of paletted images, remapped a palette color at a time
+	indexed *image.Paletted
+	err     error
+}
+
+// Returns the error that stopped the remap, if any, once the image is
+// encoded
+func (s *StreamedRemap) Err() error { return s.err }
+
+func (s *StreamedRemap) ColorModel() color.Model { return color.RGBAModel }
+
+func (s *StreamedRemap) Bounds() image.Rectangle { return s.bounds }
+
+// The remapped colors come from the palette, so they are all opaque. This
+// also keeps the PNG encoder from reading the whole image to check it
+func (s *StreamedRemap) Opaque() bool { return true }
+
+func (s *StreamedRemap) At(x, y int) color.Color {
+	for s.err == nil && y >= s.band.Rect.Max.Y {
+		s.next_band()
+	}
+	if s.err != nil || !image.Pt(x, y).In(s.band.Rect) {
+		return color.RGBA{}
+	}
+	return s.band.Palette[s.band.ColorIndexAt(x, y)]
+}
+
+// Reads and remaps the rows after the current band
+func (s *StreamedRemap) next_band() {
+	if err := s.ctx.Err(); err != nil {
+		s.err = err
+		return
+	}
+
+	y := s.band.Rect.Max.Y
+	n := min(BAND_ROWS, s.bounds.Max.Y-y)
+	if n <= 0 {
+		s.err = io.ErrUnexpectedEOF
+		return
+	}
+
+	// the buffer of the source band is reused by moving its bounds
+	rect := image.Rect(s.bounds.Min.X, y, s.bounds.Max.X, y+n)
+	if s.indexed != nil {
+		s.indexed.Rect = rect
+	} else {
+		s.src.Rect = rect
+	}
+
+	for i := range n {
+		var err error
+		if s.indexed != nil {
+			var row []uint8
+			if row, err = s.rows.(IndexedRows).NextIndexRow(); err == nil {
+				copy(s.indexed.Pix[i*s.indexed.Stride:], row)
+			}
+		} else {
+			var row []color.RGBA
+			if row, err = s.rows.NextRow(); err == nil {
+				for x, c := range row {
+					s.src.SetRGBA(s.bounds.Min.X+x, y+i, c)
+				}
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			s.err = err
+			return
+		}
+	}
+
+	var src image.Image = s.src
+	if s.indexed != nil {
+		src = s.indexed
+	}
+	band, err := Remap(s.ctx, src, s.p, s.opts)
+	if err != nil {
+		s.err = err
+		return
+	}
+	s.band = band
+}
+
+// Returns the image read from rows remapped to p, remapped as it is read
+// until ctx is done
+func NewStreamedRemap(ctx context.Context, rows RowReader, p color.Palette, opts Options) *StreamedRemap {
+	bounds := rows.Bounds()
+	s := &StreamedRemap{
+		ctx:    ctx,
+		rows:   rows,
+		p:      p,
+		opts:   opts,
+		bounds: bounds,
+		band:   image.NewPaletted(image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y), p),
+	}
+
+	band := image.Rect(bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Min.Y+BAND_ROWS)
+	if indexed, ok := rows.(IndexedRows); ok && indexed.Palette() != nil {
+		// indexes past the end of the palette are black, as when decoded
+		src_pal := make(color.Palette, 256)
+		for i := range src_pal {
+			src_pal[i] = PaletteColor(indexed.Palette(), uint8(i))
+		}
+		s.indexed = image.NewPaletted(band, src_pal)
+	} else {
+		s.src = image.NewRGBA(band)
+	}
+	return s
+}